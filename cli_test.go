@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blue/support-agent/common"
+	"github.com/blue/support-agent/common/fakegmail"
+)
+
+// End-to-end CLI tests: each case runs the built support-agent binary
+// against the Gmail emulator seeded from testdata/mailbox and compares its
+// output with testdata/golden/<name>.golden. Run with -update to rewrite the
+// golden files after an intended output change.
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+var binary string
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	dir, err := os.MkdirTemp("", "support-agent-cli")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	binary = filepath.Join(dir, "support-agent")
+	if out, err := exec.Command("go", "build", "-o", binary, ".").CombinedOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "build failed: %v\n%s", err, out)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestCLIGolden(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		check func(t *testing.T, mb *fakegmail.Mailbox)
+	}{
+		{name: "read-messages", args: []string{"read-messages"}},
+		{name: "read-messages-unread-json", args: []string{"read-messages", "--unread", "--output", "json"}},
+		{name: "read-messages-json-envelope", args: []string{"read-messages", "--limit", "1", "--output", "json", "--envelope"}},
+		{name: "search-messages-local-page-token", args: []string{"search-messages", "--query", "export", "--local", "--page-token", "abc"}},
+		{name: "read-messages-paged", args: []string{"read-messages", "--limit", "2"}},
+		{name: "search-messages-detailed", args: []string{"search-messages", "--query", "export", "--output", "detailed"}},
+		{name: "read-threads-json", args: []string{"read-threads", "--thread-id", "export-1", "--output", "json"}},
+		{name: "read-message-detail", args: []string{"read-message-detail", "--message-id", "feedback-1"}},
+		{name: "read-message-detail-missing-json", args: []string{"read-message-detail", "--message-id", "nope", "--output", "json"}},
+		{name: "download-attachment-list", args: []string{"download-attachment", "--message-id", "invoice-1", "--list"}},
+		{name: "list-labels", args: []string{"list-labels"}},
+		{
+			name: "reply-message-routes-to-customer",
+			args: []string{"reply-message", "--message-id", "export-2", "--body", "All fixed, sorry for the trouble!"},
+			check: func(t *testing.T, mb *fakegmail.Mailbox) {
+				sent := mb.Sent()
+				if len(sent) != 1 {
+					t.Fatalf("sent %d messages, want 1", len(sent))
+				}
+				h := common.ExtractHeaders(sent[0])
+				if h["to"] != "Ana Souza <ana@customer.com>" || sent[0].ThreadId != "export-1" {
+					t.Errorf("reply went to %q in thread %q", h["to"], sent[0].ThreadId)
+				}
+			},
+		},
+		{
+			name: "draft-reply",
+			args: []string{"draft-reply", "--message-id", "feedback-1", "--body", "Thanks Carla, looking into it."},
+			check: func(t *testing.T, mb *fakegmail.Mailbox) {
+				if len(mb.Sent()) != 0 || len(mb.Drafts()) != 1 {
+					t.Errorf("sent %d, drafted %d; want 0 and 1", len(mb.Sent()), len(mb.Drafts()))
+				}
+			},
+		},
+		{
+			name: "label-message-create",
+			args: []string{"label-message", "--message-id", "export-1", "--add-label", "Escalated", "--remove-label", "UNREAD", "--create-if-missing"},
+		},
+		{
+			name: "archive-message-query-json",
+			args: []string{"archive-message", "--query", "from:ana@customer.com", "--output", "json"},
+			check: func(t *testing.T, mb *fakegmail.Mailbox) {
+				for _, id := range mb.Message("export-1").LabelIds {
+					if id == "INBOX" {
+						t.Error("export-1 is still in INBOX")
+					}
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mb := fakegmail.New()
+			if err := mb.LoadDir(filepath.Join("testdata", "mailbox")); err != nil {
+				t.Fatal(err)
+			}
+			server := fakegmail.NewServer(mb)
+			defer server.Close()
+
+			got := runCLI(t, server.URL, tt.args...)
+			golden := filepath.Join("testdata", "golden", tt.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("missing golden file (run go test -update): %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("output differs from %s:\n--- got ---\n%s\n--- want ---\n%s", golden, got, want)
+			}
+
+			if tt.check != nil {
+				tt.check(t, mb)
+			}
+		})
+	}
+}
+
+// runCLI runs the binary against endpoint with an isolated environment and
+// returns its stdout, stderr and exit code in one transcript.
+func runCLI(t *testing.T, endpoint string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command(binary, args...)
+	cmd.Dir = t.TempDir()
+	cmd.Env = []string{
+		"GMAIL_ENDPOINT=" + endpoint,
+		"TOKEN_DIR=" + t.TempDir(),
+		"HOME=" + t.TempDir(),
+		"SUPPORT_AGENT_CACHE=off",
+		"TZ=UTC",
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	code := 0
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			t.Fatalf("run %v: %v", args, err)
+		}
+		code = exitErr.ExitCode()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "$ support-agent %s\n", strings.Join(args, " "))
+	b.WriteString(stdout.String())
+	if stderr.Len() > 0 {
+		b.WriteString("--- stderr ---\n")
+		b.WriteString(stderr.String())
+	}
+	fmt.Fprintf(&b, "--- exit %d ---\n", code)
+	return b.String()
+}
@@ -0,0 +1,165 @@
+package common
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// Address is an RFC 5322 mailbox: an optional display name and the address
+// itself. The domain is lowercased so the same person compares equal however
+// their header was written.
+type Address struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email"`
+}
+
+// ParseAddress parses a single address such as "Jane <jane@example.com>".
+func ParseAddress(s string) (Address, error) {
+	a, err := addressParser.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return Address{}, fmt.Errorf("invalid address %q: %v", s, err)
+	}
+	return newAddress(a), nil
+}
+
+// ParseAddressList parses a comma-separated address list. An empty string is
+// an empty list; any malformed entry is an error.
+func ParseAddressList(s string) ([]Address, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	list, err := addressParser.ParseList(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address list %q: %v", s, err)
+	}
+	if len(list) == 0 {
+		return nil, nil
+	}
+	addrs := make([]Address, len(list))
+	for i, a := range list {
+		addrs[i] = newAddress(a)
+	}
+	return addrs, nil
+}
+
+// parseAddressHeader parses an address header of a received message. Mail
+// from the wild is not always well-formed, so entries that don't parse on
+// their own are skipped rather than failing the whole header.
+func parseAddressHeader(s string) []Address {
+	if addrs, err := ParseAddressList(s); err == nil {
+		return addrs
+	}
+	var addrs []Address
+	for _, part := range strings.Split(s, ",") {
+		if a, err := ParseAddress(part); err == nil {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// ParseMessageAddresses parses the address headers of a message, as
+// returned by ExtractHeaders, or returns nil if it has none.
+func ParseMessageAddresses(headers map[string]string) *MessageAddresses {
+	addrs := &MessageAddresses{
+		To:      parseAddressHeader(headers["to"]),
+		Cc:      parseAddressHeader(headers["cc"]),
+		Bcc:     parseAddressHeader(headers["bcc"]),
+		ReplyTo: parseAddressHeader(headers["reply-to"]),
+	}
+	if from := parseAddressHeader(headers["from"]); len(from) > 0 {
+		addrs.From = &from[0]
+	}
+	if addrs.From == nil && addrs.To == nil && addrs.Cc == nil && addrs.Bcc == nil && addrs.ReplyTo == nil {
+		return nil
+	}
+	return addrs
+}
+
+func newAddress(a *mail.Address) Address {
+	email := a.Address
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		email = email[:at] + strings.ToLower(email[at:])
+	}
+	return Address{Name: a.Name, Email: email}
+}
+
+// Same reports whether a and b are the same mailbox, ignoring display names
+// and case.
+func (a Address) Same(b Address) bool {
+	return strings.EqualFold(a.Email, b.Email)
+}
+
+// String formats the address for a header: "Name <email>", with the name
+// quoted only when it needs to be and RFC 2047 encoded when not ASCII.
+func (a Address) String() string {
+	if a.Name == "" {
+		return a.Email
+	}
+	if isPlainPhrase(a.Name, false) {
+		return a.Name + " <" + a.Email + ">"
+	}
+	return (&mail.Address{Name: a.Name, Address: a.Email}).String()
+}
+
+// Display formats the address for people to read: like String, but with
+// the display name left in UTF-8 instead of RFC 2047 encoded. The result
+// still parses with ParseAddress.
+func (a Address) Display() string {
+	if a.Name == "" {
+		return a.Email
+	}
+	if isPlainPhrase(a.Name, true) {
+		return a.Name + " <" + a.Email + ">"
+	}
+	quoted := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(a.Name)
+	return `"` + quoted + `" <` + a.Email + ">"
+}
+
+// isPlainPhrase reports whether name can appear unquoted in a header: atoms
+// separated by single spaces, in ASCII unless utf8 is set (RFC 6532).
+func isPlainPhrase(name string, utf8 bool) bool {
+	if strings.TrimSpace(name) != name || strings.Contains(name, "  ") {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == ' ':
+		case strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r):
+		case r > 127 && utf8:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// FormatAddressList joins addresses for a To, Cc or Bcc header.
+func FormatAddressList(addrs []Address) string {
+	parts := make([]string, len(addrs))
+	for i, a := range addrs {
+		parts[i] = a.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// UniqueAddresses returns addrs without repeats of the same mailbox, in order
+// of first appearance. A later mention that has a display name fills in one
+// that had none.
+func UniqueAddresses(addrs []Address) []Address {
+	var unique []Address
+	index := map[string]int{}
+	for _, a := range addrs {
+		key := strings.ToLower(a.Email)
+		if i, ok := index[key]; ok {
+			if unique[i].Name == "" {
+				unique[i].Name = a.Name
+			}
+			continue
+		}
+		index[key] = len(unique)
+		unique = append(unique, a)
+	}
+	return unique
+}
@@ -0,0 +1,77 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Address
+	}{
+		{"j@x.com", Address{Email: "j@x.com"}},
+		{"Jane <Jane@X.COM>", Address{Name: "Jane", Email: "Jane@x.com"}},
+		{`"Doe, Jane" <j@x.com>`, Address{Name: "Doe, Jane", Email: "j@x.com"}},
+		{"=?utf-8?q?Zo=C3=AB?= <zoe@x.com>", Address{Name: "Zoë", Email: "zoe@x.com"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseAddress(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseAddress(%q) = %+v, %v; want %+v", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "jane", "jane@", "<j@x.com", "j@x.com, k@x.com"} {
+		if _, err := ParseAddress(bad); err == nil {
+			t.Errorf("ParseAddress(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestAddressString(t *testing.T) {
+	tests := []struct {
+		addr Address
+		want string
+	}{
+		{Address{Email: "j@x.com"}, "j@x.com"},
+		{Address{Name: "Jane Doe", Email: "j@x.com"}, "Jane Doe <j@x.com>"},
+		{Address{Name: "Doe, Jane", Email: "j@x.com"}, `"Doe, Jane" <j@x.com>`},
+		{Address{Name: "Zoë", Email: "zoe@x.com"}, "=?utf-8?q?Zo=C3=AB?= <zoe@x.com>"},
+	}
+	for _, tt := range tests {
+		if got := tt.addr.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, want %q", tt.addr, got, tt.want)
+		}
+		if back, err := ParseAddress(tt.addr.String()); err != nil || back != tt.addr {
+			t.Errorf("%q does not parse back: %+v, %v", tt.addr.String(), back, err)
+		}
+	}
+}
+
+func TestUniqueAddresses(t *testing.T) {
+	list, err := ParseAddressList(`j@x.com, Jane <J@X.com>, "Bo" <bo@y.com>, jane <j@x.com>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Address{{Name: "Jane", Email: "j@x.com"}, {Name: "Bo", Email: "bo@y.com"}}
+	if got := UniqueAddresses(list); !reflect.DeepEqual(got, want) {
+		t.Errorf("UniqueAddresses() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseMessageAddressesSkipsMalformed(t *testing.T) {
+	got := ParseMessageAddresses(map[string]string{
+		"from": "Ana <ana@customer.com>",
+		"to":   "help@blue.cc, not-an-address, Bo <bo@blue.cc>",
+	})
+	if got == nil || got.From == nil || got.From.Email != "ana@customer.com" {
+		t.Fatalf("From = %+v", got)
+	}
+	if len(got.To) != 2 || got.To[1].Name != "Bo" {
+		t.Errorf("To = %+v, want the two valid addresses", got.To)
+	}
+	if ParseMessageAddresses(map[string]string{"subject": "hi"}) != nil {
+		t.Error("a message without address headers should have no addresses")
+	}
+}
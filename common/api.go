@@ -0,0 +1,42 @@
+package common
+
+import (
+	"io"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// GmailAPI is the mailbox surface the commands are written against. The real
+// implementation is GmailClient; tests use the in-memory mailbox in
+// common/fakegmail so commands can run without a Google account.
+//
+// Streaming and bookkeeping features (history sync, watch, hydration, the
+// cache) stay on GmailClient: they are about talking to Gmail efficiently,
+// not about what a command does with the mailbox.
+type GmailAPI interface {
+	// ListMessages lists message stubs (ID and thread ID) matching a Gmail
+	// search query, newest first. See GmailClient.ListMessages.
+	ListMessages(query string, limit int64, pageToken string) (*MessageList, error)
+	GetMessage(messageID string) (*gmail.Message, error)
+	GetThread(threadID string) (*gmail.Thread, error)
+	GetAttachment(messageID, attachmentID string) (*gmail.MessagePartBody, error)
+	// GetRawMessage returns a message as the RFC 5322 bytes Gmail stores.
+	GetRawMessage(messageID string) ([]byte, error)
+
+	// SendMessage and CreateDraft read an RFC 5322 message from raw and
+	// file it in threadID, or a new thread if threadID is empty.
+	SendMessage(threadID string, raw io.Reader) (*gmail.Message, error)
+	CreateDraft(threadID string, raw io.Reader) (*gmail.Draft, error)
+
+	ModifyMessage(messageID string, addLabels, removeLabels []string) (*gmail.Message, error)
+	ModifyThread(threadID string, addLabels, removeLabels []string) (*gmail.Thread, error)
+	BatchModifyMessages(messageIDs []string, addLabels, removeLabels []string) ([]BatchResult, error)
+
+	ListLabels() ([]*gmail.Label, error)
+	CreateLabel(name string) (*gmail.Label, error)
+
+	// Close releases what the client holds locally, such as the cache.
+	Close() error
+}
+
+var _ GmailAPI = (*GmailClient)(nil)
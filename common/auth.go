@@ -3,10 +3,12 @@ package common
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
-	"path/filepath"
+	"strings"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -14,44 +16,102 @@ import (
 	"google.golang.org/api/option"
 )
 
+// GmailEndpoint returns the Gmail API base URL set with gmail_endpoint, or ""
+// for Google's. It exists to point the tool at a local emulator (see
+// common/fakegmail.NewServer); requests to an overridden endpoint are sent
+// without OAuth credentials.
+func GmailEndpoint() string {
+	endpoint := Settings().GmailEndpoint
+	if endpoint != "" && !strings.HasSuffix(endpoint, "/") {
+		endpoint += "/"
+	}
+	return endpoint
+}
+
+// gmailServiceOptions returns the options for creating a Gmail service that
+// uses client.
+func gmailServiceOptions(client *http.Client) []option.ClientOption {
+	opts := []option.ClientOption{option.WithHTTPClient(client)}
+	if endpoint := GmailEndpoint(); endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+	}
+	return opts
+}
+
 // GetAuthenticatedClient returns an authenticated Gmail service
 func GetAuthenticatedClient() (*gmail.Service, error) {
+	client, err := GetAuthenticatedHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	// Create Gmail service
+	srv, err := gmail.NewService(context.Background(), gmailServiceOptions(client)...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Gmail service: %v", err)
+	}
+
+	return srv, nil
+}
+
+// GetAuthenticatedHTTPClient returns an HTTP client that authorizes requests
+// with the cached OAuth token. It is used for the Gmail service and for raw
+// requests the generated client doesn't cover, such as batch calls.
+func GetAuthenticatedHTTPClient() (*http.Client, error) {
 	ctx := context.Background()
-	
-	// Get OAuth2 config
-	config, err := getOAuthConfig()
+
+	if GmailEndpoint() != "" {
+		return &http.Client{Transport: newRetryTransport(http.DefaultTransport, DefaultRetryPolicy, DefaultQuota)}, nil
+	}
+
+	// Unattended setups authenticate as a delegated service account
+	sa, err := serviceAccount(RequiredScope)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get OAuth config: %v", err)
+		return nil, err
+	}
+	if sa != nil {
+		return serviceAccountClient(ctx, sa), nil
 	}
 
-	// Get or refresh token
-	token, err := getToken(config)
+	// Get OAuth2 config for the scopes this command needs
+	config, err := getOAuthConfig(RequiredScope)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get token: %v", err)
+		return nil, fmt.Errorf("unable to get OAuth config: %v", err)
 	}
 
-	// Create Gmail service
-	client := config.Client(ctx, token)
-	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
+	// Get or refresh token
+	token, store, err := getToken(config, RequiredScope)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create Gmail service: %v", err)
+		return nil, fmt.Errorf("unable to get token: %w", err)
 	}
 
-	return srv, nil
+	// Save refreshed tokens, and retry transient failures and pace requests
+	// under the per-user quota.
+	client := oauth2.NewClient(ctx, newPersistingTokenSource(ctx, config, token, store))
+	client.Transport = newRetryTransport(client.Transport, DefaultRetryPolicy, DefaultQuota)
+	return client, nil
 }
 
-// getOAuthConfig loads OAuth2 config from credentials file
-func getOAuthConfig() (*oauth2.Config, error) {
-	// Check environment variable first
-	credPath := os.Getenv("GMAIL_CREDENTIALS_PATH")
+// getOAuthConfig loads OAuth2 config from credentials file, requesting the
+// scopes of class
+func getOAuthConfig(class ScopeClass) (*oauth2.Config, error) {
+	profile, err := CurrentProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	// A profile's own credentials come first, then the configuration
+	credPath := profile.CredentialsPath
 	if credPath == "" {
-		credPath = "gmail.json"
+		credPath = Settings().CredentialsPath
 	}
 
-	// Also check raw credentials from env
-	credJSON := os.Getenv("GMAIL_CREDENTIALS")
+	// Also check raw credentials from the configuration
+	credJSON := ""
+	if profile.CredentialsPath == "" {
+		credJSON = Settings().Credentials
+	}
 	var b []byte
-	var err error
 
 	if credJSON != "" {
 		b = []byte(credJSON)
@@ -62,50 +122,65 @@ func getOAuthConfig() (*oauth2.Config, error) {
 		}
 	}
 
-	config, err := google.ConfigFromJSON(b, gmail.GmailModifyScope)
+	config, err := google.ConfigFromJSON(b, class.Scopes()...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse credentials: %v", err)
 	}
+	// ConfigFromJSON only sets the auth and token URLs; the opt-in device
+	// flow needs Google's device authorization endpoint too.
+	config.Endpoint.DeviceAuthURL = google.Endpoint.DeviceAuthURL
 
 	return config, nil
 }
 
-// getToken retrieves a token from cache or initiates OAuth flow
-func getToken(config *oauth2.Config) (*oauth2.Token, error) {
-	tokenFile := getTokenPath()
-	
+// getToken retrieves a token granting class from the profile's token store
+// or initiates OAuth flow. It also returns the store refreshed tokens should
+// be saved to.
+func getToken(config *oauth2.Config, class ScopeClass) (*oauth2.Token, TokenStore, error) {
 	// Try to load existing token
-	tok, err := loadToken(tokenFile)
+	tok, store, err := loadProfileToken(ActiveProfileName(), class)
 	if err == nil {
-		return tok, nil
+		return tok, store, nil
+	}
+	if !errors.Is(err, ErrNoToken) {
+		return nil, nil, err
+	}
+
+	// Nobody is at the terminal to complete a login (cron, pipelines).
+	if !isInteractive() {
+		return nil, nil, errNotLoggedIn
 	}
 
 	// Get new token via OAuth flow
-	tok, err = getTokenFromWeb(config)
+	fmt.Fprintf(os.Stderr, "No saved Gmail token; starting login (see also: support-agent auth login).\n")
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultLoginTimeout)
+	defer cancel()
+	tok, err = authorize(ctx, config, LoginOptions{Method: LoginLoopback, Scope: class})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Save token for future use
-	saveToken(tokenFile, tok)
-	return tok, nil
+	// Save token for future use. Without it every run would need a login,
+	// so a failure here is an error rather than a warning.
+	if err := store.Save(tok); err != nil {
+		return nil, nil, err
+	}
+	return tok, store, nil
 }
 
-// getTokenPath returns the path to the token file
-func getTokenPath() string {
-	tokenDir := os.Getenv("TOKEN_DIR")
-	if tokenDir == "" {
-		home, _ := os.UserHomeDir()
-		tokenDir = filepath.Join(home, ".support-agent")
-	}
-	
+// TokenDir returns the directory holding the active profile's OAuth token
+// and other local state (TOKEN_DIR, default ~/.support-agent, or
+// profiles/NAME below it for a named profile), creating it if needed.
+func TokenDir() string {
+	tokenDir := ProfileDir(ActiveProfileName())
+
 	// Create directory if it doesn't exist
 	os.MkdirAll(tokenDir, 0700)
-	
-	return filepath.Join(tokenDir, "token.json")
+
+	return tokenDir
 }
 
-// loadToken retrieves a token from a local file
+// loadToken retrieves a token from a plaintext file
 func loadToken(file string) (*oauth2.Token, error) {
 	f, err := os.Open(file)
 	if err != nil {
@@ -118,32 +193,15 @@ func loadToken(file string) (*oauth2.Token, error) {
 	return tok, err
 }
 
-// saveToken saves a token to a file
+// saveToken saves a token to a file. The file is replaced atomically so a
+// crash or a concurrent run never leaves a truncated token behind.
 func saveToken(path string, token *oauth2.Token) error {
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	data, err := json.Marshal(token)
 	if err != nil {
 		return fmt.Errorf("unable to save token: %v", err)
 	}
-	defer f.Close()
-	
-	return json.NewEncoder(f).Encode(token)
-}
-
-// getTokenFromWeb initiates OAuth flow to get a new token
-func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser:\n%v\n", authURL)
-	fmt.Print("Enter authorization code: ")
-
-	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-		return nil, fmt.Errorf("unable to read authorization code: %v", err)
-	}
-
-	tok, err := config.Exchange(context.Background(), authCode)
-	if err != nil {
-		return nil, fmt.Errorf("unable to exchange authorization code: %v", err)
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return fmt.Errorf("unable to save token: %v", err)
 	}
-
-	return tok, nil
-}
\ No newline at end of file
+	return nil
+}
@@ -0,0 +1,308 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// batchGetChunkSize is how many messages.get calls go into one multipart
+	// batch request. Gmail accepts up to 100 but recommends 50 or fewer, since
+	// larger batches are more likely to trip the per-user rate limit.
+	batchGetChunkSize = 50
+
+	// batchModifyChunkSize is the most IDs Users.Messages.BatchModify takes
+	// in one call.
+	batchModifyChunkSize = 1000
+)
+
+// BatchResult is the outcome of one item in a bulk operation.
+type BatchResult struct {
+	ID     string    `json:"id"`
+	Status string    `json:"status"` // "ok" or "error"
+	Error  string    `json:"error,omitempty"`
+	Kind   ErrorKind `json:"kind,omitempty"`
+	// AllOrNothing is set on a failed item whose whole request failed as a
+	// unit: the item itself may have been fine, and retrying it alone or in a
+	// smaller batch may succeed.
+	AllOrNothing bool `json:"all_or_nothing,omitempty"`
+}
+
+// BatchModifyMessages adds and removes labels on many messages using
+// Users.Messages.BatchModify, one request per 1000 IDs. Gmail reports success
+// or failure per request, so every ID in a failed chunk is marked failed with
+// AllOrNothing set and an error saying the chunk failed as a whole. The
+// returned error is only set when nothing could be attempted.
+func (c *GmailClient) BatchModifyMessages(messageIDs []string, addLabels, removeLabels []string) ([]BatchResult, error) {
+	if len(addLabels) == 0 && len(removeLabels) == 0 {
+		return nil, fmt.Errorf("no labels to add or remove")
+	}
+
+	results := make([]BatchResult, 0, len(messageIDs))
+	for start := 0; start < len(messageIDs); start += batchModifyChunkSize {
+		end := start + batchModifyChunkSize
+		if end > len(messageIDs) {
+			end = len(messageIDs)
+		}
+		chunk := messageIDs[start:end]
+
+		req := &gmail.BatchModifyMessagesRequest{
+			Ids:            chunk,
+			AddLabelIds:    addLabels,
+			RemoveLabelIds: removeLabels,
+		}
+		err := wrapAPIError("modify messages", c.Service.Users.Messages.BatchModify(c.UserID, req).Do())
+		if err == nil {
+			c.invalidateCache(chunk, nil)
+		}
+		for _, id := range chunk {
+			if err != nil {
+				results = append(results, BatchResult{
+					ID:           id,
+					Status:       "error",
+					Error:        fmt.Sprintf("batch of %d messages failed as a whole: %v", len(chunk), err),
+					Kind:         ErrorKindOf(err),
+					AllOrNothing: true,
+				})
+			} else {
+				results = append(results, BatchResult{ID: id, Status: "ok"})
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// BatchGetMessages fetches full messages through Gmail's multipart batch
+// endpoint, bundling up to 50 messages.get calls per round trip. Items that
+// are rate limited or hit a server error inside an otherwise successful batch
+// are re-sent in a follow-up batch with backoff. Messages are returned in the
+// order of messageIDs; items that still failed are reported in the returned
+// MessageErrors. The error is set only if a batch request as a whole could not
+// be made.
+func (c *GmailClient) BatchGetMessages(messageIDs []string) ([]*gmail.Message, []MessageError, error) {
+	if c.HTTP == nil {
+		return nil, nil, fmt.Errorf("batch requests need an authorized HTTP client")
+	}
+
+	var messages []*gmail.Message
+	var failures []MessageError
+	for start := 0; start < len(messageIDs); start += batchGetChunkSize {
+		end := start + batchGetChunkSize
+		if end > len(messageIDs) {
+			end = len(messageIDs)
+		}
+		chunk := messageIDs[start:end]
+
+		fetched, errs, err := c.batchGetChunk(chunk)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, id := range chunk {
+			if errs[i] != nil {
+				failures = append(failures, MessageError{ID: id, Error: errs[i].Error(), Kind: ErrorKindOf(errs[i])})
+				continue
+			}
+			messages = append(messages, fetched[i])
+		}
+	}
+
+	return messages, failures, nil
+}
+
+// batchGetChunk fetches one chunk of at most batchGetChunkSize messages,
+// retrying transient per-item failures. The returned slices are indexed like
+// messageIDs.
+func (c *GmailClient) batchGetChunk(messageIDs []string) ([]*gmail.Message, []error, error) {
+	messages := make([]*gmail.Message, len(messageIDs))
+	errs := make([]error, len(messageIDs))
+
+	pending := make([]int, len(messageIDs))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	policy := DefaultRetryPolicy
+	var wait time.Duration
+	for attempt := 1; len(pending) > 0; attempt++ {
+		if attempt > 1 {
+			time.Sleep(wait)
+		}
+
+		ids := make([]string, len(pending))
+		for i, idx := range pending {
+			ids[i] = messageIDs[idx]
+		}
+		responses, err := c.doBatch(ids)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var retry []int
+		wait = 0
+		for i, idx := range pending {
+			resp, ok := responses[i]
+			if !ok {
+				errs[idx] = fmt.Errorf("no response in batch")
+				continue
+			}
+			if resp.status < 200 || resp.status > 299 {
+				errs[idx] = batchItemError("retrieve message", resp)
+				kind := ErrorKindOf(errs[idx])
+				if (kind == KindRateLimited || kind == KindUnavailable) && attempt < policy.MaxAttempts {
+					retry = append(retry, idx)
+					// The follow-up batch waits for the slowest item's
+					// Retry-After, or the backoff if none gave one.
+					wait = max(wait, policy.delay(attempt, &http.Response{Header: resp.header}))
+				}
+				continue
+			}
+			msg := &gmail.Message{}
+			if err := json.Unmarshal(resp.body, msg); err != nil {
+				errs[idx] = fmt.Errorf("unable to decode message: %v", err)
+				continue
+			}
+			messages[idx], errs[idx] = msg, nil
+		}
+		pending = retry
+	}
+
+	return messages, errs, nil
+}
+
+// batchItemResponse is one decoded part of a batch response.
+type batchItemResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// doBatch sends one multipart batch of messages.get calls and returns the
+// responses keyed by the index of the ID in messageIDs.
+func (c *GmailClient) doBatch(messageIDs []string) (map[int]batchItemResponse, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, id := range messageIDs {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "application/http")
+		header.Set("Content-ID", fmt.Sprintf("<item%d>", i))
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			return nil, fmt.Errorf("unable to build batch request: %v", err)
+		}
+		fmt.Fprintf(part, "GET /gmail/v1/users/%s/messages/%s?format=full\r\n\r\n",
+			url.PathEscape(c.UserID), url.PathEscape(id))
+	}
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("unable to build batch request: %v", err)
+	}
+
+	// The batch envelope isn't charged by the transport; its items are.
+	if err := DefaultQuota.Acquire(context.Background(), c.UserID, 5*len(messageIDs)); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", c.batchURL(), &body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build batch request: %v", err)
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, wrapAPIError("send batch request", err)
+	}
+	defer resp.Body.Close()
+
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, wrapAPIError("send batch request", err)
+	}
+
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return nil, fmt.Errorf("unexpected batch response content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	responses := make(map[int]batchItemResponse, len(messageIDs))
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read batch response: %v", err)
+		}
+
+		idx, ok := batchItemIndex(part.Header.Get("Content-ID"))
+		if !ok {
+			continue
+		}
+		inner, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse batch item %d: %v", idx, err)
+		}
+		data, err := io.ReadAll(inner.Body)
+		inner.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read batch item %d: %v", idx, err)
+		}
+		responses[idx] = batchItemResponse{status: inner.StatusCode, header: inner.Header, body: data}
+	}
+
+	return responses, nil
+}
+
+// batchURL returns the batch endpoint for the service's base path, so an
+// endpoint override applies to batch calls too.
+func (c *GmailClient) batchURL() string {
+	base := c.Service.BasePath
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base + "batch/gmail/v1"
+}
+
+// batchItemIndex extracts N from a response Content-ID of the form
+// "<response-itemN>".
+func batchItemIndex(contentID string) (int, bool) {
+	id := strings.Trim(contentID, "<>")
+	id = strings.TrimPrefix(id, "response-")
+	if !strings.HasPrefix(id, "item") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(id, "item"))
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// batchItemError turns a failed batch item into an *APIError, decoding the
+// item body the same way googleapi.CheckResponse does for single calls.
+func batchItemError(op string, resp batchItemResponse) error {
+	gErr := &googleapi.Error{Code: resp.status, Body: string(resp.body)}
+	var body struct {
+		Error *googleapi.Error `json:"error"`
+	}
+	if err := json.Unmarshal(resp.body, &body); err == nil && body.Error != nil {
+		gErr = body.Error
+		gErr.Code = resp.status
+	}
+	return wrapAPIError(op, gErr)
+}
@@ -0,0 +1,243 @@
+package common_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blue/support-agent/common"
+	"github.com/blue/support-agent/common/fakegmail"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// newFakeClient returns a GmailClient talking to h over HTTP.
+func newFakeClient(t *testing.T, h http.Handler) *common.GmailClient {
+	t.Helper()
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+
+	service, err := gmail.NewService(context.Background(),
+		option.WithHTTPClient(server.Client()), option.WithEndpoint(server.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &common.GmailClient{Service: service, HTTP: server.Client(), UserID: "me"}
+}
+
+// editBatch passes requests through to next, then lets edit rewrite the
+// parts of each batch response. edit gets the batch number (from 1), the
+// part's Content-ID and its application/http content; it returns the new
+// content, or false to drop the part.
+func editBatch(t *testing.T, next http.Handler, edit func(round int, contentID string, content []byte) ([]byte, bool)) http.Handler {
+	round := 0
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/batch/gmail/v1" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		round++
+		rec := httptest.NewRecorder()
+		next.ServeHTTP(rec, r)
+
+		_, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+		if err != nil {
+			t.Errorf("batch response: %v", err)
+			return
+		}
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mr := multipart.NewReader(rec.Body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Errorf("batch response: %v", err)
+				return
+			}
+			content, _ := io.ReadAll(part)
+			content, keep := edit(round, part.Header.Get("Content-ID"), content)
+			if !keep {
+				continue
+			}
+			out, _ := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type": {"application/http"},
+				"Content-Id":   {part.Header.Get("Content-ID")},
+			})
+			out.Write(content)
+		}
+		mw.Close()
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+		w.Write(body.Bytes())
+	})
+}
+
+// statusOf returns the status code of a batch part's HTTP response.
+func statusOf(t *testing.T, content []byte) int {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(content)), nil)
+	if err != nil {
+		t.Fatalf("batch part: %v", err)
+	}
+	return resp.StatusCode
+}
+
+func seedMailbox(ids ...string) *fakegmail.Mailbox {
+	mb := fakegmail.New()
+	for _, id := range ids {
+		mb.Add(fakegmail.Message{ID: id, From: "jane@customer.com", Subject: "Subject " + id, Body: "body " + id, Labels: []string{"INBOX"}})
+	}
+	return mb
+}
+
+func messageIDs(msgs []*gmail.Message) []string {
+	ids := make([]string, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.Id
+	}
+	return ids
+}
+
+func TestBatchGetMessagesOutOfOrder(t *testing.T) {
+	mb := seedMailbox("m1", "m2", "m3", "m4")
+	client := newFakeClient(t, fakegmail.Handler(mb))
+
+	// fakegmail answers the parts in reverse order.
+	msgs, failures, err := client.BatchGetMessages([]string{"m3", "m1", "m4", "m2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 0 {
+		t.Errorf("failures = %+v", failures)
+	}
+	if got, want := messageIDs(msgs), []string{"m3", "m1", "m4", "m2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("messages = %v, want %v", got, want)
+	}
+	if msgs[0].Payload == nil || msgs[0].Snippet != "body m3" {
+		t.Errorf("m3 = %+v, want the full message", msgs[0])
+	}
+}
+
+func TestBatchGetMessagesFailedPart(t *testing.T) {
+	mb := seedMailbox("m1", "m2")
+	client := newFakeClient(t, fakegmail.Handler(mb))
+
+	msgs, failures, err := client.BatchGetMessages([]string{"m1", "gone", "m2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := messageIDs(msgs), []string{"m1", "m2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("messages = %v, want %v", got, want)
+	}
+	if len(failures) != 1 || failures[0].ID != "gone" || failures[0].Kind != common.KindNotFound ||
+		!strings.Contains(failures[0].Error, "requested entity was not found") {
+		t.Errorf("failures = %+v, want gone as not_found", failures)
+	}
+}
+
+func TestBatchGetMessagesMissingPart(t *testing.T) {
+	mb := seedMailbox("m1", "m2", "m3")
+	rounds := 0
+	client := newFakeClient(t, editBatch(t, fakegmail.Handler(mb), func(round int, contentID string, content []byte) ([]byte, bool) {
+		rounds = round
+		return content, contentID != "<response-item1>"
+	}))
+
+	msgs, failures, err := client.BatchGetMessages([]string{"m1", "m2", "m3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := messageIDs(msgs), []string{"m1", "m3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("messages = %v, want %v", got, want)
+	}
+	if len(failures) != 1 || failures[0].ID != "m2" || failures[0].Error != "no response in batch" {
+		t.Errorf("failures = %+v, want m2 without a response", failures)
+	}
+	if rounds != 1 {
+		t.Errorf("sent %d batches, want 1: a missing part isn't retried", rounds)
+	}
+}
+
+func TestBatchGetMessagesRetriesTransientParts(t *testing.T) {
+	// Retry-After wins over the backoff, which would take far longer than
+	// the test allows.
+	orig := common.DefaultRetryPolicy
+	defer func() { common.DefaultRetryPolicy = orig }()
+	common.DefaultRetryPolicy = common.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Minute, MaxDelay: time.Minute}
+
+	mb := seedMailbox("m1", "m2", "m3")
+	var statuses []string
+	client := newFakeClient(t, editBatch(t, fakegmail.Handler(mb), func(round int, contentID string, content []byte) ([]byte, bool) {
+		statuses = append(statuses, fmt.Sprintf("%d:%s:%d", round, contentID, statusOf(t, content)))
+		if round == 1 && contentID == "<response-item1>" {
+			return []byte("HTTP/1.1 503 Service Unavailable\r\nRetry-After: 0\r\nContent-Type: application/json\r\n\r\n" +
+				`{"error":{"code":503,"message":"backend error","errors":[{"reason":"backendError"}]}}`), true
+		}
+		return content, true
+	}))
+
+	start := time.Now()
+	msgs, failures, err := client.BatchGetMessages([]string{"m1", "m2", "m3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("took %v; Retry-After: 0 should have been honored", elapsed)
+	}
+	if len(failures) != 0 {
+		t.Errorf("failures = %+v", failures)
+	}
+	if got, want := messageIDs(msgs), []string{"m1", "m2", "m3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("messages = %v, want %v", got, want)
+	}
+	// Only the failed item goes into the second batch.
+	want := []string{"1:<response-item2>:200", "1:<response-item1>:200", "1:<response-item0>:200", "2:<response-item0>:200"}
+	if !reflect.DeepEqual(statuses, want) {
+		t.Errorf("batch parts = %v, want %v", statuses, want)
+	}
+}
+
+func TestBatchModifyMessagesAllOrNothing(t *testing.T) {
+	mb := seedMailbox("m1", "m2")
+	client := newFakeClient(t, fakegmail.Handler(mb))
+
+	// Gmail rejects the whole request for one unknown ID.
+	results, err := client.BatchModifyMessages([]string{"m1", "gone", "m2"}, nil, []string{"INBOX"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("results = %+v", results)
+	}
+	for _, r := range results {
+		if r.Status != "error" || !r.AllOrNothing || r.Kind != common.KindInvalid ||
+			!strings.HasPrefix(r.Error, "batch of 3 messages failed as a whole: ") {
+			t.Errorf("result = %+v, want an all-or-nothing failure", r)
+		}
+	}
+	if labels := mb.Message("m1").LabelIds; len(labels) != 1 || labels[0] != "INBOX" {
+		t.Errorf("m1 labels = %v, want it untouched", labels)
+	}
+
+	results, err = client.BatchModifyMessages([]string{"m1", "m2"}, nil, []string{"INBOX"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Status != "ok" || r.AllOrNothing {
+			t.Errorf("result = %+v, want ok", r)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package common
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/api/gmail/v1"
+)
+
+var (
+	bucketMessages = []byte("messages")
+	bucketThreads  = []byte("threads")
+	bucketMeta     = []byte("meta")
+
+	keyHistoryID = []byte("history_id")
+)
+
+// cacheEntry is a cached message or thread together with the history ID it
+// was current at and when it was fetched.
+type cacheEntry struct {
+	HistoryID uint64          `json:"history_id"`
+	FetchedAt time.Time       `json:"fetched_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Cache is an on-disk store of full messages and threads, kept in a bbolt
+// database under TOKEN_DIR. Entries are keyed by message or thread ID and
+// stay valid until the History API reports a change to them; see
+// GmailClient.refreshCache.
+type Cache struct {
+	db   *bolt.DB
+	path string
+}
+
+// CacheStats describes the contents of the cache.
+type CacheStats struct {
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"size_bytes"`
+	Messages  int    `json:"messages"`
+	Threads   int    `json:"threads"`
+	Indexed   int    `json:"indexed"`
+	HistoryID uint64 `json:"history_id"`
+}
+
+// DefaultCachePath returns the cache database location.
+func DefaultCachePath() string {
+	return filepath.Join(TokenDir(), "cache.db")
+}
+
+// OpenCache opens (creating if needed) the cache database at path. bbolt
+// allows one writer process at a time; if another process holds the cache
+// for more than a second, OpenCache gives up with an error.
+func OpenCache(path string) (*Cache, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open cache %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketMessages, bucketThreads, bucketMeta} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to initialize cache: %v", err)
+	}
+
+	return &Cache{db: db, path: path}, nil
+}
+
+// Close releases the database.
+func (c *Cache) Close() error {
+	return c.db.Close()
+}
+
+// GetMessage returns a cached message.
+func (c *Cache) GetMessage(id string) (*gmail.Message, bool) {
+	msg := &gmail.Message{}
+	if !c.get(bucketMessages, id, msg) {
+		return nil, false
+	}
+	return msg, true
+}
+
+// PutMessage stores a full message and adds it to the full-text index, so
+// every message fetched through the cache becomes locally searchable.
+func (c *Cache) PutMessage(msg *gmail.Message) error {
+	if err := c.put(bucketMessages, msg.Id, msg.HistoryId, msg); err != nil {
+		return err
+	}
+	return c.IndexMessage(msg)
+}
+
+// GetThread returns a cached thread.
+func (c *Cache) GetThread(id string) (*gmail.Thread, bool) {
+	thread := &gmail.Thread{}
+	if !c.get(bucketThreads, id, thread) {
+		return nil, false
+	}
+	return thread, true
+}
+
+// PutThread stores a full thread.
+func (c *Cache) PutThread(thread *gmail.Thread) error {
+	return c.put(bucketThreads, thread.Id, thread.HistoryId, thread)
+}
+
+// Invalidate drops the given messages and threads. Empty IDs are ignored.
+func (c *Cache) Invalidate(messageIDs, threadIDs []string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		for _, id := range messageIDs {
+			if id != "" {
+				if err := tx.Bucket(bucketMessages).Delete([]byte(id)); err != nil {
+					return err
+				}
+			}
+		}
+		for _, id := range threadIDs {
+			if id != "" {
+				if err := tx.Bucket(bucketThreads).Delete([]byte(id)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// HistoryID returns the history ID up to which changes have been applied to
+// the cache, or 0 if the cache has never been synced.
+func (c *Cache) HistoryID() uint64 {
+	var id uint64
+	c.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucketMeta).Get(keyHistoryID); len(v) == 8 {
+			id = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	return id
+}
+
+// SetHistoryID records that changes up to id have been applied.
+func (c *Cache) SetHistoryID(id uint64) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, id)
+		return tx.Bucket(bucketMeta).Put(keyHistoryID, v)
+	})
+}
+
+// Purge removes every cached message and thread and forgets the history
+// checkpoint. The full-text index is left alone: it is the offline mirror
+// and stays searchable even when the cache has to start over.
+func (c *Cache) Purge() error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketMessages, bucketThreads, bucketMeta} {
+			if err := tx.DeleteBucket(b); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+				return err
+			}
+			if _, err := tx.CreateBucket(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PurgeIndex removes every message from the full-text index.
+func (c *Cache) PurgeIndex() error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketDocs, bucketPostings} {
+			if err := tx.DeleteBucket(b); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Stats counts the cached entries.
+func (c *Cache) Stats() (*CacheStats, error) {
+	stats := &CacheStats{Path: c.path, HistoryID: c.HistoryID()}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		stats.Messages = tx.Bucket(bucketMessages).Stats().KeyN
+		stats.Threads = tx.Bucket(bucketThreads).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats.Indexed = c.IndexedCount()
+	if fi, err := os.Stat(c.path); err == nil {
+		stats.SizeBytes = fi.Size()
+	}
+	return stats, nil
+}
+
+func (c *Cache) get(bucket []byte, id string, v interface{}) bool {
+	var entry cacheEntry
+	found := false
+	c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		if json.Unmarshal(data, &entry) == nil && json.Unmarshal(entry.Data, v) == nil {
+			found = true
+		}
+		return nil
+	})
+	return found
+}
+
+func (c *Cache) put(bucket []byte, id string, historyID uint64, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	entry, err := json.Marshal(cacheEntry{HistoryID: historyID, FetchedAt: time.Now(), Data: data})
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(id), entry)
+	})
+}
+
+// cacheState tracks whether the client's cache has been brought up to date
+// with the mailbox in this process.
+type cacheState struct {
+	once   sync.Once
+	usable bool
+}
+
+// refreshCache applies mailbox changes since the cache's checkpoint by
+// dropping every message and thread the History API reports as touched. It
+// runs once per process, on the first cached lookup. If the checkpoint is
+// too old to replay, the cache is purged. If the refresh fails (e.g. no
+// network), the cache is bypassed for this process rather than serving
+// possibly stale data.
+func (c *GmailClient) refreshCache() bool {
+	if c.Cache == nil {
+		return false
+	}
+	c.cacheState.once.Do(func() {
+		if err := c.applyCacheHistory(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: cache disabled for this run: %v\n", err)
+			return
+		}
+		c.cacheState.usable = true
+	})
+	return c.cacheState.usable
+}
+
+func (c *GmailClient) applyCacheHistory() error {
+	start := c.Cache.HistoryID()
+	if start != 0 {
+		result, err := c.History(start, "")
+		if err == nil {
+			var messageIDs, threadIDs, deletedIDs []string
+			for _, ev := range HistoryEvents(result.Records) {
+				messageIDs = append(messageIDs, ev.MessageID)
+				threadIDs = append(threadIDs, ev.ThreadID)
+				if ev.Type == EventMessageDeleted {
+					deletedIDs = append(deletedIDs, ev.MessageID)
+				}
+			}
+			if err := c.Cache.Invalidate(messageIDs, threadIDs); err != nil {
+				return err
+			}
+			if err := c.Cache.RemoveFromIndex(deletedIDs); err != nil {
+				return err
+			}
+			return c.Cache.SetHistoryID(result.HistoryID)
+		}
+		if !errors.Is(err, ErrHistoryExpired) {
+			return err
+		}
+	}
+
+	// No checkpoint, or too old to replay: nothing cached can be trusted.
+	profile, err := c.GetProfile()
+	if err != nil {
+		return err
+	}
+	if err := c.Cache.Purge(); err != nil {
+		return err
+	}
+	return c.Cache.SetHistoryID(profile.HistoryId)
+}
+
+// invalidateCache drops entries this process just changed, so later lookups
+// in the same run see the change without waiting for the History API.
+func (c *GmailClient) invalidateCache(messageIDs, threadIDs []string) {
+	if c.Cache != nil {
+		c.Cache.Invalidate(messageIDs, threadIDs)
+	}
+}
@@ -0,0 +1,121 @@
+package common
+
+import (
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestCacheRoundTrip(t *testing.T) {
+	cache := testCache(t)
+
+	msg := testMessage("m1", "jane@customer.com", "Refund request", "Please refund INV-1001.", 1000, "INBOX")
+	msg.HistoryId = 42
+	if err := cache.PutMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := cache.GetMessage("m1")
+	if !ok {
+		t.Fatal("GetMessage: not found after PutMessage")
+	}
+	if got.Id != "m1" || got.HistoryId != 42 || ExtractMessageBody(got) != "Please refund INV-1001." {
+		t.Errorf("GetMessage = %+v, body %q", got, ExtractMessageBody(got))
+	}
+	if results, _ := cache.SearchIndex("refund", 0); len(results) != 1 {
+		t.Errorf("PutMessage indexed %d messages, want 1", len(results))
+	}
+
+	thread := &gmail.Thread{Id: "t1", HistoryId: 43, Messages: []*gmail.Message{msg}}
+	if err := cache.PutThread(thread); err != nil {
+		t.Fatal(err)
+	}
+	gotThread, ok := cache.GetThread("t1")
+	if !ok || gotThread.Id != "t1" || len(gotThread.Messages) != 1 {
+		t.Errorf("GetThread = %+v, %v", gotThread, ok)
+	}
+
+	if _, ok := cache.GetMessage("missing"); ok {
+		t.Error("GetMessage found a message that was never stored")
+	}
+
+	if id := cache.HistoryID(); id != 0 {
+		t.Errorf("HistoryID of a new cache = %d, want 0", id)
+	}
+	if err := cache.SetHistoryID(1234); err != nil {
+		t.Fatal(err)
+	}
+	if id := cache.HistoryID(); id != 1234 {
+		t.Errorf("HistoryID = %d, want 1234", id)
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	cache := testCache(t)
+	for _, id := range []string{"m1", "m2"} {
+		if err := cache.PutMessage(testMessage(id, "jane@customer.com", "Export", "export failed", 1000)); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.PutThread(&gmail.Thread{Id: "t" + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cache.Invalidate([]string{"m1", ""}, []string{"tm2", ""}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.GetMessage("m1"); ok {
+		t.Error("m1 still cached after Invalidate")
+	}
+	if _, ok := cache.GetMessage("m2"); !ok {
+		t.Error("m2 was dropped but not invalidated")
+	}
+	if _, ok := cache.GetThread("tm2"); ok {
+		t.Error("thread tm2 still cached after Invalidate")
+	}
+	if _, ok := cache.GetThread("tm1"); !ok {
+		t.Error("thread tm1 was dropped but not invalidated")
+	}
+
+	// Purge starts the cache over but keeps the offline index.
+	if err := cache.SetHistoryID(99); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := cache.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Messages != 0 || stats.Threads != 0 || stats.HistoryID != 0 || stats.Indexed != 2 {
+		t.Errorf("after Purge: %+v, want an empty cache with 2 indexed messages", stats)
+	}
+}
+
+func TestGmailClientCloseReleasesCache(t *testing.T) {
+	testConfig(t)
+	path := filepath.Join(t.TempDir(), "cache.db")
+	cache, err := OpenCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &GmailClient{Cache: cache}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if client.Cache != nil {
+		t.Error("Close left the cache on the client")
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	// Another process (or command) can take the cache over now.
+	reopened, err := OpenCache(path)
+	if err != nil {
+		t.Fatalf("OpenCache after Close: %v", err)
+	}
+	reopened.Close()
+}
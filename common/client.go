@@ -1,89 +1,143 @@
 package common
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"html"
+	"io"
+	"net/http"
+	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
 )
 
 // GmailClient wraps the Gmail service with helper methods
 type GmailClient struct {
 	Service *gmail.Service
+	HTTP    *http.Client // authorized client, used for batch requests
 	UserID  string
+	Cache   *Cache // nil when caching is disabled
+
+	cacheState cacheState
 }
 
-// NewGmailClient creates a new Gmail client
+// NewGmailClient creates a new Gmail client for the active profile
 func NewGmailClient() (*GmailClient, error) {
-	service, err := GetAuthenticatedClient()
+	profile, err := CurrentProfile()
 	if err != nil {
 		return nil, err
 	}
 
-	return &GmailClient{
-		Service: service,
-		UserID:  "me",
-	}, nil
-}
+	httpClient, err := GetAuthenticatedHTTPClient()
+	if err != nil {
+		return nil, err
+	}
 
-// ListMessages lists messages with optional query
-func (c *GmailClient) ListMessages(query string, maxResults int64) ([]*gmail.Message, error) {
-	call := c.Service.Users.Messages.List(c.UserID)
-	
-	if query != "" {
-		call.Q(query)
+	service, err := gmail.NewService(context.Background(), gmailServiceOptions(httpClient)...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Gmail service: %v", err)
 	}
-	
-	if maxResults > 0 {
-		call.MaxResults(maxResults)
+
+	client := &GmailClient{
+		Service: service,
+		HTTP:    httpClient,
+		UserID:  profile.UserID,
 	}
 
-	response, err := call.Do()
-	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve messages: %v", err)
+	// The cache is an optimization: if it can't be opened (e.g. another
+	// process holds it), run uncached. --no-cache and cache: false skip it.
+	if Settings().Cache {
+		cache, err := OpenCache(DefaultCachePath())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: running without cache: %v\n", err)
+		} else {
+			client.Cache = cache
+		}
 	}
 
-	return response.Messages, nil
+	return client, nil
+}
+
+// Close releases the cache, if the client has one. bbolt lets only one
+// process hold the cache at a time, so every command closes its client when
+// done; the client keeps working afterwards, uncached.
+func (c *GmailClient) Close() error {
+	if c.Cache == nil {
+		return nil
+	}
+	err := c.Cache.Close()
+	c.Cache = nil
+	return err
 }
 
-// GetMessage retrieves a full message by ID
+// GetMessage retrieves a full message by ID, from the cache when possible
 func (c *GmailClient) GetMessage(messageID string) (*gmail.Message, error) {
+	cached := c.refreshCache()
+	if cached {
+		if msg, ok := c.Cache.GetMessage(messageID); ok {
+			return msg, nil
+		}
+	}
+
 	msg, err := c.Service.Users.Messages.Get(c.UserID, messageID).Do()
 	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve message: %v", err)
+		return nil, wrapAPIError("retrieve message", err)
+	}
+
+	if cached {
+		c.Cache.PutMessage(msg)
 	}
 	return msg, nil
 }
 
-// GetThread retrieves a full thread by ID
+// GetThread retrieves a full thread by ID, from the cache when possible
 func (c *GmailClient) GetThread(threadID string) (*gmail.Thread, error) {
+	cached := c.refreshCache()
+	if cached {
+		if thread, ok := c.Cache.GetThread(threadID); ok {
+			return thread, nil
+		}
+	}
+
 	thread, err := c.Service.Users.Threads.Get(c.UserID, threadID).Do()
 	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve thread: %v", err)
+		return nil, wrapAPIError("retrieve thread", err)
+	}
+
+	if cached {
+		c.Cache.PutThread(thread)
 	}
 	return thread, nil
 }
 
-// SendMessage sends an email message
-func (c *GmailClient) SendMessage(message *gmail.Message) (*gmail.Message, error) {
-	msg, err := c.Service.Users.Messages.Send(c.UserID, message).Do()
+// SendMessage sends the RFC 5322 message read from raw. It goes through
+// Gmail's media upload endpoint, so the message is streamed instead of
+// being base64-encoded into a JSON request, and may be up to 35MB.
+func (c *GmailClient) SendMessage(threadID string, raw io.Reader) (*gmail.Message, error) {
+	msg, err := c.Service.Users.Messages.Send(c.UserID, &gmail.Message{ThreadId: threadID}).
+		Media(raw, googleapi.ContentType("message/rfc822")).Do()
 	if err != nil {
-		return nil, fmt.Errorf("unable to send message: %v", err)
+		return nil, wrapAPIError("send message", err)
 	}
+	c.invalidateCache(nil, []string{msg.ThreadId})
 	return msg, nil
 }
 
 // CreateDraft creates a Gmail draft — it does NOT send. The draft lands in the
-// mailbox's Drafts, threaded via message.ThreadId, for a human to review and
+// mailbox's Drafts, threaded via threadID, for a human to review and
 // send. This is the only outbound-write primitive the unattended triage job is
-// permitted to use; the Send button stays the human gate.
-func (c *GmailClient) CreateDraft(message *gmail.Message) (*gmail.Draft, error) {
-	draft, err := c.Service.Users.Drafts.Create(c.UserID, &gmail.Draft{Message: message}).Do()
+// permitted to use; the Send button stays the human gate. Like SendMessage,
+// the message is uploaded as media.
+func (c *GmailClient) CreateDraft(threadID string, raw io.Reader) (*gmail.Draft, error) {
+	draft, err := c.Service.Users.Drafts.Create(c.UserID, &gmail.Draft{Message: &gmail.Message{ThreadId: threadID}}).
+		Media(raw, googleapi.ContentType("message/rfc822")).Do()
 	if err != nil {
-		return nil, fmt.Errorf("unable to create draft: %v", err)
+		return nil, wrapAPIError("create draft", err)
 	}
 	return draft, nil
 }
@@ -97,8 +151,9 @@ func (c *GmailClient) ModifyMessage(messageID string, addLabels, removeLabels []
 	
 	msg, err := c.Service.Users.Messages.Modify(c.UserID, messageID, modReq).Do()
 	if err != nil {
-		return nil, fmt.Errorf("unable to modify message: %v", err)
+		return nil, wrapAPIError("modify message", err)
 	}
+	c.invalidateCache([]string{messageID}, []string{msg.ThreadId})
 	return msg, nil
 }
 
@@ -106,11 +161,26 @@ func (c *GmailClient) ModifyMessage(messageID string, addLabels, removeLabels []
 func (c *GmailClient) GetAttachment(messageID, attachmentID string) (*gmail.MessagePartBody, error) {
 	attachment, err := c.Service.Users.Messages.Attachments.Get(c.UserID, messageID, attachmentID).Do()
 	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve attachment: %v", err)
+		return nil, wrapAPIError("retrieve attachment", err)
 	}
 	return attachment, nil
 }
 
+// GetRawMessage retrieves a message in Gmail's raw format, as received.
+// Raw messages are not cached: they are only needed to forward a message
+// whole.
+func (c *GmailClient) GetRawMessage(messageID string) ([]byte, error) {
+	msg, err := c.Service.Users.Messages.Get(c.UserID, messageID).Format("raw").Do()
+	if err != nil {
+		return nil, wrapAPIError("retrieve message", err)
+	}
+	raw, err := decodeBase64URL(msg.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode raw message: %v", err)
+	}
+	return raw, nil
+}
+
 // ModifyThread modifies labels on all messages in a thread
 func (c *GmailClient) ModifyThread(threadID string, addLabels, removeLabels []string) (*gmail.Thread, error) {
 	modReq := &gmail.ModifyThreadRequest{
@@ -120,8 +190,13 @@ func (c *GmailClient) ModifyThread(threadID string, addLabels, removeLabels []st
 	
 	thread, err := c.Service.Users.Threads.Modify(c.UserID, threadID, modReq).Do()
 	if err != nil {
-		return nil, fmt.Errorf("unable to modify thread: %v", err)
+		return nil, wrapAPIError("modify thread", err)
 	}
+	messageIDs := make([]string, len(thread.Messages))
+	for i, m := range thread.Messages {
+		messageIDs[i] = m.Id
+	}
+	c.invalidateCache(messageIDs, []string{threadID})
 	return thread, nil
 }
 
@@ -187,29 +262,50 @@ func htmlToText(s string) string {
 	return strings.TrimSpace(s)
 }
 
-// InternalDomain is the email domain considered internal to Blue.
-// Addresses on this domain are treated as support/staff, not customers.
-const InternalDomain = "blue.cc"
-
-// ExtractHeaders extracts common headers from a message
+// ExtractHeaders extracts common headers from a message, decoding RFC 2047
+// encoded-words in names and subjects for display
 func ExtractHeaders(msg *gmail.Message) map[string]string {
 	headers := make(map[string]string)
 
 	for _, header := range msg.Payload.Headers {
-		switch strings.ToLower(header.Name) {
-		case "from", "to", "cc", "bcc", "reply-to", "delivered-to",
-			"subject", "date", "message-id", "in-reply-to", "references":
-			headers[strings.ToLower(header.Name)] = header.Value
+		switch name := strings.ToLower(header.Name); name {
+		case "from", "to", "cc", "bcc", "reply-to", "delivered-to":
+			headers[name] = decodeAddressHeader(header.Value)
+		case "subject":
+			headers[name] = DecodeHeader(header.Value)
+		case "date", "message-id", "in-reply-to", "references":
+			headers[name] = header.Value
 		}
 	}
 
 	return headers
 }
 
-// IsInternalAddress reports whether an RFC 5322 address (e.g. "Name <x@blue.cc>")
-// belongs to the internal Blue domain.
-func IsInternalAddress(addr string) bool {
-	return strings.Contains(strings.ToLower(addr), "@"+InternalDomain)
+// NewMessageInfo builds the output shape for a full message. The body is
+// only extracted when withBody is set, since it is the expensive part.
+func NewMessageInfo(msg *gmail.Message, withBody bool) MessageInfo {
+	headers := ExtractHeaders(msg)
+	info := MessageInfo{
+		ID:       msg.Id,
+		ThreadID: msg.ThreadId,
+		From:     headers["from"],
+		To:       headers["to"],
+		Cc:       headers["cc"],
+		Bcc:      headers["bcc"],
+		ReplyTo:  headers["reply-to"],
+		Subject:  headers["subject"],
+		Date:     headers["date"],
+		Snippet:  msg.Snippet,
+		Labels:   GetLabelNames(msg.LabelIds),
+	}
+	if withBody {
+		info.Body = ExtractMessageBody(msg)
+	}
+	info.Addresses = ParseMessageAddresses(headers)
+	if msg.InternalDate > 0 {
+		info.Timestamp = time.UnixMilli(msg.InternalDate)
+	}
+	return info
 }
 
 // GetLabelNames returns human-readable label names
@@ -225,7 +321,7 @@ func GetLabelNames(labelIDs []string) []string {
 func (c *GmailClient) ListLabels() ([]*gmail.Label, error) {
 	resp, err := c.Service.Users.Labels.List(c.UserID).Do()
 	if err != nil {
-		return nil, fmt.Errorf("unable to list labels: %v", err)
+		return nil, wrapAPIError("list labels", err)
 	}
 	return resp.Labels, nil
 }
@@ -239,7 +335,7 @@ func (c *GmailClient) CreateLabel(name string) (*gmail.Label, error) {
 	}
 	created, err := c.Service.Users.Labels.Create(c.UserID, label).Do()
 	if err != nil {
-		return nil, fmt.Errorf("unable to create label %q: %v", name, err)
+		return nil, wrapAPIError(fmt.Sprintf("create label %q", name), err)
 	}
 	return created, nil
 }
@@ -273,6 +369,12 @@ var systemLabelIDs = map[string]bool{
 // Unknown user labels error unless createIfMissing is true, in which case
 // they are created on the fly.
 func (c *GmailClient) ResolveLabelNames(names []string, createIfMissing bool) ([]string, error) {
+	return ResolveLabelNames(c, names, createIfMissing)
+}
+
+// ResolveLabelNames resolves label names against any mailbox; see
+// GmailClient.ResolveLabelNames.
+func ResolveLabelNames(api GmailAPI, names []string, createIfMissing bool) ([]string, error) {
 	if len(names) == 0 {
 		return nil, nil
 	}
@@ -283,7 +385,7 @@ func (c *GmailClient) ResolveLabelNames(names []string, createIfMissing bool) ([
 		if labels != nil {
 			return nil
 		}
-		ls, err := c.ListLabels()
+		ls, err := api.ListLabels()
 		if err != nil {
 			return err
 		}
@@ -334,7 +436,7 @@ func (c *GmailClient) ResolveLabelNames(names []string, createIfMissing bool) ([
 			return nil, fmt.Errorf("label %q not found (available user labels: %s) — pass --create-if-missing to create it", name, strings.Join(available, ", "))
 		}
 
-		created, err := c.CreateLabel(name)
+		created, err := api.CreateLabel(name)
 		if err != nil {
 			return nil, err
 		}
@@ -1,36 +1,439 @@
 package common
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
 )
 
-// LoadConfig loads configuration from environment
-func LoadConfig() (*Config, error) {
-	// Load .env file if it exists
-	godotenv.Load()
+// Config holds application configuration. It is assembled once at startup
+// from these layers, each overriding the one before:
+//
+//  1. built-in defaults
+//  2. the config file (--config, SUPPORT_AGENT_CONFIG, else
+//     ~/.support-agent/config.yaml)
+//  3. .env in the working directory
+//  4. environment variables
+//  5. command-line flags (--profile, --no-cache)
+//
+// Per-mailbox settings live in profiles (see Profile) and override these.
+type Config struct {
+	CredentialsPath   string
+	Credentials       string
+	TokenDir          string
+	Profile           string
+	TokenStore        string
+	TokenPassphrase   string
+	ServiceAccountKey string
+	Impersonate       string
+	GmailEndpoint     string
+	InternalDomains   []string
+	StaffAddresses    []string
+	SupportUserEmail  string
+	DatabaseURL       string
+	WatchPushToken    string
+	Cache             bool
+	QuotaReport       bool
 
-	config := &Config{
-		CredentialsPath: getEnvOrDefault("GMAIL_CREDENTIALS_PATH", "gmail.json"),
-		TokenDir:        getEnvOrDefault("TOKEN_DIR", getDefaultTokenDir()),
-		UserEmail:       getEnvOrDefault("USER_EMAIL", "help@blue.cc"),
+	// Sources records which layer set each key: "default", the config
+	// file path, ".env", "env" or "flag".
+	Sources map[string]string
+}
+
+// configField describes one setting: its config file key, environment
+// variable, and how to read and write it on a Config.
+type configField struct {
+	Key    string
+	Env    string
+	Secret bool
+	Path   bool // expand a leading ~/
+	List   bool // comma-separated, or a list in the config file
+	get    func(c *Config) string
+	set    func(c *Config, v string) error
+}
+
+func stringField(key, env string, secret, path bool, p func(c *Config) *string) configField {
+	return configField{
+		Key: key, Env: env, Secret: secret, Path: path,
+		get: func(c *Config) string { return *p(c) },
+		set: func(c *Config, v string) error { *p(c) = v; return nil },
+	}
+}
+
+func listField(key, env string, p func(c *Config) *[]string) configField {
+	return configField{
+		Key: key, Env: env, List: true,
+		get: func(c *Config) string { return strings.Join(*p(c), ",") },
+		set: func(c *Config, v string) error { *p(c) = splitList(v); return nil },
+	}
+}
+
+func boolField(key, env string, p func(c *Config) *bool) configField {
+	return configField{
+		Key: key, Env: env,
+		get: func(c *Config) string { return strconv.FormatBool(*p(c)) },
+		set: func(c *Config, v string) error {
+			b, err := parseBool(v)
+			if err != nil {
+				return err
+			}
+			*p(c) = b
+			return nil
+		},
 	}
+}
 
-	return config, nil
+// configFields lists every setting, in the order "config show" prints them.
+var configFields = []configField{
+	stringField("credentials_path", "GMAIL_CREDENTIALS_PATH", false, true, func(c *Config) *string { return &c.CredentialsPath }),
+	stringField("credentials", "GMAIL_CREDENTIALS", true, false, func(c *Config) *string { return &c.Credentials }),
+	stringField("token_dir", "TOKEN_DIR", false, true, func(c *Config) *string { return &c.TokenDir }),
+	stringField("profile", "SUPPORT_AGENT_PROFILE", false, false, func(c *Config) *string { return &c.Profile }),
+	stringField("token_store", "SUPPORT_AGENT_TOKEN_STORE", false, false, func(c *Config) *string { return &c.TokenStore }),
+	stringField("token_passphrase", "SUPPORT_AGENT_TOKEN_PASSPHRASE", true, false, func(c *Config) *string { return &c.TokenPassphrase }),
+	stringField("service_account_key", "GMAIL_SERVICE_ACCOUNT_KEY", false, true, func(c *Config) *string { return &c.ServiceAccountKey }),
+	stringField("impersonate", "GMAIL_IMPERSONATE", false, false, func(c *Config) *string { return &c.Impersonate }),
+	stringField("gmail_endpoint", "GMAIL_ENDPOINT", false, false, func(c *Config) *string { return &c.GmailEndpoint }),
+	listField("internal_domains", "SUPPORT_AGENT_INTERNAL_DOMAINS", func(c *Config) *[]string { return &c.InternalDomains }),
+	listField("staff_addresses", "SUPPORT_AGENT_STAFF_ADDRESSES", func(c *Config) *[]string { return &c.StaffAddresses }),
+	stringField("support_user_email", "SUPPORT_USER_EMAIL", false, false, func(c *Config) *string { return &c.SupportUserEmail }),
+	stringField("database_url", "DATABASE_URL", true, false, func(c *Config) *string { return &c.DatabaseURL }),
+	stringField("watch_push_token", "WATCH_PUSH_TOKEN", true, false, func(c *Config) *string { return &c.WatchPushToken }),
+	boolField("cache", "SUPPORT_AGENT_CACHE", func(c *Config) *bool { return &c.Cache }),
+	boolField("quota_report", "SUPPORT_AGENT_QUOTA_REPORT", func(c *Config) *bool { return &c.QuotaReport }),
 }
 
-// getEnvOrDefault returns env value or default
-func getEnvOrDefault(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// DefaultConfig returns the built-in defaults.
+func DefaultConfig() *Config {
+	home, _ := os.UserHomeDir()
+	c := &Config{
+		CredentialsPath:  "gmail.json",
+		TokenDir:         filepath.Join(home, ".support-agent"),
+		Profile:          DefaultProfile,
+		TokenStore:       StoreAuto,
+		InternalDomains:  []string{DefaultInternalDomain},
+		SupportUserEmail: "manny@blue.cc",
+		Cache:            true,
+		Sources:          map[string]string{},
 	}
-	return defaultValue
+	for _, f := range configFields {
+		c.Sources[f.Key] = "default"
+	}
+	return c
 }
 
-// getDefaultTokenDir returns the default token directory
-func getDefaultTokenDir() string {
+// DefaultConfigPath is where LoadConfig looks for the config file when none
+// is given: SUPPORT_AGENT_CONFIG, else ~/.support-agent/config.yaml.
+func DefaultConfigPath() string {
+	if path := os.Getenv("SUPPORT_AGENT_CONFIG"); path != "" {
+		return path
+	}
 	home, _ := os.UserHomeDir()
-	return filepath.Join(home, ".support-agent")
-}
\ No newline at end of file
+	return filepath.Join(home, ".support-agent", "config.yaml")
+}
+
+// LoadConfig assembles the configuration from the defaults, the config file
+// at path (or DefaultConfigPath when empty), .env and the environment. A
+// missing file is an error only if path was given explicitly.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+
+	explicit := path != ""
+	if !explicit {
+		path = DefaultConfigPath()
+	}
+	values, err := readConfigFile(path)
+	if os.IsNotExist(err) && explicit {
+		return nil, fmt.Errorf("unable to read config file: %v", err)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := c.apply(values, path); err != nil {
+		return nil, err
+	}
+
+	dotenv, err := godotenv.Read()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read .env: %v", err)
+	}
+	if err := c.applyEnv(func(name string) (string, bool) { v, ok := dotenv[name]; return v, ok }, ".env"); err != nil {
+		return nil, err
+	}
+	if err := c.applyEnv(os.LookupEnv, "env"); err != nil {
+		return nil, err
+	}
+
+	// USER_EMAIL was read by earlier versions but never used. It is not an
+	// alias for SUPPORT_USER_EMAIL: old .env files set it to the support
+	// mailbox, not the account company-access grants access to.
+	if _, ok := dotenv["USER_EMAIL"]; ok || os.Getenv("USER_EMAIL") != "" {
+		fmt.Fprintf(os.Stderr, "Warning: USER_EMAIL is no longer read; set SUPPORT_USER_EMAIL (support_user_email) for the account company-access grants access to\n")
+	}
+
+	return c, nil
+}
+
+// readConfigFile reads a YAML config file into key/value pairs, rejecting
+// unknown keys so typos don't silently fall back to defaults.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %v", err)
+	}
+
+	var raw map[string]interface{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&raw); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unable to parse config file %s: %v", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, v := range raw {
+		f := lookupConfigField(key)
+		if f == nil {
+			return nil, fmt.Errorf("config file %s: unknown key %q", path, key)
+		}
+		switch v := v.(type) {
+		case []interface{}:
+			if !f.List {
+				return nil, fmt.Errorf("config file %s: %s must be a single value", path, key)
+			}
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		case map[string]interface{}:
+			return nil, fmt.Errorf("config file %s: %s must be a single value", path, key)
+		case nil:
+			values[key] = ""
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+func lookupConfigField(key string) *configField {
+	for i := range configFields {
+		if configFields[i].Key == key {
+			return &configFields[i]
+		}
+	}
+	return nil
+}
+
+// apply sets the given keys, recording source as where they came from.
+func (c *Config) apply(values map[string]string, source string) error {
+	for _, f := range configFields {
+		v, ok := values[f.Key]
+		if !ok {
+			continue
+		}
+		if err := c.setField(f, v, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyEnv sets every key whose environment variable lookup finds with a
+// non-empty value.
+func (c *Config) applyEnv(lookup func(string) (string, bool), source string) error {
+	for _, f := range configFields {
+		if v, ok := lookup(f.Env); ok && v != "" {
+			if err := c.setField(f, v, source); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Set overrides a key from a command-line flag.
+func (c *Config) Set(key, value string) error {
+	f := lookupConfigField(key)
+	if f == nil {
+		return fmt.Errorf("unknown config key %q", key)
+	}
+	return c.setField(*f, value, "flag")
+}
+
+func (c *Config) setField(f configField, v, source string) error {
+	if f.Path && strings.HasPrefix(v, "~/") {
+		home, _ := os.UserHomeDir()
+		v = filepath.Join(home, v[2:])
+	}
+	if err := f.set(c, v); err != nil {
+		return fmt.Errorf("invalid %s (from %s): %v", f.Key, source, err)
+	}
+	c.Sources[f.Key] = source
+	return nil
+}
+
+// Validate checks values that would otherwise fail later, deep inside a
+// command.
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(key, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s (from %s): %s", key, c.Sources[key], fmt.Sprintf(format, args...)))
+	}
+
+	if !validProfileName.MatchString(c.Profile) {
+		add("profile", "invalid profile name %q (use letters, digits, '.', '_' and '-')", c.Profile)
+	}
+	switch c.TokenStore {
+	case StoreAuto, StoreKeyring, StoreEncrypted, StoreFile:
+	default:
+		add("token_store", "unknown token store %q (use auto, keyring, encrypted or file)", c.TokenStore)
+	}
+	if c.TokenStore == StoreEncrypted && c.TokenPassphrase == "" {
+		add("token_store", "the encrypted token store needs token_passphrase")
+	}
+	if c.GmailEndpoint != "" {
+		if u, err := url.Parse(c.GmailEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("gmail_endpoint", "not an http(s) URL: %q", c.GmailEndpoint)
+		}
+	}
+	if len(c.InternalDomains) == 0 && len(c.StaffAddresses) == 0 {
+		add("internal_domains", "no internal domains or staff addresses; every sender would be a customer")
+	}
+	if err := validateDomains(c.InternalDomains); err != nil {
+		add("internal_domains", "%v", err)
+	}
+	if err := validateAddresses(c.StaffAddresses); err != nil {
+		add("staff_addresses", "%v", err)
+	}
+	if _, err := mail.ParseAddress(c.SupportUserEmail); err != nil {
+		add("support_user_email", "not an email address: %q", c.SupportUserEmail)
+	}
+	if c.TokenDir == "" {
+		add("token_dir", "must not be empty")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// ConfigValue is one effective setting, as shown by "config show".
+type ConfigValue struct {
+	Key    string `json:"key"`
+	Env    string `json:"env"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// Effective returns every setting with secrets redacted.
+func (c *Config) Effective() []ConfigValue {
+	values := make([]ConfigValue, 0, len(configFields))
+	for _, f := range configFields {
+		v := f.get(c)
+		if f.Secret {
+			v = redact(f.Key, v)
+		}
+		values = append(values, ConfigValue{Key: f.Key, Env: f.Env, Value: v, Source: c.Sources[f.Key]})
+	}
+	return values
+}
+
+// redact hides a secret value. A database URL keeps everything but its
+// password, which is what one needs to check it points at the right place.
+func redact(key, v string) string {
+	if v == "" {
+		return ""
+	}
+	if key == "database_url" {
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			if _, hasPassword := u.User.Password(); hasPassword {
+				u.User = url.UserPassword(u.User.Username(), "REDACTED")
+			}
+			return u.String()
+		}
+	}
+	return "<redacted>"
+}
+
+// ConfigKeys returns the config file keys, sorted.
+func ConfigKeys() []string {
+	keys := make([]string, len(configFields))
+	for i, f := range configFields {
+		keys[i] = f.Key
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	configMu sync.Mutex
+	current  *Config
+)
+
+// SetConfig makes c the configuration returned by Settings. main calls it
+// once at startup after applying flags and validating. Profiles take their
+// defaults from the configuration, so the cached profile is dropped.
+func SetConfig(c *Config) {
+	configMu.Lock()
+	current = c
+	configMu.Unlock()
+
+	profileMu.Lock()
+	loadedProfile = nil
+	profileMu.Unlock()
+}
+
+// Settings returns the configuration set with SetConfig. If none was set
+// (e.g. in tests), it is loaded from the default locations, falling back to
+// the defaults if that fails.
+func Settings() *Config {
+	configMu.Lock()
+	defer configMu.Unlock()
+	if current == nil {
+		c, err := LoadConfig("")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v; using defaults\n", err)
+			c = DefaultConfig()
+		}
+		current = c
+	}
+	return current
+}
+
+// splitList splits a comma-separated setting, dropping empty items.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseBool accepts the usual spellings of a yes/no setting.
+func parseBool(v string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "1", "true", "yes", "on":
+		return true, nil
+	case "0", "false", "no", "off", "":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not a boolean (use true/false, on/off, yes/no or 1/0)", v)
+}
@@ -0,0 +1,144 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrorKind classifies a Gmail API failure so callers and JSON output can
+// react to it without parsing error strings.
+type ErrorKind string
+
+const (
+	KindNotFound     ErrorKind = "not_found"
+	KindRateLimited  ErrorKind = "rate_limited"
+	KindAuthExpired  ErrorKind = "auth_expired"
+	KindPermission   ErrorKind = "permission_denied"
+	KindInvalid      ErrorKind = "invalid_request"
+	KindUnavailable  ErrorKind = "unavailable"
+	KindUnclassified ErrorKind = "error"
+)
+
+// Sentinel errors for use with errors.Is. An *APIError matches the sentinel
+// for its kind.
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrRateLimited = errors.New("rate limited")
+	ErrAuthExpired = errors.New("authorization expired")
+	ErrPermission  = errors.New("permission denied")
+	ErrInvalid     = errors.New("invalid request")
+	ErrUnavailable = errors.New("service unavailable")
+)
+
+var kindSentinels = map[ErrorKind]error{
+	KindNotFound:    ErrNotFound,
+	KindRateLimited: ErrRateLimited,
+	KindAuthExpired: ErrAuthExpired,
+	KindPermission:  ErrPermission,
+	KindInvalid:     ErrInvalid,
+	KindUnavailable: ErrUnavailable,
+}
+
+// APIError is a classified Gmail API failure. Op describes what was being
+// attempted ("retrieve message"), in the same words the old untyped errors
+// used, so the rendered message is unchanged.
+type APIError struct {
+	Op     string
+	Kind   ErrorKind
+	Status int // HTTP status, 0 if the request never got a response
+	Err    error
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("unable to %s: %v", e.Op, e.Err)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the sentinel error for e's kind.
+func (e *APIError) Is(target error) bool {
+	sentinel, ok := kindSentinels[e.Kind]
+	return ok && target == sentinel
+}
+
+// wrapAPIError classifies err and wraps it as an *APIError for op.
+func wrapAPIError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	kind, status := classifyError(err)
+	return &APIError{Op: op, Kind: kind, Status: status, Err: err}
+}
+
+// ErrorKindOf returns the kind of the first *APIError in err's chain, or
+// KindUnclassified if there is none.
+func ErrorKindOf(err error) ErrorKind {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Kind
+	}
+	kind, _ := classifyError(err)
+	return kind
+}
+
+// classifyError maps a raw error from the Gmail client or the OAuth token
+// source to an ErrorKind and HTTP status.
+func classifyError(err error) (ErrorKind, int) {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		// The token endpoint refused to refresh: the grant was revoked or
+		// expired and the user has to sign in again.
+		status := 0
+		if retrieveErr.Response != nil {
+			status = retrieveErr.Response.StatusCode
+		}
+		return KindAuthExpired, status
+	}
+
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		return kindForStatus(gErr.Code, gErr.Errors), gErr.Code
+	}
+
+	return KindUnclassified, 0
+}
+
+// kindForStatus maps an HTTP status (and, for 403, the error reasons) to an
+// ErrorKind. Gmail reports per-user rate limiting as 403 with a
+// rateLimitExceeded/userRateLimitExceeded reason as well as plain 429.
+func kindForStatus(status int, items []googleapi.ErrorItem) ErrorKind {
+	switch {
+	case status == http.StatusNotFound:
+		return KindNotFound
+	case status == http.StatusTooManyRequests:
+		return KindRateLimited
+	case status == http.StatusUnauthorized:
+		return KindAuthExpired
+	case status == http.StatusForbidden:
+		for _, item := range items {
+			if isRateLimitReason(item.Reason) {
+				return KindRateLimited
+			}
+		}
+		return KindPermission
+	case status == http.StatusBadRequest:
+		return KindInvalid
+	case status >= 500:
+		return KindUnavailable
+	}
+	return KindUnclassified
+}
+
+func isRateLimitReason(reason string) bool {
+	switch reason {
+	case "rateLimitExceeded", "userRateLimitExceeded", "quotaExceeded":
+		return true
+	}
+	return false
+}
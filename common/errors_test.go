@@ -0,0 +1,79 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+func TestKindForStatus(t *testing.T) {
+	rateLimit := []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}
+	tests := []struct {
+		status int
+		items  []googleapi.ErrorItem
+		want   ErrorKind
+	}{
+		{http.StatusNotFound, nil, KindNotFound},
+		{http.StatusTooManyRequests, nil, KindRateLimited},
+		{http.StatusUnauthorized, nil, KindAuthExpired},
+		{http.StatusForbidden, nil, KindPermission},
+		{http.StatusForbidden, rateLimit, KindRateLimited},
+		{http.StatusForbidden, []googleapi.ErrorItem{{Reason: "dailyLimitExceeded"}, {Reason: "quotaExceeded"}}, KindRateLimited},
+		{http.StatusBadRequest, nil, KindInvalid},
+		{http.StatusInternalServerError, nil, KindUnavailable},
+		{http.StatusServiceUnavailable, nil, KindUnavailable},
+		{http.StatusConflict, nil, KindUnclassified},
+		{0, nil, KindUnclassified},
+	}
+	for _, tt := range tests {
+		if got := kindForStatus(tt.status, tt.items); got != tt.want {
+			t.Errorf("kindForStatus(%d, %v) = %s, want %s", tt.status, tt.items, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		kind   ErrorKind
+		status int
+	}{
+		{"googleapi 404", &googleapi.Error{Code: 404}, KindNotFound, 404},
+		{"wrapped googleapi 503", fmt.Errorf("get: %w", &googleapi.Error{Code: 503}), KindUnavailable, 503},
+		{"refresh rejected", &oauth2.RetrieveError{Response: &http.Response{StatusCode: 400}}, KindAuthExpired, 400},
+		{"refresh rejected without response", &oauth2.RetrieveError{}, KindAuthExpired, 0},
+		{"network error", errors.New("connection reset"), KindUnclassified, 0},
+	}
+	for _, tt := range tests {
+		kind, status := classifyError(tt.err)
+		if kind != tt.kind || status != tt.status {
+			t.Errorf("%s: classifyError = %s, %d; want %s, %d", tt.name, kind, status, tt.kind, tt.status)
+		}
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	err := fmt.Errorf("failed to get message: %w", wrapAPIError("retrieve message", &googleapi.Error{Code: 404, Message: "gone"}))
+
+	if !errors.Is(err, ErrNotFound) || errors.Is(err, ErrRateLimited) {
+		t.Errorf("errors.Is matches the wrong sentinels for %v", err)
+	}
+	if kind := ErrorKindOf(err); kind != KindNotFound {
+		t.Errorf("ErrorKindOf = %s, want %s", kind, KindNotFound)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Status != 404 || apiErr.Op != "retrieve message" {
+		t.Errorf("errors.As = %+v", apiErr)
+	}
+	if wrapAPIError("retrieve message", nil) != nil {
+		t.Error("wrapAPIError(nil) is not nil")
+	}
+	if kind := ErrorKindOf(errors.New("plain")); kind != KindUnclassified {
+		t.Errorf("ErrorKindOf(plain error) = %s", kind)
+	}
+}
@@ -0,0 +1,139 @@
+package fakegmail
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/blue/support-agent/common"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Fixture headers. They are read from .eml files and stripped from the
+// stored message, the way Google Takeout uses X-Gmail-Labels.
+const (
+	headerID       = "X-Gmail-Id"
+	headerThreadID = "X-Gmail-Thread-Id"
+	headerLabels   = "X-Gmail-Labels"
+)
+
+// AddRaw stores an RFC 5322 message such as an .eml fixture under id (or its
+// X-Gmail-Id header). Labels come from a comma-separated X-Gmail-Labels
+// header, creating user labels as needed. The thread is X-Gmail-Thread-Id if
+// set, else the thread of the message named by In-Reply-To or References,
+// else a new one. InternalDate comes from the Date header.
+func (m *Mailbox) AddRaw(id string, raw []byte) (*gmail.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid message: %v", err)
+	}
+	h := parsed.Header
+
+	if v := h.Get(headerID); v != "" {
+		id = v
+	}
+	if id == "" {
+		id = m.newID("msg")
+	}
+	if _, exists := m.messages[id]; exists {
+		return nil, fmt.Errorf("duplicate message ID %s", id)
+	}
+
+	payload, err := m.parseRaw(id, raw)
+	if err != nil {
+		return nil, err
+	}
+	headers := payload.Headers[:0]
+	for _, ph := range payload.Headers {
+		if !strings.HasPrefix(ph.Name, "X-Gmail-") {
+			headers = append(headers, ph)
+		}
+	}
+	payload.Headers = headers
+
+	var labelIDs []string
+	for _, name := range strings.Split(h.Get(headerLabels), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			labelIDs = append(labelIDs, m.labelID(name))
+		}
+	}
+
+	threadID := h.Get(headerThreadID)
+	if threadID == "" {
+		threadID = m.threadFor(h.Get("In-Reply-To") + " " + h.Get("References"))
+	}
+	if threadID == "" {
+		threadID = id
+	}
+
+	date, err := mail.ParseDate(h.Get("Date"))
+	if err != nil {
+		date = m.tick()
+	}
+
+	msg := &gmail.Message{
+		Id:           id,
+		ThreadId:     threadID,
+		LabelIds:     labelIDs,
+		InternalDate: date.UnixMilli(),
+		SizeEstimate: int64(len(raw)),
+		Payload:      payload,
+	}
+	msg.Snippet = snippet(common.ExtractMessageBody(msg))
+	m.messages[id] = msg
+	m.recordAdded(msg)
+	return clone(msg), nil
+}
+
+// LoadDir adds every *.eml file in dir, in file name order, using the file
+// name without its extension as the default message ID.
+func (m *Mailbox) LoadDir(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		id := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		if _, err := m.AddRaw(id, raw); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// labelID returns the ID of a system label (matched case-insensitively, so
+// Takeout's "Inbox" works) or user label by name, creating the user label if
+// it doesn't exist.
+func (m *Mailbox) labelID(name string) string {
+	for _, l := range m.labels {
+		if (l.Type == "system" && strings.EqualFold(l.Id, name)) || l.Name == name {
+			return l.Id
+		}
+	}
+	return m.addLabel(name).Id
+}
+
+// threadFor returns the thread of the first stored message whose Message-ID
+// appears in refs, or "".
+func (m *Mailbox) threadFor(refs string) string {
+	for _, ref := range strings.Fields(refs) {
+		for _, msg := range m.messages {
+			if strings.EqualFold(common.ExtractHeaders(msg)["message-id"], ref) {
+				return msg.ThreadId
+			}
+		}
+	}
+	return ""
+}
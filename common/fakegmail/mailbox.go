@@ -0,0 +1,745 @@
+// Package fakegmail is an in-memory Gmail mailbox implementing
+// common.GmailAPI, for testing commands without a Google account.
+//
+// Seed it with Add, point the code under test at it, then inspect what was
+// sent, drafted or relabeled. Sent and drafted messages are parsed back from
+// their raw MIME the way Gmail would, so tests see the same payload structure
+// (headers, parts, attachments) as they would reading them from Gmail.
+package fakegmail
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blue/support-agent/common"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Message describes a message to seed the mailbox with. Zero fields get
+// sensible defaults: ThreadID defaults to ID, Date to a fixed clock that
+// advances a minute per message, and MessageID to "<ID@fake.mail>".
+type Message struct {
+	ID          string
+	ThreadID    string
+	From        string
+	To          string
+	Cc          string
+	ReplyTo     string
+	Subject     string
+	MessageID   string
+	InReplyTo   string
+	References  string
+	Body        string
+	HTML        bool // Body is text/html rather than text/plain
+	Date        time.Time
+	Labels      []string
+	Attachments []Attachment
+}
+
+// Attachment is a file attached to a seeded message.
+type Attachment struct {
+	Filename string
+	MimeType string
+	Data     []byte
+}
+
+// Mailbox is an in-memory mailbox. It is safe for concurrent use.
+type Mailbox struct {
+	mu          sync.Mutex
+	messages    map[string]*gmail.Message
+	labels      []*gmail.Label
+	drafts      []*gmail.Draft
+	sent        []string
+	attachments map[string][]byte // messageID + "/" + attachmentID
+	failures    map[string]error
+	seq         int
+	clock       time.Time
+	history     []*gmail.History // records after historyFloor, oldest first
+	historyID   uint64           // ID of the latest change
+	floor       uint64           // history IDs before this have expired
+}
+
+var _ common.GmailAPI = (*Mailbox)(nil)
+
+// systemLabels are the labels every mailbox starts with.
+var systemLabels = []string{
+	"INBOX", "SENT", "DRAFT", "SPAM", "TRASH", "UNREAD", "STARRED", "IMPORTANT",
+	"CATEGORY_PERSONAL", "CATEGORY_SOCIAL", "CATEGORY_PROMOTIONS", "CATEGORY_UPDATES", "CATEGORY_FORUMS",
+}
+
+// New returns an empty mailbox with Gmail's system labels.
+func New() *Mailbox {
+	m := &Mailbox{
+		messages:    make(map[string]*gmail.Message),
+		attachments: make(map[string][]byte),
+		failures:    make(map[string]error),
+		clock:       time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC),
+		historyID:   1000,
+	}
+	for _, name := range systemLabels {
+		m.labels = append(m.labels, &gmail.Label{Id: name, Name: name, Type: "system"})
+	}
+	return m
+}
+
+// Add stores a message and returns it as Gmail would.
+func (m *Mailbox) Add(msg Message) *gmail.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if msg.ID == "" {
+		msg.ID = m.newID("msg")
+	}
+	if msg.ThreadID == "" {
+		msg.ThreadID = msg.ID
+	}
+	if msg.Date.IsZero() {
+		msg.Date = m.tick()
+	}
+	if msg.MessageID == "" {
+		msg.MessageID = "<" + msg.ID + "@fake.mail>"
+	}
+
+	headers := []*gmail.MessagePartHeader{
+		{Name: "From", Value: msg.From},
+		{Name: "To", Value: msg.To},
+		{Name: "Subject", Value: msg.Subject},
+		{Name: "Date", Value: msg.Date.Format(time.RFC1123Z)},
+		{Name: "Message-ID", Value: msg.MessageID},
+	}
+	for _, h := range [][2]string{
+		{"Cc", msg.Cc}, {"Reply-To", msg.ReplyTo}, {"In-Reply-To", msg.InReplyTo}, {"References", msg.References},
+	} {
+		if h[1] != "" {
+			headers = append(headers, &gmail.MessagePartHeader{Name: h[0], Value: h[1]})
+		}
+	}
+
+	bodyType := "text/plain"
+	if msg.HTML {
+		bodyType = "text/html"
+	}
+	body := &gmail.MessagePart{
+		MimeType: bodyType,
+		Body:     &gmail.MessagePartBody{Data: encode([]byte(msg.Body)), Size: int64(len(msg.Body))},
+	}
+
+	payload := body
+	if len(msg.Attachments) > 0 {
+		payload = &gmail.MessagePart{MimeType: "multipart/mixed", Body: &gmail.MessagePartBody{}, Parts: []*gmail.MessagePart{body}}
+		for _, a := range msg.Attachments {
+			payload.Parts = append(payload.Parts, m.storeAttachment(msg.ID, a.Filename, a.MimeType, a.Data))
+		}
+	}
+	payload.Headers = headers
+
+	stored := &gmail.Message{
+		Id:           msg.ID,
+		ThreadId:     msg.ThreadID,
+		LabelIds:     append([]string(nil), msg.Labels...),
+		Snippet:      snippet(msg.Body),
+		InternalDate: msg.Date.UnixMilli(),
+		SizeEstimate: int64(len(msg.Body)),
+		Payload:      payload,
+	}
+	m.messages[msg.ID] = stored
+	m.recordAdded(stored)
+	return clone(stored)
+}
+
+// AddLabel creates a user label and returns it.
+func (m *Mailbox) AddLabel(name string) *gmail.Label {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.addLabel(name)
+}
+
+// FailOn makes every later call of the named GmailAPI method (e.g.
+// "GetThread") return err. GetMessage also takes "GetMessage ID" to fail
+// only that message. Pass a nil err to clear it.
+func (m *Mailbox) FailOn(method string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil {
+		delete(m.failures, method)
+		return
+	}
+	m.failures[method] = err
+}
+
+// Message returns a stored message, or nil.
+func (m *Mailbox) Message(id string) *gmail.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if msg, ok := m.messages[id]; ok {
+		return clone(msg)
+	}
+	return nil
+}
+
+// Sent returns the messages sent through SendMessage, oldest first.
+func (m *Mailbox) Sent() []*gmail.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]*gmail.Message, len(m.sent))
+	for i, id := range m.sent {
+		out[i] = clone(m.messages[id])
+	}
+	return out
+}
+
+// Drafts returns the drafts created through CreateDraft, oldest first.
+func (m *Mailbox) Drafts() []*gmail.Draft {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]*gmail.Draft, len(m.drafts))
+	for i, d := range m.drafts {
+		out[i] = &gmail.Draft{Id: d.Id, Message: clone(m.messages[d.Message.Id])}
+	}
+	return out
+}
+
+// ListMessages implements common.GmailAPI. Page tokens are offsets into the
+// result list. Like Gmail, messages in SPAM and TRASH are excluded unless
+// the query asks for them.
+func (m *Mailbox) ListMessages(query string, limit int64, pageToken string) (*common.MessageList, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.failure("ListMessages", "retrieve messages"); err != nil {
+		return nil, err
+	}
+
+	q, err := ParseQuery(query)
+	if err != nil {
+		return nil, apiError("retrieve messages", http.StatusBadRequest, err)
+	}
+
+	var matches []*gmail.Message
+	for _, msg := range m.messages {
+		if q.Match(msg, m.now(), m.labels) {
+			matches = append(matches, msg)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].InternalDate != matches[j].InternalDate {
+			return matches[i].InternalDate > matches[j].InternalDate
+		}
+		return matches[i].Id > matches[j].Id
+	})
+
+	start := 0
+	if pageToken != "" {
+		if _, err := fmt.Sscanf(pageToken, "offset-%d", &start); err != nil || start < 0 || start > len(matches) {
+			return nil, apiError("retrieve messages", http.StatusBadRequest, fmt.Errorf("invalid page token %q", pageToken))
+		}
+	}
+	end := len(matches)
+	if limit > 0 && int64(end-start) > limit {
+		end = start + int(limit)
+	}
+
+	list := &common.MessageList{ResultSizeEstimate: int64(len(matches))}
+	for _, msg := range matches[start:end] {
+		list.Messages = append(list.Messages, &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId})
+	}
+	if end < len(matches) {
+		list.NextPageToken = fmt.Sprintf("offset-%d", end)
+	}
+	return list, nil
+}
+
+// GetMessage implements common.GmailAPI.
+func (m *Mailbox) GetMessage(messageID string) (*gmail.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.failure("GetMessage", "retrieve message"); err != nil {
+		return nil, err
+	}
+	if err := m.failure("GetMessage "+messageID, "retrieve message"); err != nil {
+		return nil, err
+	}
+	msg, ok := m.messages[messageID]
+	if !ok {
+		return nil, notFound("retrieve message", messageID)
+	}
+	return clone(msg), nil
+}
+
+// GetThread implements common.GmailAPI. Messages are ordered oldest first.
+func (m *Mailbox) GetThread(threadID string) (*gmail.Thread, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.failure("GetThread", "retrieve thread"); err != nil {
+		return nil, err
+	}
+	thread := m.thread(threadID)
+	if thread == nil {
+		return nil, notFound("retrieve thread", threadID)
+	}
+	return thread, nil
+}
+
+// GetAttachment implements common.GmailAPI.
+func (m *Mailbox) GetAttachment(messageID, attachmentID string) (*gmail.MessagePartBody, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.failure("GetAttachment", "retrieve attachment"); err != nil {
+		return nil, err
+	}
+	data, ok := m.attachments[messageID+"/"+attachmentID]
+	if !ok {
+		return nil, notFound("retrieve attachment", attachmentID)
+	}
+	return &gmail.MessagePartBody{AttachmentId: attachmentID, Data: encode(data), Size: int64(len(data))}, nil
+}
+
+// SendMessage implements common.GmailAPI. The raw message is parsed and
+// stored with the SENT label, in threadID if set.
+func (m *Mailbox) SendMessage(threadID string, raw io.Reader) (*gmail.Message, error) {
+	data, err := io.ReadAll(raw)
+	if err != nil {
+		return nil, apiError("send message", http.StatusBadRequest, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.failure("SendMessage", "send message"); err != nil {
+		return nil, err
+	}
+	msg, err := m.storeRaw(threadID, data, "SENT")
+	if err != nil {
+		return nil, apiError("send message", http.StatusBadRequest, err)
+	}
+	m.sent = append(m.sent, msg.Id)
+	return clone(msg), nil
+}
+
+// CreateDraft implements common.GmailAPI.
+func (m *Mailbox) CreateDraft(threadID string, raw io.Reader) (*gmail.Draft, error) {
+	data, err := io.ReadAll(raw)
+	if err != nil {
+		return nil, apiError("create draft", http.StatusBadRequest, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.failure("CreateDraft", "create draft"); err != nil {
+		return nil, err
+	}
+	msg, err := m.storeRaw(threadID, data, "DRAFT")
+	if err != nil {
+		return nil, apiError("create draft", http.StatusBadRequest, err)
+	}
+	draft := &gmail.Draft{Id: m.newID("r"), Message: msg}
+	m.drafts = append(m.drafts, draft)
+	return &gmail.Draft{Id: draft.Id, Message: clone(msg)}, nil
+}
+
+// ModifyMessage implements common.GmailAPI.
+func (m *Mailbox) ModifyMessage(messageID string, addLabels, removeLabels []string) (*gmail.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.failure("ModifyMessage", "modify message"); err != nil {
+		return nil, err
+	}
+	msg, ok := m.messages[messageID]
+	if !ok {
+		return nil, notFound("modify message", messageID)
+	}
+	if err := m.checkLabels("modify message", addLabels, removeLabels); err != nil {
+		return nil, err
+	}
+	m.relabel(msg, addLabels, removeLabels)
+	return clone(msg), nil
+}
+
+// ModifyThread implements common.GmailAPI.
+func (m *Mailbox) ModifyThread(threadID string, addLabels, removeLabels []string) (*gmail.Thread, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.failure("ModifyThread", "modify thread"); err != nil {
+		return nil, err
+	}
+	if m.thread(threadID) == nil {
+		return nil, notFound("modify thread", threadID)
+	}
+	if err := m.checkLabels("modify thread", addLabels, removeLabels); err != nil {
+		return nil, err
+	}
+	for _, msg := range m.messages {
+		if msg.ThreadId == threadID {
+			m.relabel(msg, addLabels, removeLabels)
+		}
+	}
+	return m.thread(threadID), nil
+}
+
+// BatchModifyMessages implements common.GmailAPI. Unknown IDs are reported as
+// failed items; the rest are modified.
+func (m *Mailbox) BatchModifyMessages(messageIDs []string, addLabels, removeLabels []string) ([]common.BatchResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.failure("BatchModifyMessages", "batch modify messages"); err != nil {
+		return nil, err
+	}
+	if err := m.checkLabels("batch modify messages", addLabels, removeLabels); err != nil {
+		return nil, err
+	}
+
+	results := make([]common.BatchResult, len(messageIDs))
+	for i, id := range messageIDs {
+		msg, ok := m.messages[id]
+		if !ok {
+			err := notFound("modify message", id)
+			results[i] = common.BatchResult{ID: id, Status: "error", Error: err.Error(), Kind: common.KindNotFound}
+			continue
+		}
+		m.relabel(msg, addLabels, removeLabels)
+		results[i] = common.BatchResult{ID: id, Status: "ok"}
+	}
+	return results, nil
+}
+
+// ListLabels implements common.GmailAPI.
+func (m *Mailbox) ListLabels() ([]*gmail.Label, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.failure("ListLabels", "list labels"); err != nil {
+		return nil, err
+	}
+	out := make([]*gmail.Label, len(m.labels))
+	for i, l := range m.labels {
+		copied := *l
+		out[i] = &copied
+	}
+	return out, nil
+}
+
+// CreateLabel implements common.GmailAPI. Like Gmail, it rejects a name that
+// already exists (case-insensitively).
+func (m *Mailbox) CreateLabel(name string) (*gmail.Label, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	op := fmt.Sprintf("create label %q", name)
+	if err := m.failure("CreateLabel", op); err != nil {
+		return nil, err
+	}
+	for _, l := range m.labels {
+		if strings.EqualFold(l.Name, name) {
+			return nil, apiError(op, http.StatusConflict, fmt.Errorf("label name exists or conflicts"))
+		}
+	}
+	label := m.addLabel(name)
+	copied := *label
+	return &copied, nil
+}
+
+// Profile returns the mailbox profile Gmail's users.getProfile would, with
+// the current history ID.
+func (m *Mailbox) Profile() (*gmail.Profile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.failure("GetProfile", "retrieve profile"); err != nil {
+		return nil, err
+	}
+	threads := make(map[string]bool)
+	for _, msg := range m.messages {
+		threads[msg.ThreadId] = true
+	}
+	return &gmail.Profile{
+		EmailAddress:  "me@fake.mail",
+		MessagesTotal: int64(len(m.messages)),
+		ThreadsTotal:  int64(len(threads)),
+		HistoryId:     m.historyID,
+	}, nil
+}
+
+// History returns the history records after startHistoryID, oldest first,
+// and the current history ID, as users.history.list does. Every added
+// message and label change is recorded. labelID, if set, keeps only records
+// whose message had that label after the change. A start ID from before
+// ExpireHistory is a 404, as Gmail answers once it no longer has the records.
+func (m *Mailbox) History(startHistoryID uint64, labelID string) ([]*gmail.History, uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.failure("History", "retrieve history"); err != nil {
+		return nil, 0, err
+	}
+	if startHistoryID < m.floor {
+		return nil, 0, notFound("retrieve history", fmt.Sprint(startHistoryID))
+	}
+
+	var records []*gmail.History
+	for _, h := range m.history {
+		if h.Id <= startHistoryID || (labelID != "" && !contains(h.Messages[0].LabelIds, labelID)) {
+			continue
+		}
+		records = append(records, h)
+	}
+	return records, m.historyID, nil
+}
+
+// ExpireHistory drops every history record so far, as Gmail does after about
+// a week: History calls starting before now fail with 404.
+func (m *Mailbox) ExpireHistory() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.history = nil
+	m.floor = m.historyID
+}
+
+// Close implements common.GmailAPI. The mailbox holds nothing to release and
+// stays usable.
+func (m *Mailbox) Close() error {
+	return nil
+}
+
+func (m *Mailbox) addLabel(name string) *gmail.Label {
+	label := &gmail.Label{
+		Id:                    m.newID("Label_"),
+		Name:                  name,
+		Type:                  "user",
+		LabelListVisibility:   "labelShow",
+		MessageListVisibility: "show",
+	}
+	m.labels = append(m.labels, label)
+	return label
+}
+
+// checkLabels rejects label IDs the mailbox doesn't have, as Gmail does.
+func (m *Mailbox) checkLabels(op string, lists ...[]string) error {
+	for _, ids := range lists {
+		for _, id := range ids {
+			found := false
+			for _, l := range m.labels {
+				if l.Id == id {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return apiError(op, http.StatusBadRequest, fmt.Errorf("invalid label: %s", id))
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Mailbox) thread(threadID string) *gmail.Thread {
+	var msgs []*gmail.Message
+	for _, msg := range m.messages {
+		if msg.ThreadId == threadID {
+			msgs = append(msgs, clone(msg))
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		if msgs[i].InternalDate != msgs[j].InternalDate {
+			return msgs[i].InternalDate < msgs[j].InternalDate
+		}
+		return msgs[i].Id < msgs[j].Id
+	})
+	return &gmail.Thread{Id: threadID, Messages: msgs, Snippet: msgs[len(msgs)-1].Snippet}
+}
+
+// storeRaw parses an outgoing message's raw MIME and stores it with label.
+func (m *Mailbox) storeRaw(threadID string, raw []byte, label string) (*gmail.Message, error) {
+	id := m.newID("msg")
+	payload, err := m.parseRaw(id, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if threadID == "" {
+		threadID = id
+	}
+	msg := &gmail.Message{
+		Id:           id,
+		ThreadId:     threadID,
+		LabelIds:     []string{label},
+		InternalDate: m.tick().UnixMilli(),
+		SizeEstimate: int64(len(raw)),
+		Payload:      payload,
+	}
+	msg.Snippet = snippet(common.ExtractMessageBody(msg))
+	m.messages[id] = msg
+	m.recordAdded(msg)
+	return msg, nil
+}
+
+func (m *Mailbox) storeAttachment(messageID, filename, mimeType string, data []byte) *gmail.MessagePart {
+	id := m.newID("att")
+	m.attachments[messageID+"/"+id] = data
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	return &gmail.MessagePart{
+		MimeType: mimeType,
+		Filename: filename,
+		Headers: []*gmail.MessagePartHeader{
+			{Name: "Content-Type", Value: fmt.Sprintf("%s; name=%q", mimeType, filename)},
+			{Name: "Content-Disposition", Value: fmt.Sprintf("attachment; filename=%q", filename)},
+		},
+		Body: &gmail.MessagePartBody{AttachmentId: id, Size: int64(len(data))},
+	}
+}
+
+// failure returns the error registered with FailOn for method, wrapped as an
+// API error for op.
+func (m *Mailbox) failure(method, op string) error {
+	err, ok := m.failures[method]
+	if !ok {
+		return nil
+	}
+	if _, typed := err.(*common.APIError); typed {
+		return err
+	}
+	return &common.APIError{Op: op, Kind: common.KindUnclassified, Err: err}
+}
+
+func (m *Mailbox) newID(prefix string) string {
+	m.seq++
+	return fmt.Sprintf("%s%d", prefix, m.seq)
+}
+
+// tick advances the mailbox clock by a minute and returns it.
+func (m *Mailbox) tick() time.Time {
+	m.clock = m.clock.Add(time.Minute)
+	return m.clock
+}
+
+// now is the reference time for relative queries (newer_than:, older_than:).
+func (m *Mailbox) now() time.Time {
+	return m.clock
+}
+
+// recordAdded appends a messagesAdded history record for msg.
+func (m *Mailbox) recordAdded(msg *gmail.Message) {
+	ref := historyRef(msg)
+	m.record(&gmail.History{Messages: []*gmail.Message{ref}, MessagesAdded: []*gmail.HistoryMessageAdded{{Message: ref}}})
+}
+
+// relabel changes msg's labels and records the labels that actually changed.
+func (m *Mailbox) relabel(msg *gmail.Message, add, remove []string) {
+	before := msg.LabelIds
+	relabel(msg, add, remove)
+
+	var added, removed []string
+	for _, id := range msg.LabelIds {
+		if !contains(before, id) {
+			added = append(added, id)
+		}
+	}
+	for _, id := range before {
+		if !contains(msg.LabelIds, id) {
+			removed = append(removed, id)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	ref := historyRef(msg)
+	h := &gmail.History{Messages: []*gmail.Message{ref}}
+	if len(added) > 0 {
+		h.LabelsAdded = []*gmail.HistoryLabelAdded{{Message: ref, LabelIds: added}}
+	}
+	if len(removed) > 0 {
+		h.LabelsRemoved = []*gmail.HistoryLabelRemoved{{Message: ref, LabelIds: removed}}
+	}
+	m.record(h)
+}
+
+// record assigns h the next history ID, which also becomes the history ID of
+// its message.
+func (m *Mailbox) record(h *gmail.History) {
+	m.historyID++
+	h.Id = m.historyID
+	m.history = append(m.history, h)
+	if msg, ok := m.messages[h.Messages[0].Id]; ok {
+		msg.HistoryId = m.historyID
+	}
+}
+
+// historyRef is the minimal message Gmail puts in history records.
+func historyRef(msg *gmail.Message) *gmail.Message {
+	return &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId, LabelIds: append([]string(nil), msg.LabelIds...)}
+}
+
+func relabel(msg *gmail.Message, add, remove []string) {
+	labels := make([]string, 0, len(msg.LabelIds)+len(add))
+	for _, id := range msg.LabelIds {
+		if !contains(remove, id) {
+			labels = append(labels, id)
+		}
+	}
+	for _, id := range add {
+		if !contains(labels, id) {
+			labels = append(labels, id)
+		}
+	}
+	msg.LabelIds = labels
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// clone deep-copies a message so callers can't mutate the mailbox.
+func clone(msg *gmail.Message) *gmail.Message {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	out := &gmail.Message{}
+	if err := json.Unmarshal(data, out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+func snippet(body string) string {
+	s := []rune(strings.Join(strings.Fields(body), " "))
+	if len(s) > 100 {
+		s = s[:100]
+	}
+	return string(s)
+}
+
+func encode(data []byte) string {
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+func decode(s string) ([]byte, error) {
+	if data, err := base64.URLEncoding.DecodeString(s); err == nil {
+		return data, nil
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func notFound(op, id string) error {
+	return apiError(op, http.StatusNotFound, fmt.Errorf("requested entity was not found: %s", id))
+}
+
+func apiError(op string, status int, err error) error {
+	kind := common.KindUnclassified
+	switch status {
+	case http.StatusNotFound:
+		kind = common.KindNotFound
+	case http.StatusBadRequest, http.StatusConflict:
+		kind = common.KindInvalid
+	}
+	return &common.APIError{Op: op, Kind: kind, Status: status, Err: err}
+}
@@ -0,0 +1,130 @@
+package fakegmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+var headerDecoder = new(mime.WordDecoder)
+
+// parseRaw turns an RFC 5322 message into a Gmail payload: headers decoded
+// (RFC 2047), multiparts split into parts, transfer encodings undone, and
+// parts with a filename stored as attachments of messageID.
+func (m *Mailbox) parseRaw(messageID string, raw []byte) (*gmail.MessagePart, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid message: %v", err)
+	}
+	return m.parsePart(messageID, textproto.MIMEHeader(msg.Header), msg.Body)
+}
+
+func (m *Mailbox) parsePart(messageID string, header textproto.MIMEHeader, body io.Reader) (*gmail.MessagePart, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	part := &gmail.MessagePart{MimeType: mediaType, Headers: partHeaders(header)}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		part.Body = &gmail.MessagePartBody{}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid multipart body: %v", err)
+			}
+			child, err := m.parsePart(messageID, p.Header, p)
+			if err != nil {
+				return nil, err
+			}
+			part.Parts = append(part.Parts, child)
+		}
+		return part, nil
+	}
+
+	data, err := decodeTransfer(header.Get("Content-Transfer-Encoding"), body)
+	if err != nil {
+		return nil, err
+	}
+
+	filename := ""
+	if _, dparams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		filename = dparams["filename"]
+	}
+	if filename == "" {
+		filename = params["name"]
+	}
+	if filename != "" {
+		stored := m.storeAttachment(messageID, filename, mediaType, data)
+		part.Filename = filename
+		part.Body = stored.Body
+		return part, nil
+	}
+
+	part.Body = &gmail.MessagePartBody{Data: encode(data), Size: int64(len(data))}
+	return part, nil
+}
+
+// partHeaders returns header as Gmail's header list, with encoded words
+// decoded. Order is alphabetical since textproto doesn't keep it.
+func partHeaders(header textproto.MIMEHeader) []*gmail.MessagePartHeader {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out []*gmail.MessagePartHeader
+	for _, name := range names {
+		for _, value := range header[name] {
+			if decoded, err := headerDecoder.DecodeHeader(value); err == nil {
+				value = decoded
+			}
+			out = append(out, &gmail.MessagePartHeader{Name: gmailHeaderName(name), Value: value})
+		}
+	}
+	return out
+}
+
+// gmailHeaderName undoes textproto's canonicalization for the one header
+// whose usual spelling differs ("Message-Id" → "Message-ID").
+func gmailHeaderName(name string) string {
+	if name == "Message-Id" {
+		return "Message-ID"
+	}
+	return name
+}
+
+func decodeTransfer(encoding string, body io.Reader) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 body: %v", err)
+		}
+		return decoded, nil
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(body))
+	default:
+		return io.ReadAll(body)
+	}
+}
@@ -0,0 +1,299 @@
+package fakegmail
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blue/support-agent/common"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Query is a parsed Gmail search query. It understands the subset of Gmail's
+// syntax the commands and tests rely on:
+//
+//	refund "export failed"        words and phrases (any of from/to/cc/subject/body)
+//	from:x to:x cc:x bcc:x         address fields (substring match)
+//	subject:x                      subject
+//	label:x in:x                   label name or ID; in:anywhere includes spam and trash
+//	is:unread is:read is:starred is:important
+//	category:updates               CATEGORY_UPDATES
+//	has:attachment filename:pdf
+//	after:2024/01/31 before:2024-02-01 newer_than:7d older_than:1m
+//	rfc822msgid:<id@host>
+//	-term                          negation
+//	a OR b                         either term
+//
+// Matching is case-insensitive and by substring, which is looser than
+// Gmail's word matching but close enough for tests.
+type Query struct {
+	clauses []clause
+}
+
+// clause is satisfied when any of its alternatives matches (or, if negated,
+// none does).
+type clause struct {
+	negate bool
+	alts   []term
+}
+
+type term struct {
+	field string // "" for free text
+	value string
+}
+
+// ParseQuery parses a Gmail search query.
+func ParseQuery(query string) (*Query, error) {
+	tokens, err := splitQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Query{}
+	orNext := false
+	for _, tok := range tokens {
+		if tok == "OR" {
+			if len(q.clauses) == 0 {
+				return nil, fmt.Errorf("OR without a preceding term")
+			}
+			orNext = true
+			continue
+		}
+
+		negate := false
+		if strings.HasPrefix(tok, "-") && len(tok) > 1 {
+			negate = true
+			tok = tok[1:]
+		}
+
+		t := term{value: tok}
+		if i := strings.Index(tok, ":"); i > 0 && !strings.HasPrefix(tok, "\"") {
+			t.field = strings.ToLower(tok[:i])
+			t.value = tok[i+1:]
+		}
+		t.value = strings.ToLower(strings.Trim(t.value, "\""))
+		if err := t.validate(); err != nil {
+			return nil, err
+		}
+
+		if orNext {
+			last := &q.clauses[len(q.clauses)-1]
+			last.alts = append(last.alts, t)
+			orNext = false
+			continue
+		}
+		q.clauses = append(q.clauses, clause{negate: negate, alts: []term{t}})
+	}
+	if orNext {
+		return nil, fmt.Errorf("OR without a following term")
+	}
+	return q, nil
+}
+
+// splitQuery splits on whitespace, keeping quoted phrases (including
+// field:"quoted value") together.
+func splitQuery(query string) ([]string, error) {
+	var tokens []string
+	var cur strings.Builder
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			cur.WriteRune(r)
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if cur.Len() > 0 {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in query: %s", query)
+	}
+	if cur.Len() > 0 {
+		tokens = append(tokens, cur.String())
+	}
+	return tokens, nil
+}
+
+func (t term) validate() error {
+	switch t.field {
+	case "", "from", "to", "cc", "bcc", "subject", "label", "in", "is", "category", "has", "filename", "rfc822msgid":
+		return nil
+	case "after", "before":
+		_, err := parseDate(t.value)
+		return err
+	case "newer_than", "older_than":
+		_, err := parseAge(t.value)
+		return err
+	}
+	return fmt.Errorf("unsupported search operator %q", t.field+":")
+}
+
+// Match reports whether msg satisfies the query. now anchors newer_than: and
+// older_than:; labels maps label names to IDs for label:.
+func (q *Query) Match(msg *gmail.Message, now time.Time, labels []*gmail.Label) bool {
+	if !q.includesSpamTrash() && (contains(msg.LabelIds, "SPAM") || contains(msg.LabelIds, "TRASH")) {
+		return false
+	}
+
+	headers := common.ExtractHeaders(msg)
+	for _, c := range q.clauses {
+		matched := false
+		for _, t := range c.alts {
+			if t.match(msg, headers, now, labels) {
+				matched = true
+				break
+			}
+		}
+		if matched == c.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *Query) includesSpamTrash() bool {
+	for _, c := range q.clauses {
+		if c.negate {
+			continue
+		}
+		for _, t := range c.alts {
+			if (t.field == "in" || t.field == "label") && (t.value == "anywhere" || t.value == "spam" || t.value == "trash") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t term) match(msg *gmail.Message, headers map[string]string, now time.Time, labels []*gmail.Label) bool {
+	has := func(text string) bool {
+		return strings.Contains(strings.ToLower(text), t.value)
+	}
+
+	switch t.field {
+	case "":
+		return has(headers["from"]) || has(headers["to"]) || has(headers["cc"]) ||
+			has(headers["subject"]) || has(common.ExtractMessageBody(msg))
+	case "from", "to", "cc", "bcc", "subject":
+		return has(headers[t.field])
+	case "rfc822msgid":
+		return strings.Trim(strings.ToLower(headers["message-id"]), "<>") == strings.Trim(t.value, "<>")
+	case "label", "in":
+		return hasLabel(msg, t.value, labels)
+	case "is":
+		switch t.value {
+		case "read":
+			return !contains(msg.LabelIds, "UNREAD")
+		case "unread", "starred", "important":
+			return contains(msg.LabelIds, strings.ToUpper(t.value))
+		}
+		return false
+	case "category":
+		return contains(msg.LabelIds, "CATEGORY_"+strings.ToUpper(t.value))
+	case "has":
+		return t.value == "attachment" && len(filenames(msg.Payload)) > 0
+	case "filename":
+		for _, name := range filenames(msg.Payload) {
+			if strings.Contains(strings.ToLower(name), t.value) {
+				return true
+			}
+		}
+		return false
+	case "after", "before":
+		date, _ := parseDate(t.value)
+		sent := time.UnixMilli(msg.InternalDate)
+		if t.field == "after" {
+			return !sent.Before(date)
+		}
+		return sent.Before(date)
+	case "newer_than", "older_than":
+		age, _ := parseAge(t.value)
+		sent := time.UnixMilli(msg.InternalDate)
+		if t.field == "newer_than" {
+			return sent.After(now.Add(-age))
+		}
+		return sent.Before(now.Add(-age))
+	}
+	return false
+}
+
+// hasLabel matches a label: or in: value against msg's label IDs, by ID or
+// by name. Gmail lets label names be written with dashes for spaces and
+// slashes, and calls DRAFT "drafts" in in:drafts.
+func hasLabel(msg *gmail.Message, value string, labels []*gmail.Label) bool {
+	if value == "anywhere" {
+		return true
+	}
+	if value == "drafts" {
+		value = "draft"
+	}
+	normalize := func(s string) string {
+		return strings.NewReplacer(" ", "-", "/", "-").Replace(strings.ToLower(s))
+	}
+	for _, id := range msg.LabelIds {
+		if strings.ToLower(id) == value {
+			return true
+		}
+		for _, l := range labels {
+			if l.Id == id && normalize(l.Name) == normalize(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func filenames(part *gmail.MessagePart) []string {
+	if part == nil {
+		return nil
+	}
+	var names []string
+	if part.Filename != "" {
+		names = append(names, part.Filename)
+	}
+	for _, p := range part.Parts {
+		names = append(names, filenames(p)...)
+	}
+	return names
+}
+
+// parseDate parses an after:/before: value: YYYY/MM/DD, YYYY-MM-DD or Unix
+// seconds. Dates are taken as UTC midnight.
+func parseDate(s string) (time.Time, error) {
+	for _, layout := range []string{"2006/1/2", "2006-1-2"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q in query", s)
+}
+
+// parseAge parses a newer_than:/older_than: value such as 7d, 2m or 1y.
+func parseAge(s string) (time.Duration, error) {
+	if len(s) < 2 {
+		return 0, fmt.Errorf("invalid age %q in query", s)
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid age %q in query", s)
+	}
+	day := 24 * time.Hour
+	switch s[len(s)-1] {
+	case 'd':
+		return time.Duration(n) * day, nil
+	case 'm':
+		return time.Duration(n) * 30 * day, nil
+	case 'y':
+		return time.Duration(n) * 365 * day, nil
+	}
+	return 0, fmt.Errorf("invalid age %q in query", s)
+}
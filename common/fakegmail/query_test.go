@@ -0,0 +1,98 @@
+package fakegmail
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/blue/support-agent/common"
+)
+
+func seed() *Mailbox {
+	mb := New()
+	billing := mb.AddLabel("Billing")
+	mb.Add(Message{ID: "a", From: "Ana <ana@customer.com>", To: "help@blue.cc", Subject: "Export failed", Body: "The CSV export failed twice.",
+		Labels: []string{"INBOX", "UNREAD"}, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)})
+	mb.Add(Message{ID: "b", From: "billing@stripe.com", To: "help@blue.cc", Subject: "Invoice INV-2041", Body: "See attached.",
+		Labels: []string{"INBOX", billing.Id}, Date: time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC),
+		Attachments: []Attachment{{Filename: "invoice.pdf", MimeType: "application/pdf", Data: []byte("pdf")}}})
+	mb.Add(Message{ID: "c", From: "bo@blue.cc", To: "ana@customer.com", Cc: "help@blue.cc", Subject: "Re: Export failed", Body: "Fixed.",
+		Labels: []string{"SENT", "STARRED"}, Date: time.Date(2024, 2, 20, 12, 0, 0, 0, time.UTC)})
+	mb.Add(Message{ID: "d", From: "spam@spam.example", To: "help@blue.cc", Subject: "Win", Body: "export now",
+		Labels: []string{"SPAM"}, Date: time.Date(2024, 2, 21, 12, 0, 0, 0, time.UTC)})
+	return mb
+}
+
+func TestListMessagesQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"a", "b", "c"}},
+		{"export", []string{"a", "c"}},
+		{`"csv export"`, []string{"a"}},
+		{"from:ana@customer.com", []string{"a"}},
+		{"to:ana", []string{"c"}},
+		{"cc:help@blue.cc", []string{"c"}},
+		{`subject:"export failed"`, []string{"a", "c"}},
+		{"subject:export -from:blue.cc", []string{"a"}},
+		{"label:billing", []string{"b"}},
+		{"in:inbox is:unread", []string{"a"}},
+		{"is:read", []string{"b", "c"}},
+		{"is:starred", []string{"c"}},
+		{"has:attachment", []string{"b"}},
+		{"filename:pdf", []string{"b"}},
+		{"after:2024/01/31 before:2024-02-15", []string{"b"}},
+		{"from:stripe OR from:bo", []string{"b", "c"}},
+		{"in:spam", []string{"d"}},
+		{"export in:anywhere", []string{"a", "c", "d"}},
+		{"rfc822msgid:<a@fake.mail>", []string{"a"}},
+	}
+
+	mb := seed()
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			list, err := mb.ListMessages(tt.query, 0, "")
+			if err != nil {
+				t.Fatalf("ListMessages: %v", err)
+			}
+			got := common.MessageIDs(list.Messages)
+			sort.Strings(got)
+			if len(got) == 0 {
+				got = nil
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListMessagesPaging(t *testing.T) {
+	mb := seed()
+
+	first, err := mb.ListMessages("", 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := common.MessageIDs(first.Messages); !reflect.DeepEqual(ids, []string{"c", "b"}) || first.NextPageToken == "" {
+		t.Fatalf("first page = %v (token %q), want newest first with a token", ids, first.NextPageToken)
+	}
+
+	rest, err := mb.ListMessages("", 0, first.NextPageToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := common.MessageIDs(rest.Messages); !reflect.DeepEqual(ids, []string{"a"}) || rest.NextPageToken != "" {
+		t.Fatalf("second page = %v (token %q)", ids, rest.NextPageToken)
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, q := range []string{`subject:"open`, "OR foo", "after:yesterday", "newer_than:3w", "larger:5M"} {
+		if _, err := ParseQuery(q); err == nil {
+			t.Errorf("ParseQuery(%q) succeeded, want error", q)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package fakegmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// GetRawMessage implements common.GmailAPI. The message is rendered back to
+// MIME from its payload, so it parses to the same headers, parts and
+// attachments but is not byte-for-byte what was added.
+func (m *Mailbox) GetRawMessage(messageID string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.failure("GetRawMessage", "retrieve message"); err != nil {
+		return nil, err
+	}
+	msg, ok := m.messages[messageID]
+	if !ok {
+		return nil, notFound("retrieve message", messageID)
+	}
+	var buf bytes.Buffer
+	m.writePart(&buf, messageID, msg.Payload, 0)
+	return buf.Bytes(), nil
+}
+
+// writePart renders part with its headers. Leaf bodies are written base64
+// encoded; multiparts keep the boundary of their Content-Type header, or
+// get one if the part was added without it.
+func (m *Mailbox) writePart(buf *bytes.Buffer, messageID string, part *gmail.MessagePart, depth int) {
+	contentType := ""
+	for _, h := range part.Headers {
+		switch strings.ToLower(h.Name) {
+		case "content-type":
+			contentType = h.Value
+		case "content-transfer-encoding":
+			continue
+		}
+		fmt.Fprintf(buf, "%s: %s\r\n", h.Name, h.Value)
+	}
+
+	_, params, _ := mime.ParseMediaType(contentType)
+	if strings.HasPrefix(part.MimeType, "multipart/") {
+		boundary := params["boundary"]
+		if boundary == "" {
+			boundary = fmt.Sprintf("=_fakegmail_%d", depth)
+			fmt.Fprintf(buf, "Content-Type: %s; boundary=%q\r\n", part.MimeType, boundary)
+		}
+		buf.WriteString("\r\n")
+		for _, child := range part.Parts {
+			fmt.Fprintf(buf, "--%s\r\n", boundary)
+			m.writePart(buf, messageID, child, depth+1)
+		}
+		fmt.Fprintf(buf, "--%s--\r\n", boundary)
+		return
+	}
+
+	if contentType == "" {
+		fmt.Fprintf(buf, "Content-Type: %s; charset=utf-8\r\n", part.MimeType)
+	}
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+
+	var data []byte
+	if part.Body != nil {
+		if part.Body.AttachmentId != "" {
+			data = m.attachments[messageID+"/"+part.Body.AttachmentId]
+		} else {
+			data, _ = decode(part.Body.Data)
+		}
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+}
@@ -0,0 +1,445 @@
+package fakegmail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/blue/support-agent/common"
+	"google.golang.org/api/gmail/v1"
+)
+
+// NewServer starts a local HTTP server speaking the Gmail REST endpoints the
+// commands use, backed by mb. Point the CLI at it with
+// GMAIL_ENDPOINT=<server.URL>/ (see common.GmailEndpoint). Close it when
+// done.
+func NewServer(mb *Mailbox) *httptest.Server {
+	return httptest.NewServer(Handler(mb))
+}
+
+// Handler serves the Gmail REST API subset backed by mb:
+//
+//	messages.list/get (full or raw)/send/modify/batchModify, messages.attachments.get,
+//	threads.get/modify, drafts.create, labels.list/create, history.list, getProfile
+//
+// messages.send and drafts.create are also served on the media upload
+// endpoint (/upload/gmail/v1/...), which the client uses to send. Multipart
+// batches (/batch/gmail/v1) of any of these calls are served too, with the
+// parts of the response in reverse order: Gmail doesn't promise any order, so
+// clients must match them up by Content-ID.
+//
+// Only the "me" user is supported. Errors use Gmail's JSON error format, so
+// the client classifies them as it would real ones.
+func Handler(mb *Mailbox) http.Handler {
+	s := &server{mb: mb}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /batch/gmail/v1", s.batch)
+	const users = "/gmail/v1/users/{user}"
+	mux.HandleFunc("GET "+users+"/messages", s.listMessages)
+	mux.HandleFunc("GET "+users+"/messages/{id}", s.getMessage)
+	mux.HandleFunc("POST "+users+"/messages/send", s.sendMessage)
+	mux.HandleFunc("POST "+users+"/messages/batchModify", s.batchModify)
+	mux.HandleFunc("POST "+users+"/messages/{id}/modify", s.modifyMessage)
+	mux.HandleFunc("GET "+users+"/messages/{id}/attachments/{attachmentID}", s.getAttachment)
+	mux.HandleFunc("GET "+users+"/threads/{id}", s.getThread)
+	mux.HandleFunc("POST "+users+"/threads/{id}/modify", s.modifyThread)
+	mux.HandleFunc("POST "+users+"/drafts", s.createDraft)
+	mux.HandleFunc("POST /upload"+users+"/messages/send", s.uploadMessage)
+	mux.HandleFunc("POST /upload"+users+"/drafts", s.uploadDraft)
+	mux.HandleFunc("GET "+users+"/labels", s.listLabels)
+	mux.HandleFunc("POST "+users+"/labels", s.createLabel)
+	mux.HandleFunc("GET "+users+"/history", s.listHistory)
+	mux.HandleFunc("GET "+users+"/profile", s.getProfile)
+	s.api = requireMe(mux)
+	return s.api
+}
+
+type server struct {
+	mb  *Mailbox
+	api http.Handler // serves the calls inside a batch
+}
+
+// requireMe rejects requests for any user other than "me".
+func requireMe(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/upload")
+		parts := strings.Split(strings.TrimPrefix(path, "/gmail/v1/users/"), "/")
+		if strings.HasPrefix(path, "/gmail/v1/users/") && parts[0] != "me" {
+			writeError(w, apiError("access mailbox", http.StatusForbidden, errors.New("delegation denied for "+parts[0])))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) listMessages(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query := params.Get("q")
+	for _, id := range params["labelIds"] {
+		query += " label:" + id
+	}
+
+	limit := int64(100) // Gmail's default page size
+	if v := params.Get("maxResults"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			writeError(w, apiError("retrieve messages", http.StatusBadRequest, errors.New("invalid maxResults")))
+			return
+		}
+		limit = min(n, 500)
+	}
+
+	list, err := s.mb.ListMessages(strings.TrimSpace(query), limit, params.Get("pageToken"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, &gmail.ListMessagesResponse{
+		Messages:           list.Messages,
+		NextPageToken:      list.NextPageToken,
+		ResultSizeEstimate: list.ResultSizeEstimate,
+	})
+}
+
+func (s *server) getMessage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("format") != "raw" {
+		respond(w)(s.mb.GetMessage(r.PathValue("id")))
+		return
+	}
+	msg, err := s.mb.GetMessage(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	raw, err := s.mb.GetRawMessage(msg.Id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId, LabelIds: msg.LabelIds, Raw: encode(raw)})
+}
+
+func (s *server) sendMessage(w http.ResponseWriter, r *http.Request) {
+	var msg gmail.Message
+	if !readJSON(w, r, &msg) {
+		return
+	}
+	raw, ok := decodeRaw(w, msg.Raw)
+	if !ok {
+		return
+	}
+	respond(w)(s.mb.SendMessage(msg.ThreadId, raw))
+}
+
+// uploadMessage serves messages.send through the media upload endpoint.
+func (s *server) uploadMessage(w http.ResponseWriter, r *http.Request) {
+	var msg gmail.Message
+	raw, ok := readUpload(w, r, &msg)
+	if !ok {
+		return
+	}
+	respond(w)(s.mb.SendMessage(msg.ThreadId, raw))
+}
+
+func (s *server) modifyMessage(w http.ResponseWriter, r *http.Request) {
+	var req gmail.ModifyMessageRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	respond(w)(s.mb.ModifyMessage(r.PathValue("id"), req.AddLabelIds, req.RemoveLabelIds))
+}
+
+// batchModify follows Gmail: the whole request fails if any ID is unknown,
+// and success is an empty 204.
+func (s *server) batchModify(w http.ResponseWriter, r *http.Request) {
+	var req gmail.BatchModifyMessagesRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	for _, id := range req.Ids {
+		if s.mb.Message(id) == nil {
+			writeError(w, apiError("batch modify messages", http.StatusBadRequest, errors.New("invalid id value: "+id)))
+			return
+		}
+	}
+	if _, err := s.mb.BatchModifyMessages(req.Ids, req.AddLabelIds, req.RemoveLabelIds); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) getAttachment(w http.ResponseWriter, r *http.Request) {
+	respond(w)(s.mb.GetAttachment(r.PathValue("id"), r.PathValue("attachmentID")))
+}
+
+func (s *server) getThread(w http.ResponseWriter, r *http.Request) {
+	respond(w)(s.mb.GetThread(r.PathValue("id")))
+}
+
+func (s *server) modifyThread(w http.ResponseWriter, r *http.Request) {
+	var req gmail.ModifyThreadRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	respond(w)(s.mb.ModifyThread(r.PathValue("id"), req.AddLabelIds, req.RemoveLabelIds))
+}
+
+func (s *server) createDraft(w http.ResponseWriter, r *http.Request) {
+	var draft gmail.Draft
+	if !readJSON(w, r, &draft) {
+		return
+	}
+	if draft.Message == nil {
+		writeError(w, apiError("create draft", http.StatusBadRequest, errors.New("missing draft message")))
+		return
+	}
+	raw, ok := decodeRaw(w, draft.Message.Raw)
+	if !ok {
+		return
+	}
+	respond(w)(s.mb.CreateDraft(draft.Message.ThreadId, raw))
+}
+
+// uploadDraft serves drafts.create through the media upload endpoint.
+func (s *server) uploadDraft(w http.ResponseWriter, r *http.Request) {
+	var draft gmail.Draft
+	raw, ok := readUpload(w, r, &draft)
+	if !ok {
+		return
+	}
+	threadID := ""
+	if draft.Message != nil {
+		threadID = draft.Message.ThreadId
+	}
+	respond(w)(s.mb.CreateDraft(threadID, raw))
+}
+
+func (s *server) listLabels(w http.ResponseWriter, r *http.Request) {
+	labels, err := s.mb.ListLabels()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, &gmail.ListLabelsResponse{Labels: labels})
+}
+
+func (s *server) createLabel(w http.ResponseWriter, r *http.Request) {
+	var label gmail.Label
+	if !readJSON(w, r, &label) {
+		return
+	}
+	respond(w)(s.mb.CreateLabel(label.Name))
+}
+
+// listHistory serves every record in one page.
+func (s *server) listHistory(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	start, err := strconv.ParseUint(params.Get("startHistoryId"), 10, 64)
+	if err != nil {
+		writeError(w, apiError("retrieve history", http.StatusBadRequest, errors.New("invalid startHistoryId")))
+		return
+	}
+	records, historyID, err := s.mb.History(start, params.Get("labelId"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, &gmail.ListHistoryResponse{History: records, HistoryId: historyID})
+}
+
+func (s *server) getProfile(w http.ResponseWriter, r *http.Request) {
+	respond(w)(s.mb.Profile())
+}
+
+// batch serves a multipart/mixed batch: each application/http part is an
+// API call, answered by a part with Content-ID "<response-ID>" for the
+// request part's "<ID>".
+func (s *server) batch(w http.ResponseWriter, r *http.Request) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		writeError(w, apiError("decode batch", http.StatusBadRequest, errors.New("batch request is not multipart/mixed")))
+		return
+	}
+
+	type item struct {
+		contentID string
+		rec       *httptest.ResponseRecorder
+	}
+	var items []item
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, apiError("decode batch", http.StatusBadRequest, err))
+			return
+		}
+		inner, err := readBatchItem(part)
+		if err != nil {
+			writeError(w, apiError("decode batch", http.StatusBadRequest, errors.New("invalid batch item: "+err.Error())))
+			return
+		}
+		// The request line carries only a path; the inner handlers need the
+		// rest of a server request.
+		inner.RequestURI = ""
+		inner = inner.WithContext(r.Context())
+		rec := httptest.NewRecorder()
+		s.api.ServeHTTP(rec, inner)
+		items = append(items, item{contentID: strings.Trim(part.Header.Get("Content-ID"), "<>"), rec: rec})
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i := len(items) - 1; i >= 0; i-- {
+		it := items[i]
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "application/http")
+		header.Set("Content-ID", "<response-"+it.contentID+">")
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		res := it.rec.Result()
+		fmt.Fprintf(part, "HTTP/1.1 %s\r\n", res.Status)
+		res.Header.Set("Content-Length", strconv.Itoa(it.rec.Body.Len()))
+		res.Header.Write(part)
+		fmt.Fprint(part, "\r\n")
+		part.Write(it.rec.Body.Bytes())
+	}
+	mw.Close()
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.Write(body.Bytes())
+}
+
+// readBatchItem parses the HTTP request in a batch part. Gmail accepts a
+// request line without the HTTP version, as the client sends it.
+func readBatchItem(part io.Reader) (*http.Request, error) {
+	br := bufio.NewReader(part)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(strings.Fields(line)) == 2 {
+		line += " HTTP/1.1"
+	}
+	return http.ReadRequest(bufio.NewReader(io.MultiReader(strings.NewReader(line+"\r\n"), br)))
+}
+
+// respond adapts a (result, error) pair to a JSON response.
+func respond(w http.ResponseWriter) func(interface{}, error) {
+	return func(v interface{}, err error) {
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, v)
+	}
+}
+
+// decodeRaw decodes the base64url raw message of a JSON request.
+func decodeRaw(w http.ResponseWriter, s string) (io.Reader, bool) {
+	raw, err := decode(s)
+	if err != nil {
+		writeError(w, apiError("decode request", http.StatusBadRequest, errors.New("invalid raw message: "+err.Error())))
+		return nil, false
+	}
+	return bytes.NewReader(raw), true
+}
+
+// readUpload reads a media upload: with uploadType=multipart, JSON metadata
+// decoded into v followed by the media; with uploadType=media, the media
+// alone. Resumable uploads, which the client only uses for media over its
+// 16MB chunk size, are not supported.
+func readUpload(w http.ResponseWriter, r *http.Request, v interface{}) (io.Reader, bool) {
+	switch uploadType := r.URL.Query().Get("uploadType"); uploadType {
+	case "media":
+		return r.Body, true
+	case "multipart":
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+			writeError(w, apiError("decode request", http.StatusBadRequest, errors.New("multipart upload without a multipart body")))
+			return nil, false
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		metadata, err := mr.NextPart()
+		if err == nil {
+			err = json.NewDecoder(metadata).Decode(v)
+		}
+		if err != nil {
+			writeError(w, apiError("decode request", http.StatusBadRequest, err))
+			return nil, false
+		}
+		media, err := mr.NextPart()
+		if err != nil {
+			writeError(w, apiError("decode request", http.StatusBadRequest, errors.New("multipart upload without media")))
+			return nil, false
+		}
+		return media, true
+	default:
+		writeError(w, apiError("decode request", http.StatusBadRequest, errors.New("unsupported uploadType "+strconv.Quote(uploadType))))
+		return nil, false
+	}
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, apiError("decode request", http.StatusBadRequest, err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError renders err in Gmail's error format. Errors without an HTTP
+// status (e.g. from FailOn) are sent as 400 so the client doesn't retry them.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	message := err.Error()
+	var apiErr *common.APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.Status != 0 {
+			status = apiErr.Status
+		}
+		message = apiErr.Err.Error()
+	}
+
+	reason := map[int]string{
+		http.StatusBadRequest: "invalidArgument",
+		http.StatusForbidden:  "forbidden",
+		http.StatusNotFound:   "notFound",
+		http.StatusConflict:   "duplicate",
+	}[status]
+	if reason == "" {
+		reason = "backendError"
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": message,
+			"errors":  []map[string]string{{"domain": "global", "reason": reason, "message": message}},
+		},
+	})
+}
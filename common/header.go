@@ -0,0 +1,60 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// headerDecoder decodes RFC 2047 encoded-words in any charset mail clients
+// commonly use (ISO-2022-JP, Shift_JIS, windows-1252, ...), not just the
+// UTF-8 and Latin-1 the standard library knows.
+var headerDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// addressParser parses addresses, decoding encoded-word display names with
+// headerDecoder.
+var addressParser = &mail.AddressParser{WordDecoder: headerDecoder}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// DecodeHeader decodes the RFC 2047 encoded-words in an unstructured header
+// such as Subject. A header that doesn't decode is returned as it is.
+func DecodeHeader(s string) string {
+	if !strings.Contains(s, "=?") {
+		return s
+	}
+	decoded, err := headerDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+// decodeAddressHeader decodes encoded-word display names in an address
+// header. Decoding the header as plain text could turn an encoded comma into
+// a list separator, so the addresses are parsed and written back with their
+// names quoted as needed.
+func decodeAddressHeader(s string) string {
+	if !strings.Contains(s, "=?") {
+		return s
+	}
+	addrs, err := ParseAddressList(s)
+	if err != nil || len(addrs) == 0 {
+		return DecodeHeader(s)
+	}
+	parts := make([]string, len(addrs))
+	for i, a := range addrs {
+		parts[i] = a.Display()
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,37 @@
+package common
+
+import (
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestExtractHeadersDecodes(t *testing.T) {
+	msg := &gmail.Message{Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+		{Name: "Subject", Value: "=?UTF-8?B?Q1NW44Ko44Kv44K544Od44O844OI?= failed"},
+		{Name: "From", Value: "=?utf-8?q?Souza=2C_Ana?= <ana@customer.com>"},
+		{Name: "To", Value: "=?ISO-2022-JP?B?GyRCJUYlOSVIGyhC?= <test@example.jp>, help@blue.cc"},
+		{Name: "Cc", Value: "=?x-unknown?q?abc?= <x@y.com>"},
+		{Name: "Message-Id", Value: "<=?not-decoded?=@x>"},
+	}}}
+
+	h := ExtractHeaders(msg)
+	want := map[string]string{
+		"subject":    "CSVエクスポート failed",
+		"from":       `"Souza, Ana" <ana@customer.com>`,
+		"to":         "テスト <test@example.jp>, help@blue.cc",
+		"cc":         "=?x-unknown?q?abc?= <x@y.com>",
+		"message-id": "<=?not-decoded?=@x>",
+	}
+	for name, w := range want {
+		if h[name] != w {
+			t.Errorf("%s = %q, want %q", name, h[name], w)
+		}
+	}
+
+	// The decoded From still parses as one address, not two.
+	addrs, err := ParseAddressList(h["from"])
+	if err != nil || len(addrs) != 1 || addrs[0].Name != "Souza, Ana" {
+		t.Errorf("decoded From parses as %+v, %v", addrs, err)
+	}
+}
@@ -0,0 +1,267 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// ErrHistoryExpired is returned by History when Gmail no longer has records
+// back to the requested history ID (it keeps roughly a week). The caller has
+// to fall back to a full resync.
+var ErrHistoryExpired = errors.New("history ID is too old; full resync required")
+
+// Sync event types emitted by the sync and watch commands.
+const (
+	EventMessageAdded   = "message_added"
+	EventMessageDeleted = "message_deleted"
+	EventLabelsAdded    = "labels_added"
+	EventLabelsRemoved  = "labels_removed"
+	EventResync         = "resync"
+	EventCheckpoint     = "checkpoint"
+)
+
+// SyncEvent is one change to the mailbox, emitted as a line of NDJSON.
+type SyncEvent struct {
+	Type      string   `json:"type"`
+	MessageID string   `json:"message_id,omitempty"`
+	ThreadID  string   `json:"thread_id,omitempty"`
+	LabelIDs  []string `json:"label_ids,omitempty"`
+	HistoryID uint64   `json:"history_id,omitempty"`
+	Reason    string   `json:"reason,omitempty"`
+}
+
+// HistoryResult is every history record since a starting point, plus the
+// mailbox's current history ID to resume from next time.
+type HistoryResult struct {
+	Records   []*gmail.History
+	HistoryID uint64
+}
+
+// GetProfile returns the mailbox profile (address, totals, current history ID).
+func (c *GmailClient) GetProfile() (*gmail.Profile, error) {
+	profile, err := c.Service.Users.GetProfile(c.UserID).Do()
+	if err != nil {
+		return nil, wrapAPIError("retrieve profile", err)
+	}
+	return profile, nil
+}
+
+// History returns all history records after startHistoryID, following page
+// tokens. labelID, if set, restricts records to messages with that label.
+// It returns ErrHistoryExpired when Gmail reports the start ID as too old.
+func (c *GmailClient) History(startHistoryID uint64, labelID string) (*HistoryResult, error) {
+	result := &HistoryResult{HistoryID: startHistoryID}
+
+	pageToken := ""
+	for {
+		call := c.Service.Users.History.List(c.UserID).StartHistoryId(startHistoryID)
+		if labelID != "" {
+			call.LabelId(labelID)
+		}
+		if pageToken != "" {
+			call.PageToken(pageToken)
+		}
+
+		resp, err := call.Do()
+		if err != nil {
+			wrapped := wrapAPIError("retrieve history", err)
+			if errors.Is(wrapped, ErrNotFound) {
+				return nil, ErrHistoryExpired
+			}
+			return nil, wrapped
+		}
+
+		result.Records = append(result.Records, resp.History...)
+		if resp.HistoryId > result.HistoryID {
+			result.HistoryID = resp.HistoryId
+		}
+
+		if resp.NextPageToken == "" {
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+
+	return result, nil
+}
+
+// HistoryEvents flattens history records into sync events, in history order.
+func HistoryEvents(records []*gmail.History) []SyncEvent {
+	var events []SyncEvent
+	for _, h := range records {
+		for _, m := range h.MessagesAdded {
+			events = append(events, SyncEvent{
+				Type:      EventMessageAdded,
+				MessageID: m.Message.Id,
+				ThreadID:  m.Message.ThreadId,
+				LabelIDs:  m.Message.LabelIds,
+				HistoryID: h.Id,
+			})
+		}
+		for _, m := range h.MessagesDeleted {
+			events = append(events, SyncEvent{
+				Type:      EventMessageDeleted,
+				MessageID: m.Message.Id,
+				ThreadID:  m.Message.ThreadId,
+				HistoryID: h.Id,
+			})
+		}
+		for _, l := range h.LabelsAdded {
+			events = append(events, SyncEvent{
+				Type:      EventLabelsAdded,
+				MessageID: l.Message.Id,
+				ThreadID:  l.Message.ThreadId,
+				LabelIDs:  l.LabelIds,
+				HistoryID: h.Id,
+			})
+		}
+		for _, l := range h.LabelsRemoved {
+			events = append(events, SyncEvent{
+				Type:      EventLabelsRemoved,
+				MessageID: l.Message.Id,
+				ThreadID:  l.Message.ThreadId,
+				LabelIDs:  l.LabelIds,
+				HistoryID: h.Id,
+			})
+		}
+	}
+	return events
+}
+
+// Sync emits every change since startHistoryID and returns the history ID to
+// resume from next time. labelID, if set, limits the sync to messages with
+// that label. With no starting point, or when Gmail reports the starting point
+// as too old, it falls back to a full resync: a resync event, then a
+// message_added event (reason "resync") for every message currently matching,
+// up to resyncLimit (0 for all). Consumers should treat a resync event as
+// "rebuild your view".
+//
+// Sync does not persist anything; callers save the returned ID once the
+// events have been handled, so a failed run is simply repeated. When
+// resyncLimit cut a resync short the returned ID is 0: saving the mailbox's
+// current ID would skip the messages that were never emitted, so there is
+// nothing to checkpoint and the next run resyncs again.
+func (c *GmailClient) Sync(startHistoryID uint64, labelID string, resyncLimit int64, emit func(SyncEvent) error) (uint64, error) {
+	reason := "no_state"
+	if startHistoryID != 0 {
+		result, err := c.History(startHistoryID, labelID)
+		if err == nil {
+			for _, ev := range HistoryEvents(result.Records) {
+				if err := emit(ev); err != nil {
+					return 0, err
+				}
+			}
+			return result.HistoryID, nil
+		}
+		if !errors.Is(err, ErrHistoryExpired) {
+			return 0, err
+		}
+		reason = "history_expired"
+	}
+
+	// Capture the history ID before listing so anything that changes while
+	// we list is picked up by the next incremental run.
+	profile, err := c.GetProfile()
+	if err != nil {
+		return 0, err
+	}
+	if err := emit(SyncEvent{Type: EventResync, Reason: reason, HistoryID: profile.HistoryId}); err != nil {
+		return 0, err
+	}
+
+	it := c.NewMessageIterator("", resyncLimit, "")
+	if labelID != "" {
+		it.WithLabels(labelID)
+	}
+	for {
+		page, err := it.Next()
+		if err != nil {
+			return 0, err
+		}
+		if page == nil {
+			break
+		}
+		for _, m := range page {
+			ev := SyncEvent{Type: EventMessageAdded, MessageID: m.Id, ThreadID: m.ThreadId, Reason: "resync"}
+			if err := emit(ev); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if it.PageToken() != "" {
+		return 0, nil
+	}
+
+	return profile.HistoryId, nil
+}
+
+// SyncState is the checkpoint persisted between sync runs.
+type SyncState struct {
+	HistoryID uint64    `json:"history_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// syncStatePath returns where the sync checkpoint for name is stored.
+func syncStatePath(name string) string {
+	return filepath.Join(TokenDir(), name+".json")
+}
+
+// LoadSyncState reads the checkpoint stored under name. A missing file
+// returns a zero state and no error.
+func LoadSyncState(name string) (*SyncState, error) {
+	data, err := os.ReadFile(syncStatePath(name))
+	if os.IsNotExist(err) {
+		return &SyncState{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read sync state: %v", err)
+	}
+
+	state := &SyncState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("unable to parse sync state: %v", err)
+	}
+	return state, nil
+}
+
+// SaveSyncState writes the checkpoint under name, replacing the old file
+// atomically so an interrupted run never leaves a truncated checkpoint.
+func SaveSyncState(name string, state *SyncState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode sync state: %v", err)
+	}
+	if err := writeFileAtomic(syncStatePath(name), data, 0600); err != nil {
+		return fmt.Errorf("unable to save sync state: %v", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temp file in the same directory and
+// renames it over path.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
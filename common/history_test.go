@@ -0,0 +1,70 @@
+package common_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blue/support-agent/common"
+	"github.com/blue/support-agent/common/fakegmail"
+)
+
+// collectSync runs Sync and returns its events as "type:message:reason".
+func collectSync(t *testing.T, client *common.GmailClient, start uint64, labelID string, limit int64) ([]string, uint64) {
+	t.Helper()
+	var events []string
+	historyID, err := client.Sync(start, labelID, limit, func(ev common.SyncEvent) error {
+		events = append(events, ev.Type+":"+ev.MessageID+":"+ev.Reason)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	return events, historyID
+}
+
+func TestSyncIncremental(t *testing.T) {
+	mb := seedMailbox("m1")
+	client := newFakeClient(t, fakegmail.Handler(mb))
+	start := mb.Message("m1").HistoryId
+
+	mb.Add(fakegmail.Message{ID: "m2", Labels: []string{"INBOX"}})
+	mb.ModifyMessage("m1", nil, []string{"INBOX"})
+
+	events, historyID := collectSync(t, client, start, "", 0)
+	want := []string{"message_added:m2:", "labels_removed:m1:"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+	if profile, _ := mb.Profile(); historyID != profile.HistoryId {
+		t.Errorf("history ID = %d, want %d", historyID, profile.HistoryId)
+	}
+}
+
+func TestSyncResyncsExpiredHistory(t *testing.T) {
+	mb := seedMailbox("m1", "m2")
+	mb.Add(fakegmail.Message{ID: "spam", Labels: []string{"SPAM"}})
+	client := newFakeClient(t, fakegmail.Handler(mb))
+	start := mb.Message("m1").HistoryId
+	mb.ExpireHistory()
+	profile, _ := mb.Profile()
+
+	events, historyID := collectSync(t, client, start, "INBOX", 0)
+	want := []string{"resync::history_expired", "message_added:m2:resync", "message_added:m1:resync"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+	if historyID != profile.HistoryId {
+		t.Errorf("history ID = %d, want the mailbox's %d", historyID, profile.HistoryId)
+	}
+
+	// A resync that --limit cut short has no checkpoint to save.
+	events, historyID = collectSync(t, client, start, "INBOX", 1)
+	if len(events) != 2 || historyID != 0 {
+		t.Errorf("limited resync: events %v, history ID %d; want 2 events and 0", events, historyID)
+	}
+
+	// A limit that covers every message still checkpoints.
+	if _, historyID = collectSync(t, client, 0, "INBOX", 2); historyID != profile.HistoryId {
+		t.Errorf("resync within the limit: history ID = %d, want %d", historyID, profile.HistoryId)
+	}
+}
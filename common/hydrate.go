@@ -0,0 +1,57 @@
+package common
+
+import (
+	"sync"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// DefaultHydrateWorkers is the number of concurrent messages.get calls used
+// when hydrating a listing. Gmail's per-user rate limit comfortably absorbs
+// this many in-flight requests.
+const DefaultHydrateWorkers = 8
+
+// HydrateMessages fetches the full message for each stub returned by a list
+// call, using up to workers concurrent requests. The returned messages keep
+// the order of stubs; messages that could not be fetched are left out and
+// reported in the returned errors, also in list order.
+func (c *GmailClient) HydrateMessages(stubs []*gmail.Message, workers int) ([]*gmail.Message, []MessageError) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(stubs) {
+		workers = len(stubs)
+	}
+
+	full := make([]*gmail.Message, len(stubs))
+	errs := make([]error, len(stubs))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				full[i], errs[i] = c.GetMessage(stubs[i].Id)
+			}
+		}()
+	}
+	for i := range stubs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	messages := make([]*gmail.Message, 0, len(stubs))
+	var failures []MessageError
+	for i, msg := range full {
+		if errs[i] != nil {
+			failures = append(failures, MessageError{ID: stubs[i].Id, Error: errs[i].Error(), Kind: ErrorKindOf(errs[i])})
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, failures
+}
@@ -0,0 +1,102 @@
+package common_test
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blue/support-agent/common"
+	"github.com/blue/support-agent/common/fakegmail"
+	"google.golang.org/api/gmail/v1"
+)
+
+// concurrency counts the requests h is serving at once.
+type concurrency struct {
+	mu       sync.Mutex
+	current  int
+	max      int
+	requests int
+}
+
+func (c *concurrency) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		c.current++
+		c.requests++
+		c.max = max(c.max, c.current)
+		c.mu.Unlock()
+		// Hold the request long enough for the other workers to start theirs.
+		time.Sleep(10 * time.Millisecond)
+		h.ServeHTTP(w, r)
+		c.mu.Lock()
+		c.current--
+		c.mu.Unlock()
+	})
+}
+
+func TestHydrateMessages(t *testing.T) {
+	mb := seedMailbox("m1", "m2", "m3", "m4", "m5", "m6", "m7", "m8")
+	mb.FailOn("GetMessage m6", errors.New("backend hiccup"))
+
+	var stubs []*gmail.Message
+	for _, id := range []string{"m8", "gone1", "m2", "m6", "m5", "m1", "gone2", "m3", "m7", "m4"} {
+		stubs = append(stubs, &gmail.Message{Id: id})
+	}
+
+	tests := []struct {
+		workers int
+		max     int // most requests allowed in flight
+	}{
+		{workers: -3, max: 1},
+		{workers: 0, max: 1},
+		{workers: 1, max: 1},
+		{workers: 4, max: 4},
+		{workers: 50, max: len(stubs)},
+	}
+	for _, tt := range tests {
+		var c concurrency
+		client := newFakeClient(t, c.wrap(fakegmail.Handler(mb)))
+
+		msgs, failures := client.HydrateMessages(stubs, tt.workers)
+
+		if got, want := messageIDs(msgs), []string{"m8", "m2", "m5", "m1", "m3", "m7", "m4"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("workers %d: messages = %v, want %v", tt.workers, got, want)
+		}
+		for _, m := range msgs {
+			if m.Payload == nil {
+				t.Errorf("workers %d: %s is not the full message", tt.workers, m.Id)
+			}
+		}
+
+		var got []string
+		for _, f := range failures {
+			got = append(got, string(f.Kind)+":"+f.ID)
+		}
+		notFound, invalid := string(common.KindNotFound), string(common.KindInvalid)
+		want := []string{notFound + ":gone1", invalid + ":m6", notFound + ":gone2"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("workers %d: failures = %v, want %v", tt.workers, got, want)
+		}
+		if len(failures) == 3 && !strings.Contains(failures[1].Error, "backend hiccup") {
+			t.Errorf("workers %d: m6 error = %q", tt.workers, failures[1].Error)
+		}
+
+		if c.requests != len(stubs) {
+			t.Errorf("workers %d: %d requests, want one per stub", tt.workers, c.requests)
+		}
+		if c.max > tt.max {
+			t.Errorf("workers %d: %d requests in flight, want at most %d", tt.workers, c.max, tt.max)
+		}
+		if tt.max > 1 && c.max < 2 {
+			t.Errorf("workers %d: requests never overlapped", tt.workers)
+		}
+	}
+
+	if msgs, failures := newFakeClient(t, fakegmail.Handler(mb)).HydrateMessages(nil, 4); len(msgs) != 0 || len(failures) != 0 {
+		t.Errorf("no stubs: got %v, %v", msgs, failures)
+	}
+}
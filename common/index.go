@@ -0,0 +1,219 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"unicode"
+
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/api/gmail/v1"
+)
+
+var (
+	bucketDocs     = []byte("index_docs")
+	bucketPostings = []byte("index_postings")
+)
+
+// Indexed fields. Each posting key is field code + term + 0x00 + message ID,
+// so a prefix scan over field code + term + 0x00 yields every message
+// containing the term in that field.
+const (
+	fieldSubject = 's'
+	fieldBody    = 'b'
+	fieldFrom    = 'f'
+	fieldTo      = 't'
+	fieldLabels  = 'l'
+)
+
+var indexedFields = []byte{fieldSubject, fieldBody, fieldFrom, fieldTo, fieldLabels}
+
+// fieldText returns the text of one indexed field of a document.
+func fieldText(doc *MessageInfo, field byte) string {
+	switch field {
+	case fieldSubject:
+		return doc.Subject
+	case fieldBody:
+		return doc.Body
+	case fieldFrom:
+		return doc.From
+	case fieldTo:
+		return strings.Join([]string{doc.To, doc.Cc}, " ")
+	case fieldLabels:
+		return strings.Join(doc.Labels, " ")
+	}
+	return ""
+}
+
+// tokenize lowercases s and splits it into runs of letters and digits.
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// IndexMessage adds or replaces a message in the local full-text index. The
+// stored document is the message's MessageInfo with its body, so local search
+// results have the same shape as Gmail ones.
+func (c *Cache) IndexMessage(msg *gmail.Message) error {
+	doc := NewMessageInfo(msg, true)
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		docs, err := tx.CreateBucketIfNotExists(bucketDocs)
+		if err != nil {
+			return err
+		}
+		postings, err := tx.CreateBucketIfNotExists(bucketPostings)
+		if err != nil {
+			return err
+		}
+		if err := unindex(docs, postings, doc.ID); err != nil {
+			return err
+		}
+		for _, key := range postingKeys(&doc) {
+			if err := postings.Put(key, nil); err != nil {
+				return err
+			}
+		}
+		return docs.Put([]byte(doc.ID), data)
+	})
+}
+
+// RemoveFromIndex drops a message from the full-text index.
+func (c *Cache) RemoveFromIndex(messageIDs []string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		docs, postings := tx.Bucket(bucketDocs), tx.Bucket(bucketPostings)
+		if docs == nil || postings == nil {
+			return nil
+		}
+		for _, id := range messageIDs {
+			if err := unindex(docs, postings, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// IndexedCount returns the number of messages in the full-text index.
+func (c *Cache) IndexedCount() int {
+	n := 0
+	c.db.View(func(tx *bolt.Tx) error {
+		if docs := tx.Bucket(bucketDocs); docs != nil {
+			n = docs.Stats().KeyN
+		}
+		return nil
+	})
+	return n
+}
+
+// unindex removes a document and its postings, if present.
+func unindex(docs, postings *bolt.Bucket, id string) error {
+	data := docs.Get([]byte(id))
+	if data == nil {
+		return nil
+	}
+	var old MessageInfo
+	if err := json.Unmarshal(data, &old); err == nil {
+		for _, key := range postingKeys(&old) {
+			if err := postings.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	return docs.Delete([]byte(id))
+}
+
+// postingKeys returns one key per distinct (field, term) in doc.
+func postingKeys(doc *MessageInfo) [][]byte {
+	var keys [][]byte
+	for _, field := range indexedFields {
+		seen := make(map[string]bool)
+		for _, term := range tokenize(fieldText(doc, field)) {
+			if seen[term] {
+				continue
+			}
+			seen[term] = true
+			keys = append(keys, postingKey(field, term, doc.ID))
+		}
+	}
+	return keys
+}
+
+func postingKey(field byte, term, id string) []byte {
+	key := make([]byte, 0, 2+len(term)+len(id))
+	key = append(key, field)
+	key = append(key, term...)
+	key = append(key, 0)
+	return append(key, id...)
+}
+
+// lookupTerm returns the IDs of messages containing term in any of fields.
+func lookupTerm(postings *bolt.Bucket, term string, fields []byte) map[string]bool {
+	ids := make(map[string]bool)
+	cur := postings.Cursor()
+	for _, field := range fields {
+		prefix := postingKey(field, term, "")
+		for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cur.Next() {
+			ids[string(k[len(prefix):])] = true
+		}
+	}
+	return ids
+}
+
+// SearchIndex runs a local query (see ParseLocalQuery) over the full-text
+// index and returns matching messages, newest first, up to limit (0 for all).
+// It never touches the network.
+func (c *Cache) SearchIndex(query string, limit int) ([]MessageInfo, error) {
+	q, err := ParseLocalQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []MessageInfo
+	err = c.db.View(func(tx *bolt.Tx) error {
+		docs, postings := tx.Bucket(bucketDocs), tx.Bucket(bucketPostings)
+		if docs == nil || postings == nil {
+			return nil
+		}
+
+		match := func(data []byte) {
+			var doc MessageInfo
+			if json.Unmarshal(data, &doc) == nil && q.Match(&doc) {
+				results = append(results, doc)
+			}
+		}
+
+		// Narrow the candidates with the postings of every required term,
+		// then verify phrases, proximity and regexes against the documents.
+		candidates := q.candidates(postings)
+		if candidates == nil {
+			return docs.ForEach(func(_, data []byte) error {
+				match(data)
+				return nil
+			})
+		}
+		for id := range candidates {
+			if data := docs.Get([]byte(id)); data != nil {
+				match(data)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Timestamp.After(results[j].Timestamp)
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
@@ -0,0 +1,126 @@
+package common
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// testMessage returns a full text/plain message as Gmail would return it.
+func testMessage(id, from, subject, body string, internalDate int64, labels ...string) *gmail.Message {
+	return &gmail.Message{
+		Id:           id,
+		ThreadId:     id,
+		LabelIds:     labels,
+		InternalDate: internalDate,
+		Payload: &gmail.MessagePart{
+			MimeType: "text/plain",
+			Headers: []*gmail.MessagePartHeader{
+				{Name: "From", Value: from},
+				{Name: "To", Value: "support@blue.cc"},
+				{Name: "Subject", Value: subject},
+			},
+			Body: &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte(body))},
+		},
+	}
+}
+
+// testCache opens a cache in a temporary directory.
+func testCache(t *testing.T) *Cache {
+	t.Helper()
+	testConfig(t)
+	cache, err := OpenCache(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cache.Close() })
+	return cache
+}
+
+func TestSearchIndex(t *testing.T) {
+	cache := testCache(t)
+	for _, msg := range []*gmail.Message{
+		testMessage("m1", "Jane <jane@customer.com>", "Refund request", "Please refund INV-1001.", 1000, "INBOX"),
+		testMessage("m2", "Ana <ana@customer.com>", "Export failed", "The CSV export failed twice.", 2000, "INBOX", "SPAM"),
+		testMessage("m3", "Jane <jane@customer.com>", "Re: Export failed", "Still no refund for the export.", 3000, "INBOX"),
+	} {
+		if err := cache.IndexMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		limit int
+		want  []string
+	}{
+		{"refund", 0, []string{"m3", "m1"}},
+		{"refund", 1, []string{"m3"}},
+		{"from:jane export", 0, []string{"m3"}},
+		{`"export failed"`, 0, []string{"m3", "m2"}},
+		{`body:"export failed"`, 0, []string{"m2"}},
+		{"export -label:spam", 0, []string{"m3"}},
+		{`/INV-\d+/`, 0, []string{"m1"}},
+		{"-label:spam", 0, []string{"m3", "m1"}},
+		{"nothing", 0, nil},
+	}
+	for _, tt := range tests {
+		results, err := cache.SearchIndex(tt.query, tt.limit)
+		if err != nil {
+			t.Errorf("SearchIndex(%q): %v", tt.query, err)
+			continue
+		}
+		var got []string
+		for _, r := range results {
+			got = append(got, r.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SearchIndex(%q, %d) = %v, want %v", tt.query, tt.limit, got, tt.want)
+		}
+	}
+
+	if _, err := cache.SearchIndex(`"unterminated`, 0); err == nil {
+		t.Error("SearchIndex with an invalid query succeeded")
+	}
+}
+
+func TestIndexMessageReplacesAndRemoves(t *testing.T) {
+	cache := testCache(t)
+	if err := cache.IndexMessage(testMessage("m1", "jane@customer.com", "Refund request", "refund please", 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.IndexMessage(testMessage("m1", "jane@customer.com", "Invoice question", "which invoice", 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(query string) int {
+		t.Helper()
+		results, err := cache.SearchIndex(query, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(results)
+	}
+	if n := search("refund"); n != 0 {
+		t.Errorf("old terms still match %d messages after reindexing", n)
+	}
+	if n := search("invoice"); n != 1 {
+		t.Errorf("new terms match %d messages, want 1", n)
+	}
+	if n := cache.IndexedCount(); n != 1 {
+		t.Errorf("IndexedCount = %d, want 1", n)
+	}
+
+	if err := cache.RemoveFromIndex([]string{"m1", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := search("invoice"); n != 0 {
+		t.Errorf("removed message still matches")
+	}
+	if n := cache.IndexedCount(); n != 0 {
+		t.Errorf("IndexedCount = %d after removal, want 0", n)
+	}
+}
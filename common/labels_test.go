@@ -0,0 +1,76 @@
+package common_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/blue/support-agent/common"
+	"github.com/blue/support-agent/common/fakegmail"
+)
+
+func TestResolveLabelNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		create  bool
+		want    []string
+		wantErr string
+		created []string // label names that should exist afterwards
+	}{
+		{name: "empty", names: nil, want: nil},
+		{name: "system labels any case", names: []string{"inbox", "Unread", "STARRED"}, want: []string{"INBOX", "UNREAD", "STARRED"}},
+		{name: "user label by name", names: []string{"billing"}, want: []string{"Label_1"}},
+		{name: "raw user label id", names: []string{"Label_99"}, want: []string{"Label_99"}},
+		{name: "blanks skipped", names: []string{" ", "Billing "}, want: []string{"Label_1"}},
+		{name: "unknown label", names: []string{"Refunds"}, wantErr: `label "Refunds" not found (available user labels: Billing, Support/Escalated)`},
+		{name: "create if missing", names: []string{"Refunds", "Billing"}, create: true, want: []string{"Label_3", "Label_1"}, created: []string{"Refunds"}},
+		{name: "create once for duplicates", names: []string{"Refunds", "refunds"}, create: true, want: []string{"Label_3", "Label_3"}, created: []string{"Refunds"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mb := fakegmail.New()
+			mb.AddLabel("Billing")           // Label_1
+			mb.AddLabel("Support/Escalated") // Label_2
+
+			got, err := common.ResolveLabelNames(mb, tt.names, tt.create)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveLabelNames: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+
+			labels, _ := mb.ListLabels()
+			for _, name := range tt.created {
+				found := false
+				for _, l := range labels {
+					found = found || l.Name == name
+				}
+				if !found {
+					t.Errorf("label %q was not created", name)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveLabelNamesSkipsListForSystemLabels(t *testing.T) {
+	mb := fakegmail.New()
+	mb.FailOn("ListLabels", errors.New("should not be called"))
+
+	if _, err := common.ResolveLabelNames(mb, []string{"INBOX", "Label_7"}, false); err != nil {
+		t.Fatalf("ResolveLabelNames: %v", err)
+	}
+	if _, err := common.ResolveLabelNames(mb, []string{"Billing"}, false); err == nil {
+		t.Fatal("expected the ListLabels failure for a user label")
+	}
+}
@@ -0,0 +1,222 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// LocalQuery is a parsed query for the local full-text index. It supports a
+// subset of Gmail's syntax plus what Gmail can't do:
+//
+//	refund invoice          every word must appear (any field)
+//	"export csv"            exact phrase
+//	"export failed"~5       all words, in order, at most 5 words apart
+//	/inv-\d{4,}/            regular expression (RE2) over the raw field text
+//	subject:refund          restrict to a field: from, to, cc, subject, body, label
+//	from:"jane doe"         fields take phrases and regexes too
+//	-label:spam             exclude matches
+//
+// Matching is case-insensitive except inside regexes (use (?i) there).
+type LocalQuery struct {
+	clauses []queryClause
+}
+
+type queryClause struct {
+	fields []byte         // fields to search; all of them if empty
+	terms  []string       // tokenized word or phrase
+	slop   int            // max extra words between phrase terms
+	re     *regexp.Regexp // set for /regex/ clauses instead of terms
+	negate bool
+}
+
+var queryFields = map[string][]byte{
+	"from":    {fieldFrom},
+	"to":      {fieldTo},
+	"cc":      {fieldTo},
+	"subject": {fieldSubject},
+	"body":    {fieldBody},
+	"label":   {fieldLabels},
+	"labels":  {fieldLabels},
+	"in":      {fieldLabels},
+}
+
+// ParseLocalQuery parses a local search query.
+func ParseLocalQuery(query string) (*LocalQuery, error) {
+	q := &LocalQuery{}
+	s := strings.TrimSpace(query)
+
+	for s != "" {
+		var c queryClause
+
+		if strings.HasPrefix(s, "-") && len(s) > 1 {
+			c.negate = true
+			s = s[1:]
+		}
+
+		if i := strings.IndexAny(s, ": \t\"/"); i > 0 && s[i] == ':' {
+			if fields, ok := queryFields[strings.ToLower(s[:i])]; ok {
+				c.fields = fields
+				s = s[i+1:]
+			}
+		}
+
+		switch {
+		case strings.HasPrefix(s, "\""):
+			end := strings.Index(s[1:], "\"")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated phrase in query: %s", s)
+			}
+			c.terms = tokenize(s[1 : end+1])
+			s = s[end+2:]
+			if strings.HasPrefix(s, "~") {
+				n := 1
+				for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+					n++
+				}
+				slop, err := strconv.Atoi(s[1:n])
+				if err != nil {
+					return nil, fmt.Errorf("invalid proximity %q in query", s[:n])
+				}
+				c.slop = slop
+				s = s[n:]
+			}
+
+		case strings.HasPrefix(s, "/"):
+			end := closingSlash(s)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated regex in query: %s", s)
+			}
+			re, err := regexp.Compile(strings.ReplaceAll(s[1:end], `\/`, "/"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex in query: %v", err)
+			}
+			c.re = re
+			s = s[end+1:]
+
+		default:
+			end := strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			c.terms = tokenize(s[:end])
+			s = s[end:]
+		}
+
+		s = strings.TrimSpace(s)
+		if c.re == nil && len(c.terms) == 0 {
+			continue
+		}
+		q.clauses = append(q.clauses, c)
+	}
+
+	if len(q.clauses) == 0 {
+		return nil, fmt.Errorf("query is empty")
+	}
+	return q, nil
+}
+
+// closingSlash returns the index of the unescaped '/' closing a regex that
+// starts at s[0], or -1.
+func closingSlash(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '/':
+			return i
+		}
+	}
+	return -1
+}
+
+// Match reports whether doc satisfies every clause.
+func (q *LocalQuery) Match(doc *MessageInfo) bool {
+	for _, c := range q.clauses {
+		if c.match(doc) == c.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *queryClause) match(doc *MessageInfo) bool {
+	fields := c.fields
+	if len(fields) == 0 {
+		fields = indexedFields
+	}
+	for _, field := range fields {
+		text := fieldText(doc, field)
+		if c.re != nil {
+			if c.re.MatchString(text) {
+				return true
+			}
+			continue
+		}
+		if matchPhrase(tokenize(text), c.terms, c.slop) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPhrase reports whether terms occur in tokens in order, with at most
+// slop extra tokens between the first and last term in total.
+func matchPhrase(tokens, terms []string, slop int) bool {
+	for start, tok := range tokens {
+		if tok != terms[0] {
+			continue
+		}
+		pos, ok := start, true
+		for _, term := range terms[1:] {
+			next := -1
+			for j := pos + 1; j < len(tokens) && j-start <= slop+len(terms)-1; j++ {
+				if tokens[j] == term {
+					next = j
+					break
+				}
+			}
+			if next < 0 {
+				ok = false
+				break
+			}
+			pos = next
+		}
+		if ok && pos-start-(len(terms)-1) <= slop {
+			return true
+		}
+	}
+	return false
+}
+
+// candidates intersects the postings of every term in required (non-negated,
+// non-regex) clauses. It returns nil when the query has no such clause and
+// every document has to be scanned.
+func (q *LocalQuery) candidates(postings *bolt.Bucket) map[string]bool {
+	var result map[string]bool
+	for _, c := range q.clauses {
+		if c.negate || c.re != nil {
+			continue
+		}
+		fields := c.fields
+		if len(fields) == 0 {
+			fields = indexedFields
+		}
+		for _, term := range c.terms {
+			ids := lookupTerm(postings, term, fields)
+			if result == nil {
+				result = ids
+				continue
+			}
+			for id := range result {
+				if !ids[id] {
+					delete(result, id)
+				}
+			}
+		}
+	}
+	return result
+}
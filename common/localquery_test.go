@@ -0,0 +1,94 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLocalQuery(t *testing.T) {
+	doc := &MessageInfo{
+		From:    "Jane Doe <jane@customer.com>",
+		To:      "support@blue.cc",
+		Subject: "Billing issue: refund for INV-20419",
+		Body:    "The CSV export failed again this morning, please look into the export.",
+		Labels:  []string{"INBOX", "billing"},
+	}
+
+	tests := []struct {
+		query string
+		match bool
+		err   string
+	}{
+		{query: "refund", match: true},
+		{query: "REFUND csv", match: true},
+		{query: "refund missing", match: false},
+		{query: `"failed export"`, match: false},
+		{query: `"csv export failed"`, match: true},
+		{query: `"export again"~1`, match: true},
+		{query: `"csv morning"~3`, match: false},
+		{query: `"csv morning"~4`, match: true},
+		{query: "subject:refund", match: true},
+		{query: "body:refund", match: false},
+		{query: `from:"jane doe"`, match: true},
+		{query: "to:jane", match: false},
+		{query: "label:billing", match: true},
+		{query: "-label:spam refund", match: true},
+		{query: "-label:billing", match: false},
+		{query: `/INV-\d{4,}/`, match: true},
+		{query: `/inv-\d{4,}/`, match: false},
+		{query: `/(?i)inv-\d{4,}/`, match: true},
+		{query: `subject:/^Billing/`, match: true},
+		{query: `body:/^Billing/`, match: false},
+		{query: `/a\/b/`, match: false},
+		{query: "unknown:refund", match: false},
+		{query: "", err: "query is empty"},
+		{query: "  - ", err: "query is empty"},
+		{query: `"export failed`, err: "unterminated phrase"},
+		{query: "/INV-", err: "unterminated regex"},
+		{query: "/[/", err: "invalid regex"},
+		{query: `"export"~x`, err: "invalid proximity"},
+	}
+	for _, tt := range tests {
+		q, err := ParseLocalQuery(tt.query)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ParseLocalQuery(%q) error = %v, want %q", tt.query, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseLocalQuery(%q): %v", tt.query, err)
+			continue
+		}
+		if got := q.Match(doc); got != tt.match {
+			t.Errorf("ParseLocalQuery(%q).Match = %v, want %v", tt.query, got, tt.match)
+		}
+	}
+}
+
+func TestMatchPhrase(t *testing.T) {
+	tokens := tokenize("the csv export failed and the export retried")
+
+	tests := []struct {
+		terms string
+		slop  int
+		want  bool
+	}{
+		{"csv", 0, true},
+		{"csv export", 0, true},
+		{"export csv", 0, false},
+		{"csv failed", 0, false},
+		{"csv failed", 1, true},
+		{"csv export failed", 0, true},
+		{"csv retried", 4, false},
+		{"csv retried", 5, true},
+		{"export retried", 0, true}, // second occurrence of "export"
+		{"missing", 10, false},
+		{"the and", 3, true},
+	}
+	for _, tt := range tests {
+		if got := matchPhrase(tokens, strings.Fields(tt.terms), tt.slop); got != tt.want {
+			t.Errorf("matchPhrase(%q, %d) = %v, want %v", tt.terms, tt.slop, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// LoginMethod selects how Login obtains the user's consent.
+type LoginMethod string
+
+const (
+	// LoginLoopback opens the consent page in a browser and receives the
+	// authorization code on a temporary 127.0.0.1 listener. It is the
+	// default, including over SSH: with NoBrowser the URL is printed along
+	// with how to forward the listener's port.
+	LoginLoopback LoginMethod = "loopback"
+	// LoginDevice shows a code to enter at google.com/device from any other
+	// device. It is opt-in: it needs an OAuth client of type "TVs and
+	// Limited Input devices", and Google's device flow does not allow the
+	// Gmail scopes, so it only works with clients Google has exempted.
+	LoginDevice LoginMethod = "device"
+)
+
+// DefaultLoginTimeout is how long Login waits for the user to finish consent.
+const DefaultLoginTimeout = 5 * time.Minute
+
+// LoginOptions configures Login.
+type LoginOptions struct {
+	Method    LoginMethod
+	Scope     ScopeClass    // scopes to request; "" means ScopeModify
+	NoBrowser bool          // print the consent URL without opening a browser
+	Timeout   time.Duration // 0 means DefaultLoginTimeout
+}
+
+// openBrowser opens url in the user's browser. Tests replace it.
+var openBrowser = func(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
+
+// Login runs the OAuth consent flow for the scope class in opts and saves the
+// resulting token in the profile's token store, replacing any existing token
+// of that class. Instructions are printed to stderr so stdout stays clean for
+// command output.
+func Login(opts LoginOptions) (*oauth2.Token, error) {
+	class := opts.Scope
+	if class == "" {
+		class = ScopeModify
+	}
+
+	if sa, err := serviceAccount(class); err != nil {
+		return nil, err
+	} else if sa != nil {
+		return nil, fmt.Errorf("this profile uses service account %s acting as %s; no login is needed", sa.Email, sa.Subject)
+	}
+
+	config, err := getOAuthConfig(class)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get OAuth config: %v", err)
+	}
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultLoginTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	tok, err := authorize(ctx, config, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := OpenTokenStore(ActiveProfileName(), class)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Save(tok); err != nil {
+		return nil, err
+	}
+	// A plaintext copy from before the store was configured is now stale.
+	if _, isFile := store.(*fileStore); !isFile {
+		plaintextTokenStore(ActiveProfileName(), class).Delete()
+	}
+	return tok, nil
+}
+
+// authorize obtains a token with the method selected in opts.
+func authorize(ctx context.Context, config *oauth2.Config, opts LoginOptions) (*oauth2.Token, error) {
+	switch opts.Method {
+	case LoginLoopback, "":
+		return loopbackLogin(ctx, config, opts.NoBrowser)
+	case LoginDevice:
+		return deviceLogin(ctx, config)
+	}
+	return nil, fmt.Errorf("unknown login method %q (use loopback or device)", opts.Method)
+}
+
+// loopbackResult is what the redirect handler received.
+type loopbackResult struct {
+	code string
+	err  error
+}
+
+// loopbackLogin implements the loopback redirect flow for installed apps
+// (RFC 8252): the consent page redirects to a one-shot listener on
+// 127.0.0.1, with a random state against CSRF and PKCE so an intercepted
+// code is useless on its own.
+func loopbackLogin(ctx context.Context, config *oauth2.Config, noBrowser bool) (*oauth2.Token, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+
+	state, err := randomState()
+	if err != nil {
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	// Google accepts any port on the loopback redirect for desktop clients.
+	cfg := *config
+	cfg.RedirectURL = fmt.Sprintf("http://%s/", listener.Addr())
+
+	results := make(chan loopbackResult, 1)
+	server := &http.Server{
+		Handler:           loopbackHandler(state, results),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go server.Serve(listener)
+	defer server.Shutdown(context.Background())
+
+	authURL := cfg.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
+	if noBrowser {
+		printLoopbackGuidance(os.Stderr, authURL, listener.Addr().(*net.TCPAddr).Port)
+	} else {
+		fmt.Fprintf(os.Stderr, "Opening the Google consent page. If your browser doesn't open, visit:\n\n  %s\n\n", authURL)
+		if err := openBrowser(authURL); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not open a browser: %v\n", err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Waiting for authorization...\n")
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("timed out waiting for authorization")
+	case res := <-results:
+		if res.err != nil {
+			return nil, res.err
+		}
+		tok, err := cfg.Exchange(ctx, res.code, oauth2.VerifierOption(verifier))
+		if err != nil {
+			return nil, fmt.Errorf("unable to exchange authorization code: %v", err)
+		}
+		return tok, nil
+	}
+}
+
+// printLoopbackGuidance prints the consent URL for a browser on another
+// machine. Google redirects that browser to 127.0.0.1:port, so the port must
+// reach this machine's listener: through an SSH tunnel, or by replaying the
+// redirect here.
+func printLoopbackGuidance(w io.Writer, authURL string, port int) {
+	fmt.Fprintf(w, "Open this URL in a browser and approve access:\n\n  %s\n\n", authURL)
+	fmt.Fprintf(w, "Google then redirects the browser to http://127.0.0.1:%d/ on this machine.\n", port)
+	fmt.Fprintf(w, "If the browser runs elsewhere (e.g. this is an SSH session), first forward the port from the browser's machine:\n\n")
+	fmt.Fprintf(w, "  ssh -L %d:127.0.0.1:%d <this-host>\n\n", port, port)
+	fmt.Fprintf(w, "or, after approving, copy the address the browser failed to load and run here:\n\n")
+	fmt.Fprintf(w, "  curl '<that address>'\n\n")
+}
+
+// loopbackHandler receives the OAuth redirect. Requests with the wrong state
+// are rejected without ending the login, so a stray or forged request can't
+// abort or hijack it; the first request with the right state delivers its
+// result.
+func loopbackHandler(state string, results chan<- loopbackResult) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 {
+			http.Error(w, "Invalid state parameter.", http.StatusBadRequest)
+			return
+		}
+
+		res := loopbackResult{code: q.Get("code")}
+		switch {
+		case q.Get("error") != "":
+			res.err = fmt.Errorf("authorization denied: %s", q.Get("error"))
+		case res.code == "":
+			res.err = fmt.Errorf("authorization response has no code")
+		}
+
+		select {
+		case results <- res:
+		default:
+			http.Error(w, "Authorization already received.", http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if res.err != nil {
+			fmt.Fprint(w, "<p>Authorization failed. You can close this window and check the terminal.</p>")
+			return
+		}
+		fmt.Fprint(w, "<p>Authorized support-agent. You can close this window.</p>")
+	})
+}
+
+// deviceLogin implements the OAuth device authorization grant (RFC 8628).
+func deviceLogin(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+	resp, err := config.DeviceAuth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start device authorization: %v (it needs a \"TVs and Limited Input devices\" client, and Google's device flow does not allow Gmail scopes for most clients; use auth login --no-browser instead)", err)
+	}
+
+	uri := resp.VerificationURIComplete
+	if uri == "" {
+		uri = resp.VerificationURI
+	}
+	fmt.Fprintf(os.Stderr, "On any device, visit:\n\n  %s\n\nand enter the code: %s\n\nWaiting for authorization...\n", uri, resp.UserCode)
+
+	tok, err := config.DeviceAccessToken(ctx, resp)
+	if err != nil {
+		return nil, fmt.Errorf("device authorization failed: %v (Google's device flow does not allow Gmail scopes for most clients; use auth login --no-browser instead)", err)
+	}
+	return tok, nil
+}
+
+// randomState returns an unguessable OAuth state value.
+func randomState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate state: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
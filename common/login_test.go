@@ -0,0 +1,217 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeOAuthServer issues a token for code "good-code" if the PKCE verifier
+// matches the challenge recorded from the consent URL.
+func fakeOAuthServer(t *testing.T, challenge *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "good-code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		if oauth2.S256ChallengeFromVerifier(r.Form.Get("code_verifier")) != *challenge {
+			http.Error(w, `{"error":"invalid_grant","error_description":"pkce"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "at", "refresh_token": "rt", "token_type": "Bearer", "expires_in": 3600,
+		})
+	}))
+}
+
+func TestLoopbackLogin(t *testing.T) {
+	var challenge string
+	tokenServer := fakeOAuthServer(t, &challenge)
+	defer tokenServer.Close()
+
+	config := &oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://accounts.example/auth", TokenURL: tokenServer.URL},
+		Scopes:   []string{"scope"},
+	}
+
+	orig := openBrowser
+	defer func() { openBrowser = orig }()
+	openBrowser = func(authURL string) error {
+		u, err := url.Parse(authURL)
+		if err != nil {
+			return err
+		}
+		q := u.Query()
+		challenge = q.Get("code_challenge")
+		if q.Get("code_challenge_method") != "S256" || q.Get("state") == "" || q.Get("state") == "state-token" {
+			t.Errorf("consent URL lacks PKCE or a random state: %s", authURL)
+		}
+		redirect := q.Get("redirect_uri")
+
+		// A forged callback with the wrong state is rejected and doesn't
+		// end the login.
+		resp, err := http.Get(redirect + "?code=evil&state=forged")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("forged callback status = %d, want 400", resp.StatusCode)
+		}
+
+		go func() {
+			resp, err := http.Get(redirect + "?code=good-code&state=" + url.QueryEscape(q.Get("state")))
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tok, err := loopbackLogin(ctx, config, false)
+	if err != nil {
+		t.Fatalf("loopbackLogin: %v", err)
+	}
+	if tok.AccessToken != "at" || tok.RefreshToken != "rt" {
+		t.Errorf("token = %+v", tok)
+	}
+}
+
+func TestLoopbackLoginDenied(t *testing.T) {
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: "https://accounts.example/auth", TokenURL: "http://127.0.0.1:1/"}}
+
+	orig := openBrowser
+	defer func() { openBrowser = orig }()
+	openBrowser = func(authURL string) error {
+		u, _ := url.Parse(authURL)
+		q := u.Query()
+		go func() {
+			resp, err := http.Get(q.Get("redirect_uri") + "?error=access_denied&state=" + url.QueryEscape(q.Get("state")))
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := loopbackLogin(ctx, config, false); err == nil || err.Error() != "authorization denied: access_denied" {
+		t.Fatalf("err = %v, want authorization denied", err)
+	}
+}
+
+func TestPrintLoopbackGuidance(t *testing.T) {
+	var buf bytes.Buffer
+	printLoopbackGuidance(&buf, "https://accounts.example/auth?x=1", 43117)
+	out := buf.String()
+	for _, want := range []string{"https://accounts.example/auth?x=1", "http://127.0.0.1:43117/", "ssh -L 43117:127.0.0.1:43117"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("guidance lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestAuthorizeDefaultsToLoopback(t *testing.T) {
+	// Over SSH and without a display the default is still the loopback flow;
+	// the device flow is opt-in.
+	t.Setenv("SSH_CONNECTION", "10.0.0.1 22 10.0.0.2 22")
+	t.Setenv("DISPLAY", "")
+	t.Setenv("WAYLAND_DISPLAY", "")
+
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: "https://accounts.example/auth", TokenURL: "http://127.0.0.1:1/", DeviceAuthURL: "http://127.0.0.1:1/device"}}
+	orig := openBrowser
+	defer func() { openBrowser = orig }()
+	openBrowser = func(authURL string) error {
+		u, _ := url.Parse(authURL)
+		q := u.Query()
+		go func() {
+			resp, err := http.Get(q.Get("redirect_uri") + "?error=access_denied&state=" + url.QueryEscape(q.Get("state")))
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := authorize(ctx, config, LoginOptions{}); err == nil || err.Error() != "authorization denied: access_denied" {
+		t.Fatalf("err = %v, want the loopback flow's denial", err)
+	}
+	if _, err := authorize(ctx, config, LoginOptions{Method: "auto"}); err == nil || !strings.Contains(err.Error(), "unknown login method") {
+		t.Errorf("auto method: err = %v, want unknown login method", err)
+	}
+}
+
+func TestGetOAuthConfigDeviceAuthURL(t *testing.T) {
+	testConfig(t).Credentials = `{"installed":{"client_id":"id","client_secret":"secret","auth_uri":"https://accounts.google.com/o/oauth2/auth","token_uri":"https://oauth2.googleapis.com/token","redirect_uris":["http://localhost"]}}`
+	config, err := getOAuthConfig(ScopeRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Endpoint.DeviceAuthURL == "" {
+		t.Error("DeviceAuthURL is empty, so device logins can't start")
+	}
+}
+
+func TestDeviceLogin(t *testing.T) {
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/device/code":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"device_code": "dev-code", "user_code": "ABCD-EFGH", "verification_url": "https://www.google.com/device",
+				"expires_in": 60, "interval": 1,
+			})
+		case "/token":
+			if r.Form.Get("device_code") != "dev-code" {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+			if polls++; polls == 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"authorization_pending"}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": "at", "refresh_token": "rt", "token_type": "Bearer", "expires_in": 3600,
+			})
+		}
+	}))
+	defer server.Close()
+
+	config := &oauth2.Config{
+		ClientID: "id",
+		Endpoint: oauth2.Endpoint{
+			DeviceAuthURL: server.URL + "/device/code",
+			TokenURL:      server.URL + "/token",
+			AuthStyle:     oauth2.AuthStyleInParams,
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tok, err := deviceLogin(ctx, config)
+	if err != nil {
+		t.Fatalf("deviceLogin: %v", err)
+	}
+	if tok.RefreshToken != "rt" || polls != 2 {
+		t.Errorf("token = %+v after %d polls, want the refresh token after waiting once", tok, polls)
+	}
+}
@@ -0,0 +1,153 @@
+package common
+
+import (
+	"google.golang.org/api/gmail/v1"
+)
+
+// maxPageSize is the largest page Users.Messages.List will return.
+const maxPageSize = 500
+
+// MessageList is the result of a paginated listing. NextPageToken is empty
+// once the listing is exhausted; otherwise it can be passed back as a page
+// token to resume exactly where this listing stopped.
+type MessageList struct {
+	Messages           []*gmail.Message
+	NextPageToken      string
+	ResultSizeEstimate int64
+}
+
+// MessageIterator walks Users.Messages.List page by page, following
+// NextPageToken until the limit is reached or the listing is exhausted.
+//
+// Page sizes are trimmed so the last page ends exactly at the limit. That way
+// the token returned by PageToken never skips messages that were listed but
+// not returned, and a later run can resume from it without gaps.
+type MessageIterator struct {
+	client    *GmailClient
+	query     string
+	labelIDs  []string
+	limit     int64 // 0 means no limit
+	pageToken string
+	fetched   int64
+	estimate  int64
+	done      bool
+}
+
+// NewMessageIterator returns an iterator over messages matching query. A limit
+// of 0 or less lists every match. pageToken resumes a previous listing; pass
+// "" to start from the beginning.
+func (c *GmailClient) NewMessageIterator(query string, limit int64, pageToken string) *MessageIterator {
+	if limit < 0 {
+		limit = 0
+	}
+	return &MessageIterator{
+		client:    c,
+		query:     query,
+		limit:     limit,
+		pageToken: pageToken,
+	}
+}
+
+// WithLabels restricts the listing to messages carrying all of labelIDs.
+// Unlike a label: query term it takes label IDs, so it also works for user
+// labels whose names need quoting. Call it before the first Next.
+func (it *MessageIterator) WithLabels(labelIDs ...string) *MessageIterator {
+	it.labelIDs = labelIDs
+	return it
+}
+
+// Next returns the next page of message stubs (ID and thread ID only). It
+// returns nil, nil once the limit is reached or there are no more pages.
+func (it *MessageIterator) Next() ([]*gmail.Message, error) {
+	if it.done {
+		return nil, nil
+	}
+
+	pageSize := int64(maxPageSize)
+	if it.limit > 0 {
+		remaining := it.limit - it.fetched
+		if remaining <= 0 {
+			it.done = true
+			return nil, nil
+		}
+		if remaining < pageSize {
+			pageSize = remaining
+		}
+	}
+
+	call := it.client.Service.Users.Messages.List(it.client.UserID).MaxResults(pageSize)
+	if it.query != "" {
+		call.Q(it.query)
+	}
+	if len(it.labelIDs) > 0 {
+		call.LabelIds(it.labelIDs...)
+	}
+	if it.pageToken != "" {
+		call.PageToken(it.pageToken)
+	}
+
+	response, err := call.Do()
+	if err != nil {
+		return nil, wrapAPIError("retrieve messages", err)
+	}
+
+	it.fetched += int64(len(response.Messages))
+	it.pageToken = response.NextPageToken
+	if it.estimate == 0 {
+		it.estimate = response.ResultSizeEstimate
+	}
+	if it.pageToken == "" || (it.limit > 0 && it.fetched >= it.limit) {
+		it.done = true
+	}
+
+	// An empty page can still carry a token; return a non-nil slice so callers
+	// only stop on nil.
+	if response.Messages == nil {
+		return []*gmail.Message{}, nil
+	}
+	return response.Messages, nil
+}
+
+// PageToken returns the token to resume listing after the last page returned
+// by Next, or "" if the listing is exhausted.
+func (it *MessageIterator) PageToken() string {
+	return it.pageToken
+}
+
+// ResultSizeEstimate returns Gmail's estimate of the total number of matches,
+// as reported with the first page.
+func (it *MessageIterator) ResultSizeEstimate() int64 {
+	return it.estimate
+}
+
+// ListMessages lists messages matching query, following page tokens until
+// limit messages have been collected. A limit of 0 or less lists every match.
+// pageToken resumes a previous listing.
+func (c *GmailClient) ListMessages(query string, limit int64, pageToken string) (*MessageList, error) {
+	it := c.NewMessageIterator(query, limit, pageToken)
+
+	list := &MessageList{}
+	for {
+		page, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		if page == nil {
+			break
+		}
+		list.Messages = append(list.Messages, page...)
+	}
+
+	list.NextPageToken = it.PageToken()
+	list.ResultSizeEstimate = it.ResultSizeEstimate()
+	return list, nil
+}
+
+// MessageIDs returns the IDs of a list of message stubs.
+func MessageIDs(messages []*gmail.Message) []string {
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		ids[i] = m.Id
+	}
+	return ids
+}
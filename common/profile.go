@@ -0,0 +1,206 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// DefaultProfile is the profile used when none is selected. It keeps its
+// token and state directly in the base directory, as before profiles existed.
+const DefaultProfile = "default"
+
+// Profile holds the settings of one mailbox. Each profile has its own
+// directory (see ProfileDir) for its token, cache and sync state, and an
+// optional profile.json with the fields below.
+type Profile struct {
+	Name string `json:"-"`
+
+	// CredentialsPath is the OAuth client file. Empty uses the
+	// credentials / credentials_path configuration.
+	CredentialsPath string `json:"credentials_path,omitempty"`
+	// ServiceAccountKey is a service account JSON key used instead of an
+	// OAuth user token; empty uses the service_account_key configuration. The account
+	// needs domain-wide delegation for the Gmail scope.
+	ServiceAccountKey string `json:"service_account_key,omitempty"`
+	// Impersonate is the Workspace user a service account acts as.
+	Impersonate string `json:"impersonate,omitempty"`
+	// UserID is the mailbox to act on: "me" (the authorized account) or
+	// an address the account has access to.
+	UserID string `json:"user_id,omitempty"`
+	// InternalDomains are the email domains, with their subdomains, treated
+	// as staff rather than customers.
+	InternalDomains []string `json:"internal_domains,omitempty"`
+	// StaffAddresses are further addresses treated as staff, e.g.
+	// contractors on their own domains.
+	StaffAddresses []string `json:"staff_addresses,omitempty"`
+	// Signature is appended to replies, drafts and new messages.
+	Signature string `json:"signature,omitempty"`
+	// Quote makes replies and drafts quote the message they answer by
+	// default.
+	Quote bool `json:"quote,omitempty"`
+	// QuoteLines limits how many lines of the original are quoted; zero
+	// quotes all of it.
+	QuoteLines int `json:"quote_lines,omitempty"`
+	// Labels are what read-messages lists when no filter is given, instead
+	// of the inbox.
+	Labels []string `json:"labels,omitempty"`
+}
+
+var validProfileName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// ActiveProfileName returns the name of the selected profile: --profile,
+// else the profile configuration, else DefaultProfile.
+func ActiveProfileName() string {
+	if name := Settings().Profile; name != "" {
+		return name
+	}
+	return DefaultProfile
+}
+
+// baseDir returns the token_dir configuration, default ~/.support-agent.
+func baseDir() string {
+	return Settings().TokenDir
+}
+
+// ProfileDir returns the directory holding a profile's settings, token and
+// local state.
+func ProfileDir(name string) string {
+	if name == DefaultProfile {
+		return baseDir()
+	}
+	return filepath.Join(baseDir(), "profiles", name)
+}
+
+func profilePath(name string) string {
+	return filepath.Join(ProfileDir(name), "profile.json")
+}
+
+var (
+	profileMu     sync.Mutex
+	loadedProfile *Profile
+	loadedFrom    string
+)
+
+// CurrentProfile returns the active profile with defaults filled in. A named
+// profile must have been created with "profiles add"; the default profile
+// needs no profile.json.
+func CurrentProfile() (*Profile, error) {
+	name := ActiveProfileName()
+
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	if loadedProfile != nil && loadedFrom == profilePath(name) {
+		return loadedProfile, nil
+	}
+
+	p, err := LoadProfile(name)
+	if err != nil {
+		return nil, err
+	}
+	loadedProfile, loadedFrom = p, profilePath(name)
+	return p, nil
+}
+
+// LoadProfile reads the named profile and fills in defaults.
+func LoadProfile(name string) (*Profile, error) {
+	if !validProfileName.MatchString(name) {
+		return nil, fmt.Errorf("invalid profile name %q (use letters, digits, '.', '_' and '-')", name)
+	}
+
+	p := &Profile{Name: name}
+	data, err := os.ReadFile(profilePath(name))
+	switch {
+	case os.IsNotExist(err) && name == DefaultProfile:
+	case os.IsNotExist(err):
+		return nil, fmt.Errorf("unknown profile %q (see 'support-agent profiles list')", name)
+	case err != nil:
+		return nil, fmt.Errorf("unable to read profile %s: %v", name, err)
+	default:
+		if err := json.Unmarshal(data, p); err != nil {
+			return nil, fmt.Errorf("unable to parse profile %s: %v", name, err)
+		}
+		if err := validateDomains(p.InternalDomains); err != nil {
+			return nil, fmt.Errorf("profile %s: internal_domains: %v", name, err)
+		}
+		if err := validateAddresses(p.StaffAddresses); err != nil {
+			return nil, fmt.Errorf("profile %s: staff_addresses: %v", name, err)
+		}
+		if p.QuoteLines < 0 {
+			return nil, fmt.Errorf("profile %s: quote_lines must not be negative", name)
+		}
+	}
+
+	if p.UserID == "" {
+		p.UserID = "me"
+	}
+	if len(p.InternalDomains) == 0 {
+		p.InternalDomains = Settings().InternalDomains
+	}
+	if len(p.StaffAddresses) == 0 {
+		p.StaffAddresses = Settings().StaffAddresses
+	}
+	return p, nil
+}
+
+// SaveProfile writes p to its profile.json, creating the profile directory.
+// Fields left at their defaults are omitted.
+func SaveProfile(p *Profile) error {
+	if !validProfileName.MatchString(p.Name) {
+		return fmt.Errorf("invalid profile name %q (use letters, digits, '.', '_' and '-')", p.Name)
+	}
+	if err := validateDomains(p.InternalDomains); err != nil {
+		return fmt.Errorf("invalid internal domain: %v", err)
+	}
+	if err := validateAddresses(p.StaffAddresses); err != nil {
+		return fmt.Errorf("invalid staff address: %v", err)
+	}
+	if p.QuoteLines < 0 {
+		return fmt.Errorf("invalid quote lines %d: must not be negative", p.QuoteLines)
+	}
+	if err := os.MkdirAll(ProfileDir(p.Name), 0700); err != nil {
+		return fmt.Errorf("unable to create profile directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode profile: %v", err)
+	}
+	if err := writeFileAtomic(profilePath(p.Name), append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("unable to save profile: %v", err)
+	}
+	return nil
+}
+
+// ProfileNames returns the default profile followed by every named profile,
+// sorted.
+func ProfileNames() ([]string, error) {
+	names := []string{DefaultProfile}
+	entries, err := os.ReadDir(filepath.Join(baseDir(), "profiles"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to list profiles: %v", err)
+	}
+
+	var named []string
+	for _, e := range entries {
+		if !e.IsDir() || !validProfileName.MatchString(e.Name()) || e.Name() == DefaultProfile {
+			continue
+		}
+		if _, err := os.Stat(profilePath(e.Name())); err == nil {
+			named = append(named, e.Name())
+		}
+	}
+	sort.Strings(named)
+	return append(names, named...), nil
+}
+
+// HasToken reports whether the named profile has a saved OAuth token of any
+// scope class.
+func HasToken(name string) bool {
+	_, _, err := loadProfileToken(name, ScopeRead)
+	return err == nil
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProfiles(t *testing.T) {
+	config := testConfig(t)
+	base := config.TokenDir
+
+	def, err := LoadProfile(DefaultProfile)
+	if err != nil {
+		t.Fatalf("default profile without profile.json: %v", err)
+	}
+	if def.UserID != "me" || !reflect.DeepEqual(def.InternalDomains, []string{DefaultInternalDomain}) {
+		t.Errorf("default profile = %+v, want defaults filled in", def)
+	}
+
+	if _, err := LoadProfile("billing"); err == nil {
+		t.Error("loading a profile that was never added should fail")
+	}
+	if err := SaveProfile(&Profile{Name: "../escape"}); err == nil {
+		t.Error("saving a profile with a path in its name should fail")
+	}
+
+	want := &Profile{Name: "billing", UserID: "billing@blue.cc", InternalDomains: []string{"blue.io"}, StaffAddresses: []string{"pat@contractor.dev"}, Signature: "Billing team", Labels: []string{"Billing"}}
+	if err := SaveProfile(want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadProfile("billing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded %+v, want %+v", got, want)
+	}
+
+	names, err := ProfileNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{DefaultProfile, "billing"}) {
+		t.Errorf("ProfileNames() = %v", names)
+	}
+
+	config.Profile = "billing"
+	if dir := TokenDir(); dir != filepath.Join(base, "profiles", "billing") {
+		t.Errorf("TokenDir() = %s, want the billing profile directory", dir)
+	}
+	if !IsInternalAddress("Dana <dana@blue.io>") || !IsInternalAddress("pat@contractor.dev") || IsInternalAddress("ana@blue.cc") {
+		t.Error("IsInternalAddress should use the active profile's staff")
+	}
+}
@@ -0,0 +1,138 @@
+package common
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// PushNotification is the payload Gmail publishes to Pub/Sub when a watched
+// mailbox changes.
+type PushNotification struct {
+	EmailAddress string `json:"emailAddress"`
+	HistoryID    uint64 `json:"historyId"`
+}
+
+// pushEnvelope is the body Pub/Sub POSTs to a push subscription endpoint.
+type pushEnvelope struct {
+	Message struct {
+		Data      string `json:"data"`
+		MessageID string `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// PushHandler receives Pub/Sub push deliveries for Gmail watch notifications
+// and forwards the decoded notifications on Notifications. If Token is set,
+// requests must carry it as the "token" query parameter (configure the push
+// subscription endpoint as https://host/path?token=SECRET).
+//
+// Notifications is buffered and never blocks the HTTP response: when the
+// consumer is busy the notification is dropped, which is safe because each
+// notification only means "something changed since historyId" and the next
+// sync picks up everything anyway.
+type PushHandler struct {
+	Token         string
+	Notifications chan PushNotification
+}
+
+// NewPushHandler returns a handler with a small notification buffer.
+func NewPushHandler(token string) *PushHandler {
+	return &PushHandler{
+		Token:         token,
+		Notifications: make(chan PushNotification, 16),
+	}
+}
+
+func (h *PushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.Token != "" && subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(h.Token)) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	n, err := DecodePushNotification(r)
+	if err != nil {
+		// Pub/Sub redelivers on non-2xx; a malformed body will never parse,
+		// so reject it with 400 and let the subscription's dead-lettering
+		// deal with it.
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case h.Notifications <- *n:
+	default:
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DecodePushNotification parses a Pub/Sub push request body into the Gmail
+// notification it carries.
+func DecodePushNotification(r *http.Request) (*PushNotification, error) {
+	var env pushEnvelope
+	if err := json.NewDecoder(r.Body).Decode(&env); err != nil {
+		return nil, fmt.Errorf("invalid push envelope: %v", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(env.Message.Data)
+	if err != nil {
+		// Some emulators use URL-safe encoding.
+		if data, err = decodeBase64URL(env.Message.Data); err != nil {
+			return nil, fmt.Errorf("invalid push message data: %v", err)
+		}
+	}
+
+	n := &PushNotification{}
+	if err := json.Unmarshal(data, n); err != nil {
+		return nil, fmt.Errorf("invalid Gmail notification: %v", err)
+	}
+	if n.HistoryID == 0 {
+		return nil, fmt.Errorf("Gmail notification has no historyId")
+	}
+	return n, nil
+}
+
+// EncodePushNotification builds a Pub/Sub push request body carrying n. It
+// is what a local stand-in for Pub/Sub (or a curl command) posts to the watch
+// endpoint.
+func EncodePushNotification(n PushNotification, subscription string) ([]byte, error) {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+	var env pushEnvelope
+	env.Message.Data = base64.StdEncoding.EncodeToString(data)
+	env.Message.MessageID = fmt.Sprintf("local-%d", n.HistoryID)
+	env.Subscription = subscription
+	return json.Marshal(env)
+}
+
+// Watch asks Gmail to publish change notifications for labelIDs to a Pub/Sub
+// topic. The watch expires after 7 days and must be renewed.
+func (c *GmailClient) Watch(topic string, labelIDs []string) (*gmail.WatchResponse, error) {
+	req := &gmail.WatchRequest{
+		TopicName:         topic,
+		LabelIds:          labelIDs,
+		LabelFilterAction: "include",
+	}
+	resp, err := c.Service.Users.Watch(c.UserID, req).Do()
+	if err != nil {
+		return nil, wrapAPIError("start watch", err)
+	}
+	return resp, nil
+}
+
+// StopWatch stops push notifications for the mailbox.
+func (c *GmailClient) StopWatch() error {
+	if err := c.Service.Users.Stop(c.UserID).Do(); err != nil {
+		return wrapAPIError("stop watch", err)
+	}
+	return nil
+}
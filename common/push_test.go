@@ -0,0 +1,73 @@
+package common
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// postPush delivers body to the handler the way a Pub/Sub push subscription
+// would, returning the response status.
+func postPush(t *testing.T, url string, body []byte) int {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestPushHandler(t *testing.T) {
+	handler := NewPushHandler("s3cret")
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	body, err := EncodePushNotification(PushNotification{EmailAddress: "help@blue.cc", HistoryID: 4242}, "projects/p/subscriptions/s")
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		url    string
+		body   []byte
+		status int
+	}{
+		{"valid", server.URL + "?token=s3cret", body, http.StatusNoContent},
+		{"missing token", server.URL, body, http.StatusForbidden},
+		{"wrong token", server.URL + "?token=nope", body, http.StatusForbidden},
+		{"malformed envelope", server.URL + "?token=s3cret", []byte("{"), http.StatusBadRequest},
+		{"no history id", server.URL + "?token=s3cret", []byte(`{"message":{"data":"e30="}}`), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := postPush(t, tt.url, tt.body); got != tt.status {
+				t.Errorf("status = %d, want %d", got, tt.status)
+			}
+		})
+	}
+
+	select {
+	case n := <-handler.Notifications:
+		if n.HistoryID != 4242 || n.EmailAddress != "help@blue.cc" {
+			t.Errorf("notification = %+v", n)
+		}
+	default:
+		t.Fatal("valid push produced no notification")
+	}
+	select {
+	case n := <-handler.Notifications:
+		t.Errorf("unexpected extra notification %+v", n)
+	default:
+	}
+}
+
+func TestPushHandlerRejectsGet(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewPushHandler("").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,179 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GmailUserQuotaPerSecond is Gmail's per-user rate limit in quota units.
+const GmailUserQuotaPerSecond = 250
+
+// DefaultQuota tracks quota units for every request made through an
+// authenticated client in this process.
+var DefaultQuota = NewQuotaTracker(GmailUserQuotaPerSecond)
+
+// QuotaUsage summarizes the quota units spent for one mailbox user.
+type QuotaUsage struct {
+	User     string `json:"user"`
+	Units    int64  `json:"units"`
+	Requests int64  `json:"requests"`
+}
+
+// QuotaTracker accounts for Gmail quota units per user and paces requests so
+// a user stays under the per-second limit. Each user gets a token bucket
+// holding one second's worth of units; a request that doesn't fit waits for
+// the bucket to refill instead of being rejected by Gmail with a 429.
+type QuotaTracker struct {
+	mu    sync.Mutex
+	rate  float64 // units per second
+	users map[string]*userQuota
+}
+
+type userQuota struct {
+	used     int64
+	requests int64
+	tokens   float64
+	last     time.Time
+}
+
+// NewQuotaTracker returns a tracker allowing unitsPerSecond per user.
+func NewQuotaTracker(unitsPerSecond int) *QuotaTracker {
+	return &QuotaTracker{
+		rate:  float64(unitsPerSecond),
+		users: make(map[string]*userQuota),
+	}
+}
+
+// Acquire records units against user, first waiting until the user's bucket
+// has room for them. It returns early with the context's error if ctx is done.
+func (q *QuotaTracker) Acquire(ctx context.Context, user string, units int) error {
+	for {
+		wait := q.reserve(user, float64(units))
+		if wait <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reserve takes units from user's bucket if they fit and returns 0, or
+// returns how long to wait before trying again.
+func (q *QuotaTracker) reserve(user string, units float64) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	u, ok := q.users[user]
+	if !ok {
+		u = &userQuota{tokens: q.rate, last: now}
+		q.users[user] = u
+	}
+
+	u.tokens += now.Sub(u.last).Seconds() * q.rate
+	if u.tokens > q.rate {
+		u.tokens = q.rate
+	}
+	u.last = now
+
+	// A single request larger than the whole bucket can never fit; let it
+	// through once the bucket is full rather than blocking forever.
+	need := units
+	if need > q.rate {
+		need = q.rate
+	}
+	if u.tokens < need {
+		return time.Duration((need - u.tokens) / q.rate * float64(time.Second))
+	}
+
+	u.tokens -= units
+	u.used += int64(units)
+	u.requests++
+	return 0
+}
+
+// Usage returns the units spent so far per user, sorted by user.
+func (q *QuotaTracker) Usage() []QuotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage := make([]QuotaUsage, 0, len(q.users))
+	for user, u := range q.users {
+		usage = append(usage, QuotaUsage{User: user, Units: u.used, Requests: u.requests})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].User < usage[j].User })
+	return usage
+}
+
+// quotaCost returns the mailbox user and quota units for a Gmail REST
+// request, based on the published per-method costs. ok is false for
+// requests that aren't per-user Gmail calls (token refreshes, batch
+// envelopes, whose items are charged individually).
+func quotaCost(req *http.Request) (user string, units int, ok bool) {
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	i := 0
+	for i < len(segments) && segments[i] != "users" {
+		i++
+	}
+	if i+1 >= len(segments) || strings.Contains(req.URL.Path, "/batch/") {
+		return "", 0, false
+	}
+	user = segments[i+1]
+	rest := segments[i+2:]
+	if len(rest) == 0 {
+		return user, 5, true
+	}
+
+	get := req.Method == http.MethodGet
+	switch rest[0] {
+	case "messages":
+		switch {
+		case len(rest) == 1 && get:
+			return user, 5, true // list
+		case len(rest) == 1:
+			return user, 25, true // insert
+		case rest[1] == "send":
+			return user, 100, true
+		case rest[1] == "import":
+			return user, 25, true
+		case rest[1] == "batchModify", rest[1] == "batchDelete":
+			return user, 50, true
+		case len(rest) == 2 && req.Method == http.MethodDelete:
+			return user, 10, true
+		}
+		return user, 5, true // get, modify, trash, attachments.get
+	case "threads":
+		return user, 10, true
+	case "drafts":
+		switch {
+		case len(rest) > 1 && rest[1] == "send":
+			return user, 100, true
+		case len(rest) == 1 && get:
+			return user, 5, true // list
+		}
+		return user, 10, true
+	case "labels":
+		if get {
+			return user, 1, true
+		}
+		return user, 5, true
+	case "history":
+		return user, 2, true
+	case "profile":
+		return user, 1, true
+	case "watch":
+		return user, 100, true
+	case "stop":
+		return user, 50, true
+	}
+	return user, 5, true
+}
@@ -0,0 +1,99 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestQuotaCost(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		user   string
+		units  int
+		ok     bool
+	}{
+		{"GET", "/gmail/v1/users/me/messages", "me", 5, true},
+		{"GET", "/gmail/v1/users/me/messages/m1", "me", 5, true},
+		{"GET", "/gmail/v1/users/me/messages/m1/attachments/a1", "me", 5, true},
+		{"POST", "/gmail/v1/users/me/messages/m1/modify", "me", 5, true},
+		{"POST", "/gmail/v1/users/me/messages", "me", 25, true},
+		{"POST", "/gmail/v1/users/me/messages/send", "me", 100, true},
+		{"POST", "/upload/gmail/v1/users/me/messages/send", "me", 100, true},
+		{"POST", "/gmail/v1/users/help@blue.cc/messages/import", "help@blue.cc", 25, true},
+		{"POST", "/gmail/v1/users/me/messages/batchModify", "me", 50, true},
+		{"DELETE", "/gmail/v1/users/me/messages/m1", "me", 10, true},
+		{"GET", "/gmail/v1/users/me/threads/t1", "me", 10, true},
+		{"GET", "/gmail/v1/users/me/drafts", "me", 5, true},
+		{"POST", "/upload/gmail/v1/users/me/drafts", "me", 10, true},
+		{"POST", "/gmail/v1/users/me/drafts/send", "me", 100, true},
+		{"GET", "/gmail/v1/users/me/labels", "me", 1, true},
+		{"POST", "/gmail/v1/users/me/labels", "me", 5, true},
+		{"GET", "/gmail/v1/users/me/history", "me", 2, true},
+		{"GET", "/gmail/v1/users/me/profile", "me", 1, true},
+		{"POST", "/gmail/v1/users/me/watch", "me", 100, true},
+		{"POST", "/gmail/v1/users/me/stop", "me", 50, true},
+		{"POST", "/batch/gmail/v1", "", 0, false},
+		{"POST", "/token", "", 0, false},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, "https://gmail.googleapis.com"+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, units, ok := quotaCost(req)
+		if user != tt.user || units != tt.units || ok != tt.ok {
+			t.Errorf("quotaCost(%s %s) = %q, %d, %v; want %q, %d, %v", tt.method, tt.path, user, units, ok, tt.user, tt.units, tt.ok)
+		}
+	}
+}
+
+func TestQuotaTracker(t *testing.T) {
+	q := NewQuotaTracker(100)
+	ctx := context.Background()
+
+	// A full bucket's worth goes through at once.
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := q.Acquire(ctx, "a", 25); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("first 100 units took %v, want no wait", elapsed)
+	}
+
+	// The next 20 units wait for the bucket to refill (~200ms at 100/s).
+	start = time.Now()
+	if err := q.Acquire(ctx, "a", 20); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("units over the limit went through after %v, want ~200ms", elapsed)
+	}
+
+	// Users have separate buckets, and an oversized request still goes
+	// through once the bucket is full.
+	start = time.Now()
+	if err := q.Acquire(ctx, "b", 500); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("another user's request waited %v", elapsed)
+	}
+
+	// A cancelled context stops the wait.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := q.Acquire(cancelled, "b", 50); err != context.Canceled {
+		t.Errorf("Acquire with a cancelled context = %v, want context.Canceled", err)
+	}
+
+	want := []QuotaUsage{{User: "a", Units: 120, Requests: 5}, {User: "b", Units: 500, Requests: 1}}
+	got := q.Usage()
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Usage = %+v, want %+v", got, want)
+	}
+}
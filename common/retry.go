@@ -0,0 +1,223 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// RetryPolicy controls how failed Gmail requests are retried.
+type RetryPolicy struct {
+	MaxAttempts int           // total attempts, including the first
+	BaseDelay   time.Duration // delay before the first retry
+	MaxDelay    time.Duration // cap for backoff and Retry-After waits
+}
+
+// DefaultRetryPolicy retries up to four times with exponential backoff
+// (0.5s, 1s, 2s, 4s, jittered), which rides out Gmail's short rate-limit
+// windows and transient 5xx errors.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    32 * time.Second,
+}
+
+// retryTransport retries requests that failed for transient reasons and
+// charges each Gmail call against the quota tracker before sending it. It
+// wraps the OAuth transport, so a retried request also picks up a refreshed
+// token.
+type retryTransport struct {
+	base   http.RoundTripper
+	policy RetryPolicy
+	quota  *QuotaTracker
+}
+
+func newRetryTransport(base http.RoundTripper, policy RetryPolicy, quota *QuotaTracker) *retryTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &retryTransport{base: base, policy: policy, quota: quota}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	// A request body that can't be replayed can only be sent once, and a
+	// request that isn't idempotent may have taken effect before it failed.
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	replayable = replayable && idempotent(req)
+
+	for attempt := 1; ; attempt++ {
+		if t.quota != nil {
+			if user, units, ok := quotaCost(req); ok {
+				if err := t.quota.Acquire(ctx, user, units); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		r := req
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(ctx)
+			r.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(r)
+		if !replayable || attempt >= t.policy.MaxAttempts || !shouldRetry(resp, err) {
+			return resp, err
+		}
+
+		wait := t.policy.delay(attempt, resp)
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// idempotent reports whether sending req twice has the same effect as
+// sending it once. GET, PUT and DELETE are; of Gmail's POSTs only label
+// changes, batches of gets and push watch calls are. messages.send,
+// drafts.create and the like are never retried: a 5xx or timeout can come
+// after Gmail accepted the message, and a retry would send it again.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	case http.MethodPost:
+	default:
+		return false
+	}
+
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	if strings.HasSuffix(path, "/batch/gmail/v1") {
+		return true // the envelope only carries messages.get calls
+	}
+	switch path[strings.LastIndex(path, "/")+1:] {
+	case "modify", "batchModify", "trash", "untrash", "watch", "stop":
+		return true
+	}
+	return false
+}
+
+// Backoff returns the jittered delay before retry number attempt: a random
+// duration between half and all of BaseDelay*2^(attempt-1), capped at
+// MaxDelay.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := p.BaseDelay << uint(attempt-1)
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// delay returns how long to wait before retrying after the given attempt:
+// the server's Retry-After if resp has one, capped at MaxDelay, else the
+// jittered backoff.
+func (p RetryPolicy) delay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if ra, ok := retryAfter(resp); ok {
+			if ra > p.MaxDelay {
+				ra = p.MaxDelay
+			}
+			return ra
+		}
+	}
+	return p.Backoff(attempt)
+}
+
+// shouldRetry reports whether a response or transport error is transient.
+// Rate limits (429, or 403 with a rate-limit reason) and 5xx errors are
+// retried; other 4xx responses are permanent. Network errors are retried
+// unless the context was cancelled or the token refresh itself was
+// rejected, which retrying cannot fix.
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) {
+			return false
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+		return true
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusForbidden:
+		return isRateLimitResponse(resp)
+	}
+	return false
+}
+
+// isRateLimitResponse peeks at a 403 body for a rate-limit reason, restoring
+// the body so the caller can still decode it.
+func isRateLimitResponse(resp *http.Response) bool {
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+
+	var body struct {
+		Error struct {
+			Errors []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(data, &body) != nil {
+		return false
+	}
+	for _, e := range body.Error.Errors {
+		if isRateLimitReason(e.Reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryAfter parses a Retry-After header given as seconds or an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		d := time.Until(at)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
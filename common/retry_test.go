@@ -0,0 +1,196 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestRetryTransportOnlyRetriesIdempotentRequests(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	client := &http.Client{Transport: newRetryTransport(http.DefaultTransport, policy, nil)}
+
+	tests := []struct {
+		method string
+		path   string
+		calls  int32
+	}{
+		{"GET", "/gmail/v1/users/me/messages/m1", 3},
+		{"POST", "/gmail/v1/users/me/messages/m1/modify", 3},
+		{"POST", "/gmail/v1/users/me/messages/batchModify", 3},
+		{"POST", "/batch/gmail/v1", 3},
+		{"POST", "/upload/gmail/v1/users/me/messages/send", 1},
+		{"POST", "/gmail/v1/users/me/messages/send", 1},
+		{"POST", "/upload/gmail/v1/users/me/drafts", 1},
+		{"POST", "/gmail/v1/users/me/labels", 1},
+	}
+	for _, tt := range tests {
+		calls.Store(0)
+		// bytes.Reader bodies set GetBody, so the request is replayable.
+		req, err := http.NewRequest(tt.method, server.URL+tt.path, bytes.NewReader([]byte("{}")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.method, tt.path, err)
+		}
+		resp.Body.Close()
+		if got := calls.Load(); got != tt.calls {
+			t.Errorf("%s %s: sent %d times, want %d", tt.method, tt.path, got, tt.calls)
+		}
+	}
+}
+
+func TestRetryTransportRetriesTransientFailure(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "got %s", body)
+	}))
+	defer server.Close()
+
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	client := &http.Client{Transport: newRetryTransport(http.DefaultTransport, policy, nil)}
+
+	// The retried request carries its body again.
+	resp, err := client.Post(server.URL+"/gmail/v1/users/me/messages/m1/modify", "application/json", strings.NewReader(`{"addLabelIds":["X"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != `got {"addLabelIds":["X"]}` || calls.Load() != 2 {
+		t.Errorf("modify: status %d, body %q after %d calls; want 200 with the body after 2", resp.StatusCode, body, calls.Load())
+	}
+
+	// A send is not retried, even though the failure was transient.
+	calls.Store(0)
+	resp, err = client.Post(server.URL+"/upload/gmail/v1/users/me/messages/send?uploadType=media", "message/rfc822", strings.NewReader("Subject: hi\r\n\r\nhi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Errorf("send: status %d after %d calls; want the 503 after 1", resp.StatusCode, calls.Load())
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: 500 * time.Millisecond}
+	tests := []struct {
+		attempt int
+		full    time.Duration // the un-jittered delay
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 500 * time.Millisecond},  // capped
+		{40, 500 * time.Millisecond}, // shift overflow is capped too
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := p.Backoff(tt.attempt); d < tt.full/2 || d > tt.full {
+				t.Fatalf("Backoff(%d) = %v, want between %v and %v", tt.attempt, d, tt.full/2, tt.full)
+			}
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"7", 7 * time.Second, true},
+		{"-3", 0, false},
+		{"soon", 0, false},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, true},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.header != "" {
+			resp.Header.Set("Retry-After", tt.header)
+		}
+		got, ok := retryAfter(resp)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%q) = %v, %v; want %v, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	// An HTTP date in the future waits until then.
+	resp := &http.Response{Header: http.Header{"Retry-After": {time.Now().Add(90 * time.Second).UTC().Format(http.TimeFormat)}}}
+	if got, ok := retryAfter(resp); !ok || got < 80*time.Second || got > 90*time.Second {
+		t.Errorf("retryAfter(date in 90s) = %v, %v", got, ok)
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	rateLimited := `{"error":{"code":403,"errors":[{"reason":"userRateLimitExceeded"}]}}`
+	forbidden := `{"error":{"code":403,"errors":[{"reason":"insufficientPermissions"}]}}`
+
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		err    error
+		want   bool
+	}{
+		{name: "ok", status: 200, want: false},
+		{name: "not found", status: 404, want: false},
+		{name: "bad request", status: 400, want: false},
+		{name: "too many requests", status: 429, want: true},
+		{name: "server error", status: 500, want: true},
+		{name: "bad gateway", status: 502, want: true},
+		{name: "unavailable", status: 503, want: true},
+		{name: "gateway timeout", status: 504, want: true},
+		{name: "not implemented", status: 501, want: false},
+		{name: "403 rate limit", status: 403, body: rateLimited, want: true},
+		{name: "403 permission", status: 403, body: forbidden, want: false},
+		{name: "403 not json", status: 403, body: "denied", want: false},
+		{name: "network error", err: errors.New("connection reset"), want: true},
+		{name: "cancelled", err: fmt.Errorf("get: %w", context.Canceled), want: false},
+		{name: "deadline", err: context.DeadlineExceeded, want: false},
+		{name: "refresh rejected", err: &oauth2.RetrieveError{}, want: false},
+	}
+	for _, tt := range tests {
+		var resp *http.Response
+		if tt.err == nil {
+			resp = &http.Response{StatusCode: tt.status, Body: io.NopCloser(strings.NewReader(tt.body))}
+		}
+		if got := shouldRetry(resp, tt.err); got != tt.want {
+			t.Errorf("%s: shouldRetry = %v, want %v", tt.name, got, tt.want)
+		}
+		// Peeking at a 403 must leave the body for the caller to decode.
+		if resp != nil {
+			if body, _ := io.ReadAll(resp.Body); string(body) != tt.body {
+				t.Errorf("%s: body after shouldRetry = %q, want %q", tt.name, body, tt.body)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package common
+
+import (
+	"fmt"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// ScopeClass is a set of OAuth scopes a command needs. Each class gets its
+// own token, so a machine that only reads mail can hold a token that cannot
+// send or change anything.
+type ScopeClass string
+
+const (
+	// ScopeRead reads messages, threads, labels and attachments.
+	ScopeRead ScopeClass = "read"
+	// ScopeCompose also creates drafts and sends mail, but cannot change
+	// labels or delete anything.
+	ScopeCompose ScopeClass = "compose"
+	// ScopeModify also archives, labels and creates labels.
+	ScopeModify ScopeClass = "modify"
+)
+
+// ScopeClasses lists every class from narrowest to broadest.
+var ScopeClasses = []ScopeClass{ScopeRead, ScopeCompose, ScopeModify}
+
+// RequiredScope is the class the current command needs. main sets it per
+// command; the default is the broadest so nothing fails for lack of scope.
+var RequiredScope = ScopeModify
+
+// ParseScopeClass validates a class name given on the command line.
+func ParseScopeClass(s string) (ScopeClass, error) {
+	for _, c := range ScopeClasses {
+		if string(c) == s {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("unknown scope %q (use read, compose or modify)", s)
+}
+
+// Scopes returns the OAuth scopes requested for the class. Composing a reply
+// needs to read the original, so compose includes read-only access.
+func (c ScopeClass) Scopes() []string {
+	switch c {
+	case ScopeRead:
+		return []string{gmail.GmailReadonlyScope}
+	case ScopeCompose:
+		return []string{gmail.GmailReadonlyScope, gmail.GmailComposeScope}
+	}
+	return []string{gmail.GmailModifyScope}
+}
+
+// satisfiedBy returns the classes whose tokens can serve c, narrowest first,
+// so the least privileged token available is used.
+func (c ScopeClass) satisfiedBy() []ScopeClass {
+	for i, class := range ScopeClasses {
+		if class == c {
+			return ScopeClasses[i:]
+		}
+	}
+	return []ScopeClass{ScopeModify}
+}
+
+// tokenName is the base file name of the class's token. The modify token
+// keeps the name tokens had before scope classes existed.
+func (c ScopeClass) tokenName() string {
+	if c == ScopeModify || c == "" {
+		return "token"
+	}
+	return "token-" + string(c)
+}
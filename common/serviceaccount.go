@@ -0,0 +1,66 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
+)
+
+// serviceAccount returns the JWT config requesting the scopes of class for
+// the active profile's service account key, or nil when the profile signs in
+// with OAuth user credentials.
+//
+// With domain-wide delegation, the service account acts as a Workspace user
+// (the JWT subject): the profile's impersonate setting, else the
+// impersonate configuration, else its user_id when that is an address. The key is
+// read on every run, so rotating it is just replacing the file.
+func serviceAccount(class ScopeClass) (*jwt.Config, error) {
+	profile, err := CurrentProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	keyPath := profile.ServiceAccountKey
+	if keyPath == "" {
+		keyPath = Settings().ServiceAccountKey
+	}
+	if keyPath == "" {
+		return nil, nil
+	}
+
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account key: %v", err)
+	}
+	config, err := google.JWTConfigFromJSON(key, class.Scopes()...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse service account key: %v", err)
+	}
+
+	subject := profile.Impersonate
+	if subject == "" {
+		subject = Settings().Impersonate
+	}
+	if subject == "" && strings.Contains(profile.UserID, "@") {
+		subject = profile.UserID
+	}
+	if subject == "" {
+		return nil, fmt.Errorf("service account %s needs a Workspace user to impersonate (set impersonate in the profile or the configuration)", config.Email)
+	}
+	config.Subject = subject
+
+	return config, nil
+}
+
+// serviceAccountClient returns an HTTP client authorized as the delegated
+// user. Tokens are minted from the key as needed, so nothing is saved.
+func serviceAccountClient(ctx context.Context, config *jwt.Config) *http.Client {
+	client := config.Client(ctx)
+	client.Transport = newRetryTransport(client.Transport, DefaultRetryPolicy, DefaultQuota)
+	return client
+}
@@ -0,0 +1,93 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeServiceAccountKey writes a service account key whose token endpoint
+// is tokenURL and returns its path.
+func writeServiceAccountKey(t *testing.T, tokenURL string) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	data, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "triage@project.iam.gserviceaccount.com",
+		"private_key_id": "key-1",
+		"private_key":    string(keyPEM),
+		"token_uri":      tokenURL,
+	})
+	path := filepath.Join(t.TempDir(), "sa.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestServiceAccountImpersonation(t *testing.T) {
+	var subject string
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		// The assertion is a JWT; its claims are the middle segment.
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if len(parts) != 3 {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var c struct {
+			Sub string `json:"sub"`
+		}
+		json.Unmarshal(claims, &c)
+		subject = c.Sub
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "sa-token", "token_type": "Bearer", "expires_in": 3600})
+	}))
+	defer tokenServer.Close()
+
+	testConfig(t).Profile = "triage"
+
+	keyPath := writeServiceAccountKey(t, tokenServer.URL)
+	if err := SaveProfile(&Profile{Name: "triage", ServiceAccountKey: keyPath, UserID: "help@blue.cc"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sa, err := serviceAccount(ScopeModify)
+	if err != nil || sa == nil {
+		t.Fatalf("serviceAccount(ScopeModify) = %v, %v", sa, err)
+	}
+	tok, err := sa.TokenSource(context.Background()).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "sa-token" || subject != "help@blue.cc" {
+		t.Errorf("got token %q for subject %q, want sa-token for help@blue.cc", tok.AccessToken, subject)
+	}
+
+	if _, err := Login(LoginOptions{}); err == nil {
+		t.Error("Login should refuse a service account profile")
+	}
+}
+
+func TestServiceAccountNeedsSubject(t *testing.T) {
+	testConfig(t).ServiceAccountKey = writeServiceAccountKey(t, "http://127.0.0.1:0")
+
+	if _, err := serviceAccount(ScopeModify); err == nil || !strings.Contains(err.Error(), "impersonate") {
+		t.Errorf("serviceAccount(ScopeModify) error = %v, want a missing impersonation error", err)
+	}
+}
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// DefaultInternalDomain is the email domain considered internal to Blue
+// unless the configuration or active profile sets others.
+const DefaultInternalDomain = "blue.cc"
+
+// Staff identifies the addresses that belong to the support team rather than
+// customers: anyone on an internal domain or one of its subdomains, plus
+// explicitly listed addresses such as contractors on other domains.
+type Staff struct {
+	Domains   []string
+	Addresses []string
+}
+
+// CurrentStaff returns the staff of the active profile, which defaults to
+// the internal_domains and staff_addresses configuration.
+func CurrentStaff() Staff {
+	if profile, err := CurrentProfile(); err == nil {
+		return Staff{Domains: profile.InternalDomains, Addresses: profile.StaffAddresses}
+	}
+	return Staff{Domains: Settings().InternalDomains, Addresses: Settings().StaffAddresses}
+}
+
+// IsInternalAddress reports whether an RFC 5322 address (e.g. "Name <x@blue.cc>")
+// belongs to the active profile's staff.
+func IsInternalAddress(addr string) bool {
+	return CurrentStaff().IsInternal(addr)
+}
+
+// IsInternal reports whether addr, an RFC 5322 address or address list,
+// belongs to staff. A list is internal only if every address in it is.
+// Only the address itself counts, never the display name, and anything
+// that doesn't parse is treated as a customer.
+func (s Staff) IsInternal(addr string) bool {
+	list, err := ParseAddressList(addr)
+	if err != nil || len(list) == 0 {
+		return false
+	}
+	for _, a := range list {
+		if !s.IsStaff(a) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsStaff reports whether a single parsed address belongs to staff.
+func (s Staff) IsStaff(a Address) bool {
+	for _, staff := range s.Addresses {
+		if sa, err := ParseAddress(staff); err == nil && sa.Same(a) {
+			return true
+		}
+	}
+
+	address := strings.ToLower(a.Email)
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return false
+	}
+	domain := address[at+1:]
+	for _, d := range s.Domains {
+		d = normalizeDomain(d)
+		if d != "" && (domain == d || strings.HasSuffix(domain, "."+d)) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeDomain lowercases a domain and drops a leading "@", which people
+// tend to include.
+func normalizeDomain(d string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(d)), "@")
+}
+
+// validateDomains checks internal domains for mistakes that would silently
+// classify staff as customers.
+func validateDomains(domains []string) error {
+	for _, d := range domains {
+		d = normalizeDomain(d)
+		if d == "" || strings.ContainsAny(d, "@ \t<>,") || !strings.Contains(d, ".") {
+			return fmt.Errorf("not a domain: %q", d)
+		}
+	}
+	return nil
+}
+
+// validateAddresses checks that every staff address parses.
+func validateAddresses(addresses []string) error {
+	for _, a := range addresses {
+		if _, err := mail.ParseAddress(a); err != nil {
+			return fmt.Errorf("not an email address: %q", a)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package common
+
+import "testing"
+
+func TestStaffIsInternal(t *testing.T) {
+	staff := Staff{
+		Domains:   []string{"blue.cc", "@Blue.IO"},
+		Addresses: []string{"Pat <pat@contractor.dev>"},
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"help@blue.cc", true},
+		{"Support Team <HELP@Blue.CC>", true},
+		{"bo@eu.blue.cc", true},
+		{"dana@blue.io", true},
+		{"pat@contractor.dev", true},
+		{`"Pat (contract)" <PAT@contractor.dev>`, true},
+		{"help@blue.cc, bo@blue.io", true},
+
+		{"someone@blue.cc.attacker.com", false},
+		{"someone@notblue.cc", false},
+		{`"help@blue.cc" <evil@attacker.com>`, false},
+		{"Ana <ana@customer.com>", false},
+		{"other@contractor.dev", false},
+		{"help@blue.cc, ana@customer.com", false},
+		{"not an address", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := staff.IsInternal(tt.addr); got != tt.want {
+			t.Errorf("IsInternal(%q) = %t, want %t", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/term"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Google's token introspection and revocation endpoints.
+var (
+	tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+	revokeURL    = "https://oauth2.googleapis.com/revoke"
+)
+
+// reauthHint is appended to errors that only signing in again can fix.
+const reauthHint = "run 'support-agent auth login' to sign in again"
+
+// errNotLoggedIn is returned when there is no saved token and logging in
+// interactively isn't possible.
+var errNotLoggedIn = &APIError{
+	Op:   "authorize Gmail access",
+	Kind: KindAuthExpired,
+	Err:  errors.New("no saved token; " + reauthHint),
+}
+
+// persistingTokenSource hands out tokens from base and saves each one that
+// differs from the last saved token, so an access token refreshed during a
+// run is reused by the next run instead of being refreshed again.
+type persistingTokenSource struct {
+	base  oauth2.TokenSource
+	store TokenStore
+
+	mu   sync.Mutex
+	last string // access token last written to store
+}
+
+func newPersistingTokenSource(ctx context.Context, config *oauth2.Config, tok *oauth2.Token, store TokenStore) oauth2.TokenSource {
+	return &persistingTokenSource{
+		base:  config.TokenSource(ctx, tok),
+		store: store,
+		last:  tok.AccessToken,
+	}
+}
+
+func (s *persistingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.base.Token()
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant" {
+			return nil, fmt.Errorf("Gmail authorization was revoked or has expired (%s): %w", reauthHint, err)
+		}
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tok.AccessToken != s.last {
+		if err := s.store.Save(tok); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: unable to save refreshed token: %v\n", err)
+		} else {
+			s.last = tok.AccessToken
+		}
+	}
+	return tok, nil
+}
+
+// isInteractive reports whether a person is likely at the terminal, so an
+// interactive login can be started. Cron jobs and pipelines get an error
+// instead of a login prompt that nobody will answer.
+func isInteractive() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// AuthStatus describes the saved Gmail authorization.
+type AuthStatus struct {
+	// ServiceAccount is the service account's address when the profile
+	// uses domain-wide delegation; Email is then the impersonated user.
+	ServiceAccount  string    `json:"service_account,omitempty"`
+	TokenStore      string    `json:"token_store,omitempty"`
+	Email           string    `json:"email,omitempty"`
+	Scopes          []string  `json:"scopes,omitempty"`
+	Expiry          time.Time `json:"expiry"`
+	HasRefreshToken bool      `json:"has_refresh_token"`
+}
+
+// GetAuthStatus checks the token commands of scope class would use,
+// refreshing (and saving) it if it has expired, and reports the account and
+// scopes it grants. A missing, revoked or expired authorization returns an
+// error of kind KindAuthExpired.
+func GetAuthStatus(class ScopeClass) (*AuthStatus, error) {
+	ctx := context.Background()
+	status := &AuthStatus{}
+
+	var src oauth2.TokenSource
+	sa, err := serviceAccount(class)
+	if err != nil {
+		return nil, err
+	}
+	if sa != nil {
+		status.ServiceAccount = sa.Email
+		src = sa.TokenSource(ctx)
+	} else {
+		config, err := getOAuthConfig(class)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get OAuth config: %v", err)
+		}
+		tok, store, err := loadProfileToken(ActiveProfileName(), class)
+		if errors.Is(err, ErrNoToken) {
+			return nil, errNotLoggedIn
+		}
+		if err != nil {
+			return nil, err
+		}
+		status.TokenStore = store.String()
+		src = newPersistingTokenSource(ctx, config, tok, store)
+	}
+
+	current, err := src.Token()
+	if err != nil {
+		return nil, wrapAPIError("get access token", err)
+	}
+	status.Expiry = current.Expiry
+	status.HasRefreshToken = current.RefreshToken != ""
+
+	if scopes, err := tokenScopes(current.AccessToken); err == nil {
+		status.Scopes = scopes
+	} else {
+		fmt.Fprintf(os.Stderr, "Warning: unable to look up token scopes: %v\n", err)
+	}
+
+	httpClient := oauth2.NewClient(ctx, src)
+	service, err := gmail.NewService(ctx, gmailServiceOptions(httpClient)...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Gmail service: %v", err)
+	}
+	profile, err := service.Users.GetProfile("me").Do()
+	if err != nil {
+		return nil, wrapAPIError("get mailbox profile", err)
+	}
+	status.Email = profile.EmailAddress
+
+	return status, nil
+}
+
+// tokenScopes asks Google which scopes an access token grants.
+func tokenScopes(accessToken string) ([]string, error) {
+	resp, err := http.PostForm(tokenInfoURL, url.Values{"access_token": {accessToken}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tokeninfo returned %s", resp.Status)
+	}
+
+	var info struct {
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return strings.Fields(info.Scope), nil
+}
+
+// RevokeTokens revokes every saved authorization of the active profile, of
+// all scope classes, with Google and deletes the saved tokens, including
+// leftover plaintext copies. A token Google no longer recognizes (already
+// revoked or expired) is still deleted locally.
+func RevokeTokens() error {
+	if sa, err := serviceAccount(ScopeModify); err != nil {
+		return err
+	} else if sa != nil {
+		return fmt.Errorf("this profile uses service account %s; disable its key in the Google Cloud console instead", sa.Email)
+	}
+
+	name := ActiveProfileName()
+	found := false
+	for _, class := range ScopeClasses {
+		store, err := OpenTokenStore(name, class)
+		if err != nil {
+			return err
+		}
+		for _, s := range []TokenStore{store, plaintextTokenStore(name, class)} {
+			tok, err := s.Load()
+			if errors.Is(err, ErrNoToken) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			found = true
+			if err := revoke(tok); err != nil {
+				return err
+			}
+			if err := s.Delete(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !found {
+		return errNotLoggedIn
+	}
+	return nil
+}
+
+// revoke revokes tok with Google. Revoking the refresh token also revokes
+// the access tokens issued from it.
+func revoke(tok *oauth2.Token) error {
+	token := tok.RefreshToken
+	if token == "" {
+		token = tok.AccessToken
+	}
+
+	resp, err := http.PostForm(revokeURL, url.Values{"token": {token}})
+	if err != nil {
+		return fmt.Errorf("unable to revoke token: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("unable to revoke token: Google returned %s", resp.Status)
+	}
+	return nil
+}
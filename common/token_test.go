@@ -0,0 +1,76 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestPersistingTokenSourceSavesRefreshedToken(t *testing.T) {
+	refreshes := 0
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		refreshes++
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "fresh", "token_type": "Bearer", "expires_in": 3600,
+		})
+	}))
+	defer tokenServer.Close()
+
+	config := &oauth2.Config{ClientID: "client", Endpoint: oauth2.Endpoint{TokenURL: tokenServer.URL}}
+	path := filepath.Join(t.TempDir(), "token.json")
+	expired := &oauth2.Token{AccessToken: "stale", RefreshToken: "rt", Expiry: time.Now().Add(-time.Hour)}
+
+	src := newPersistingTokenSource(context.Background(), config, expired, &fileStore{path: path})
+	for i := 0; i < 2; i++ {
+		tok, err := src.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.AccessToken != "fresh" {
+			t.Fatalf("access token = %q, want fresh", tok.AccessToken)
+		}
+	}
+	if refreshes != 1 {
+		t.Errorf("refreshed %d times, want 1", refreshes)
+	}
+
+	saved, err := loadToken(path)
+	if err != nil {
+		t.Fatalf("refreshed token not saved: %v", err)
+	}
+	// The refresh response has no refresh token; the old one must be kept.
+	if saved.AccessToken != "fresh" || saved.RefreshToken != "rt" {
+		t.Errorf("saved token = %q/%q, want fresh/rt", saved.AccessToken, saved.RefreshToken)
+	}
+}
+
+func TestPersistingTokenSourceRevoked(t *testing.T) {
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`))
+	}))
+	defer tokenServer.Close()
+
+	config := &oauth2.Config{ClientID: "client", Endpoint: oauth2.Endpoint{TokenURL: tokenServer.URL}}
+	path := filepath.Join(t.TempDir(), "token.json")
+	expired := &oauth2.Token{AccessToken: "stale", RefreshToken: "rt", Expiry: time.Now().Add(-time.Hour)}
+
+	_, err := newPersistingTokenSource(context.Background(), config, expired, &fileStore{path: path}).Token()
+	if err == nil {
+		t.Fatal("expected an error for a revoked grant")
+	}
+	if kind := ErrorKindOf(err); kind != KindAuthExpired {
+		t.Errorf("error kind = %s, want %s", kind, KindAuthExpired)
+	}
+	if _, err := loadToken(path); err == nil {
+		t.Error("token saved after a failed refresh")
+	}
+}
@@ -0,0 +1,417 @@
+package common
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+)
+
+// ErrNoToken is returned by TokenStore.Load when no token is saved.
+var ErrNoToken = errors.New("no saved token")
+
+// TokenStore saves a profile's OAuth token.
+type TokenStore interface {
+	// Load returns the saved token, or ErrNoToken.
+	Load() (*oauth2.Token, error)
+	// Save replaces the saved token.
+	Save(tok *oauth2.Token) error
+	// Delete removes the saved token. Deleting a missing token is not an
+	// error.
+	Delete() error
+	// String describes where the token is kept, for messages.
+	String() string
+}
+
+// Token store backends, selected with SUPPORT_AGENT_TOKEN_STORE.
+const (
+	StoreAuto      = "auto"      // keyring, else encrypted, else file
+	StoreKeyring   = "keyring"   // macOS Keychain or Secret Service (secret-tool)
+	StoreEncrypted = "encrypted" // token*.json.enc, AES-GCM keyed from the passphrase
+	StoreFile      = "file"      // plaintext token*.json, mode 0600
+)
+
+// keyringService is the service name of keyring entries.
+const keyringService = "support-agent"
+
+// OpenTokenStore returns the store for the named profile's token of the
+// given scope class, using the backend chosen with the token_store
+// configuration (default auto). The encrypted store uses token_passphrase.
+func OpenTokenStore(profile string, class ScopeClass) (TokenStore, error) {
+	dir := ProfileDir(profile)
+	name := class.tokenName()
+	passphrase := Settings().TokenPassphrase
+
+	backend := Settings().TokenStore
+	switch backend {
+	case "", StoreAuto:
+		switch {
+		case keyringAvailable():
+			return newKeyringStore(dir, class), nil
+		case passphrase != "":
+			return &encryptedFileStore{path: filepath.Join(dir, name+".json.enc"), passphrase: passphrase}, nil
+		default:
+			return plaintextTokenStore(profile, class), nil
+		}
+	case StoreKeyring:
+		if !keyringAvailable() {
+			return nil, fmt.Errorf("no OS keyring available (needs the macOS Keychain, or secret-tool and a D-Bus session on Linux)")
+		}
+		return newKeyringStore(dir, class), nil
+	case StoreEncrypted:
+		if passphrase == "" {
+			return nil, fmt.Errorf("the encrypted token store needs SUPPORT_AGENT_TOKEN_PASSPHRASE")
+		}
+		return &encryptedFileStore{path: filepath.Join(dir, name+".json.enc"), passphrase: passphrase}, nil
+	case StoreFile:
+		return plaintextTokenStore(profile, class), nil
+	}
+	return nil, fmt.Errorf("unknown token store %q (use auto, keyring, encrypted or file)", backend)
+}
+
+// plaintextTokenStore is the plaintext token file of a scope class. Every
+// version before pluggable stores wrote token.json, so existing logins keep
+// working from it until migrated.
+func plaintextTokenStore(profile string, class ScopeClass) TokenStore {
+	return &fileStore{path: filepath.Join(ProfileDir(profile), class.tokenName()+".json")}
+}
+
+// loadProfileToken loads a token for the named profile that grants class:
+// the narrowest one saved, falling back to a plaintext file left by an older
+// version or the file store. It returns the store the token came from, so
+// refreshed tokens are saved back there; with ErrNoToken, the store is where
+// a new token for class should be saved.
+func loadProfileToken(profile string, class ScopeClass) (*oauth2.Token, TokenStore, error) {
+	for _, c := range class.satisfiedBy() {
+		store, err := OpenTokenStore(profile, c)
+		if err != nil {
+			return nil, nil, err
+		}
+		tok, err := store.Load()
+		if !errors.Is(err, ErrNoToken) {
+			return tok, store, err
+		}
+		if _, isFile := store.(*fileStore); !isFile {
+			plain := plaintextTokenStore(profile, c)
+			if tok, err := plain.Load(); err == nil {
+				fmt.Fprintf(os.Stderr, "Warning: using a plaintext token; run 'support-agent auth migrate' to move it to the %s.\n", store)
+				return tok, store, nil
+			}
+		}
+	}
+
+	store, err := OpenTokenStore(profile, class)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, store, ErrNoToken
+}
+
+// fileStore keeps the token as plaintext JSON.
+type fileStore struct {
+	path string
+}
+
+func (s *fileStore) Load() (*oauth2.Token, error) {
+	tok, err := loadToken(s.path)
+	if os.IsNotExist(err) {
+		return nil, ErrNoToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token: %v", err)
+	}
+	return tok, nil
+}
+
+func (s *fileStore) Save(tok *oauth2.Token) error { return saveToken(s.path, tok) }
+
+func (s *fileStore) Delete() error { return removeIfExists(s.path) }
+
+func (s *fileStore) String() string { return "plaintext file " + s.path }
+
+// encryptedFile is the on-disk format of encryptedFileStore.
+type encryptedFile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// encryptedFileStore keeps the token encrypted with AES-256-GCM under a key
+// derived from a passphrase with scrypt. A fresh salt and nonce are used on
+// every save.
+type encryptedFileStore struct {
+	path       string
+	passphrase string
+}
+
+// scrypt cost parameters for new files (the 2017 recommendation for
+// interactive logins); existing files record their own.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+func (s *encryptedFileStore) Load() (*oauth2.Token, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, ErrNoToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token: %v", err)
+	}
+
+	var f encryptedFile
+	if err := json.Unmarshal(data, &f); err != nil || f.Version != 1 || f.KDF != "scrypt" || f.N > 1<<20 {
+		return nil, fmt.Errorf("unable to read token: %s is not a supported encrypted token file", s.path)
+	}
+	gcm, err := s.cipher(f.Salt, f.N, f.R, f.P)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, f.Nonce, f.Ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt token (wrong SUPPORT_AGENT_TOKEN_PASSPHRASE?)")
+	}
+
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(plain, tok); err != nil {
+		return nil, fmt.Errorf("unable to parse token: %v", err)
+	}
+	return tok, nil
+}
+
+func (s *encryptedFileStore) Save(tok *oauth2.Token) error {
+	plain, err := json.Marshal(tok)
+	if err != nil {
+		return fmt.Errorf("unable to save token: %v", err)
+	}
+
+	f := encryptedFile{Version: 1, KDF: "scrypt", N: scryptN, R: scryptR, P: scryptP, Salt: make([]byte, 16)}
+	if _, err := rand.Read(f.Salt); err != nil {
+		return fmt.Errorf("unable to save token: %v", err)
+	}
+	gcm, err := s.cipher(f.Salt, f.N, f.R, f.P)
+	if err != nil {
+		return err
+	}
+	f.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(f.Nonce); err != nil {
+		return fmt.Errorf("unable to save token: %v", err)
+	}
+	f.Ciphertext = gcm.Seal(nil, f.Nonce, plain, nil)
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to save token: %v", err)
+	}
+	if err := writeFileAtomic(s.path, data, 0600); err != nil {
+		return fmt.Errorf("unable to save token: %v", err)
+	}
+	return nil
+}
+
+func (s *encryptedFileStore) cipher(salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(s.passphrase), salt, n, r, p, 32)
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive token key: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *encryptedFileStore) Delete() error { return removeIfExists(s.path) }
+
+func (s *encryptedFileStore) String() string { return "encrypted file " + s.path }
+
+// keyringStore keeps the token in the OS keyring through its command-line
+// tool, so no cgo or D-Bus library is needed: security(1) on macOS and
+// secret-tool(1) (libsecret) on Linux. Entries are keyed by the profile
+// directory and scope class, so separate installations, profiles and
+// classes don't collide.
+type keyringStore struct {
+	account string
+}
+
+func newKeyringStore(dir string, class ScopeClass) *keyringStore {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		abs = dir
+	}
+	if class != ScopeModify {
+		abs += "#" + string(class)
+	}
+	return &keyringStore{account: abs}
+}
+
+// keyringAvailable reports whether keyringStore can work here.
+var keyringAvailable = func() bool {
+	switch runtime.GOOS {
+	case "darwin":
+		_, err := exec.LookPath("security")
+		return err == nil
+	case "linux", "freebsd", "openbsd":
+		_, err := exec.LookPath("secret-tool")
+		return err == nil && os.Getenv("DBUS_SESSION_BUS_ADDRESS") != ""
+	}
+	return false
+}
+
+func (s *keyringStore) Load() (*oauth2.Token, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "find-generic-password", "-s", keyringService, "-a", s.account, "-w")
+	} else {
+		cmd = exec.Command("secret-tool", "lookup", "service", keyringService, "account", s.account)
+	}
+	out, err := cmd.Output()
+	secret := strings.TrimSpace(string(out))
+	var exitErr *exec.ExitError
+	if secret == "" && (err == nil || errors.As(err, &exitErr)) {
+		// Both tools exit non-zero with no output for a missing entry.
+		return nil, ErrNoToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token from keyring: %v", err)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token from keyring: %v", err)
+	}
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(data, tok); err != nil {
+		return nil, fmt.Errorf("unable to parse token: %v", err)
+	}
+	return tok, nil
+}
+
+// Save passes the secret on stdin, never on the command line where other
+// users could see it in the process list. It is base64 encoded so it needs
+// no quoting.
+func (s *keyringStore) Save(tok *oauth2.Token) error {
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return fmt.Errorf("unable to save token: %v", err)
+	}
+	secret := base64.StdEncoding.EncodeToString(data)
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %q -w %s\n", keyringService, s.account, secret))
+	} else {
+		cmd = exec.Command("secret-tool", "store", "--label=support-agent Gmail token", "service", keyringService, "account", s.account)
+		cmd.Stdin = strings.NewReader(secret)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("unable to save token to keyring: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func (s *keyringStore) Delete() error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "delete-generic-password", "-s", keyringService, "-a", s.account)
+	} else {
+		cmd = exec.Command("secret-tool", "clear", "service", keyringService, "account", s.account)
+	}
+	if err := cmd.Run(); err != nil {
+		if _, loadErr := s.Load(); errors.Is(loadErr, ErrNoToken) {
+			return nil
+		}
+		return fmt.Errorf("unable to delete token from keyring: %v", err)
+	}
+	return nil
+}
+
+func (s *keyringStore) String() string { return "OS keyring" }
+
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to delete token: %v", err)
+	}
+	return nil
+}
+
+// MigrateResult reports what MigrateTokens did for one token.
+type MigrateResult struct {
+	Profile string     `json:"profile"`
+	Scope   ScopeClass `json:"scope"`
+	Store   string     `json:"store"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// MigrateTokens moves every plaintext token file of every profile into the
+// configured token store and deletes the plaintext file once the copy reads
+// back correctly. Profiles without plaintext tokens are skipped.
+func MigrateTokens() ([]MigrateResult, error) {
+	names, err := ProfileNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []MigrateResult
+	for _, name := range names {
+		for _, class := range ScopeClasses {
+			plain := plaintextTokenStore(name, class)
+			tok, err := plain.Load()
+			if errors.Is(err, ErrNoToken) {
+				continue
+			}
+
+			results = append(results, MigrateResult{Profile: name, Scope: class})
+			r := &results[len(results)-1]
+			if err != nil {
+				r.Error = err.Error()
+				continue
+			}
+
+			store, err := OpenTokenStore(name, class)
+			if err != nil {
+				return nil, err
+			}
+			if _, isFile := store.(*fileStore); isFile {
+				return nil, fmt.Errorf("no secure token store available: set SUPPORT_AGENT_TOKEN_PASSPHRASE or SUPPORT_AGENT_TOKEN_STORE")
+			}
+			r.Store = store.String()
+
+			if err := store.Save(tok); err != nil {
+				r.Error = err.Error()
+				continue
+			}
+			saved, err := store.Load()
+			if err != nil || saved.RefreshToken != tok.RefreshToken || saved.AccessToken != tok.AccessToken {
+				r.Error = fmt.Sprintf("token did not read back from the %s; plaintext file kept", store)
+				continue
+			}
+			if err := plain.Delete(); err != nil {
+				r.Error = err.Error()
+			}
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,124 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func withoutKeyring(t *testing.T) {
+	orig := keyringAvailable
+	keyringAvailable = func() bool { return false }
+	t.Cleanup(func() { keyringAvailable = orig })
+}
+
+func TestEncryptedFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json.enc")
+	store := &encryptedFileStore{path: path, passphrase: "correct horse"}
+
+	if _, err := store.Load(); !errors.Is(err, ErrNoToken) {
+		t.Fatalf("Load() on a missing file = %v, want ErrNoToken", err)
+	}
+
+	want := &oauth2.Token{AccessToken: "at", RefreshToken: "secret-refresh-token", TokenType: "Bearer"}
+	if err := store.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := os.ReadFile(path)
+	if bytes.Contains(raw, []byte("secret-refresh-token")) {
+		t.Error("refresh token stored in plaintext")
+	}
+
+	got, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RefreshToken != want.RefreshToken || got.AccessToken != want.AccessToken {
+		t.Errorf("loaded %+v, want %+v", got, want)
+	}
+
+	wrong := &encryptedFileStore{path: path, passphrase: "wrong"}
+	if _, err := wrong.Load(); err == nil || errors.Is(err, ErrNoToken) {
+		t.Errorf("Load() with the wrong passphrase = %v, want a decryption error", err)
+	}
+}
+
+func TestMigrateTokens(t *testing.T) {
+	withoutKeyring(t)
+	config := testConfig(t)
+	base := config.TokenDir
+
+	if err := saveToken(filepath.Join(base, "token.json"), &oauth2.Token{RefreshToken: "rt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a keyring or passphrase there is nowhere safer to move it.
+	if _, err := MigrateTokens(); err == nil {
+		t.Fatal("MigrateTokens() without a secure store should fail")
+	}
+
+	config.TokenPassphrase = "correct horse"
+
+	// Before migrating, the plaintext token is still found.
+	if tok, _, err := loadProfileToken(DefaultProfile, ScopeModify); err != nil || tok.RefreshToken != "rt" {
+		t.Fatalf("loadProfileToken() before migration = %v, %v", tok, err)
+	}
+
+	results, err := MigrateTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Error != "" {
+		t.Fatalf("MigrateTokens() = %+v", results)
+	}
+	if _, err := os.Stat(filepath.Join(base, "token.json")); !os.IsNotExist(err) {
+		t.Error("plaintext token.json not deleted")
+	}
+
+	tok, store, err := loadProfileToken(DefaultProfile, ScopeModify)
+	if err != nil || tok.RefreshToken != "rt" {
+		t.Fatalf("loadProfileToken() after migration = %v, %v", tok, err)
+	}
+	if _, ok := store.(*encryptedFileStore); !ok {
+		t.Errorf("token store = %s, want the encrypted file", store)
+	}
+}
+
+func TestLoadProfileTokenByScope(t *testing.T) {
+	withoutKeyring(t)
+	testConfig(t).TokenStore = StoreFile
+
+	save := func(class ScopeClass, refresh string) {
+		store, err := OpenTokenStore(DefaultProfile, class)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Save(&oauth2.Token{RefreshToken: refresh}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A read-only box: its token must not be usable to send or modify.
+	save(ScopeRead, "read-rt")
+	if tok, _, err := loadProfileToken(DefaultProfile, ScopeRead); err != nil || tok.RefreshToken != "read-rt" {
+		t.Errorf("read token for a read command = %v, %v", tok, err)
+	}
+	for _, class := range []ScopeClass{ScopeCompose, ScopeModify} {
+		if _, _, err := loadProfileToken(DefaultProfile, class); !errors.Is(err, ErrNoToken) {
+			t.Errorf("%s command with only a read token: err = %v, want ErrNoToken", class, err)
+		}
+	}
+
+	// A broader token serves narrower commands, but the narrowest wins.
+	save(ScopeModify, "modify-rt")
+	if tok, _, err := loadProfileToken(DefaultProfile, ScopeCompose); err != nil || tok.RefreshToken != "modify-rt" {
+		t.Errorf("compose command with a modify token = %v, %v", tok, err)
+	}
+	if tok, _, _ := loadProfileToken(DefaultProfile, ScopeRead); tok == nil || tok.RefreshToken != "read-rt" {
+		t.Errorf("read command should prefer the read token, got %v", tok)
+	}
+}
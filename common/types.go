@@ -4,19 +4,49 @@ import "time"
 
 // MessageInfo represents simplified message data for output
 type MessageInfo struct {
-	ID        string    `json:"id"`
-	ThreadID  string    `json:"thread_id"`
-	From      string    `json:"from"`
-	To        string    `json:"to"`
-	Cc        string    `json:"cc,omitempty"`
-	Bcc       string    `json:"bcc,omitempty"`
-	ReplyTo   string    `json:"reply_to,omitempty"`
-	Subject   string    `json:"subject"`
-	Date      string    `json:"date"`
-	Snippet   string    `json:"snippet,omitempty"`
-	Body      string    `json:"body,omitempty"`
-	Labels    []string  `json:"labels"`
-	Timestamp time.Time `json:"timestamp,omitempty"`
+	ID        string            `json:"id"`
+	ThreadID  string            `json:"thread_id"`
+	From      string            `json:"from"`
+	To        string            `json:"to"`
+	Cc        string            `json:"cc,omitempty"`
+	Bcc       string            `json:"bcc,omitempty"`
+	ReplyTo   string            `json:"reply_to,omitempty"`
+	Subject   string            `json:"subject"`
+	Date      string            `json:"date"`
+	Snippet   string            `json:"snippet,omitempty"`
+	Body      string            `json:"body,omitempty"`
+	Labels    []string          `json:"labels"`
+	Timestamp time.Time         `json:"timestamp,omitempty"`
+	Addresses *MessageAddresses `json:"addresses,omitempty"`
+}
+
+// MessageAddresses holds a message's address headers parsed, so consumers
+// need not parse the raw From/To/Cc strings themselves.
+type MessageAddresses struct {
+	From    *Address  `json:"from,omitempty"`
+	To      []Address `json:"to,omitempty"`
+	Cc      []Address `json:"cc,omitempty"`
+	Bcc     []Address `json:"bcc,omitempty"`
+	ReplyTo []Address `json:"reply_to,omitempty"`
+}
+
+// MessageListInfo is the output envelope for list-style commands.
+// NextPageToken is set when more results are available; pass it back via
+// --page-token to resume the listing.
+type MessageListInfo struct {
+	Messages           []MessageInfo  `json:"messages"`
+	NextPageToken      string         `json:"next_page_token,omitempty"`
+	ResultSizeEstimate int64          `json:"result_size_estimate,omitempty"`
+	Errors             []MessageError `json:"errors,omitempty"`
+}
+
+// MessageError records a message that could not be fetched while building a
+// listing, so failures are reported alongside the results instead of aborting
+// the whole command.
+type MessageError struct {
+	ID    string    `json:"id"`
+	Error string    `json:"error"`
+	Kind  ErrorKind `json:"kind,omitempty"`
 }
 
 // ThreadInfo represents simplified thread data for output
@@ -38,10 +68,3 @@ const (
 	OutputDetailed OutputFormat = "detailed"
 	OutputJSON     OutputFormat = "json"
 )
-
-// Config holds application configuration
-type Config struct {
-	CredentialsPath string
-	TokenDir        string
-	UserEmail       string
-}
\ No newline at end of file
@@ -1,22 +1,38 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 
+	"github.com/blue/support-agent/common"
 	"github.com/blue/support-agent/tools"
 )
 
 func main() {
-	if len(os.Args) < 2 {
+	argv, configPath, overrides, err := extractGlobalFlags(os.Args[1:])
+	if err == nil {
+		err = loadConfig(configPath, overrides)
+	}
+	if err == nil {
+		_, err = common.CurrentProfile()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(argv) < 1 {
 		printUsage()
 		os.Exit(1)
 	}
 
-	command := os.Args[1]
-	args := os.Args[2:]
-
-	var err error
+	command := argv[0]
+	args := argv[1:]
+	if class, ok := commandScopes[command]; ok {
+		common.RequiredScope = class
+	}
 
 	switch command {
 	// Read operations
@@ -30,6 +46,10 @@ func main() {
 		err = tools.RunDownloadAttachment(args)
 	case "search-messages":
 		err = tools.RunSearchMessages(args)
+	case "sync":
+		err = tools.RunSync(args)
+	case "watch":
+		err = tools.RunWatch(args)
 		
 	// Write operations
 	case "reply-message":
@@ -38,6 +58,8 @@ func main() {
 		err = tools.RunDraftReply(args)
 	case "compose-message":
 		err = tools.RunComposeMessage(args)
+	case "forward-message":
+		err = tools.RunForwardMessage(args)
 	case "archive-message":
 		err = tools.RunArchiveMessage(args)
 	case "label-message":
@@ -47,6 +69,18 @@ func main() {
 	case "create-label":
 		err = tools.RunCreateLabel(args)
 
+	// Authorization
+	case "auth":
+		err = tools.RunAuth(args)
+	case "profiles":
+		err = tools.RunProfiles(args)
+	case "config":
+		err = tools.RunConfig(args)
+
+	// Local cache
+	case "cache":
+		err = tools.RunCache(args)
+
 	// Company access (support investigation)
 	case "company-access":
 		err = tools.RunCompanyAccess(args)
@@ -62,12 +96,138 @@ func main() {
 		os.Exit(1)
 	}
 
+	if common.Settings().QuotaReport {
+		for _, u := range common.DefaultQuota.Usage() {
+			fmt.Fprintf(os.Stderr, "Quota: %s used %d units in %d requests\n", u.User, u.Units, u.Requests)
+		}
+	}
+
 	if err != nil {
+		// With --output json, also report the error on stdout so a consumer
+		// parsing stdout can tell "not found" from "rate limited", unless the
+		// command's result already did.
+		var reported *tools.ReportedError
+		if wantsJSON(args) && !errors.As(err, &reported) {
+			printJSONError(err)
+		}
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		if common.ErrorKindOf(err) == common.KindAuthExpired {
+			os.Exit(exitAuthRequired)
+		}
 		os.Exit(1)
 	}
 }
 
+// commandScopes is the OAuth scope class each Gmail command needs, so a
+// read-only login is enough for triage. Commands not listed need modify.
+var commandScopes = map[string]common.ScopeClass{
+	"read-messages":       common.ScopeRead,
+	"read-threads":        common.ScopeRead,
+	"read-message-detail": common.ScopeRead,
+	"download-attachment": common.ScopeRead,
+	"search-messages":     common.ScopeRead,
+	"sync":                common.ScopeRead,
+	"watch":               common.ScopeRead,
+	"list-labels":         common.ScopeRead,
+	"reply-message":       common.ScopeCompose,
+	"draft-reply":         common.ScopeCompose,
+	"compose-message":     common.ScopeCompose,
+	"forward-message":     common.ScopeCompose,
+}
+
+// exitAuthRequired is the exit status when the Gmail authorization is
+// missing, revoked or expired, so scheduled jobs can alert someone to run
+// "support-agent auth login" instead of failing like any other error.
+const exitAuthRequired = 3
+
+// extractGlobalFlags removes flags that work with every command. They go
+// before the command or right after its name; scanning stops at the first
+// other argument or at "--", so a command's own flag value that looks like a
+// global flag (e.g. --body --no-cache) is left to the command. It returns the
+// remaining arguments, the --config path and the configuration keys set by
+// the other flags.
+func extractGlobalFlags(argv []string) ([]string, string, map[string]string, error) {
+	rest := make([]string, 0, len(argv))
+	configPath := ""
+	overrides := map[string]string{}
+	command := false
+	for i := 0; i < len(argv); i++ {
+		a := argv[i]
+		switch {
+		case a == "--":
+			return append(rest, argv[i:]...), configPath, overrides, nil
+		case a == "--no-cache" || a == "-no-cache":
+			overrides["cache"] = "false"
+		case a == "--profile" || a == "-profile", a == "--config" || a == "-config":
+			if i+1 >= len(argv) {
+				return nil, "", nil, fmt.Errorf("%s requires a value", a)
+			}
+			i++
+			if strings.HasSuffix(a, "profile") {
+				overrides["profile"] = argv[i]
+			} else {
+				configPath = argv[i]
+			}
+		case strings.HasPrefix(a, "--profile=") || strings.HasPrefix(a, "-profile="):
+			overrides["profile"] = a[strings.Index(a, "=")+1:]
+		case strings.HasPrefix(a, "--config=") || strings.HasPrefix(a, "-config="):
+			configPath = a[strings.Index(a, "=")+1:]
+		case !command:
+			command = true
+			rest = append(rest, a)
+		default:
+			return append(rest, argv[i:]...), configPath, overrides, nil
+		}
+	}
+	return rest, configPath, overrides, nil
+}
+
+// loadConfig loads the configuration file, .env and environment, applies
+// the global flags on top and validates the result before any command runs.
+func loadConfig(path string, overrides map[string]string) error {
+	config, err := common.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	for key, value := range overrides {
+		if err := config.Set(key, value); err != nil {
+			return err
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	common.SetConfig(config)
+	return nil
+}
+
+// wantsJSON reports whether the command was asked for JSON output.
+func wantsJSON(args []string) bool {
+	for i, a := range args {
+		switch a {
+		case "--output=json", "-output=json":
+			return true
+		case "--output", "-output":
+			if i+1 < len(args) && args[i+1] == "json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// printJSONError writes err to stdout as {"error": {"message", "kind"}}.
+func printJSONError(err error) {
+	out := map[string]interface{}{
+		"error": map[string]string{
+			"message": err.Error(),
+			"kind":    string(common.ErrorKindOf(err)),
+		},
+	}
+	jsonData, _ := json.MarshalIndent(out, "", "  ")
+	fmt.Println(string(jsonData))
+}
+
 func printUsage() {
 	fmt.Println("Gmail Support Agent - Command-line tools for Gmail integration")
 	fmt.Println()
@@ -79,8 +239,13 @@ func printUsage() {
 	fmt.Println("    --from EMAIL        Filter by sender")
 	fmt.Println("    --subject TEXT      Filter by subject")
 	fmt.Println("    --label LABEL       Filter by label")
-	fmt.Println("    --limit N           Max results (default: 10)")
+	fmt.Println("    --limit N           Max results across pages (default: 10)")
+	fmt.Println("    --all               Return every matching message")
+	fmt.Println("    --page-token TOKEN  Resume from a previous next_page_token")
+	fmt.Println("    --workers N         Messages fetched concurrently (default: 8)")
+	fmt.Println("    --batch             Fetch messages via Gmail batch requests instead")
 	fmt.Println("    --output FORMAT     Output format: simple, detailed, json")
+	fmt.Println("    --envelope          With json, print {messages, next_page_token, errors} instead of an array")
 	fmt.Println()
 	fmt.Println("  read-threads           Get full conversation thread")
 	fmt.Println("    --thread-id ID      Thread ID (required)")
@@ -98,8 +263,30 @@ func printUsage() {
 	fmt.Println()
 	fmt.Println("  search-messages        Search using Gmail query syntax")
 	fmt.Println("    --query QUERY       Search query (required)")
-	fmt.Println("    --limit N           Max results (default: 20)")
+	fmt.Println("    --limit N           Max results across pages (default: 20)")
+	fmt.Println("    --all               Return every matching message")
+	fmt.Println("    --page-token TOKEN  Resume from a previous next_page_token")
+	fmt.Println("    --workers N         Messages fetched concurrently (default: 8)")
+	fmt.Println("    --batch             Fetch messages via Gmail batch requests instead")
+	fmt.Println("    --local             Search the local mirror offline (phrases, \"a b\"~N, /regex/; no --page-token)")
 	fmt.Println("    --output FORMAT     Output format: simple, detailed, json")
+	fmt.Println("    --envelope          With json, print {messages, next_page_token, errors} instead of an array")
+	fmt.Println()
+	fmt.Println("  sync                   Emit mailbox changes since the last run as NDJSON")
+	fmt.Println("    --label LABEL       Only sync this label (default: INBOX; \"\" for all mail)")
+	fmt.Println("    --reset             Ignore the saved checkpoint and do a full resync")
+	fmt.Println("    --dry-run           Don't save the new checkpoint")
+	fmt.Println("    --limit N           Max messages emitted by a full resync (default: all; a cut-short resync isn't checkpointed)")
+	fmt.Println("    --mirror            Also fetch changes into the local search index")
+	fmt.Println()
+	fmt.Println("  watch                  Stream newly arrived messages as NDJSON (runs until stopped)")
+	fmt.Println("    --interval DUR      Polling interval (default: 30s; 0 for push only)")
+	fmt.Println("    --listen ADDR       Serve a Pub/Sub push endpoint (e.g. :8080)")
+	fmt.Println("    --path PATH         Push endpoint path (default: /gmail/push)")
+	fmt.Println("    --push-token TOKEN  Require ?token=TOKEN on push requests (required with --listen)")
+	fmt.Println("    --topic TOPIC       Register a Gmail watch on this Pub/Sub topic")
+	fmt.Println("    --label LABEL       Only emit messages with this label (default: INBOX)")
+	fmt.Println("    --no-body           Omit message bodies")
 	fmt.Println()
 	fmt.Println("Write Commands:")
 	fmt.Println("  reply-message          Send a reply to a message")
@@ -110,6 +297,10 @@ func printUsage() {
 	fmt.Println("    --cc EMAIL          Cc recipients (comma-separated)")
 	fmt.Println("    --bcc EMAIL         Bcc recipients (comma-separated)")
 	fmt.Println("    --attach PATH       File to attach (repeatable)")
+	fmt.Println("    --body-format FMT   text (default), markdown or html")
+	fmt.Println("    --inline IMAGE      Image shown in the body, by filename or cid:FILENAME (repeatable)")
+	fmt.Println("    --quote             Quote the original message below the reply (default: profile quote)")
+	fmt.Println("    --quote-lines N     Quote at most N lines of the original (default: profile quote_lines, 0: all)")
 	fmt.Println()
 	fmt.Println("  draft-reply            Create a draft reply in Gmail (does NOT send)")
 	fmt.Println("    --message-id ID     Original message ID (required)")
@@ -119,6 +310,10 @@ func printUsage() {
 	fmt.Println("    --cc EMAIL          Cc recipients (comma-separated)")
 	fmt.Println("    --bcc EMAIL         Bcc recipients (comma-separated)")
 	fmt.Println("    --attach PATH       File to attach (repeatable)")
+	fmt.Println("    --body-format FMT   text (default), markdown or html")
+	fmt.Println("    --inline IMAGE      Image shown in the body, by filename or cid:FILENAME (repeatable)")
+	fmt.Println("    --quote             Quote the original message below the reply (default: profile quote)")
+	fmt.Println("    --quote-lines N     Quote at most N lines of the original (default: profile quote_lines, 0: all)")
 	fmt.Println()
 	fmt.Println("  compose-message        Start a new email thread")
 	fmt.Println("    --to EMAIL          Recipient (required)")
@@ -127,10 +322,26 @@ func printUsage() {
 	fmt.Println("    --cc EMAIL          Cc recipients (comma-separated)")
 	fmt.Println("    --bcc EMAIL         Bcc recipients (comma-separated)")
 	fmt.Println("    --attach PATH       File to attach (repeatable)")
+	fmt.Println("    --body-format FMT   text (default), markdown or html")
+	fmt.Println("    --inline IMAGE      Image shown in the body, by filename or cid:FILENAME (repeatable)")
+	fmt.Println()
+	fmt.Println("  forward-message        Forward a message with its attachments")
+	fmt.Println("    --message-id ID     Message to forward (required)")
+	fmt.Println("    --to EMAIL          Recipients (required)")
+	fmt.Println("    --note TEXT         Text above the forwarded message")
+	fmt.Println("    --body-format FMT   text (default), markdown or html")
+	fmt.Println("    --inline IMAGE      Image shown in the body, by filename or cid:FILENAME (repeatable)")
+	fmt.Println("    --cc EMAIL          Cc recipients (comma-separated)")
+	fmt.Println("    --bcc EMAIL         Bcc recipients (comma-separated)")
+	fmt.Println("    --as-attachment     Attach the original whole (message/rfc822) instead of inlining it")
+	fmt.Println("    --attach PATH       Another file to attach (repeatable)")
 	fmt.Println()
 	fmt.Println("  archive-message        Archive messages or threads")
 	fmt.Println("    --message-id ID     Message to archive")
 	fmt.Println("    --thread-id ID      Thread to archive")
+	fmt.Println("    --query QUERY       Archive all messages matching a Gmail query (batched)")
+	fmt.Println("    --limit N           Max messages for --query (default: 500)")
+	fmt.Println("    --output FORMAT     Output format for --query: simple, json")
 	fmt.Println()
 	fmt.Println("  label-message          Add/remove labels")
 	fmt.Println("    --message-id ID     Message to label")
@@ -138,6 +349,9 @@ func printUsage() {
 	fmt.Println("    --add-label LABEL   Label(s) to add (comma-separated, name or ID)")
 	fmt.Println("    --remove-label LABEL Label(s) to remove (comma-separated, name or ID)")
 	fmt.Println("    --create-if-missing Create labels in --add-label that don't exist yet")
+	fmt.Println("    --query QUERY       Label all messages matching a Gmail query (batched)")
+	fmt.Println("    --limit N           Max messages for --query (default: 500)")
+	fmt.Println("    --output FORMAT     Output format for --query: simple, json")
 	fmt.Println()
 	fmt.Println("  list-labels            List all Gmail labels (system + user)")
 	fmt.Println("    --user-only         Only show user-created labels")
@@ -146,6 +360,48 @@ func printUsage() {
 	fmt.Println("  create-label           Create a new user label")
 	fmt.Println("    --name TEXT         Label name (required, e.g. \"Follow-up\")")
 	fmt.Println()
+	fmt.Println("Auth Commands:")
+	fmt.Println("  auth login             Authorize Gmail access and save the token")
+	fmt.Println("    --scope CLASS       read, compose (read + drafts/send) or modify (default: modify)")
+	fmt.Println("    --no-browser        Print the consent URL and SSH port-forward steps instead of opening a browser")
+	fmt.Println("    --device            Opt in to the device-code flow (Google refuses Gmail scopes for most clients)")
+	fmt.Println("    --timeout DUR       How long to wait for authorization (default: 5m)")
+	fmt.Println("  auth status            Show the authorized account, scopes and token expiry")
+	fmt.Println("    --scope CLASS       Check the token commands of this class use (default: read)")
+	fmt.Println("    --output FORMAT     Output format: simple, json")
+	fmt.Println("  auth revoke            Revoke all authorizations with Google and delete the tokens")
+	fmt.Println("  auth migrate           Move plaintext token.json files into the keyring or encrypted store")
+	fmt.Println("    --output FORMAT     Output format: simple, json")
+	fmt.Println()
+	fmt.Println("Profile Commands:")
+	fmt.Println("  profiles list          List mailbox profiles (* marks the active one)")
+	fmt.Println("    --output FORMAT     Output format: simple, json")
+	fmt.Println("  profiles add NAME      Create a profile with its own credentials, token and defaults")
+	fmt.Println("    --credentials PATH  OAuth client credentials file for this profile")
+	fmt.Println("    --service-account-key PATH  Service account key (domain-wide delegation) instead of a login")
+	fmt.Println("    --impersonate EMAIL Workspace user the service account acts as")
+	fmt.Println("    --user-id ID        Mailbox to act on (default: me)")
+	fmt.Println("    --internal-domain D Email domain treated as staff, with subdomains (repeatable; default: blue.cc)")
+	fmt.Println("    --staff EMAIL       Address on another domain treated as staff, e.g. a contractor (repeatable)")
+	fmt.Println("    --signature TEXT    Signature appended to replies, drafts and new messages")
+	fmt.Println("    --quote             Quote the original message in replies and drafts by default")
+	fmt.Println("    --quote-lines N     Quote at most N lines of the original (default: all)")
+	fmt.Println("    --label NAME        Label read-messages lists by default instead of INBOX (repeatable)")
+	fmt.Println()
+	fmt.Println("Cache Commands:")
+	fmt.Println("  cache stats            Show local message cache size and entry counts")
+	fmt.Println("    --output FORMAT     Output format: simple, json")
+	fmt.Println("  cache purge            Delete all cached messages and threads")
+	fmt.Println()
+	fmt.Println("Config Commands:")
+	fmt.Println("  config show            Show effective settings and where each came from (secrets redacted)")
+	fmt.Println("    --output FORMAT     Output format: simple, json")
+	fmt.Println()
+	fmt.Println("Global Options (before the command or right after its name):")
+	fmt.Println("  --config PATH          Config file (default: $SUPPORT_AGENT_CONFIG, else ~/.support-agent/config.yaml)")
+	fmt.Println("  --no-cache             Bypass the local message cache for this run")
+	fmt.Println("  --profile NAME         Use a mailbox profile (default: $SUPPORT_AGENT_PROFILE, else default)")
+	fmt.Println()
 	fmt.Println("Company Access Commands (Support Investigation):")
 	fmt.Println("  company-access         Grant/remove owner access for support")
 	fmt.Println("    --company SLUG      Company slug or ID (required)")
@@ -157,6 +413,7 @@ func printUsage() {
 	fmt.Println("  support-agent read-messages --unread --limit 5")
 	fmt.Println("  support-agent search-messages --query \"from:customer@example.com\"")
 	fmt.Println("  support-agent read-threads --thread-id THREAD_ID --output json")
+	fmt.Println("  support-agent sync")
 	fmt.Println("  support-agent reply-message --message-id MSG_ID --body \"Thank you for contacting us\"")
 	fmt.Println("  support-agent archive-message --thread-id THREAD_ID")
 	fmt.Println("  support-agent company-access --company acme-corp")
@@ -164,12 +421,23 @@ func printUsage() {
 	fmt.Println("  support-agent company-access --company acme-corp --remove")
 	fmt.Println()
 	fmt.Println("Authentication:")
-	fmt.Println("  On first run, you'll be prompted to authenticate with Gmail.")
-	fmt.Println("  The token is saved in ~/.support-agent/token.json")
+	fmt.Println("  Run 'support-agent auth login' once; a browser opens for Google consent.")
+	fmt.Println("  Over SSH, use 'auth login --no-browser' and forward the printed port (ssh -L).")
+	fmt.Println("  Read commands only need 'auth login --scope read'; replies and drafts need compose;")
+	fmt.Println("  archiving and labeling need modify. Each scope class keeps its own token.")
+	fmt.Println("  The token is saved in the OS keyring, else encrypted with SUPPORT_AGENT_TOKEN_PASSPHRASE,")
+	fmt.Println("  else in ~/.support-agent/token.json, and kept up to date as it refreshes.")
+	fmt.Println("  Commands exit with status 3 when the authorization is missing, revoked or")
+	fmt.Println("  expired; without a terminal they fail instead of starting a login.")
+	fmt.Println("  Unattended servers can use a service account instead: set GMAIL_SERVICE_ACCOUNT_KEY")
+	fmt.Println("  and GMAIL_IMPERSONATE, or a profile with --service-account-key.")
 	fmt.Println()
 	fmt.Println("Configuration:")
-	fmt.Println("  Create a .env file with:")
-	fmt.Println("    GMAIL_CREDENTIALS_PATH=./gmail.json")
-	fmt.Println("    TOKEN_DIR=~/.support-agent")
-	fmt.Println("    USER_EMAIL=your-email@example.com")
+	fmt.Println("  Settings come from defaults, then the config file, then .env, then the")
+	fmt.Println("  environment, then flags. For example, in ~/.support-agent/config.yaml:")
+	fmt.Println("    credentials_path: ~/.support-agent/gmail.json")
+	fmt.Println("    token_store: keyring")
+	fmt.Println("    quota_report: true")
+	fmt.Println("  or in .env / the environment: GMAIL_CREDENTIALS_PATH, TOKEN_DIR, DATABASE_URL, ...")
+	fmt.Println("  Run 'support-agent config show' to see the effective values.")
 }
\ No newline at end of file
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtractGlobalFlags(t *testing.T) {
+	tests := []struct {
+		argv      []string
+		rest      []string
+		config    string
+		overrides map[string]string
+	}{
+		{
+			argv:      []string{"--profile", "billing", "read-messages", "--unread"},
+			rest:      []string{"read-messages", "--unread"},
+			overrides: map[string]string{"profile": "billing"},
+		},
+		{
+			argv:      []string{"read-threads", "--no-cache", "--config=c.yaml", "--thread-id", "t1"},
+			rest:      []string{"read-threads", "--thread-id", "t1"},
+			config:    "c.yaml",
+			overrides: map[string]string{"cache": "false"},
+		},
+		{
+			argv:      []string{"auth", "-profile=billing", "login"},
+			rest:      []string{"auth", "login"},
+			overrides: map[string]string{"profile": "billing"},
+		},
+		{
+			// Values of the command's own flags are left alone.
+			argv:      []string{"compose-message", "--to", "a@b.c", "--subject", "--profile", "--body", "--no-cache"},
+			rest:      []string{"compose-message", "--to", "a@b.c", "--subject", "--profile", "--body", "--no-cache"},
+			overrides: map[string]string{},
+		},
+		{
+			argv:      []string{"--no-cache", "search-messages", "--", "--profile", "x"},
+			rest:      []string{"search-messages", "--", "--profile", "x"},
+			overrides: map[string]string{"cache": "false"},
+		},
+		{
+			argv:      []string{},
+			rest:      []string{},
+			overrides: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		rest, config, overrides, err := extractGlobalFlags(tt.argv)
+		if err != nil {
+			t.Errorf("extractGlobalFlags(%q): %v", tt.argv, err)
+			continue
+		}
+		if !reflect.DeepEqual(rest, tt.rest) || config != tt.config || !reflect.DeepEqual(overrides, tt.overrides) {
+			t.Errorf("extractGlobalFlags(%q) = %q, %q, %v; want %q, %q, %v", tt.argv, rest, config, overrides, tt.rest, tt.config, tt.overrides)
+		}
+	}
+
+	if _, _, _, err := extractGlobalFlags([]string{"read-messages", "--profile"}); err == nil {
+		t.Error("--profile without a value was accepted")
+	}
+}
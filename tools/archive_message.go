@@ -3,8 +3,6 @@ package tools
 import (
 	"flag"
 	"fmt"
-
-	"github.com/blue/support-agent/common"
 )
 
 // RunArchiveMessage archives messages or threads
@@ -14,35 +12,44 @@ func RunArchiveMessage(args []string) error {
 	// Define flags
 	messageID := fs.String("message-id", "", "Message ID to archive")
 	threadID := fs.String("thread-id", "", "Thread ID to archive (archives all messages in thread)")
+	query := fs.String("query", "", "Archive every message matching this Gmail query (batched)")
+	limit := fs.Int64("limit", 500, "Maximum number of messages to archive with --query")
+	output := fs.String("output", "simple", "Output format for --query: simple or json")
 	
 	// Parse args
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
 
-	// Validate - need either message or thread ID
-	if *messageID == "" && *threadID == "" {
-		fmt.Println("Error: either message-id or thread-id is required")
+	// Validate - need a message ID, thread ID or query
+	if *messageID == "" && *threadID == "" && *query == "" {
+		fmt.Println("Error: one of message-id, thread-id or query is required")
 		fmt.Println("\nUsage:")
 		fmt.Println("  archive-message --message-id MESSAGE_ID")
 		fmt.Println("  archive-message --thread-id THREAD_ID")
-		return fmt.Errorf("message-id or thread-id required")
+		fmt.Println("  archive-message --query \"in:inbox older_than:30d\" [--limit N] [--output json]")
+		return fmt.Errorf("message-id, thread-id or query required")
 	}
 
 	// Create client
-	client, err := common.NewGmailClient()
+	client, err := newGmailAPI()
 	if err != nil {
-		return fmt.Errorf("failed to create Gmail client: %v", err)
+		return fmt.Errorf("failed to create Gmail client: %w", err)
 	}
+	defer client.Close()
 
 	// Archive by removing INBOX label
 	removeLabels := []string{"INBOX"}
 	
+	if *query != "" {
+		return runBulkModify(client, *query, *limit, nil, removeLabels, *output, "archived")
+	}
+
 	if *threadID != "" {
 		// Archive entire thread
 		thread, err := client.ModifyThread(*threadID, nil, removeLabels)
 		if err != nil {
-			return fmt.Errorf("failed to archive thread: %v", err)
+			return fmt.Errorf("failed to archive thread: %w", err)
 		}
 		
 		fmt.Printf("Thread archived successfully!\n")
@@ -53,7 +60,7 @@ func RunArchiveMessage(args []string) error {
 		// Archive single message
 		msg, err := client.ModifyMessage(*messageID, nil, removeLabels)
 		if err != nil {
-			return fmt.Errorf("failed to archive message: %v", err)
+			return fmt.Errorf("failed to archive message: %w", err)
 		}
 		
 		fmt.Printf("Message archived successfully!\n")
@@ -0,0 +1,182 @@
+package tools
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/blue/support-agent/common"
+)
+
+const authUsage = "Usage: auth login [--scope read|compose|modify] [--no-browser] [--device] [--timeout DUR] | auth status [--scope CLASS] [--output FORMAT] | auth revoke | auth migrate [--output FORMAT]"
+
+// RunAuth manages the Gmail authorization
+func RunAuth(args []string) error {
+	if len(args) == 0 {
+		fmt.Println(authUsage)
+		return fmt.Errorf("auth subcommand required")
+	}
+
+	switch args[0] {
+	case "login":
+		return runAuthLogin(args[1:])
+	case "status":
+		return runAuthStatus(args[1:])
+	case "revoke":
+		return runAuthRevoke(args[1:])
+	case "migrate":
+		return runAuthMigrate(args[1:])
+	default:
+		fmt.Println(authUsage)
+		return fmt.Errorf("unknown auth subcommand: %s", args[0])
+	}
+}
+
+// runAuthLogin authorizes the tool with Gmail and saves the token,
+// replacing any existing one of the same scope class.
+func runAuthLogin(args []string) error {
+	fs := flag.NewFlagSet("auth login", flag.ExitOnError)
+
+	scope := fs.String("scope", string(common.ScopeModify), "Access to grant: read, compose (read + drafts/send) or modify (everything)")
+	noBrowser := fs.Bool("no-browser", false, "Print the consent URL and how to forward its port (e.g. over SSH) instead of opening a browser")
+	device := fs.Bool("device", false, "Use the device flow (code entered on another device); needs a \"TVs and Limited Input devices\" client and Google does not allow Gmail scopes for it on most clients")
+	timeout := fs.Duration("timeout", common.DefaultLoginTimeout, "How long to wait for authorization")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	class, err := common.ParseScopeClass(*scope)
+	if err != nil {
+		return err
+	}
+
+	method := common.LoginLoopback
+	if *device {
+		method = common.LoginDevice
+	}
+	_, err = common.Login(common.LoginOptions{
+		Method:    method,
+		Scope:     class,
+		NoBrowser: *noBrowser,
+		Timeout:   *timeout,
+	})
+	if err != nil {
+		return fmt.Errorf("login failed: %w", err)
+	}
+
+	store, err := common.OpenTokenStore(common.ActiveProfileName(), class)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Logged in with %s access. Token saved in the %s\n", class, store)
+	return nil
+}
+
+// runAuthStatus shows which account the saved token authorizes, its scopes
+// and when the access token expires. An expired access token is refreshed
+// first, so a revoked authorization is reported as an error.
+func runAuthStatus(args []string) error {
+	fs := flag.NewFlagSet("auth status", flag.ExitOnError)
+	scope := fs.String("scope", string(common.ScopeRead), "Check the token used by commands needing this access: read, compose or modify")
+	output := fs.String("output", "simple", "Output format: simple or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	class, err := common.ParseScopeClass(*scope)
+	if err != nil {
+		return err
+	}
+
+	status, err := common.GetAuthStatus(class)
+	if err != nil {
+		return fmt.Errorf("failed to check authorization: %w", err)
+	}
+
+	if *output == "json" {
+		jsonData, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal JSON: %w", err)
+		}
+		fmt.Println(string(jsonData))
+		return nil
+	}
+
+	expiry := "never"
+	if !status.Expiry.IsZero() {
+		expiry = fmt.Sprintf("%s (in %s)", status.Expiry.Local().Format(time.RFC1123), time.Until(status.Expiry).Round(time.Second))
+	}
+	fmt.Printf("Account:       %s\n", status.Email)
+	fmt.Printf("Scopes:        %s\n", strings.Join(status.Scopes, " "))
+	fmt.Printf("Expires:       %s\n", expiry)
+	if status.ServiceAccount != "" {
+		fmt.Printf("Service acct:  %s (domain-wide delegation)\n", status.ServiceAccount)
+		return nil
+	}
+	fmt.Printf("Refreshable:   %t\n", status.HasRefreshToken)
+	fmt.Printf("Token store:   %s\n", status.TokenStore)
+	return nil
+}
+
+// runAuthRevoke revokes the saved authorizations of every scope class with
+// Google and deletes the tokens.
+func runAuthRevoke(args []string) error {
+	fs := flag.NewFlagSet("auth revoke", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := common.RevokeTokens(); err != nil {
+		return fmt.Errorf("failed to revoke authorization: %w", err)
+	}
+
+	fmt.Println("Authorization revoked and token deleted.")
+	return nil
+}
+
+// runAuthMigrate moves plaintext token.json files of every profile into the
+// configured token store and deletes them.
+func runAuthMigrate(args []string) error {
+	fs := flag.NewFlagSet("auth migrate", flag.ExitOnError)
+	output := fs.String("output", "simple", "Output format: simple or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	results, err := common.MigrateTokens()
+	if err != nil {
+		return fmt.Errorf("failed to migrate tokens: %w", err)
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+		}
+	}
+
+	if *output == "json" {
+		jsonData, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal JSON: %w", err)
+		}
+		fmt.Println(string(jsonData))
+	} else {
+		if len(results) == 0 {
+			fmt.Println("No plaintext tokens to migrate.")
+		}
+		for _, r := range results {
+			if r.Error != "" {
+				fmt.Printf("%s: FAILED: %s\n", r.Profile, r.Error)
+				continue
+			}
+			fmt.Printf("%s: moved to the %s; plaintext token deleted\n", r.Profile, r.Store)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tokens could not be migrated", failed, len(results))
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package tools
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/blue/support-agent/common"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+	xhtml "golang.org/x/net/html"
+)
+
+// BodyFormat is how a --body argument is written.
+type BodyFormat string
+
+const (
+	BodyText     BodyFormat = "text"
+	BodyMarkdown BodyFormat = "markdown"
+	BodyHTML     BodyFormat = "html"
+)
+
+// parseBodyFormat validates a --body-format value.
+func parseBodyFormat(s string) (BodyFormat, error) {
+	switch f := BodyFormat(s); f {
+	case BodyText, BodyMarkdown, BodyHTML:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown body format %q (use text, markdown or html)", s)
+}
+
+// markdown renders GitHub-flavored Markdown. Raw HTML in the source is
+// dropped rather than passed through, and single newlines are kept as line
+// breaks, the way people expect an email to look.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithRendererOptions(gmhtml.WithHardWraps()),
+)
+
+// htmlPolicy is what outgoing HTML is reduced to: formatting, links, lists,
+// tables and images, but no scripts, styles, forms or event handlers.
+// Images may use cid: URLs to show inline images.
+var htmlPolicy = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowURLSchemes("cid")
+	return p
+}()
+
+// renderBody returns the plain-text and HTML versions of body, each with the
+// profile signature appended. The HTML version is empty for BodyText. Image
+// references to inline images are pointed at their Content-IDs.
+func renderBody(body string, format BodyFormat, inline []InlineImage) (string, string, error) {
+	var rendered string
+	switch format {
+	case BodyText, "":
+		if len(inline) > 0 {
+			return "", "", fmt.Errorf("--inline needs --body-format markdown or html, so the body can show the images")
+		}
+		return withSignature(body), "", nil
+	case BodyMarkdown:
+		var buf bytes.Buffer
+		if err := markdown.Convert([]byte(body), &buf); err != nil {
+			return "", "", fmt.Errorf("failed to render Markdown: %w", err)
+		}
+		rendered = buf.String()
+	case BodyHTML:
+		rendered = body
+	default:
+		return "", "", fmt.Errorf("unknown body format %q", format)
+	}
+
+	if len(inline) > 0 {
+		var err error
+		if rendered, err = linkInlineImages(rendered, inline); err != nil {
+			return "", "", err
+		}
+	}
+	safe := htmlPolicy.Sanitize(rendered)
+	return withSignature(renderedHTMLToText(safe)), withSignatureHTML(safe), nil
+}
+
+// withSignatureHTML appends the active profile's signature to an HTML body.
+func withSignatureHTML(body string) string {
+	profile, err := common.CurrentProfile()
+	if err != nil || profile.Signature == "" {
+		return body
+	}
+	sig := strings.ReplaceAll(html.EscapeString(profile.Signature), "\n", "<br>\n")
+	return body + "\n<div class=\"signature\">-- <br>\n" + sig + "</div>\n"
+}
+
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+// renderedHTMLToText renders HTML as readable plain text for the text/plain
+// alternative: paragraphs separated by blank lines, list items bulleted or
+// numbered, links followed by their URL and preformatted text kept as is.
+// common's htmlToText only strips tags from received mail for reading; this
+// one lays out HTML we send.
+func renderedHTMLToText(s string) string {
+	doc, err := xhtml.Parse(strings.NewReader(s))
+	if err != nil {
+		return s
+	}
+
+	var out strings.Builder
+	var walk func(n *xhtml.Node, pre bool, list *int)
+	blank := func() { out.WriteString("\n\n") }
+
+	walk = func(n *xhtml.Node, pre bool, list *int) {
+		switch n.Type {
+		case xhtml.TextNode:
+			if pre {
+				out.WriteString(n.Data)
+			} else {
+				writeText(&out, n.Data)
+			}
+			return
+		case xhtml.ElementNode:
+		default:
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				walk(c, pre, list)
+			}
+			return
+		}
+
+		children := func(pre bool, list *int) {
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				walk(c, pre, list)
+			}
+		}
+
+		switch n.Data {
+		case "script", "style", "head":
+		case "br":
+			out.WriteString("\n")
+		case "hr":
+			blank()
+			out.WriteString("----")
+			blank()
+		case "p", "div", "blockquote", "table", "h1", "h2", "h3", "h4", "h5", "h6":
+			blank()
+			children(pre, list)
+			blank()
+		case "tr":
+			out.WriteString("\n")
+			children(pre, list)
+		case "td", "th":
+			children(pre, list)
+			out.WriteString("\t")
+		case "pre":
+			blank()
+			children(true, list)
+			blank()
+		case "ul":
+			blank()
+			children(pre, nil)
+			blank()
+		case "ol":
+			count := 0
+			blank()
+			children(pre, &count)
+			blank()
+		case "li":
+			out.WriteString("\n")
+			if list != nil {
+				*list++
+				fmt.Fprintf(&out, "%d. ", *list)
+			} else {
+				out.WriteString("- ")
+			}
+			children(pre, nil)
+		case "a":
+			start := out.Len()
+			children(pre, list)
+			text := out.String()[start:]
+			href := attr(n, "href")
+			if href != "" && strings.TrimPrefix(href, "mailto:") != strings.TrimSpace(text) {
+				fmt.Fprintf(&out, " (%s)", href)
+			}
+		case "img":
+			if alt := attr(n, "alt"); alt != "" {
+				fmt.Fprintf(&out, "[%s]", alt)
+			}
+		default:
+			children(pre, list)
+		}
+	}
+	walk(doc, false, nil)
+
+	text := out.String()
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	text = blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(text) + "\n"
+}
+
+var spaceRun = regexp.MustCompile(`\s+`)
+
+// writeText writes HTML text with runs of whitespace collapsed to a single
+// space, as a browser would, dropping a space at the start of a line.
+func writeText(out *strings.Builder, s string) {
+	s = spaceRun.ReplaceAllString(s, " ")
+	if strings.HasPrefix(s, " ") {
+		written := out.String()
+		if written == "" || strings.HasSuffix(written, " ") || strings.HasSuffix(written, "\n") {
+			s = s[1:]
+		}
+	}
+	out.WriteString(s)
+}
+
+// attr returns the value of the named attribute of n.
+func attr(n *xhtml.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+package tools
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderBodyMarkdown(t *testing.T) {
+	useConfig(t)
+	src := "Hi Ana,\n\nTo export again:\n\n1. Open **Settings**\n2. Click [Export](https://help.blue.cc/export)\n\n```\nblue export --all\n```\n\n<script>alert(1)</script>\n\n[click](javascript:alert(1))"
+
+	text, html, err := renderBody(src, BodyMarkdown, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"<strong>Settings</strong>", `href="https://help.blue.cc/export"`, "<pre><code>blue export --all"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML lacks %q:\n%s", want, html)
+		}
+	}
+	for _, bad := range []string{"<script", "javascript:"} {
+		if strings.Contains(html, bad) {
+			t.Errorf("HTML contains %q:\n%s", bad, html)
+		}
+	}
+
+	want := "Hi Ana,\n\nTo export again:\n\n1. Open Settings\n2. Click Export (https://help.blue.cc/export)\n\nblue export --all\n\nclick"
+	if strings.TrimSpace(text) != want {
+		t.Errorf("plain text =\n%s\nwant\n%s", text, want)
+	}
+}
+
+func TestRenderBodyHTMLSanitized(t *testing.T) {
+	useConfig(t)
+	_, html, err := renderBody(`<p onclick="steal()">Hello <img src=x onerror=alert(1)><a href="https://blue.cc">docs</a></p><style>p{}</style>`, BodyHTML, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{"onclick", "onerror", "<style"} {
+		if strings.Contains(html, bad) {
+			t.Errorf("sanitized HTML contains %q: %s", bad, html)
+		}
+	}
+	if !strings.Contains(html, `href="https://blue.cc"`) {
+		t.Errorf("sanitized HTML lost the link: %s", html)
+	}
+
+	if text, html, _ := renderBody("plain *text*", BodyText, nil); text != "plain *text*" || html != "" {
+		t.Errorf("text format = %q, %q; want the body unchanged and no HTML", text, html)
+	}
+	if _, err := parseBodyFormat("rtf"); err == nil {
+		t.Error("parseBodyFormat accepted rtf")
+	}
+}
+
+func TestHTMLToText(t *testing.T) {
+	got := renderedHTMLToText("<h1>Title</h1><p>One\n   two<br>three</p><ul><li>a</li><li><a href=\"mailto:x@y.com\">x@y.com</a></li></ul><pre>  keep\n  this</pre>")
+	want := "Title\n\nOne two\nthree\n\n- a\n- x@y.com\n\n  keep\n  this\n"
+	if got != want {
+		t.Errorf("renderedHTMLToText =\n%q\nwant\n%q", got, want)
+	}
+}
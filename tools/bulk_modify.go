@@ -0,0 +1,92 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/blue/support-agent/common"
+)
+
+// BulkModifyResult is the output of a query-driven label change
+type BulkModifyResult struct {
+	Query         string               `json:"query"`
+	Matched       int                  `json:"matched"`
+	Succeeded     int                  `json:"succeeded"`
+	Failed        int                  `json:"failed"`
+	Results       []common.BatchResult `json:"results"`
+	NextPageToken string               `json:"next_page_token,omitempty"`
+}
+
+// runBulkModify applies a label change to every message matching query (up
+// to limit) via BatchModify, so hundreds of messages take a handful of
+// requests. action is used in human-readable output ("labeled", "archived").
+func runBulkModify(client common.GmailAPI, query string, limit int64, addLabels, removeLabels []string, output, action string) error {
+	list, err := client.ListMessages(query, limit, "")
+	if err != nil {
+		return fmt.Errorf("failed to list messages: %w", err)
+	}
+
+	result := BulkModifyResult{
+		Query:         query,
+		Matched:       len(list.Messages),
+		Results:       []common.BatchResult{},
+		NextPageToken: list.NextPageToken,
+	}
+
+	if len(list.Messages) > 0 {
+		results, err := client.BatchModifyMessages(common.MessageIDs(list.Messages), addLabels, removeLabels)
+		if err != nil {
+			return fmt.Errorf("failed to modify messages: %w", err)
+		}
+		result.Results = results
+	}
+
+	for _, r := range result.Results {
+		if r.Status == "ok" {
+			result.Succeeded++
+		} else {
+			result.Failed++
+		}
+	}
+
+	if output == "json" {
+		jsonData, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal JSON: %w", err)
+		}
+		fmt.Println(string(jsonData))
+	} else {
+		fmt.Printf("Matched %d messages for query: %s\n", result.Matched, query)
+		for _, r := range result.Results {
+			if r.Status == "ok" {
+				fmt.Printf("  %s: %s\n", r.ID, action)
+			} else {
+				fmt.Printf("  %s: FAILED (%s)\n", r.ID, r.Error)
+			}
+		}
+		fmt.Printf("\n%d %s, %d failed\n", result.Succeeded, action, result.Failed)
+		if result.NextPageToken != "" {
+			fmt.Printf("More messages match the query; raise --limit to include them.\n")
+		}
+	}
+
+	if result.Failed > 0 {
+		err := fmt.Errorf("%d of %d messages could not be %s", result.Failed, result.Matched, action)
+		if output == "json" {
+			return &ReportedError{Err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+// ReportedError is a command failure already described in the JSON result it
+// printed. The command still exits non-zero, but main doesn't print a second
+// {"error": ...} document after the result.
+type ReportedError struct {
+	Err error
+}
+
+func (e *ReportedError) Error() string { return e.Err.Error() }
+
+func (e *ReportedError) Unwrap() error { return e.Err }
@@ -0,0 +1,46 @@
+package tools
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/blue/support-agent/common"
+	"github.com/blue/support-agent/common/fakegmail"
+	"google.golang.org/api/gmail/v1"
+)
+
+// vanishingMailbox lists a message that is gone by the time it is modified.
+type vanishingMailbox struct {
+	*fakegmail.Mailbox
+}
+
+func (m vanishingMailbox) ListMessages(query string, limit int64, pageToken string) (*common.MessageList, error) {
+	list, err := m.Mailbox.ListMessages(query, limit, pageToken)
+	if err != nil {
+		return nil, err
+	}
+	list.Messages = append(list.Messages, &gmail.Message{Id: "gone"})
+	return list, nil
+}
+
+func TestRunBulkModifyPartialFailure(t *testing.T) {
+	useConfig(t)
+	mb := fakegmail.New()
+	mb.Add(fakegmail.Message{ID: "m1", From: "ana@customer.com", To: "help@blue.cc", Subject: "Export", Body: "Broken.", Labels: []string{"INBOX"}})
+	client := vanishingMailbox{mb}
+
+	var reported *ReportedError
+	err := runBulkModify(client, "from:ana@customer.com", 10, nil, []string{"INBOX"}, "json", "archived")
+	if err == nil || !errors.As(err, &reported) {
+		t.Fatalf("json output: err = %v, want a ReportedError", err)
+	}
+	err = runBulkModify(client, "from:ana@customer.com", 10, nil, []string{"INBOX"}, "text", "archived")
+	if err == nil || errors.As(err, &reported) {
+		t.Fatalf("text output: err = %v, want an unreported error", err)
+	}
+	for _, id := range mb.Message("m1").LabelIds {
+		if id == "INBOX" {
+			t.Error("m1 was not archived")
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package tools
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"github.com/blue/support-agent/common"
+)
+
+// RunCache inspects or clears the local message cache
+func RunCache(args []string) error {
+	if len(args) == 0 {
+		fmt.Println("Usage: cache stats [--output FORMAT] | cache purge")
+		return fmt.Errorf("cache subcommand required")
+	}
+
+	sub := args[0]
+	fs := flag.NewFlagSet("cache "+sub, flag.ExitOnError)
+	output := fs.String("output", "simple", "Output format: simple or json")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	cache, err := common.OpenCache(common.DefaultCachePath())
+	if err != nil {
+		return err
+	}
+	defer cache.Close()
+
+	switch sub {
+	case "stats":
+		stats, err := cache.Stats()
+		if err != nil {
+			return fmt.Errorf("failed to read cache stats: %w", err)
+		}
+		if *output == "json" {
+			jsonData, err := json.MarshalIndent(stats, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to marshal JSON: %w", err)
+			}
+			fmt.Println(string(jsonData))
+			return nil
+		}
+		fmt.Printf("Path:       %s\n", stats.Path)
+		fmt.Printf("Size:       %d bytes\n", stats.SizeBytes)
+		fmt.Printf("Messages:   %d\n", stats.Messages)
+		fmt.Printf("Threads:    %d\n", stats.Threads)
+		fmt.Printf("Indexed:    %d\n", stats.Indexed)
+		fmt.Printf("History ID: %d\n", stats.HistoryID)
+
+	case "purge":
+		if err := cache.Purge(); err != nil {
+			return fmt.Errorf("failed to purge cache: %w", err)
+		}
+		if err := cache.PurgeIndex(); err != nil {
+			return fmt.Errorf("failed to purge search index: %w", err)
+		}
+		fmt.Println("Cache and local search index purged.")
+
+	default:
+		fmt.Println("Usage: cache stats [--output FORMAT] | cache purge")
+		return fmt.Errorf("unknown cache subcommand: %s", sub)
+	}
+
+	return nil
+}
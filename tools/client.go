@@ -0,0 +1,13 @@
+package tools
+
+import "github.com/blue/support-agent/common"
+
+// newGmailAPI creates the mailbox client for commands that only need the
+// common.GmailAPI surface. Tests replace it with a fakegmail.Mailbox.
+var newGmailAPI = func() (common.GmailAPI, error) {
+	client, err := common.NewGmailClient()
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
@@ -6,19 +6,14 @@ import (
 	"flag"
 	"fmt"
 	"math/rand"
-	"os"
 	"strings"
 	"time"
 
+	"github.com/blue/support-agent/common"
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/joho/godotenv"
 )
 
-const (
-	// Support user email - hardcoded for security
-	supportUserEmail = "manny@blue.cc"
-	ownerLevel       = "OWNER"
-)
+const ownerLevel = "OWNER"
 
 // AccessResult represents the result of an access operation
 type AccessResult struct {
@@ -61,13 +56,11 @@ type CompanyUserInfo struct {
 	Level string `json:"level"`
 }
 
-// getDatabaseURL loads the database URL from environment
+// getDatabaseURL returns the database URL from the configuration
 func getDatabaseURL() (string, error) {
-	godotenv.Load()
-
-	dbURL := os.Getenv("DATABASE_URL")
+	dbURL := common.Settings().DatabaseURL
 	if dbURL == "" {
-		return "", fmt.Errorf("DATABASE_URL not set in environment")
+		return "", fmt.Errorf("database_url not configured (set DATABASE_URL or database_url in the config file)")
 	}
 
 	// Convert from prisma format to Go MySQL driver format
@@ -196,9 +189,9 @@ func grantAccess(db *sql.DB, companySlug string, projectSlugs []string, outputFo
 		SELECT id, uid, email, CONCAT(firstName, ' ', lastName) as name
 		FROM User
 		WHERE email = ?
-	`, supportUserEmail).Scan(&user.ID, &user.UID, &user.Email, &user.Name)
+	`, common.Settings().SupportUserEmail).Scan(&user.ID, &user.UID, &user.Email, &user.Name)
 	if err != nil {
-		return fmt.Errorf("failed to find support user (%s): %v", supportUserEmail, err)
+		return fmt.Errorf("failed to find support user (%s): %v", common.Settings().SupportUserEmail, err)
 	}
 
 	// 2. Find the company
@@ -359,9 +352,9 @@ func removeAccess(db *sql.DB, companySlug string, projectSlugs []string, outputF
 		SELECT id, uid, email, CONCAT(firstName, ' ', lastName) as name
 		FROM User
 		WHERE email = ?
-	`, supportUserEmail).Scan(&user.ID, &user.UID, &user.Email, &user.Name)
+	`, common.Settings().SupportUserEmail).Scan(&user.ID, &user.UID, &user.Email, &user.Name)
 	if err != nil {
-		return fmt.Errorf("failed to find support user (%s): %v", supportUserEmail, err)
+		return fmt.Errorf("failed to find support user (%s): %v", common.Settings().SupportUserEmail, err)
 	}
 
 	// 2. Find the company
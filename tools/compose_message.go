@@ -3,6 +3,7 @@ package tools
 import (
 	"flag"
 	"fmt"
+	"io"
 
 	"github.com/blue/support-agent/common"
 	"google.golang.org/api/gmail/v1"
@@ -12,13 +13,16 @@ import (
 func RunComposeMessage(args []string) error {
 	fs := flag.NewFlagSet("compose-message", flag.ExitOnError)
 
-	to := fs.String("to", "", "Recipient email (required)")
+	to := fs.String("to", "", "Recipients (required, comma-separated)")
 	subject := fs.String("subject", "", "Subject line (required)")
 	body := fs.String("body", "", "Message body (required)")
+	bodyFormat := fs.String("body-format", string(BodyText), "How --body is written: text, markdown or html (sent as HTML with a plain-text alternative)")
 	cc := fs.String("cc", "", "Cc recipients (comma-separated)")
 	bcc := fs.String("bcc", "", "Bcc recipients (comma-separated)")
 	var attachments StringSliceFlag
 	fs.Var(&attachments, "attach", "Path to file to attach (repeatable)")
+	var inline StringSliceFlag
+	fs.Var(&inline, "inline", "Image to show in the body, referenced by filename or cid:FILENAME (repeatable; needs --body-format markdown or html)")
 
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -26,43 +30,74 @@ func RunComposeMessage(args []string) error {
 
 	if *to == "" || *subject == "" || *body == "" {
 		fmt.Println("Error: to, subject and body are required")
-		fmt.Println("\nUsage: compose-message --to EMAIL --subject \"Subject\" --body \"Body\" [--cc EMAIL] [--bcc EMAIL] [--attach PATH ...]")
+		fmt.Println("\nUsage: compose-message --to EMAIL --subject \"Subject\" --body \"Body\" [--body-format text|markdown|html] [--cc EMAIL] [--bcc EMAIL] [--attach PATH ...] [--inline IMAGE ...]")
 		return fmt.Errorf("to, subject and body are required")
 	}
 
-	client, err := common.NewGmailClient()
+	format, err := parseBodyFormat(*bodyFormat)
 	if err != nil {
-		return fmt.Errorf("failed to create Gmail client: %v", err)
+		return err
+	}
+	images, err := newInlineImages(inline)
+	if err != nil {
+		return err
+	}
+	text, htmlBody, err := renderBody(*body, format, images)
+	if err != nil {
+		return err
 	}
 
+	toList, err := parseRecipients("to", *to)
+	if err != nil {
+		return err
+	}
+	ccList, err := parseRecipients("cc", *cc)
+	if err != nil {
+		return err
+	}
+	bccList, err := parseRecipients("bcc", *bcc)
+	if err != nil {
+		return err
+	}
+
+	client, err := newGmailAPI()
+	if err != nil {
+		return fmt.Errorf("failed to create Gmail client: %w", err)
+	}
+	defer client.Close()
+
 	msg := &MIMEMessage{
 		From:        "me",
-		To:          *to,
-		Cc:          *cc,
-		Bcc:         *bcc,
+		To:          toList,
+		Cc:          ccList,
+		Bcc:         bccList,
 		Subject:     *subject,
-		Body:        *body,
+		Body:        text,
+		HTMLBody:    htmlBody,
 		Attachments: attachments,
+		Inline:      images,
 	}
 
-	encoded, err := msg.Build()
-	if err != nil {
-		return fmt.Errorf("failed to build message: %v", err)
-	}
-
-	sentMsg, err := client.SendMessage(&gmail.Message{Raw: encoded})
+	var sentMsg *gmail.Message
+	err = uploadMIME(msg, func(raw io.Reader) (err error) {
+		sentMsg, err = client.SendMessage("", raw)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("failed to send message: %v", err)
+		return fmt.Errorf("failed to send message: %w", err)
 	}
 
 	fmt.Printf("Message sent successfully!\n")
 	fmt.Printf("Message ID: %s\n", sentMsg.Id)
 	fmt.Printf("Thread ID: %s\n", sentMsg.ThreadId)
-	fmt.Printf("To: %s\n", *to)
+	fmt.Printf("To: %s\n", common.FormatAddressList(toList))
 	fmt.Printf("Subject: %s\n", *subject)
 	if len(attachments) > 0 {
 		fmt.Printf("Attachments: %d\n", len(attachments))
 	}
+	if len(images) > 0 {
+		fmt.Printf("Inline images: %d\n", len(images))
+	}
 
 	return nil
 }
@@ -0,0 +1,57 @@
+package tools
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"github.com/blue/support-agent/common"
+)
+
+const configUsage = "Usage: config show [--output FORMAT]"
+
+// RunConfig inspects the effective configuration
+func RunConfig(args []string) error {
+	if len(args) == 0 {
+		fmt.Println(configUsage)
+		return fmt.Errorf("config subcommand required")
+	}
+
+	switch args[0] {
+	case "show":
+		return runConfigShow(args[1:])
+	default:
+		fmt.Println(configUsage)
+		return fmt.Errorf("unknown config subcommand: %s", args[0])
+	}
+}
+
+// runConfigShow prints every setting, where its value came from and the
+// environment variable that sets it. Secrets are redacted.
+func runConfigShow(args []string) error {
+	fs := flag.NewFlagSet("config show", flag.ExitOnError)
+	output := fs.String("output", "simple", "Output format: simple or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	values := common.Settings().Effective()
+
+	if *output == "json" {
+		jsonData, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal JSON: %w", err)
+		}
+		fmt.Println(string(jsonData))
+		return nil
+	}
+
+	for _, v := range values {
+		value := v.Value
+		if value == "" {
+			value = "(unset)"
+		}
+		fmt.Printf("%-20s %-40s %s\n", v.Key, value, v.Source)
+	}
+	return nil
+}
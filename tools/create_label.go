@@ -3,8 +3,6 @@ package tools
 import (
 	"flag"
 	"fmt"
-
-	"github.com/blue/support-agent/common"
 )
 
 // RunCreateLabel creates a new Gmail label.
@@ -23,10 +21,11 @@ func RunCreateLabel(args []string) error {
 		return fmt.Errorf("name is required")
 	}
 
-	client, err := common.NewGmailClient()
+	client, err := newGmailAPI()
 	if err != nil {
-		return fmt.Errorf("failed to create Gmail client: %v", err)
+		return fmt.Errorf("failed to create Gmail client: %w", err)
 	}
+	defer client.Close()
 
 	label, err := client.CreateLabel(*name)
 	if err != nil {
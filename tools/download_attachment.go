@@ -39,14 +39,15 @@ func RunDownloadAttachment(args []string) error {
 		return fmt.Errorf("message-id is required")
 	}
 
-	client, err := common.NewGmailClient()
+	client, err := newGmailAPI()
 	if err != nil {
-		return fmt.Errorf("failed to create Gmail client: %v", err)
+		return fmt.Errorf("failed to create Gmail client: %w", err)
 	}
+	defer client.Close()
 
 	msg, err := client.GetMessage(*messageID)
 	if err != nil {
-		return fmt.Errorf("failed to get message: %v", err)
+		return fmt.Errorf("failed to get message: %w", err)
 	}
 
 	attachments := extractAttachmentInfos(msg.Payload)
@@ -81,39 +82,63 @@ func RunDownloadAttachment(args []string) error {
 
 	// Ensure output directory exists
 	if err := os.MkdirAll(*outputDir, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %v", err)
+		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
 	// Download each attachment
 	for _, a := range toDownload {
 		if err := downloadAttachment(client, *messageID, a, *outputDir); err != nil {
-			return fmt.Errorf("failed to download %s: %v", a.Filename, err)
+			return fmt.Errorf("failed to download %s: %w", a.Filename, err)
 		}
 	}
 
 	return nil
 }
 
-func downloadAttachment(client *common.GmailClient, messageID string, a AttachmentInfo, outputDir string) error {
-	body, err := client.GetAttachment(messageID, a.AttachmentID)
+func downloadAttachment(client common.GmailAPI, messageID string, a AttachmentInfo, outputDir string) error {
+	data, err := fetchAttachment(client, messageID, a)
 	if err != nil {
 		return err
 	}
 
-	data, err := base64.URLEncoding.DecodeString(body.Data)
+	outPath, err := attachmentPath(outputDir, a.Filename)
 	if err != nil {
-		return fmt.Errorf("failed to decode attachment data: %v", err)
+		return err
 	}
-
-	outPath := filepath.Join(outputDir, a.Filename)
 	if err := os.WriteFile(outPath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write file: %v", err)
+		return fmt.Errorf("failed to write file: %w", err)
 	}
 
 	fmt.Printf("Downloaded: %s -> %s (%d bytes)\n", a.Filename, outPath, len(data))
 	return nil
 }
 
+// attachmentPath returns where an attachment is saved in outputDir. The
+// filename comes from the sender, so any directory part is dropped (with
+// either slash, as a Windows client may send one) to keep the file inside
+// outputDir.
+func attachmentPath(outputDir, filename string) (string, error) {
+	name := filepath.Base(strings.ReplaceAll(filename, `\`, "/"))
+	if name == "." || name == ".." || name == "/" {
+		return "", fmt.Errorf("attachment filename %q is not a valid file name", filename)
+	}
+	return filepath.Join(outputDir, name), nil
+}
+
+// fetchAttachment returns the decoded contents of an attachment.
+func fetchAttachment(client common.GmailAPI, messageID string, a AttachmentInfo) ([]byte, error) {
+	body, err := client.GetAttachment(messageID, a.AttachmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := base64.URLEncoding.DecodeString(body.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode attachment data: %w", err)
+	}
+	return data, nil
+}
+
 // extractAttachmentInfos recursively finds all attachments in message parts
 func extractAttachmentInfos(part *gmail.MessagePart) []AttachmentInfo {
 	var attachments []AttachmentInfo
@@ -124,7 +149,7 @@ func extractAttachmentInfos(part *gmail.MessagePart) []AttachmentInfo {
 
 	if part.Filename != "" && part.Body != nil && part.Body.AttachmentId != "" {
 		attachments = append(attachments, AttachmentInfo{
-			Filename:     part.Filename,
+			Filename:     common.DecodeHeader(part.Filename),
 			AttachmentID: part.Body.AttachmentId,
 			MimeType:     part.MimeType,
 			Size:         part.Body.Size,
@@ -0,0 +1,70 @@
+package tools
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blue/support-agent/common/fakegmail"
+)
+
+func TestAttachmentPath(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string // "" for an error
+	}{
+		{"report.pdf", "out/report.pdf"},
+		{"my report.pdf", "out/my report.pdf"},
+		{"../../.ssh/authorized_keys", "out/authorized_keys"},
+		{"/etc/passwd", "out/passwd"},
+		{`..\..\evil.exe`, "out/evil.exe"},
+		{"logs/", "out/logs"},
+		{"", ""},
+		{".", ""},
+		{"..", ""},
+		{"a/..", ""},
+		{"/", ""},
+	}
+	for _, tt := range tests {
+		got, err := attachmentPath("out", tt.filename)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("attachmentPath(%q) = %q, want an error", tt.filename, got)
+			}
+			continue
+		}
+		if err != nil || got != filepath.FromSlash(tt.want) {
+			t.Errorf("attachmentPath(%q) = %q, %v, want %q", tt.filename, got, err, tt.want)
+		}
+	}
+}
+
+func TestRunDownloadAttachmentStaysInOutputDir(t *testing.T) {
+	useConfig(t)
+	mb := fakegmail.New()
+	mb.Add(fakegmail.Message{
+		ID:      "m1",
+		From:    "ana@customer.com",
+		To:      "help@blue.cc",
+		Subject: "Logs",
+		Body:    "Attached.",
+		Attachments: []fakegmail.Attachment{
+			// RFC 2047 encoded "../escaped.txt", decoded before it is used.
+			{Filename: "=?utf-8?q?=2E=2E=2Fescaped=2Etxt?=", MimeType: "text/plain", Data: []byte("contents")},
+		},
+	})
+	useMailbox(t, mb)
+
+	root := t.TempDir()
+	outputDir := filepath.Join(root, "out")
+	if err := RunDownloadAttachment([]string{"--message-id", "m1", "--output-dir", outputDir}); err != nil {
+		t.Fatalf("RunDownloadAttachment: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped.txt")); err == nil {
+		t.Fatal("attachment was written outside the output directory")
+	}
+	data, err := os.ReadFile(filepath.Join(outputDir, "escaped.txt"))
+	if err != nil || string(data) != "contents" {
+		t.Errorf("downloaded attachment = %q, %v", data, err)
+	}
+}
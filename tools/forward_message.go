@@ -0,0 +1,208 @@
+package tools
+
+import (
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/blue/support-agent/common"
+	"google.golang.org/api/gmail/v1"
+)
+
+// RunForwardMessage forwards a message to new recipients, e.g. to hand a
+// customer report to engineering or a partner.
+//
+// By default the forward is built the way Gmail does it: the note, then a
+// "Forwarded message" header block and the original text, with the original
+// attachments attached again. With --as-attachment the original is attached
+// whole as message/rfc822 instead, keeping every header and part intact.
+func RunForwardMessage(args []string) error {
+	fs := flag.NewFlagSet("forward-message", flag.ExitOnError)
+
+	messageID := fs.String("message-id", "", "Message ID to forward (required)")
+	to := fs.String("to", "", "Recipients (required, comma-separated)")
+	note := fs.String("note", "", "Text to put above the forwarded message")
+	bodyFormat := fs.String("body-format", string(BodyText), "How --note is written: text, markdown or html (sent as HTML with a plain-text alternative)")
+	cc := fs.String("cc", "", "Cc recipients (comma-separated)")
+	bcc := fs.String("bcc", "", "Bcc recipients (comma-separated)")
+	asAttachment := fs.Bool("as-attachment", false, "Attach the original as a message/rfc822 file instead of inlining it")
+	var attachments StringSliceFlag
+	fs.Var(&attachments, "attach", "Path to another file to attach (repeatable)")
+	var inline StringSliceFlag
+	fs.Var(&inline, "inline", "Image to show in the body, referenced by filename or cid:FILENAME (repeatable; needs --body-format markdown or html)")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *messageID == "" || *to == "" {
+		fmt.Println("Error: message-id and to are required")
+		fmt.Println("\nUsage: forward-message --message-id MESSAGE_ID --to EMAIL [--note TEXT] [--body-format text|markdown|html] [--cc EMAIL] [--bcc EMAIL] [--as-attachment] [--attach PATH ...] [--inline IMAGE ...]")
+		return fmt.Errorf("message-id and to are required")
+	}
+
+	format, err := parseBodyFormat(*bodyFormat)
+	if err != nil {
+		return err
+	}
+	images, err := newInlineImages(inline)
+	if err != nil {
+		return err
+	}
+	text, htmlBody, err := renderBody(*note, format, images)
+	if err != nil {
+		return err
+	}
+
+	toList, err := parseRecipients("to", *to)
+	if err != nil {
+		return err
+	}
+	ccList, err := parseRecipients("cc", *cc)
+	if err != nil {
+		return err
+	}
+	bccList, err := parseRecipients("bcc", *bcc)
+	if err != nil {
+		return err
+	}
+
+	client, err := newGmailAPI()
+	if err != nil {
+		return fmt.Errorf("failed to create Gmail client: %w", err)
+	}
+	defer client.Close()
+
+	originalMsg, err := client.GetMessage(*messageID)
+	if err != nil {
+		return fmt.Errorf("failed to get original message: %w", err)
+	}
+	headers := common.ExtractHeaders(originalMsg)
+
+	var files []Attachment
+	if *asAttachment {
+		raw, err := client.GetRawMessage(*messageID)
+		if err != nil {
+			return fmt.Errorf("failed to get original message: %w", err)
+		}
+		files = append(files, Attachment{
+			Filename:    emlFilename(headers["subject"]),
+			ContentType: "message/rfc822",
+			Data:        raw,
+		})
+	} else {
+		fwdText, fwdHTML := forwardedMessage(originalMsg, headers)
+		text = strings.TrimLeft(strings.TrimRight(text, "\n")+"\n\n"+fwdText, "\n")
+		if htmlBody != "" {
+			htmlBody = strings.TrimRight(htmlBody, "\n") + "\n" + fwdHTML
+		}
+		for _, a := range extractAttachmentInfos(originalMsg.Payload) {
+			data, err := fetchAttachment(client, *messageID, a)
+			if err != nil {
+				return fmt.Errorf("failed to fetch attachment %s: %w", a.Filename, err)
+			}
+			files = append(files, Attachment{Filename: a.Filename, ContentType: a.MimeType, Data: data})
+		}
+	}
+
+	msg := &MIMEMessage{
+		From:        "me",
+		To:          toList,
+		Cc:          ccList,
+		Bcc:         bccList,
+		Subject:     forwardSubject(headers["subject"]),
+		Body:        text,
+		HTMLBody:    htmlBody,
+		Attachments: attachments,
+		Inline:      images,
+		Files:       files,
+	}
+
+	var sentMsg *gmail.Message
+	err = uploadMIME(msg, func(raw io.Reader) (err error) {
+		sentMsg, err = client.SendMessage("", raw)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to forward message: %w", err)
+	}
+
+	fmt.Printf("Message forwarded successfully!\n")
+	fmt.Printf("Message ID: %s\n", sentMsg.Id)
+	fmt.Printf("Thread ID: %s\n", sentMsg.ThreadId)
+	fmt.Printf("To: %s\n", common.FormatAddressList(toList))
+	if len(ccList) > 0 {
+		fmt.Printf("Cc: %s\n", common.FormatAddressList(ccList))
+	}
+	if len(bccList) > 0 {
+		fmt.Printf("Bcc: %s\n", common.FormatAddressList(bccList))
+	}
+	fmt.Printf("Subject: %s\n", msg.Subject)
+	if n := len(attachments) + len(files); n > 0 {
+		fmt.Printf("Attachments: %d\n", n)
+	}
+	if len(images) > 0 {
+		fmt.Printf("Inline images: %d\n", len(images))
+	}
+
+	return nil
+}
+
+// forwardSubject prefixes subject with "Fwd: " unless it already has a
+// forward prefix.
+func forwardSubject(subject string) string {
+	lower := strings.ToLower(subject)
+	if strings.HasPrefix(lower, "fwd:") || strings.HasPrefix(lower, "fw:") {
+		return subject
+	}
+	return "Fwd: " + subject
+}
+
+// forwardedMessage returns the original message as Gmail shows it in a
+// forward, in plain text and HTML: a header block followed by the text.
+func forwardedMessage(msg *gmail.Message, headers map[string]string) (string, string) {
+	lines := []string{"---------- Forwarded message ---------"}
+	for _, h := range []struct{ label, key string }{
+		{"From", "from"}, {"Date", "date"}, {"Subject", "subject"}, {"To", "to"}, {"Cc", "cc"},
+	} {
+		value := headers[h.key]
+		if value == "" {
+			continue
+		}
+		if h.key == "date" {
+			if date, err := mail.ParseDate(value); err == nil {
+				value = date.Format(quoteDateLayout)
+			}
+		}
+		lines = append(lines, h.label+": "+value)
+	}
+	body := strings.TrimRight(strings.ReplaceAll(common.ExtractMessageBody(msg), "\r\n", "\n"), " \t\n")
+
+	text := strings.Join(lines, "\n") + "\n\n" + body + "\n"
+
+	escaped := make([]string, len(lines))
+	for i, line := range lines {
+		escaped[i] = html.EscapeString(line)
+	}
+	htmlText := `<div class="forward">` + strings.Join(escaped, "<br>\n") + "<br>\n<br>\n" +
+		strings.ReplaceAll(html.EscapeString(body), "\n", "<br>\n") + "\n</div>\n"
+	return text, htmlText
+}
+
+var unsafeFilename = regexp.MustCompile(`[\\/:*?"<>|\x00-\x1f]+`)
+
+// emlFilename names the file a message is attached as after its subject.
+func emlFilename(subject string) string {
+	name := strings.TrimSpace(unsafeFilename.ReplaceAllString(subject, "_"))
+	if name == "" {
+		name = "forwarded message"
+	}
+	if len(name) > 100 {
+		name = strings.ToValidUTF8(name[:100], "")
+	}
+	return name + ".eml"
+}
@@ -0,0 +1,84 @@
+package tools
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blue/support-agent/common"
+	"github.com/blue/support-agent/common/fakegmail"
+)
+
+func TestRunForwardMessage(t *testing.T) {
+	useConfig(t)
+	mb := fakegmail.New()
+	mb.Add(fakegmail.Message{
+		ID:      "m1",
+		From:    "Ana <ana@customer.com>",
+		To:      "help@blue.cc",
+		Subject: "Export broken",
+		Date:    time.Date(2024, 3, 4, 9, 15, 0, 0, time.UTC),
+		Body:    "It fails with error 500.",
+		Attachments: []fakegmail.Attachment{
+			{Filename: "export.log", MimeType: "text/plain", Data: []byte("500 Internal Server Error")},
+		},
+	})
+	useMailbox(t, mb)
+
+	if err := RunForwardMessage([]string{"--message-id", "m1", "--to", "eng@blue.cc", "--note", "Can you look?"}); err != nil {
+		t.Fatalf("RunForwardMessage: %v", err)
+	}
+	sent := mb.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent))
+	}
+	got := sent[0]
+	if v := header(t, mb, got.Id, "Subject"); v != "Fwd: Export broken" {
+		t.Errorf("Subject = %q", v)
+	}
+	body := strings.ReplaceAll(common.ExtractMessageBody(got), "\r\n", "\n")
+	want := "Can you look?\n\n---------- Forwarded message ---------\nFrom: Ana <ana@customer.com>\nDate: Mon, Mar 4, 2024 at 9:15 AM\nSubject: Export broken\nTo: help@blue.cc\n\nIt fails with error 500.\n"
+	if body != want {
+		t.Errorf("body =\n%s\nwant\n%s", body, want)
+	}
+	infos := extractAttachmentInfos(got.Payload)
+	if len(infos) != 1 || infos[0].Filename != "export.log" {
+		t.Fatalf("attachments = %+v, want export.log", infos)
+	}
+	data, err := fetchAttachment(mb, got.Id, infos[0])
+	if err != nil || string(data) != "500 Internal Server Error" {
+		t.Errorf("forwarded attachment = %q, %v", data, err)
+	}
+}
+
+func TestRunForwardMessageAsAttachment(t *testing.T) {
+	useConfig(t)
+	mb := fakegmail.New()
+	mb.Add(fakegmail.Message{ID: "m1", From: "ana@customer.com", To: "help@blue.cc", Subject: "Fwd: Invoice 12/2024", Body: "See below."})
+	useMailbox(t, mb)
+
+	if err := RunForwardMessage([]string{"--message-id", "m1", "--to", "billing@partner.example", "--as-attachment"}); err != nil {
+		t.Fatalf("RunForwardMessage: %v", err)
+	}
+	got := mb.Sent()[0]
+	if v := header(t, mb, got.Id, "Subject"); v != "Fwd: Invoice 12/2024" {
+		t.Errorf("Subject = %q, want the forward prefix not doubled", v)
+	}
+	infos := extractAttachmentInfos(got.Payload)
+	if len(infos) != 1 || infos[0].MimeType != "message/rfc822" || infos[0].Filename != "Fwd_ Invoice 12_2024.eml" {
+		t.Fatalf("attachments = %+v, want one message/rfc822", infos)
+	}
+	data, err := fetchAttachment(mb, got.Id, infos[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("attached message does not parse: %v", err)
+	}
+	if original.Header.Get("From") != "ana@customer.com" || original.Header.Get("Subject") != "Fwd: Invoice 12/2024" {
+		t.Errorf("attached message headers = %v", original.Header)
+	}
+}
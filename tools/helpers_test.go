@@ -0,0 +1,55 @@
+package tools
+
+import (
+	"testing"
+
+	"github.com/blue/support-agent/common"
+	"github.com/blue/support-agent/common/fakegmail"
+)
+
+// useMailbox points every command at mb for the duration of the test.
+func useMailbox(t *testing.T, mb *fakegmail.Mailbox) {
+	t.Helper()
+	orig := newGmailAPI
+	newGmailAPI = func() (common.GmailAPI, error) { return mb, nil }
+	t.Cleanup(func() { newGmailAPI = orig })
+}
+
+// useConfig installs the default configuration, with a temporary token
+// directory, for the duration of the test and returns it for tweaking.
+func useConfig(t *testing.T) *common.Config {
+	t.Helper()
+	config := common.DefaultConfig()
+	config.TokenDir = t.TempDir()
+	common.SetConfig(config)
+	t.Cleanup(func() { common.SetConfig(nil) })
+	return config
+}
+
+// useServer serves mb over HTTP and points the Gmail endpoint at it, for
+// commands that need a *common.GmailClient rather than common.GmailAPI. It
+// installs a configuration like useConfig and returns it.
+func useServer(t *testing.T, mb *fakegmail.Mailbox) *common.Config {
+	t.Helper()
+	server := fakegmail.NewServer(mb)
+	t.Cleanup(server.Close)
+	config := useConfig(t)
+	config.GmailEndpoint = server.URL + "/"
+	config.Cache = false
+	return config
+}
+
+// header returns the first value of the named header of a stored message.
+func header(t *testing.T, mb *fakegmail.Mailbox, messageID, name string) string {
+	t.Helper()
+	msg := mb.Message(messageID)
+	if msg == nil {
+		t.Fatalf("message %s not found", messageID)
+	}
+	for _, h := range msg.Payload.Headers {
+		if h.Name == name {
+			return h.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+package tools
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// InlineImage is an image shown in the HTML body rather than attached: it
+// is sent in a multipart/related part and referenced as cid:ContentID.
+type InlineImage struct {
+	Path      string
+	ContentID string // without the angle brackets of the Content-ID header
+}
+
+// newInlineImages checks the --inline paths are images and gives each a
+// random Content-ID.
+func newInlineImages(paths []string) ([]InlineImage, error) {
+	var images []InlineImage
+	names := map[string]bool{}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if names[name] {
+			return nil, fmt.Errorf("two inline images are named %s; rename one", name)
+		}
+		names[name] = true
+		if !strings.HasPrefix(mime.TypeByExtension(filepath.Ext(name)), "image/") {
+			return nil, fmt.Errorf("inline image %s is not a recognized image type", path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("inline image %s: %w", path, err)
+		}
+
+		var id [12]byte
+		if _, err := rand.Read(id[:]); err != nil {
+			return nil, fmt.Errorf("failed to generate Content-ID: %w", err)
+		}
+		images = append(images, InlineImage{Path: path, ContentID: hex.EncodeToString(id[:]) + "@support-agent"})
+	}
+	return images, nil
+}
+
+// matches reports whether an <img> src refers to the image: by filename,
+// by the path given to --inline, or as cid: with either of those or the
+// generated Content-ID. Markdown rendering percent-encodes spaces and
+// non-ASCII characters in the src, so it is also compared unescaped.
+func (img InlineImage) matches(src string) bool {
+	src = strings.TrimPrefix(src, "cid:")
+	candidates := []string{src}
+	if unescaped, err := url.PathUnescape(src); err == nil && unescaped != src {
+		candidates = append(candidates, unescaped)
+	}
+	for _, s := range candidates {
+		if s == img.ContentID || s == filepath.Base(img.Path) || s == img.Path {
+			return true
+		}
+	}
+	return false
+}
+
+// linkInlineImages points the <img> tags of an HTML body that refer to
+// inline images at their Content-IDs. Images the body doesn't show are
+// added at the end, so none is sent without being displayed.
+func linkInlineImages(body string, images []InlineImage) (string, error) {
+	context := &xhtml.Node{Type: xhtml.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := xhtml.ParseFragment(strings.NewReader(body), context)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse HTML body: %w", err)
+	}
+
+	shown := make([]bool, len(images))
+	var walk func(n *xhtml.Node)
+	walk = func(n *xhtml.Node) {
+		if n.Type == xhtml.ElementNode && n.DataAtom == atom.Img {
+			for i, a := range n.Attr {
+				if a.Key != "src" {
+					continue
+				}
+				for j, img := range images {
+					if img.matches(a.Val) {
+						n.Attr[i].Val = "cid:" + img.ContentID
+						shown[j] = true
+						break
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+
+	var out strings.Builder
+	for _, n := range nodes {
+		walk(n)
+		if err := xhtml.Render(&out, n); err != nil {
+			return "", fmt.Errorf("failed to render HTML body: %w", err)
+		}
+	}
+	for i, img := range images {
+		if !shown[i] {
+			fmt.Fprintf(&out, "\n<p><img src=\"cid:%s\" alt=\"%s\"></p>", img.ContentID, xhtml.EscapeString(filepath.Base(img.Path)))
+		}
+	}
+	return out.String(), nil
+}
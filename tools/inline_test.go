@@ -0,0 +1,125 @@
+package tools
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blue/support-agent/common/fakegmail"
+	"google.golang.org/api/gmail/v1"
+)
+
+// writeImages creates image files in a temporary directory and returns
+// their paths.
+func writeImages(t *testing.T, names ...string) []string {
+	t.Helper()
+	dir := t.TempDir()
+	var paths []string
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("\x89PNG fake "+name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestRenderBodyInline(t *testing.T) {
+	useConfig(t)
+	images, err := newInlineImages(writeImages(t, "export.png", "settings.png", "extra.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, html, err := renderBody("Open settings:\n\n![](settings.png)\n\nthen export:\n\n![the export button](cid:export.png)", BodyMarkdown, images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, img := range images {
+		if !strings.Contains(html, `src="cid:`+img.ContentID+`"`) {
+			t.Errorf("HTML does not show %s as cid:%s:\n%s", img.Path, img.ContentID, html)
+		}
+	}
+	if strings.Index(html, images[1].ContentID) > strings.Index(html, images[0].ContentID) {
+		t.Errorf("images out of order, want settings before export:\n%s", html)
+	}
+
+	// Markdown percent-encodes spaces and non-ASCII characters in the src.
+	encoded, err := newInlineImages(writeImages(t, "my shot.png", "設定.png", "100%.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, html, err = renderBody("![](<my shot.png>) ![](設定.png) ![](cid:my%20shot.png) ![](100%.png)", BodyMarkdown, encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, img := range encoded {
+		if !strings.Contains(html, `src="cid:`+img.ContentID+`"`) {
+			t.Errorf("HTML does not show %s as cid:%s:\n%s", img.Path, img.ContentID, html)
+		}
+	}
+	if n := strings.Count(html, "<img"); n != 4 {
+		t.Errorf("HTML has %d images, want the 4 referenced and none appended:\n%s", n, html)
+	}
+
+	if _, _, err := renderBody("see attached", BodyText, images); err == nil {
+		t.Error("--inline with a text body should be an error")
+	}
+	if _, err := newInlineImages(writeImages(t, "notes.txt")); err == nil {
+		t.Error("newInlineImages accepted a text file")
+	}
+	if _, err := newInlineImages(append(writeImages(t, "a.png"), writeImages(t, "a.png")...)); err == nil {
+		t.Error("newInlineImages accepted two images with the same name")
+	}
+}
+
+func TestRunComposeMessageInline(t *testing.T) {
+	useConfig(t)
+	mb := fakegmail.New()
+	useMailbox(t, mb)
+	shot := writeImages(t, "screenshot.png")[0]
+
+	err := RunComposeMessage([]string{"--to", "ana@customer.com", "--subject", "How to export", "--body-format", "markdown",
+		"--body", "Click here:\n\n![](screenshot.png)", "--inline", shot})
+	if err != nil {
+		t.Fatalf("RunComposeMessage: %v", err)
+	}
+	sent := mb.Sent()[0]
+	if sent.Payload.MimeType != "multipart/related" {
+		t.Fatalf("message is %s, want multipart/related", sent.Payload.MimeType)
+	}
+
+	// The image part's Content-ID is what the HTML refers to.
+	var cid, disposition, html string
+	var walk func(p *gmail.MessagePart)
+	walk = func(p *gmail.MessagePart) {
+		switch p.MimeType {
+		case "text/html":
+			data, _ := base64.URLEncoding.DecodeString(p.Body.Data)
+			html = string(data)
+		case "image/png":
+			for _, h := range p.Headers {
+				switch {
+				case strings.EqualFold(h.Name, "Content-ID"):
+					cid = strings.Trim(h.Value, "<>")
+				case strings.EqualFold(h.Name, "Content-Disposition"):
+					disposition = h.Value
+				}
+			}
+		}
+		for _, c := range p.Parts {
+			walk(c)
+		}
+	}
+	walk(sent.Payload)
+
+	if cid == "" || !strings.Contains(html, `src="cid:`+cid+`"`) {
+		t.Errorf("HTML %q does not refer to the image Content-ID %q", html, cid)
+	}
+	if !strings.HasPrefix(disposition, "inline") {
+		t.Errorf("image Content-Disposition = %q, want inline", disposition)
+	}
+}
@@ -18,6 +18,9 @@ func RunLabelMessage(args []string) error {
 	addLabel := fs.String("add-label", "", "Label to add (e.g., IMPORTANT, STARRED, or custom)")
 	removeLabel := fs.String("remove-label", "", "Label to remove")
 	createIfMissing := fs.Bool("create-if-missing", false, "Create labels in --add-label that don't exist yet")
+	query := fs.String("query", "", "Label every message matching this Gmail query (batched)")
+	limit := fs.Int64("limit", 500, "Maximum number of messages to label with --query")
+	output := fs.String("output", "simple", "Output format for --query: simple or json")
 	
 	// Parse args
 	if err := fs.Parse(args); err != nil {
@@ -25,12 +28,13 @@ func RunLabelMessage(args []string) error {
 	}
 
 	// Validate
-	if *messageID == "" && *threadID == "" {
-		fmt.Println("Error: either message-id or thread-id is required")
+	if *messageID == "" && *threadID == "" && *query == "" {
+		fmt.Println("Error: one of message-id, thread-id or query is required")
 		fmt.Println("\nUsage:")
 		fmt.Println("  label-message --message-id MESSAGE_ID --add-label LABEL")
 		fmt.Println("  label-message --thread-id THREAD_ID --remove-label LABEL")
-		return fmt.Errorf("message-id or thread-id required")
+		fmt.Println("  label-message --query \"from:billing@example.com\" --add-label Billing [--limit N] [--output json]")
+		return fmt.Errorf("message-id, thread-id or query required")
 	}
 
 	if *addLabel == "" && *removeLabel == "" {
@@ -39,10 +43,11 @@ func RunLabelMessage(args []string) error {
 	}
 
 	// Create client
-	client, err := common.NewGmailClient()
+	client, err := newGmailAPI()
 	if err != nil {
-		return fmt.Errorf("failed to create Gmail client: %v", err)
+		return fmt.Errorf("failed to create Gmail client: %w", err)
 	}
+	defer client.Close()
 
 	// Prepare label lists (parse comma-separated user input)
 	var addNames, removeNames []string
@@ -66,21 +71,25 @@ func RunLabelMessage(args []string) error {
 	// Resolve label names → Gmail label IDs. The modify API rejects names for
 	// user labels; we look up the actual ID via labels.list. --create-if-missing
 	// only applies to add-label (creating a label just to remove it is silly).
-	addLabels, err := client.ResolveLabelNames(addNames, *createIfMissing)
+	addLabels, err := common.ResolveLabelNames(client, addNames, *createIfMissing)
 	if err != nil {
-		return fmt.Errorf("failed to resolve add-label: %v", err)
+		return fmt.Errorf("failed to resolve add-label: %w", err)
 	}
-	removeLabels, err := client.ResolveLabelNames(removeNames, false)
+	removeLabels, err := common.ResolveLabelNames(client, removeNames, false)
 	if err != nil {
-		return fmt.Errorf("failed to resolve remove-label: %v", err)
+		return fmt.Errorf("failed to resolve remove-label: %w", err)
 	}
 
 	// Apply labels
+	if *query != "" {
+		return runBulkModify(client, *query, *limit, addLabels, removeLabels, *output, "labeled")
+	}
+
 	if *threadID != "" {
 		// Modify thread
 		thread, err := client.ModifyThread(*threadID, addLabels, removeLabels)
 		if err != nil {
-			return fmt.Errorf("failed to modify thread labels: %v", err)
+			return fmt.Errorf("failed to modify thread labels: %w", err)
 		}
 		
 		fmt.Printf("Thread labels updated successfully!\n")
@@ -96,7 +105,7 @@ func RunLabelMessage(args []string) error {
 		// Modify single message
 		msg, err := client.ModifyMessage(*messageID, addLabels, removeLabels)
 		if err != nil {
-			return fmt.Errorf("failed to modify message labels: %v", err)
+			return fmt.Errorf("failed to modify message labels: %w", err)
 		}
 		
 		fmt.Printf("Message labels updated successfully!\n")
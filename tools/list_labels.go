@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"sort"
 
-	"github.com/blue/support-agent/common"
 	"google.golang.org/api/gmail/v1"
 )
 
@@ -21,10 +20,11 @@ func RunListLabels(args []string) error {
 		return err
 	}
 
-	client, err := common.NewGmailClient()
+	client, err := newGmailAPI()
 	if err != nil {
-		return fmt.Errorf("failed to create Gmail client: %v", err)
+		return fmt.Errorf("failed to create Gmail client: %w", err)
 	}
+	defer client.Close()
 
 	labels, err := client.ListLabels()
 	if err != nil {
@@ -53,7 +53,7 @@ func RunListLabels(args []string) error {
 	case "json":
 		jsonData, err := json.MarshalIndent(labels, "", "  ")
 		if err != nil {
-			return fmt.Errorf("failed to marshal labels: %v", err)
+			return fmt.Errorf("failed to marshal labels: %w", err)
 		}
 		fmt.Println(string(jsonData))
 
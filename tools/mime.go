@@ -1,12 +1,22 @@
 package tools
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+
+	"github.com/blue/support-agent/common"
 )
 
 // StringSliceFlag implements flag.Value for repeatable string flags
@@ -21,95 +31,492 @@ func (s *StringSliceFlag) Set(v string) error {
 	return nil
 }
 
-// MIMEMessage builds an RFC 2822 message, optionally with attachments.
-// If attachments is empty, produces a simple text/plain message.
-// Otherwise produces a multipart/mixed message.
+// parseRecipients parses the address list given with a --to, --cc or --bcc
+// flag, so a malformed recipient is reported before anything is sent.
+func parseRecipients(flagName, value string) ([]common.Address, error) {
+	addrs, err := common.ParseAddressList(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --%s: %w", flagName, err)
+	}
+	return addrs, nil
+}
+
+// MIMEMessage builds an RFC 5322 message, optionally with attachments.
+// The text is text/plain, or with HTMLBody set, a multipart/alternative of
+// Body and HTMLBody. Inline images go with the text in a multipart/related
+// part. With attachments, the text is the first part of a multipart/mixed
+// message.
 type MIMEMessage struct {
 	From        string
-	To          string
-	Cc          string
-	Bcc         string
+	To          []common.Address
+	Cc          []common.Address
+	Bcc         []common.Address
 	Subject     string
 	Body        string
+	HTMLBody    string // sanitized HTML version of Body, or empty
 	InReplyTo   string
 	References  string
 	Attachments []string // file paths
+	// Files are attachments already in memory, such as those of a message
+	// being forwarded. They follow Attachments.
+	Files []Attachment
+	// Inline are images HTMLBody shows by Content-ID.
+	Inline []InlineImage
 }
 
-const maxTotalAttachmentBytes = 25 * 1024 * 1024 // 25MB Gmail limit
+// Attachment is a file to attach held in memory.
+type Attachment struct {
+	Filename    string
+	ContentType string // empty guesses from the filename extension
+	Data        []byte
+}
+
+// maxMessageBytes is the largest message Gmail's upload endpoint accepts.
+const maxMessageBytes = 35 * 1024 * 1024
+
+// WriteTo writes the message to w. Attachments are read from disk and
+// encoded as they are written, so memory use doesn't grow with their size.
+// Multipart boundaries are random, so no content can end a part early.
+func (m *MIMEMessage) WriteTo(w io.Writer) (int64, error) {
+	if err := m.check(); err != nil {
+		return 0, err
+	}
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	if err := m.write(bw); err != nil {
+		return cw.n, err
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
 
-// Build returns the base64url-encoded raw message ready for gmail.Message.Raw
-func (m *MIMEMessage) Build() (string, error) {
-	var totalSize int64
+// check reports what would stop the message from being sent before any of
+// it is written: no recipients, a missing attachment, or a message too big
+// for Gmail once its attachments are encoded.
+func (m *MIMEMessage) check() error {
+	if len(m.To) == 0 {
+		return fmt.Errorf("no recipients")
+	}
+	if len(m.Inline) > 0 && m.HTMLBody == "" {
+		return fmt.Errorf("inline images need an HTML body to show them")
+	}
+	size := int64(len(m.Body) + len(m.HTMLBody))
+	for _, img := range m.Inline {
+		fi, err := os.Stat(img.Path)
+		if err != nil {
+			return fmt.Errorf("inline image %s: %w", img.Path, err)
+		}
+		size += base64Size(fi.Size())
+	}
 	for _, p := range m.Attachments {
 		fi, err := os.Stat(p)
 		if err != nil {
-			return "", fmt.Errorf("attachment %s: %v", p, err)
+			return fmt.Errorf("attachment %s: %w", p, err)
 		}
-		totalSize += fi.Size()
+		size += base64Size(fi.Size())
+	}
+	for _, f := range m.Files {
+		size += base64Size(int64(len(f.Data)))
 	}
-	if totalSize > maxTotalAttachmentBytes {
-		return "", fmt.Errorf("total attachment size %d bytes exceeds 25MB Gmail limit", totalSize)
+	if size > maxMessageBytes {
+		return fmt.Errorf("message is about %d MB with attachments encoded, over Gmail's 35 MB limit", size>>20)
 	}
+	return nil
+}
+
+// base64Size is how many bytes n bytes take base64 encoded in MIME lines.
+func base64Size(n int64) int64 {
+	encoded := (n + 2) / 3 * 4
+	return encoded + encoded/76*2
+}
 
-	var buf strings.Builder
-	fmt.Fprintf(&buf, "From: %s\r\n", m.From)
-	fmt.Fprintf(&buf, "To: %s\r\n", m.To)
-	if m.Cc != "" {
-		fmt.Fprintf(&buf, "Cc: %s\r\n", m.Cc)
+// write writes the message. Errors writing to w are sticky in a
+// bufio.Writer, so only the ones reading attachments are returned here.
+func (m *MIMEMessage) write(w *bufio.Writer) error {
+	writeHeader(w, "From", m.From)
+	writeHeader(w, "To", common.FormatAddressList(m.To))
+	if len(m.Cc) > 0 {
+		writeHeader(w, "Cc", common.FormatAddressList(m.Cc))
 	}
-	if m.Bcc != "" {
-		fmt.Fprintf(&buf, "Bcc: %s\r\n", m.Bcc)
+	if len(m.Bcc) > 0 {
+		writeHeader(w, "Bcc", common.FormatAddressList(m.Bcc))
 	}
-	fmt.Fprintf(&buf, "Subject: %s\r\n", m.Subject)
+	writeHeader(w, "Subject", encodeHeaderText(m.Subject))
 	if m.InReplyTo != "" {
-		fmt.Fprintf(&buf, "In-Reply-To: %s\r\n", m.InReplyTo)
+		writeHeader(w, "In-Reply-To", m.InReplyTo)
 	}
 	if m.References != "" {
-		fmt.Fprintf(&buf, "References: %s\r\n", m.References)
-	}
-	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
-
-	if len(m.Attachments) == 0 {
-		fmt.Fprintf(&buf, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
-		buf.WriteString(m.Body)
-	} else {
-		boundary := "----=_SupportAgent_Boundary_7a3f9c2e"
-		fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=\"%s\"\r\n\r\n", boundary)
-
-		fmt.Fprintf(&buf, "--%s\r\n", boundary)
-		fmt.Fprintf(&buf, "Content-Type: text/plain; charset=UTF-8\r\n")
-		fmt.Fprintf(&buf, "Content-Transfer-Encoding: 7bit\r\n\r\n")
-		buf.WriteString(m.Body)
-		buf.WriteString("\r\n")
-
-		for _, path := range m.Attachments {
-			data, err := os.ReadFile(path)
-			if err != nil {
-				return "", fmt.Errorf("read attachment %s: %v", path, err)
-			}
-			filename := filepath.Base(path)
-			ctype := mime.TypeByExtension(filepath.Ext(filename))
-			if ctype == "" {
-				ctype = "application/octet-stream"
+		writeHeader(w, "References", m.References)
+	}
+	w.WriteString("MIME-Version: 1.0\r\n")
+
+	if len(m.Attachments) == 0 && len(m.Files) == 0 {
+		return m.writeBody(headerWriter(w))
+	}
+
+	mw := multipart.NewWriter(w)
+	writeHeader(w, "Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()}))
+	w.WriteString("\r\n")
+	if err := m.writeBody(mw.CreatePart); err != nil {
+		return err
+	}
+	for _, path := range m.Attachments {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("read attachment %s: %w", path, err)
+		}
+		err = writeAttachment(mw, filepath.Base(path), "", "", f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("read attachment %s: %w", path, err)
+		}
+	}
+	for _, f := range m.Files {
+		if err := writeAttachment(mw, f.Filename, f.ContentType, "", bytes.NewReader(f.Data)); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// writeBody writes what the reader sees as a part made by create: the text,
+// and with inline images, a multipart/related of the text and the images.
+func (m *MIMEMessage) writeBody(create func(textproto.MIMEHeader) (io.Writer, error)) error {
+	if len(m.Inline) == 0 {
+		return m.writeText(create)
+	}
+
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	w, err := create(textproto.MIMEHeader{
+		"Content-Type": {foldValue("Content-Type", mime.FormatMediaType("multipart/related",
+			map[string]string{"type": "multipart/alternative", "boundary": boundary}))},
+	})
+	if err != nil {
+		return err
+	}
+	related := multipart.NewWriter(w)
+	if err := related.SetBoundary(boundary); err != nil {
+		return err
+	}
+	if err := m.writeText(related.CreatePart); err != nil {
+		return err
+	}
+	for _, img := range m.Inline {
+		f, err := os.Open(img.Path)
+		if err != nil {
+			return fmt.Errorf("read inline image %s: %w", img.Path, err)
+		}
+		err = writeAttachment(related, filepath.Base(img.Path), "", img.ContentID, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("read inline image %s: %w", img.Path, err)
+		}
+	}
+	return related.Close()
+}
+
+// writeText writes the message text as a part made by create: text/plain,
+// or with an HTML version, a multipart/alternative of the two. The HTML
+// comes last since clients show the last alternative they support.
+func (m *MIMEMessage) writeText(create func(textproto.MIMEHeader) (io.Writer, error)) error {
+	if m.HTMLBody == "" {
+		return writeQuotedPrintable(create, "text/plain", m.Body)
+	}
+
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	w, err := create(textproto.MIMEHeader{
+		"Content-Type": {foldValue("Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": boundary}))},
+	})
+	if err != nil {
+		return err
+	}
+	alt := multipart.NewWriter(w)
+	if err := alt.SetBoundary(boundary); err != nil {
+		return err
+	}
+	if err := writeQuotedPrintable(alt.CreatePart, "text/plain", m.Body); err != nil {
+		return err
+	}
+	if err := writeQuotedPrintable(alt.CreatePart, "text/html", m.HTMLBody); err != nil {
+		return err
+	}
+	return alt.Close()
+}
+
+// writeQuotedPrintable writes text as a quoted-printable UTF-8 part of the
+// given type.
+func writeQuotedPrintable(create func(textproto.MIMEHeader) (io.Writer, error), contentType, text string) error {
+	w, err := create(textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=UTF-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qp, text); err != nil {
+		return fmt.Errorf("encode %s part: %w", contentType, err)
+	}
+	if err := qp.Close(); err != nil {
+		return fmt.Errorf("encode %s part: %w", contentType, err)
+	}
+	return nil
+}
+
+// writeAttachment writes an attachment part read from r. A message/rfc822
+// attachment, a whole forwarded message, is copied as is since RFC 2046
+// doesn't allow it to be base64 encoded; anything else is base64. With a
+// contentID the part is an inline image the HTML refers to.
+func writeAttachment(mw *multipart.Writer, filename, contentType, contentID string, r io.Reader) error {
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(filename))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	encoding := "base64"
+	if contentType == "message/rfc822" {
+		encoding = "8bit"
+	}
+	disposition := "attachment"
+	if contentID != "" {
+		disposition = "inline"
+	}
+	header := textproto.MIMEHeader{
+		"Content-Type":              {foldValue("Content-Type", formatMediaType(contentType, "name", filename))},
+		"Content-Transfer-Encoding": {encoding},
+		"Content-Disposition":       {foldValue("Content-Disposition", formatMediaType(disposition, "filename", filename))},
+	}
+	if contentID != "" {
+		header["Content-ID"] = []string{"<" + contentID + ">"}
+	}
+	w, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	if encoding != "base64" {
+		_, err = io.Copy(w, r)
+		return err
+	}
+	enc := base64.NewEncoder(base64.StdEncoding, &lineBreaker{w: w})
+	if _, err := io.Copy(enc, r); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// lineBreaker breaks what is written to it into 76-character lines, the
+// longest base64 lines MIME allows.
+type lineBreaker struct {
+	w   io.Writer
+	col int
+}
+
+func (l *lineBreaker) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if l.col == 76 {
+			if _, err := io.WriteString(l.w, "\r\n"); err != nil {
+				return written, err
 			}
-			fmt.Fprintf(&buf, "--%s\r\n", boundary)
-			fmt.Fprintf(&buf, "Content-Type: %s; name=\"%s\"\r\n", ctype, filename)
-			fmt.Fprintf(&buf, "Content-Transfer-Encoding: base64\r\n")
-			fmt.Fprintf(&buf, "Content-Disposition: attachment; filename=\"%s\"\r\n\r\n", filename)
-
-			encoded := base64.StdEncoding.EncodeToString(data)
-			for i := 0; i < len(encoded); i += 76 {
-				end := i + 76
-				if end > len(encoded) {
-					end = len(encoded)
-				}
-				buf.WriteString(encoded[i:end])
-				buf.WriteString("\r\n")
+			l.col = 0
+		}
+		n := min(len(p), 76-l.col)
+		if _, err := l.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		l.col += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// countingWriter counts the bytes written through it, for WriteTo.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// headerWriter starts a part directly on w, for a message that is a single
+// part: it writes the part's headers after the message headers. Like
+// multipart.Writer.CreatePart, it expects values to be folded already.
+func headerWriter(w io.Writer) func(textproto.MIMEHeader) (io.Writer, error) {
+	return func(header textproto.MIMEHeader) (io.Writer, error) {
+		names := make([]string, 0, len(header))
+		for name := range header {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			for _, value := range header[name] {
+				io.WriteString(w, name+": "+value+"\r\n")
 			}
 		}
-		fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+		_, err := io.WriteString(w, "\r\n")
+		return w, err
 	}
+}
 
-	return base64.URLEncoding.EncodeToString([]byte(buf.String())), nil
+// uploadMIME streams m into upload, which sends it through Gmail's media
+// upload endpoint, so the encoded message is never held in memory whole.
+// The message is checked first, so a missing attachment fails before
+// anything is sent.
+func uploadMIME(m *MIMEMessage, upload func(raw io.Reader) error) error {
+	if err := m.check(); err != nil {
+		return fmt.Errorf("failed to build message: %w", err)
+	}
+	pr, pw := io.Pipe()
+	built := make(chan error, 1)
+	go func() {
+		_, err := m.WriteTo(pw)
+		pw.CloseWithError(err)
+		built <- err
+	}()
+
+	err := upload(pr)
+	pr.Close() // unblock the writer if the upload stopped reading early
+	if buildErr := <-built; buildErr != nil && !errors.Is(buildErr, io.ErrClosedPipe) {
+		return fmt.Errorf("failed to build message: %w", buildErr)
+	}
+	return err
+}
+
+// maxHeaderLine is the line length headers are folded at (RFC 5322 2.1.1).
+const maxHeaderLine = 78
+
+// writeHeader writes "Name: value", folded at whitespace so lines stay
+// within maxHeaderLine where the value allows it.
+func writeHeader(w io.Writer, name, value string) {
+	io.WriteString(w, foldHeader(name+": "+value)+"\r\n")
+}
+
+// foldValue folds a header value as foldHeader would, for a part header
+// written by mime/multipart.
+func foldValue(name, value string) string {
+	return strings.TrimPrefix(foldHeader(name+": "+value), name+": ")
+}
+
+// foldHeader breaks a header line before spaces so no line exceeds
+// maxHeaderLine. A single word longer than that is left whole.
+func foldHeader(line string) string {
+	if len(line) <= maxHeaderLine {
+		return line
+	}
+	var out strings.Builder
+	lineLen := 0
+	for i, word := range strings.Split(line, " ") {
+		switch {
+		case i == 0:
+		case lineLen+1+len(word) > maxHeaderLine:
+			out.WriteString("\r\n")
+			lineLen = 0
+			fallthrough
+		default:
+			out.WriteString(" ")
+			lineLen++
+		}
+		out.WriteString(word)
+		lineLen += len(word)
+	}
+	return out.String()
+}
+
+// encodeHeaderText returns s as RFC 2047 encoded-words if it is not plain
+// ASCII. Text that is mostly non-ASCII, like Japanese, is shorter in base64
+// than quoted-printable.
+func encodeHeaderText(s string) string {
+	nonASCII := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 || (s[i] < 0x20 && s[i] != '\t') {
+			nonASCII++
+		}
+	}
+	switch {
+	case nonASCII == 0:
+		return s
+	case nonASCII > len(s)/3:
+		return mime.BEncoding.Encode("utf-8", s)
+	default:
+		return mime.QEncoding.Encode("utf-8", s)
+	}
+}
+
+// formatMediaType adds a parameter to a Content-Type or Content-Disposition
+// value such as "text/plain; charset=utf-8", RFC 2231 encoding it when it is
+// not ASCII. A parameter too long for one header line, like a long non-ASCII
+// filename, is split into RFC 2231 continuations so the value can be folded.
+func formatMediaType(value, param, paramValue string) string {
+	mediaType, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		mediaType, params = value, map[string]string{}
+	}
+	params[param] = paramValue
+	v := mime.FormatMediaType(mediaType, params)
+	if v == "" {
+		return value
+	}
+
+	// mime writes the parameter as a single token, which folding can't
+	// break. Each token goes on its own line as " token;".
+	token := strings.TrimPrefix(mime.FormatMediaType("x", map[string]string{param: paramValue}), "x; ")
+	if len(token) <= maxHeaderLine-2 {
+		return v
+	}
+	delete(params, param)
+	base := mime.FormatMediaType(mediaType, params)
+	if base == "" {
+		return v
+	}
+	return base + continuations(param, paramValue)
+}
+
+// continuations encodes a parameter as RFC 2231 continuations (name*0*,
+// name*1*, ...; the first names the UTF-8 charset), each short enough for its
+// own folded header line. Percent-escapes are never split between sections.
+func continuations(param, value string) string {
+	var out strings.Builder
+	var section strings.Builder
+	n := 0
+	prefix := func() string {
+		if n == 0 {
+			return fmt.Sprintf("%s*0*=utf-8''", param)
+		}
+		return fmt.Sprintf("%s*%d*=", param, n)
+	}
+	flush := func() {
+		out.WriteString("; " + prefix() + section.String())
+		section.Reset()
+		n++
+	}
+
+	for i := 0; i < len(value); i++ {
+		unit := string(value[i])
+		if !isAttributeChar(value[i]) {
+			unit = fmt.Sprintf("%%%02X", value[i])
+		}
+		if section.Len() > 0 && 1+len(prefix())+section.Len()+len(unit)+1 > maxHeaderLine {
+			flush()
+		}
+		section.WriteString(unit)
+	}
+	flush()
+	return out.String()
+}
+
+// isAttributeChar reports whether b may appear unescaped in an RFC 2231
+// extended parameter value.
+func isAttributeChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
 }
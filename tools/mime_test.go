@@ -0,0 +1,439 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blue/support-agent/common"
+)
+
+// addrs parses an address list, failing the test if it is malformed.
+func addrs(t *testing.T, s string) []common.Address {
+	t.Helper()
+	list, err := common.ParseAddressList(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+// build returns the message MIMEMessage.WriteTo writes.
+func build(t *testing.T, m *MIMEMessage) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d, wrote %d bytes", n, buf.Len())
+	}
+	return buf.Bytes()
+}
+
+// parseBuilt parses the message MIMEMessage.WriteTo writes.
+func parseBuilt(t *testing.T, m *MIMEMessage) *mail.Message {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(build(t, m)))
+	if err != nil {
+		t.Fatalf("WriteTo produced an unparseable message: %v", err)
+	}
+	return msg
+}
+
+func TestMIMEMessageBuild(t *testing.T) {
+	dir := t.TempDir()
+	pdf := filepath.Join(dir, "invoice.pdf")
+	if err := os.WriteFile(pdf, []byte("%PDF-1.4 fake"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		msg         MIMEMessage
+		headers     map[string]string
+		contentType string
+		attachments map[string]string // filename → content
+	}{
+		{
+			name: "plain text",
+			msg:  MIMEMessage{From: "me", To: addrs(t, "ana@customer.com"), Subject: "Hello", Body: "Hi Ana"},
+			headers: map[string]string{
+				"To":      "ana@customer.com",
+				"Subject": "Hello",
+			},
+			contentType: "text/plain",
+		},
+		{
+			name: "reply headers and cc/bcc",
+			msg: MIMEMessage{From: "me", To: addrs(t, "ana@customer.com"), Cc: addrs(t, "bo@blue.cc"), Bcc: addrs(t, "audit@blue.cc"),
+				Subject: "Re: Hello", Body: "Hi", InReplyTo: "<a1@x>", References: "<a0@x> <a1@x>"},
+			headers: map[string]string{
+				"Cc":          "bo@blue.cc",
+				"Bcc":         "audit@blue.cc",
+				"In-Reply-To": "<a1@x>",
+				"References":  "<a0@x> <a1@x>",
+			},
+			contentType: "text/plain",
+		},
+		{
+			name:        "attachment",
+			msg:         MIMEMessage{From: "me", To: addrs(t, "ana@customer.com"), Subject: "Invoice", Body: "Attached.", Attachments: []string{pdf}},
+			contentType: "multipart/mixed",
+			attachments: map[string]string{"invoice.pdf": "%PDF-1.4 fake"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := parseBuilt(t, &tt.msg)
+			for name, want := range tt.headers {
+				if got := msg.Header.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+
+			mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+			if err != nil {
+				t.Fatalf("Content-Type: %v", err)
+			}
+			if mediaType != tt.contentType {
+				t.Fatalf("Content-Type = %q, want %q", mediaType, tt.contentType)
+			}
+			if mediaType != "multipart/mixed" {
+				return
+			}
+
+			got := map[string]string{}
+			mr := multipart.NewReader(msg.Body, params["boundary"])
+			for {
+				part, err := mr.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("multipart: %v", err)
+				}
+				data, _ := io.ReadAll(part)
+				if part.FileName() == "" {
+					if strings.TrimSpace(string(data)) != tt.msg.Body {
+						t.Errorf("body part = %q, want %q", data, tt.msg.Body)
+					}
+					continue
+				}
+				decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+				if err != nil {
+					t.Fatalf("attachment %s: %v", part.FileName(), err)
+				}
+				got[part.FileName()] = string(decoded)
+			}
+			for name, want := range tt.attachments {
+				if got[name] != want {
+					t.Errorf("attachment %s = %q, want %q", name, got[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestMIMEMessageBuildAddresses(t *testing.T) {
+	m := &MIMEMessage{
+		From:    "me",
+		To:      addrs(t, `"Souza, Ana" <ana@Customer.COM>, Bo <bo@blue.cc>`),
+		Cc:      addrs(t, "Zoë <zoe@customer.com>"),
+		Subject: "s",
+		Body:    "b",
+	}
+	msg := parseBuilt(t, m)
+
+	to, err := msg.Header.AddressList("To")
+	if err != nil || len(to) != 2 || to[0].Name != "Souza, Ana" || to[0].Address != "ana@customer.com" {
+		t.Errorf("To = %v (%v), want the quoted name kept and the domain lowercased", to, err)
+	}
+	cc, err := msg.Header.AddressList("Cc")
+	if err != nil || len(cc) != 1 || cc[0].Name != "Zoë" {
+		t.Errorf("Cc = %v (%v), want the non-ASCII name round-tripped", cc, err)
+	}
+
+	if _, err := (&MIMEMessage{From: "me", Subject: "s", Body: "b"}).WriteTo(io.Discard); err == nil {
+		t.Error("WriteTo succeeded without recipients")
+	}
+}
+
+func TestParseRecipients(t *testing.T) {
+	for _, bad := range []string{"ana@", "Ana <ana@customer.com", "ana@customer.com; bo@blue.cc", "just a name"} {
+		if _, err := parseRecipients("cc", bad); err == nil || !strings.Contains(err.Error(), "--cc") {
+			t.Errorf("parseRecipients(%q) error = %v, want an invalid --cc error", bad, err)
+		}
+	}
+	if got, err := parseRecipients("cc", ""); err != nil || got != nil {
+		t.Errorf("parseRecipients(\"\") = %v, %v, want no recipients", got, err)
+	}
+}
+
+func TestMIMEMessageBuildMissingAttachment(t *testing.T) {
+	m := &MIMEMessage{From: "me", To: addrs(t, "a@b.c"), Subject: "s", Body: "b", Attachments: []string{filepath.Join(t.TempDir(), "nope.txt")}}
+	if _, err := m.WriteTo(io.Discard); err == nil {
+		t.Fatal("WriteTo succeeded with a missing attachment")
+	}
+}
+
+func TestMIMEMessageBuildNonASCII(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "請求書 2024.txt")
+	if err := os.WriteFile(name, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	subject := "Re: CSVエクスポートが失敗しました — réponse à votre demande concernant l'export du tableau"
+	m := &MIMEMessage{
+		From:        "me",
+		To:          []common.Address{{Name: "José Müller", Email: "jose@customer.com"}, {Name: "Ana Souza", Email: "ana@customer.com"}},
+		Subject:     subject,
+		Body:        "b",
+		Attachments: []string{name},
+	}
+	raw := string(build(t, m))
+	header := raw[:strings.Index(raw, "\r\n\r\n")]
+	for _, line := range strings.Split(header, "\r\n") {
+		if len(line) > maxHeaderLine {
+			t.Errorf("header line is %d characters: %q", len(line), line)
+		}
+		for _, r := range line {
+			if r > 127 {
+				t.Fatalf("raw non-ASCII in header line %q", line)
+			}
+		}
+	}
+
+	msg := parseBuilt(t, m)
+	dec := new(mime.WordDecoder)
+	if got, err := dec.DecodeHeader(msg.Header.Get("Subject")); err != nil || got != subject {
+		t.Errorf("Subject decodes to %q (%v), want %q", got, err, subject)
+	}
+	to, err := msg.Header.AddressList("To")
+	if err != nil || len(to) != 2 || to[0].Name != "José Müller" {
+		t.Errorf("To = %v (%v)", to, err)
+	}
+
+	_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal("no attachment part found")
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		if part.FileName() != "請求書 2024.txt" {
+			t.Errorf("attachment filename = %q", part.FileName())
+		}
+		if !strings.Contains(part.Header.Get("Content-Disposition"), "filename*=utf-8''") {
+			t.Errorf("Content-Disposition = %q, want an RFC 2231 filename", part.Header.Get("Content-Disposition"))
+		}
+		if ct := part.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; charset=utf-8") {
+			t.Errorf("Content-Type = %q, want the type's own parameters kept", ct)
+		}
+		break
+	}
+}
+
+func TestWriteAttachmentLongNonASCIIFilename(t *testing.T) {
+	filename := strings.Repeat("Relatório de exportação — ", 12) + "final.csv"
+	if n := len([]rune(filename)); n < 300 {
+		t.Fatalf("filename is only %d characters", n)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := writeAttachment(mw, filename, "", "", strings.NewReader("a,b\n")); err != nil {
+		t.Fatal(err)
+	}
+	mw.Close()
+
+	raw := buf.String()
+	header := raw[:strings.Index(raw, "\r\n\r\n")]
+	for _, line := range strings.Split(header, "\r\n") {
+		if len(line) > maxHeaderLine {
+			t.Errorf("header line is %d characters: %q", len(line), line)
+		}
+	}
+	if !strings.Contains(header, "filename*0*=utf-8''") || !strings.Contains(header, "filename*1*=") {
+		t.Errorf("Content-Disposition isn't split into RFC 2231 continuations:\n%s", header)
+	}
+
+	part, err := multipart.NewReader(&buf, mw.Boundary()).NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.FileName() != filename {
+		t.Errorf("filename = %q, want %q", part.FileName(), filename)
+	}
+	mediaType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/csv" || params["name"] != filename || params["charset"] != "utf-8" {
+		t.Errorf("Content-Type = %q, %v (%v)", mediaType, params, err)
+	}
+
+	// Short names stay a single parameter.
+	if got := formatMediaType("attachment", "filename", "résumé.pdf"); got != "attachment; filename*=utf-8''r%C3%A9sum%C3%A9.pdf" {
+		t.Errorf("short filename = %q", got)
+	}
+}
+
+func TestFoldHeader(t *testing.T) {
+	refs := strings.Repeat("<0123456789abcdef@mail.example.com> ", 5)
+	folded := foldHeader("References: " + strings.TrimSpace(refs))
+	lines := strings.Split(folded, "\r\n")
+	if len(lines) < 2 {
+		t.Fatalf("not folded: %q", folded)
+	}
+	for i, line := range lines {
+		if len(line) > maxHeaderLine || (i > 0 && !strings.HasPrefix(line, " ")) {
+			t.Errorf("bad folded line %q", line)
+		}
+	}
+	if unfolded := strings.ReplaceAll(folded, "\r\n", ""); unfolded != "References: "+strings.TrimSpace(refs) {
+		t.Errorf("unfolding gives %q", unfolded)
+	}
+
+	long := "Subject: " + strings.Repeat("x", 100)
+	if folded := foldHeader(long); !strings.Contains(folded, strings.Repeat("x", 100)) {
+		t.Errorf("a single long word must not be broken: %q", folded)
+	}
+}
+
+func TestMIMEMessageBuildHTML(t *testing.T) {
+	dir := t.TempDir()
+	pdf := filepath.Join(dir, "invoice.pdf")
+	if err := os.WriteFile(pdf, []byte("%PDF-1.4 fake"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// readAlternative checks a multipart/alternative part holds the text
+	// then the HTML.
+	readAlternative := func(t *testing.T, contentType string, body io.Reader) {
+		t.Helper()
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != "multipart/alternative" {
+			t.Fatalf("Content-Type = %q, want multipart/alternative", contentType)
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for _, want := range []struct{ ctype, content string }{{"text/plain", "Hi *Ana*"}, {"text/html", "<p>Hi <em>Ana</em></p>"}} {
+			part, err := mr.NextPart()
+			if err != nil {
+				t.Fatalf("missing %s part: %v", want.ctype, err)
+			}
+			data, _ := io.ReadAll(part) // multipart decodes quoted-printable
+			if !strings.HasPrefix(part.Header.Get("Content-Type"), want.ctype) || strings.TrimSpace(string(data)) != want.content {
+				t.Errorf("part %s = %q, want %s %q", part.Header.Get("Content-Type"), data, want.ctype, want.content)
+			}
+		}
+		if _, err := mr.NextPart(); err != io.EOF {
+			t.Errorf("extra part after the HTML: %v", err)
+		}
+	}
+
+	m := &MIMEMessage{From: "me", To: addrs(t, "ana@customer.com"), Subject: "s", Body: "Hi *Ana*", HTMLBody: "<p>Hi <em>Ana</em></p>"}
+	msg := parseBuilt(t, m)
+	readAlternative(t, msg.Header.Get("Content-Type"), msg.Body)
+
+	m.Attachments = []string{pdf}
+	msg = parseBuilt(t, m)
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type = %q, want multipart/mixed", mediaType)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	first, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAlternative(t, first.Header.Get("Content-Type"), first)
+	if second, err := mr.NextPart(); err != nil || second.FileName() != "invoice.pdf" {
+		t.Errorf("second part = %v, %v; want the attachment", second, err)
+	}
+}
+
+func TestMIMEMessageWriteToStreams(t *testing.T) {
+	dir := t.TempDir()
+	// An attachment containing what used to be the fixed boundary, plus
+	// enough data to span many base64 lines.
+	content := "------=_SupportAgent_Boundary_7a3f9c2e\r\n" + strings.Repeat("log line\n", 20000)
+	path := filepath.Join(dir, "support.log")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m := &MIMEMessage{From: "me", To: addrs(t, "ana@customer.com"), Subject: "s", Body: "b", HTMLBody: "<p>b</p>", Attachments: []string{path}}
+
+	first, second := parseBuilt(t, m), parseBuilt(t, m)
+	if first.Header.Get("Content-Type") == second.Header.Get("Content-Type") {
+		t.Error("two messages have the same boundary, want a random one each time")
+	}
+
+	raw := string(build(t, m))
+	for _, line := range strings.Split(raw, "\r\n") {
+		if len(line) > 78 {
+			t.Fatalf("line of %d characters: %q", len(line), line[:40])
+		}
+	}
+
+	_, params, _ := mime.ParseMediaType(first.Header.Get("Content-Type"))
+	mr := multipart.NewReader(first.Body, params["boundary"])
+	var got string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.FileName() == "support.log" {
+			data, _ := io.ReadAll(part)
+			decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = string(decoded)
+		}
+	}
+	if got != content {
+		t.Errorf("attachment came back as %d bytes, want %d", len(got), len(content))
+	}
+}
+
+func TestUploadMIME(t *testing.T) {
+	m := &MIMEMessage{From: "me", To: addrs(t, "ana@customer.com"), Subject: "s", Body: "hello"}
+
+	var uploaded []byte
+	err := uploadMIME(m, func(raw io.Reader) (err error) {
+		uploaded, err = io.ReadAll(raw)
+		return err
+	})
+	if err != nil || !bytes.Contains(uploaded, []byte("hello")) {
+		t.Errorf("uploadMIME = %v, uploaded %q", err, uploaded)
+	}
+
+	// An upload that gives up without reading must not leave the writer
+	// blocked, and its error is the one reported.
+	boom := errors.New("quota exceeded")
+	if err := uploadMIME(m, func(io.Reader) error { return boom }); err != boom {
+		t.Errorf("uploadMIME with a failed upload = %v, want %v", err, boom)
+	}
+
+	m.Attachments = []string{filepath.Join(t.TempDir(), "missing.pdf")}
+	called := false
+	if err := uploadMIME(m, func(io.Reader) error { called = true; return nil }); err == nil || called {
+		t.Errorf("uploadMIME with a missing attachment = %v (upload called: %v), want an error before uploading", err, called)
+	}
+}
@@ -0,0 +1,198 @@
+package tools
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/blue/support-agent/common"
+)
+
+// ProfileInfo is the output shape for one profile in "profiles list".
+type ProfileInfo struct {
+	Name            string   `json:"name"`
+	Active          bool     `json:"active"`
+	Dir             string   `json:"dir"`
+	UserID          string   `json:"user_id"`
+	InternalDomains []string `json:"internal_domains"`
+	StaffAddresses  []string `json:"staff_addresses,omitempty"`
+	CredentialsPath string   `json:"credentials_path,omitempty"`
+	ServiceAccount  string   `json:"service_account_key,omitempty"`
+	Impersonate     string   `json:"impersonate,omitempty"`
+	Labels          []string `json:"labels,omitempty"`
+	HasSignature    bool     `json:"has_signature"`
+	Quote           bool     `json:"quote,omitempty"`
+	QuoteLines      int      `json:"quote_lines,omitempty"`
+	LoggedIn        bool     `json:"logged_in"`
+}
+
+const profilesUsage = "Usage: profiles list [--output FORMAT] | profiles add NAME [--credentials PATH | --service-account-key PATH --impersonate EMAIL] [--user-id ID] [--internal-domain DOMAIN ...] [--staff EMAIL ...] [--signature TEXT] [--quote] [--quote-lines N] [--label NAME ...]"
+
+// RunProfiles lists and creates mailbox profiles
+func RunProfiles(args []string) error {
+	if len(args) == 0 {
+		fmt.Println(profilesUsage)
+		return fmt.Errorf("profiles subcommand required")
+	}
+
+	switch args[0] {
+	case "list":
+		return runProfilesList(args[1:])
+	case "add":
+		return runProfilesAdd(args[1:])
+	default:
+		fmt.Println(profilesUsage)
+		return fmt.Errorf("unknown profiles subcommand: %s", args[0])
+	}
+}
+
+func runProfilesList(args []string) error {
+	fs := flag.NewFlagSet("profiles list", flag.ExitOnError)
+	output := fs.String("output", "simple", "Output format: simple or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	names, err := common.ProfileNames()
+	if err != nil {
+		return err
+	}
+
+	active := common.ActiveProfileName()
+	var profiles []ProfileInfo
+	for _, name := range names {
+		p, err := common.LoadProfile(name)
+		if err != nil {
+			return err
+		}
+		profiles = append(profiles, ProfileInfo{
+			Name:            name,
+			Active:          name == active,
+			Dir:             common.ProfileDir(name),
+			UserID:          p.UserID,
+			InternalDomains: p.InternalDomains,
+			StaffAddresses:  p.StaffAddresses,
+			CredentialsPath: p.CredentialsPath,
+			ServiceAccount:  p.ServiceAccountKey,
+			Impersonate:     p.Impersonate,
+			Labels:          p.Labels,
+			HasSignature:    p.Signature != "",
+			Quote:           p.Quote,
+			QuoteLines:      p.QuoteLines,
+			LoggedIn:        common.HasToken(name),
+		})
+	}
+
+	if *output == "json" {
+		jsonData, err := json.MarshalIndent(profiles, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal JSON: %w", err)
+		}
+		fmt.Println(string(jsonData))
+		return nil
+	}
+
+	for _, p := range profiles {
+		marker := " "
+		if p.Active {
+			marker = "*"
+		}
+		login := "not logged in"
+		switch {
+		case p.ServiceAccount != "":
+			login = "service account"
+		case p.LoggedIn:
+			login = "logged in"
+		}
+		fmt.Printf("%s %-12s %-28s %-14s %s\n", marker, p.Name, p.UserID, strings.Join(p.InternalDomains, ","), login)
+		if len(p.StaffAddresses) > 0 {
+			fmt.Printf("  %-12s staff: %s\n", "", strings.Join(p.StaffAddresses, ", "))
+		}
+		if len(p.Labels) > 0 {
+			fmt.Printf("  %-12s labels: %s\n", "", strings.Join(p.Labels, ", "))
+		}
+	}
+	return nil
+}
+
+func runProfilesAdd(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Println(profilesUsage)
+		return fmt.Errorf("profile name required")
+	}
+	name := args[0]
+
+	fs := flag.NewFlagSet("profiles add", flag.ExitOnError)
+	credentials := fs.String("credentials", "", "OAuth client credentials file for this profile (default: GMAIL_CREDENTIALS_PATH)")
+	serviceAccountKey := fs.String("service-account-key", "", "Service account JSON key with domain-wide delegation, used instead of a login")
+	impersonate := fs.String("impersonate", "", "Workspace user the service account acts as (default: --user-id)")
+	userID := fs.String("user-id", "", "Mailbox to act on (default: me, the authorized account)")
+	var internalDomains, staffAddresses StringSliceFlag
+	fs.Var(&internalDomains, "internal-domain", "Email domain treated as staff, with its subdomains (repeatable; default: the internal_domains configuration)")
+	fs.Var(&staffAddresses, "staff", "Address on another domain treated as staff, e.g. a contractor (repeatable)")
+	signature := fs.String("signature", "", "Signature appended to outgoing messages")
+	quote := fs.Bool("quote", false, "Quote the original message in replies and drafts by default")
+	quoteLines := fs.Int("quote-lines", 0, "Quote at most this many lines of the original (0: all)")
+	var labels StringSliceFlag
+	fs.Var(&labels, "label", "Label read-messages lists by default instead of INBOX (repeatable)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if _, err := common.LoadProfile(name); err == nil && name != common.DefaultProfile {
+		return fmt.Errorf("profile %s already exists", name)
+	}
+
+	if *credentials != "" && *serviceAccountKey != "" {
+		return fmt.Errorf("use either --credentials or --service-account-key, not both")
+	}
+
+	p := &common.Profile{
+		Name:            name,
+		Impersonate:     *impersonate,
+		UserID:          *userID,
+		InternalDomains: internalDomains,
+		StaffAddresses:  staffAddresses,
+		Signature:       *signature,
+		Quote:           *quote,
+		QuoteLines:      *quoteLines,
+		Labels:          labels,
+	}
+	if *credentials != "" {
+		abs, err := filepath.Abs(*credentials)
+		if err != nil {
+			return fmt.Errorf("failed to resolve credentials path: %w", err)
+		}
+		p.CredentialsPath = abs
+	}
+	if *serviceAccountKey != "" {
+		abs, err := filepath.Abs(*serviceAccountKey)
+		if err != nil {
+			return fmt.Errorf("failed to resolve service account key path: %w", err)
+		}
+		p.ServiceAccountKey = abs
+	}
+	if err := common.SaveProfile(p); err != nil {
+		return err
+	}
+
+	fmt.Printf("Profile %s saved in %s\n", name, common.ProfileDir(name))
+	if p.ServiceAccountKey != "" {
+		fmt.Printf("Next: support-agent auth status --profile %s\n", name)
+	} else {
+		fmt.Printf("Next: support-agent auth login --profile %s\n", name)
+	}
+	return nil
+}
+
+// withSignature appends the active profile's signature to body, using the
+// conventional "-- " separator line.
+func withSignature(body string) string {
+	profile, err := common.CurrentProfile()
+	if err != nil || profile.Signature == "" {
+		return body
+	}
+	return strings.TrimRight(body, "\n") + "\n\n-- \n" + profile.Signature
+}
@@ -0,0 +1,98 @@
+package tools
+
+import (
+	"fmt"
+	"html"
+	"net/mail"
+	"strings"
+
+	"github.com/blue/support-agent/common"
+	"google.golang.org/api/gmail/v1"
+)
+
+// quoteDefaults returns the active profile's defaults for --quote and
+// --quote-lines.
+func quoteDefaults() (bool, int) {
+	profile, err := common.CurrentProfile()
+	if err != nil {
+		return false, 0
+	}
+	return profile.Quote, profile.QuoteLines
+}
+
+// quoteOriginal returns the original message quoted below a reply, the way
+// Gmail does it: an "On <date>, <sender> wrote:" attribution followed by the
+// original body with each line prefixed by "> ", and for HTML replies the
+// same in a <blockquote>. When maxLines is positive only that many lines
+// are quoted, followed by a note of how many were left out.
+func quoteOriginal(msg *gmail.Message, headers map[string]string, maxLines int) (string, string) {
+	body := strings.ReplaceAll(common.ExtractMessageBody(msg), "\r\n", "\n")
+	lines := strings.Split(strings.TrimRight(body, " \t\n"), "\n")
+	trimmed := 0
+	if maxLines > 0 && len(lines) > maxLines {
+		trimmed = len(lines) - maxLines
+		lines = lines[:maxLines]
+	}
+
+	intro := attribution(headers)
+	var text, htmlQuote strings.Builder
+	text.WriteString(intro + "\n")
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		switch {
+		case line == "":
+			text.WriteString(">\n")
+		case strings.HasPrefix(line, ">"):
+			// Already quoted further down the thread: nest it.
+			text.WriteString(">" + line + "\n")
+		default:
+			text.WriteString("> " + line + "\n")
+		}
+	}
+	if trimmed > 0 {
+		fmt.Fprintf(&text, "> [%d more lines not quoted]\n", trimmed)
+	}
+
+	htmlQuote.WriteString(`<div class="quote">` + html.EscapeString(intro) + "<br>\n")
+	htmlQuote.WriteString(`<blockquote type="cite" style="margin:0 0 0 .8ex;border-left:1px solid #ccc;padding-left:1ex">` + "\n")
+	for i, line := range lines {
+		if i > 0 {
+			htmlQuote.WriteString("<br>\n")
+		}
+		htmlQuote.WriteString(html.EscapeString(line))
+	}
+	if trimmed > 0 {
+		fmt.Fprintf(&htmlQuote, "<br>\n[%d more lines not quoted]", trimmed)
+	}
+	htmlQuote.WriteString("\n</blockquote></div>\n")
+
+	return text.String(), htmlQuote.String()
+}
+
+// quoteDateLayout is how Gmail shows a date in quote attributions and
+// forwarded headers.
+const quoteDateLayout = "Mon, Jan 2, 2006 at 3:04 PM"
+
+// attribution is the line introducing a quote, e.g. "On Mon, Mar 4, 2024 at
+// 9:15 AM, Ana <ana@customer.com> wrote:". The date is left out when the
+// original has none that parses.
+func attribution(headers map[string]string) string {
+	sender := headers["from"]
+	if a, err := common.ParseAddress(sender); err == nil {
+		sender = a.Display()
+	}
+	if date, err := mail.ParseDate(headers["date"]); err == nil {
+		return fmt.Sprintf("On %s, %s wrote:", date.Format(quoteDateLayout), sender)
+	}
+	return sender + " wrote:"
+}
+
+// appendQuote adds a quote from quoteOriginal below the reply's text and,
+// if the reply has one, HTML body.
+func appendQuote(text, htmlBody, quoteText, quoteHTML string) (string, string) {
+	text = strings.TrimRight(text, "\n") + "\n\n" + quoteText
+	if htmlBody != "" {
+		htmlBody = strings.TrimRight(htmlBody, "\n") + "\n" + quoteHTML
+	}
+	return text, htmlBody
+}
@@ -0,0 +1,63 @@
+package tools
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blue/support-agent/common"
+	"github.com/blue/support-agent/common/fakegmail"
+)
+
+func TestQuoteOriginal(t *testing.T) {
+	mb := fakegmail.New()
+	msg := mb.Add(fakegmail.Message{
+		From: `"Ana <Acme>" <ana@customer.com>`,
+		Date: time.Date(2024, 3, 4, 9, 15, 0, 0, time.UTC),
+		Body: "Export fails.\r\n\r\n> earlier reply\r\nline 4\r\nline 5\r\n",
+	})
+	headers := common.ExtractHeaders(msg)
+
+	text, html := quoteOriginal(msg, headers, 0)
+	want := "On Mon, Mar 4, 2024 at 9:15 AM, \"Ana <Acme>\" <ana@customer.com> wrote:\n> Export fails.\n>\n>> earlier reply\n> line 4\n> line 5\n"
+	if text != want {
+		t.Errorf("text quote =\n%s\nwant\n%s", text, want)
+	}
+	if !strings.Contains(html, "&#34;Ana &lt;Acme&gt;&#34;") || !strings.Contains(html, "<blockquote") || !strings.Contains(html, "line 5") {
+		t.Errorf("HTML quote not escaped or incomplete:\n%s", html)
+	}
+
+	text, html = quoteOriginal(msg, headers, 2)
+	if strings.Contains(text, "earlier reply") || !strings.HasSuffix(text, "> [3 more lines not quoted]\n") {
+		t.Errorf("quote trimmed to 2 lines =\n%s", text)
+	}
+	if strings.Contains(html, "line 4") || !strings.Contains(html, "[3 more lines not quoted]") {
+		t.Errorf("HTML quote trimmed to 2 lines =\n%s", html)
+	}
+
+	delete(headers, "date")
+	if got := attribution(headers); got != `"Ana <Acme>" <ana@customer.com> wrote:` {
+		t.Errorf("attribution without a date = %q", got)
+	}
+}
+
+func TestRunDraftReplyQuote(t *testing.T) {
+	useConfig(t)
+	mb := fakegmail.New()
+	mb.Add(fakegmail.Message{ID: "m1", ThreadID: "t1", From: "Ana <ana@customer.com>", Subject: "Export broken", Date: time.Date(2024, 3, 4, 9, 15, 0, 0, time.UTC), Body: "It fails with error 500."})
+	useMailbox(t, mb)
+
+	if err := RunDraftReply([]string{"--message-id", "m1", "--body", "Fixed **now**.", "--body-format", "markdown", "--quote"}); err != nil {
+		t.Fatalf("RunDraftReply: %v", err)
+	}
+	drafts := mb.Drafts()
+	if len(drafts) != 1 {
+		t.Fatalf("created %d drafts, want 1", len(drafts))
+	}
+	msg := mb.Message(drafts[0].Message.Id)
+	body := strings.ReplaceAll(common.ExtractMessageBody(msg), "\r\n", "\n")
+	want := "Fixed now.\n\nOn Mon, Mar 4, 2024 at 9:15 AM, Ana <ana@customer.com> wrote:\n> It fails with error 500.\n"
+	if body != want {
+		t.Errorf("text body =\n%q\nwant\n%q", body, want)
+	}
+}
@@ -31,20 +31,20 @@ func RunReadMessageDetail(args []string) error {
 	}
 
 	// Create client
-	client, err := common.NewGmailClient()
+	client, err := newGmailAPI()
 	if err != nil {
-		return fmt.Errorf("failed to create Gmail client: %v", err)
+		return fmt.Errorf("failed to create Gmail client: %w", err)
 	}
+	defer client.Close()
 
 	// Get message
 	msg, err := client.GetMessage(*messageID)
 	if err != nil {
-		return fmt.Errorf("failed to get message: %v", err)
+		return fmt.Errorf("failed to get message: %w", err)
 	}
 
 	// Extract message info
-	headers := common.ExtractHeaders(msg)
-	body := common.ExtractMessageBody(msg)
+	msgInfo := common.NewMessageInfo(msg, true)
 	
 	// Check for attachments
 	var attachments []string
@@ -52,21 +52,6 @@ func RunReadMessageDetail(args []string) error {
 		attachments = extractAttachments(msg.Payload)
 	}
 
-	msgInfo := common.MessageInfo{
-		ID:       msg.Id,
-		ThreadID: msg.ThreadId,
-		From:     headers["from"],
-		To:       headers["to"],
-		Cc:       headers["cc"],
-		Bcc:      headers["bcc"],
-		ReplyTo:  headers["reply-to"],
-		Subject:  headers["subject"],
-		Date:     headers["date"],
-		Snippet:  msg.Snippet,
-		Body:     body,
-		Labels:   common.GetLabelNames(msg.LabelIds),
-	}
-
 	// Output results
 	switch *output {
 	case "json":
@@ -83,7 +68,7 @@ func RunReadMessageDetail(args []string) error {
 		
 		jsonData, err := json.MarshalIndent(msgWithAttach, "", "  ")
 		if err != nil {
-			return fmt.Errorf("failed to marshal JSON: %v", err)
+			return fmt.Errorf("failed to marshal JSON: %w", err)
 		}
 		fmt.Println(string(jsonData))
 		
@@ -122,7 +107,7 @@ func RunReadMessageDetail(args []string) error {
 			}
 		}
 		
-		fmt.Printf("\nBody:\n%s\n", body)
+		fmt.Printf("\nBody:\n%s\n", msgInfo.Body)
 	}
 
 	return nil
@@ -134,7 +119,7 @@ func extractAttachments(part *gmail.MessagePart) []string {
 	
 	// Check if this part is an attachment
 	if part.Filename != "" {
-		attachments = append(attachments, part.Filename)
+		attachments = append(attachments, common.DecodeHeader(part.Filename))
 	}
 	
 	// Recursively check parts
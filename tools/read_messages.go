@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/blue/support-agent/common"
+	"google.golang.org/api/gmail/v1"
 )
 
 // RunReadMessages lists messages from Gmail
@@ -18,13 +20,21 @@ func RunReadMessages(args []string) error {
 	from := fs.String("from", "", "Filter by sender email")
 	subject := fs.String("subject", "", "Filter by subject (partial match)")
 	label := fs.String("label", "", "Filter by label (e.g., INBOX, IMPORTANT)")
-	limit := fs.Int64("limit", 10, "Maximum number of messages to return")
+	limit := fs.Int64("limit", 10, "Maximum number of messages to return (across pages)")
+	all := fs.Bool("all", false, "Return every matching message (ignores --limit)")
+	pageToken := fs.String("page-token", "", "Resume a previous listing from its next_page_token")
 	output := fs.String("output", "simple", "Output format: simple, detailed, or json")
+	envelope := fs.Bool("envelope", false, "With --output json, print an object with the messages, next_page_token, result_size_estimate and errors instead of a bare array")
+	workers := fs.Int("workers", common.DefaultHydrateWorkers, "Number of messages to fetch concurrently")
+	batch := fs.Bool("batch", false, "Fetch messages through Gmail's batch endpoint (up to 50 per request)")
 	
 	// Parse args
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
+	if *envelope && *output != "json" {
+		return fmt.Errorf("--envelope requires --output json")
+	}
 
 	// Build query
 	var queryParts []string
@@ -41,9 +51,9 @@ func RunReadMessages(args []string) error {
 		queryParts = append(queryParts, fmt.Sprintf("label:%s", *label))
 	}
 	
-	// Default to inbox if no query specified
+	// Default to the profile's labels, else the inbox, if no query specified
 	if len(queryParts) == 0 {
-		queryParts = append(queryParts, "in:inbox")
+		queryParts = append(queryParts, defaultListQuery())
 	}
 	
 	query := strings.Join(queryParts, " ")
@@ -51,51 +61,57 @@ func RunReadMessages(args []string) error {
 	// Create client
 	client, err := common.NewGmailClient()
 	if err != nil {
-		return fmt.Errorf("failed to create Gmail client: %v", err)
+		return fmt.Errorf("failed to create Gmail client: %w", err)
 	}
+	defer client.Close()
 
 	// List messages
-	messages, err := client.ListMessages(query, *limit)
+	maxResults := *limit
+	if *all {
+		maxResults = 0
+	}
+	list, err := client.ListMessages(query, maxResults, *pageToken)
 	if err != nil {
-		return fmt.Errorf("failed to list messages: %v", err)
+		return fmt.Errorf("failed to list messages: %w", err)
 	}
 
 	// Get full message details
-	var messageInfos []common.MessageInfo
-	for _, msg := range messages {
-		fullMsg, err := client.GetMessage(msg.Id)
+	var fullMessages []*gmail.Message
+	var failures []common.MessageError
+	if *batch {
+		fullMessages, failures, err = client.BatchGetMessages(common.MessageIDs(list.Messages))
 		if err != nil {
-			fmt.Printf("Warning: failed to get message %s: %v\n", msg.Id, err)
-			continue
+			return fmt.Errorf("failed to fetch messages: %w", err)
 		}
-
-		headers := common.ExtractHeaders(fullMsg)
-		body := ""
-		if *output == "detailed" || *output == "json" {
-			body = common.ExtractMessageBody(fullMsg)
+	} else {
+		fullMessages, failures = client.HydrateMessages(list.Messages, *workers)
+	}
+	if !*envelope {
+		for _, f := range failures {
+			fmt.Fprintf(os.Stderr, "Warning: failed to get message %s: %s\n", f.ID, f.Error)
 		}
+	}
 
-		info := common.MessageInfo{
-			ID:       fullMsg.Id,
-			ThreadID: fullMsg.ThreadId,
-			From:     headers["from"],
-			To:       headers["to"],
-			Subject:  headers["subject"],
-			Date:     headers["date"],
-			Snippet:  fullMsg.Snippet,
-			Body:     body,
-			Labels:   common.GetLabelNames(fullMsg.LabelIds),
-		}
-		
-		messageInfos = append(messageInfos, info)
+	messageInfos := []common.MessageInfo{}
+	for _, fullMsg := range fullMessages {
+		messageInfos = append(messageInfos, common.NewMessageInfo(fullMsg, *output == "detailed" || *output == "json"))
 	}
 
 	// Output results
 	switch *output {
 	case "json":
-		jsonData, err := json.MarshalIndent(messageInfos, "", "  ")
+		var result interface{} = messageInfos
+		if *envelope {
+			result = common.MessageListInfo{
+				Messages:           messageInfos,
+				NextPageToken:      list.NextPageToken,
+				ResultSizeEstimate: list.ResultSizeEstimate,
+				Errors:             failures,
+			}
+		}
+		jsonData, err := json.MarshalIndent(result, "", "  ")
 		if err != nil {
-			return fmt.Errorf("failed to marshal JSON: %v", err)
+			return fmt.Errorf("failed to marshal JSON: %w", err)
 		}
 		fmt.Println(string(jsonData))
 		
@@ -127,5 +143,23 @@ func RunReadMessages(args []string) error {
 		}
 	}
 
+	if list.NextPageToken != "" && !*envelope {
+		printMoreResults(list.NextPageToken, *output == "json")
+	}
+
 	return nil
-}
\ No newline at end of file
+}
+
+// defaultListQuery is what read-messages lists without filters: the active
+// profile's labels if it has any, else the inbox.
+func defaultListQuery() string {
+	profile, err := common.CurrentProfile()
+	if err != nil || len(profile.Labels) == 0 {
+		return "in:inbox"
+	}
+	terms := make([]string, len(profile.Labels))
+	for i, l := range profile.Labels {
+		terms[i] = "label:" + strings.ReplaceAll(l, " ", "-")
+	}
+	return strings.Join(terms, " OR ")
+}
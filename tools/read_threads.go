@@ -31,15 +31,16 @@ func RunReadThreads(args []string) error {
 	}
 
 	// Create client
-	client, err := common.NewGmailClient()
+	client, err := newGmailAPI()
 	if err != nil {
-		return fmt.Errorf("failed to create Gmail client: %v", err)
+		return fmt.Errorf("failed to create Gmail client: %w", err)
 	}
+	defer client.Close()
 
 	// Get thread
 	thread, err := client.GetThread(*threadID)
 	if err != nil {
-		return fmt.Errorf("failed to get thread: %v", err)
+		return fmt.Errorf("failed to get thread: %w", err)
 	}
 
 	// Build thread info
@@ -50,16 +51,17 @@ func RunReadThreads(args []string) error {
 	}
 
 	// Extract participants
-	participantMap := make(map[string]bool)
+	var participants []common.Address
 	var lastMessageTime time.Time
 
 	// Process messages
 	for _, msg := range thread.Messages {
 		headers := common.ExtractHeaders(msg)
 		
-		// Track participants
-		if from := headers["from"]; from != "" {
-			participantMap[from] = true
+		// Track participants, in order of first appearance
+		addrs := common.ParseMessageAddresses(headers)
+		if addrs != nil && addrs.From != nil {
+			participants = append(participants, *addrs.From)
 		}
 		
 		// Extract body for detailed/json output
@@ -93,6 +95,7 @@ func RunReadThreads(args []string) error {
 			Body:      body,
 			Labels:    common.GetLabelNames(msg.LabelIds),
 			Timestamp: msgTime,
+			Addresses: addrs,
 		}
 		
 		threadInfo.Messages = append(threadInfo.Messages, msgInfo)
@@ -103,19 +106,17 @@ func RunReadThreads(args []string) error {
 		}
 	}
 
-	// Set participants
-	for participant := range participantMap {
-		threadInfo.Participants = append(threadInfo.Participants, participant)
-	}
-	
 	threadInfo.LastMessage = lastMessageTime
+	for _, p := range common.UniqueAddresses(participants) {
+		threadInfo.Participants = append(threadInfo.Participants, p.String())
+	}
 
 	// Output results
 	switch *output {
 	case "json":
 		jsonData, err := json.MarshalIndent(threadInfo, "", "  ")
 		if err != nil {
-			return fmt.Errorf("failed to marshal JSON: %v", err)
+			return fmt.Errorf("failed to marshal JSON: %w", err)
 		}
 		fmt.Println(string(jsonData))
 		
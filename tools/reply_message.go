@@ -3,6 +3,7 @@ package tools
 import (
 	"flag"
 	"fmt"
+	"io"
 	"strings"
 
 	"github.com/blue/support-agent/common"
@@ -15,12 +16,18 @@ func RunReplyMessage(args []string) error {
 
 	messageID := fs.String("message-id", "", "Message ID to reply to (required)")
 	body := fs.String("body", "", "Reply body text (required)")
+	bodyFormat := fs.String("body-format", string(BodyText), "How --body is written: text, markdown or html (sent as HTML with a plain-text alternative)")
 	threadID := fs.String("thread-id", "", "Thread ID (optional, will be fetched if not provided)")
 	toOverride := fs.String("to", "", "Override recipient — defaults to the original sender. Use when the thread was started by a no-reply bot and you want to route the reply to the real customer.")
 	cc := fs.String("cc", "", "Cc recipients (comma-separated)")
 	bcc := fs.String("bcc", "", "Bcc recipients (comma-separated)")
 	var attachments StringSliceFlag
 	fs.Var(&attachments, "attach", "Path to file to attach (repeatable)")
+	var inline StringSliceFlag
+	fs.Var(&inline, "inline", "Image to show in the body, referenced by filename or cid:FILENAME (repeatable; needs --body-format markdown or html)")
+	quoteDefault, quoteLinesDefault := quoteDefaults()
+	quote := fs.Bool("quote", quoteDefault, "Quote the original message below the reply (default from the profile's quote setting)")
+	quoteLines := fs.Int("quote-lines", quoteLinesDefault, "Quote at most this many lines of the original (0: all)")
 
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -28,21 +35,56 @@ func RunReplyMessage(args []string) error {
 
 	if *messageID == "" || *body == "" {
 		fmt.Println("Error: message-id and body are required")
-		fmt.Println("\nUsage: reply-message --message-id MESSAGE_ID --body \"Reply text\" [--to EMAIL] [--cc EMAIL] [--bcc EMAIL] [--attach PATH ...] [--thread-id THREAD_ID]")
+		fmt.Println("\nUsage: reply-message --message-id MESSAGE_ID --body \"Reply text\" [--to EMAIL] [--body-format text|markdown|html] [--cc EMAIL] [--bcc EMAIL] [--attach PATH ...] [--inline IMAGE ...] [--quote] [--quote-lines N] [--thread-id THREAD_ID]")
 		return fmt.Errorf("message-id and body are required")
 	}
 
-	client, err := common.NewGmailClient()
+	if *quoteLines < 0 {
+		return fmt.Errorf("--quote-lines must not be negative")
+	}
+
+	format, err := parseBodyFormat(*bodyFormat)
+	if err != nil {
+		return err
+	}
+	images, err := newInlineImages(inline)
+	if err != nil {
+		return err
+	}
+	text, htmlBody, err := renderBody(*body, format, images)
 	if err != nil {
-		return fmt.Errorf("failed to create Gmail client: %v", err)
+		return err
 	}
 
+	toList, err := parseRecipients("to", *toOverride)
+	if err != nil {
+		return err
+	}
+	ccList, err := parseRecipients("cc", *cc)
+	if err != nil {
+		return err
+	}
+	bccList, err := parseRecipients("bcc", *bcc)
+	if err != nil {
+		return err
+	}
+
+	client, err := newGmailAPI()
+	if err != nil {
+		return fmt.Errorf("failed to create Gmail client: %w", err)
+	}
+	defer client.Close()
+
 	originalMsg, err := client.GetMessage(*messageID)
 	if err != nil {
-		return fmt.Errorf("failed to get original message: %v", err)
+		return fmt.Errorf("failed to get original message: %w", err)
 	}
 
 	headers := common.ExtractHeaders(originalMsg)
+	if *quote {
+		quoteText, quoteHTML := quoteOriginal(originalMsg, headers, *quoteLines)
+		text, htmlBody = appendQuote(text, htmlBody, quoteText, quoteHTML)
+	}
 
 	tid := *threadID
 	if tid == "" {
@@ -52,9 +94,14 @@ func RunReplyMessage(args []string) error {
 	to := defaultReplyRecipient(client, headers, tid)
 	if *toOverride != "" {
 		to = *toOverride
-	} else if to != headers["from"] {
-		fmt.Printf("Note: original message is from an internal address (%s); routing reply to %s (first external participant in thread). Use --to to override.\n",
-			headers["from"], to)
+	} else {
+		if to != headers["from"] {
+			fmt.Printf("Note: original message is from an internal address (%s); routing reply to %s (first external participant in thread). Use --to to override.\n",
+				headers["from"], to)
+		}
+		if toList, err = common.ParseAddressList(to); err != nil || len(toList) == 0 {
+			return fmt.Errorf("no valid reply recipient in %q; use --to", to)
+		}
 	}
 
 	subject := headers["subject"]
@@ -72,27 +119,25 @@ func RunReplyMessage(args []string) error {
 
 	msg := &MIMEMessage{
 		From:        "me",
-		To:          to,
-		Cc:          *cc,
-		Bcc:         *bcc,
+		To:          toList,
+		Cc:          ccList,
+		Bcc:         bccList,
 		Subject:     subject,
-		Body:        *body,
+		Body:        text,
+		HTMLBody:    htmlBody,
 		InReplyTo:   originalMessageID,
 		References:  references,
 		Attachments: attachments,
+		Inline:      images,
 	}
 
-	encoded, err := msg.Build()
-	if err != nil {
-		return fmt.Errorf("failed to build message: %v", err)
-	}
-
-	sentMsg, err := client.SendMessage(&gmail.Message{
-		Raw:      encoded,
-		ThreadId: tid,
+	var sentMsg *gmail.Message
+	err = uploadMIME(msg, func(raw io.Reader) (err error) {
+		sentMsg, err = client.SendMessage(tid, raw)
+		return err
 	})
 	if err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+		return fmt.Errorf("failed to send reply: %w", err)
 	}
 
 	fmt.Printf("Reply sent successfully!\n")
@@ -109,6 +154,9 @@ func RunReplyMessage(args []string) error {
 	if len(attachments) > 0 {
 		fmt.Printf("Attachments: %d\n", len(attachments))
 	}
+	if len(images) > 0 {
+		fmt.Printf("Inline images: %d\n", len(images))
+	}
 
 	return nil
 }
@@ -125,7 +173,7 @@ func RunReplyMessage(args []string) error {
 // This avoids the footgun where Gmail's "reply-all logic" would otherwise
 // bounce the reply back to the last internal sender and the customer
 // never receives it.
-func defaultReplyRecipient(client *common.GmailClient, headers map[string]string, threadID string) string {
+func defaultReplyRecipient(client common.GmailAPI, headers map[string]string, threadID string) string {
 	if rt := headers["reply-to"]; rt != "" && !common.IsInternalAddress(rt) {
 		return rt
 	}
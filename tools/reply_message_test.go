@@ -0,0 +1,143 @@
+package tools
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/blue/support-agent/common"
+	"github.com/blue/support-agent/common/fakegmail"
+)
+
+func TestDefaultReplyRecipient(t *testing.T) {
+	useConfig(t).StaffAddresses = []string{"pat@contractor.dev"}
+
+	tests := []struct {
+		name     string
+		thread   []fakegmail.Message // oldest first; the last one is replied to
+		failList bool
+		want     string
+	}{
+		{
+			name: "external sender",
+			thread: []fakegmail.Message{
+				{From: "Ana <ana@customer.com>"},
+			},
+			want: "Ana <ana@customer.com>",
+		},
+		{
+			name: "reply-to wins over from",
+			thread: []fakegmail.Message{
+				{From: "Forms <noreply@forms.example>", ReplyTo: "ana@customer.com"},
+			},
+			want: "ana@customer.com",
+		},
+		{
+			name: "internal reply-to is ignored",
+			thread: []fakegmail.Message{
+				{From: "ana@customer.com", ReplyTo: "help@blue.cc"},
+			},
+			want: "ana@customer.com",
+		},
+		{
+			name: "internal handoff routes to first external participant",
+			thread: []fakegmail.Message{
+				{From: "Ana <ana@customer.com>"},
+				{From: "Support <help@blue.cc>"},
+				{From: "Bo <bo@blue.cc>"},
+			},
+			want: "Ana <ana@customer.com>",
+		},
+		{
+			name: "all internal falls back to from",
+			thread: []fakegmail.Message{
+				{From: "help@blue.cc"},
+				{From: "bo@blue.cc"},
+			},
+			want: "bo@blue.cc",
+		},
+		{
+			name: "lookalike of the internal domain is a customer",
+			thread: []fakegmail.Message{
+				{From: "Ana <ana@customer.com>"},
+				{From: "Support <help@blue.cc.attacker.com>"},
+			},
+			want: "Support <help@blue.cc.attacker.com>",
+		},
+		{
+			name: "internal address in the display name is a customer",
+			thread: []fakegmail.Message{
+				{From: `"help@blue.cc" <mallory@attacker.com>`},
+			},
+			want: `"help@blue.cc" <mallory@attacker.com>`,
+		},
+		{
+			name: "staff address on another domain routes past the contractor",
+			thread: []fakegmail.Message{
+				{From: "Ana <ana@customer.com>"},
+				{From: "Pat <pat@contractor.dev>"},
+			},
+			want: "Ana <ana@customer.com>",
+		},
+		{
+			name: "thread lookup failure falls back to from",
+			thread: []fakegmail.Message{
+				{From: "ana@customer.com"},
+				{From: "bo@blue.cc"},
+			},
+			failList: true,
+			want:     "bo@blue.cc",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mb := fakegmail.New()
+			var last string
+			for _, m := range tt.thread {
+				m.ThreadID = "t1"
+				last = mb.Add(m).Id
+			}
+			if tt.failList {
+				mb.FailOn("GetThread", errors.New("boom"))
+			}
+
+			headers := common.ExtractHeaders(mb.Message(last))
+			if got := defaultReplyRecipient(mb, headers, "t1"); got != tt.want {
+				t.Errorf("defaultReplyRecipient = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunReplyMessage(t *testing.T) {
+	mb := fakegmail.New()
+	mb.Add(fakegmail.Message{ID: "m1", ThreadID: "t1", From: "ana@customer.com", To: "help@blue.cc", Subject: "Export broken", MessageID: "<a1@customer.com>"})
+	mb.Add(fakegmail.Message{ID: "m2", ThreadID: "t1", From: "bo@blue.cc", To: "help@blue.cc", Subject: "Re: Export broken", MessageID: "<b2@blue.cc>", References: "<a1@customer.com>"})
+	useMailbox(t, mb)
+
+	if err := RunReplyMessage([]string{"--message-id", "m2", "--body", "Fixed now."}); err != nil {
+		t.Fatalf("RunReplyMessage: %v", err)
+	}
+
+	sent := mb.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent))
+	}
+	got := sent[0]
+	if got.ThreadId != "t1" {
+		t.Errorf("thread = %q, want t1", got.ThreadId)
+	}
+	for name, want := range map[string]string{
+		"To":          "ana@customer.com",
+		"Subject":     "Re: Export broken",
+		"In-Reply-To": "<b2@blue.cc>",
+		"References":  "<a1@customer.com> <b2@blue.cc>",
+	} {
+		if v := header(t, mb, got.Id, name); v != want {
+			t.Errorf("%s = %q, want %q", name, v, want)
+		}
+	}
+	if body := common.ExtractMessageBody(got); body != "Fixed now." {
+		t.Errorf("body = %q", body)
+	}
+}
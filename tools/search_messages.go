@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/blue/support-agent/common"
+	"google.golang.org/api/gmail/v1"
 )
 
 // RunSearchMessages searches messages using Gmail query syntax
@@ -15,13 +17,25 @@ func RunSearchMessages(args []string) error {
 	
 	// Define flags
 	query := fs.String("query", "", "Gmail search query (required)")
-	limit := fs.Int64("limit", 20, "Maximum number of results")
+	limit := fs.Int64("limit", 20, "Maximum number of results (across pages)")
+	all := fs.Bool("all", false, "Return every matching message (ignores --limit)")
+	pageToken := fs.String("page-token", "", "Resume a previous search from its next_page_token")
 	output := fs.String("output", "simple", "Output format: simple, detailed, or json")
+	envelope := fs.Bool("envelope", false, "With --output json, print an object with the messages, next_page_token, result_size_estimate and errors instead of a bare array")
+	workers := fs.Int("workers", common.DefaultHydrateWorkers, "Number of messages to fetch concurrently")
+	batch := fs.Bool("batch", false, "Fetch messages through Gmail's batch endpoint (up to 50 per request)")
+	local := fs.Bool("local", false, "Search the local mirror instead of Gmail (offline; supports phrases~N, /regex/)")
 	
 	// Parse args
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
+	if *envelope && *output != "json" {
+		return fmt.Errorf("--envelope requires --output json")
+	}
+	if *local && *pageToken != "" {
+		return fmt.Errorf("--page-token can't be used with --local: local results aren't paged")
+	}
 
 	// Validate
 	if *query == "" {
@@ -37,61 +51,49 @@ func RunSearchMessages(args []string) error {
 		return fmt.Errorf("query is required")
 	}
 
-	// Create client
-	client, err := common.NewGmailClient()
-	if err != nil {
-		return fmt.Errorf("failed to create Gmail client: %v", err)
+	maxResults := *limit
+	if *all {
+		maxResults = 0
 	}
+	withBody := *output == "detailed" || *output == "json"
 
-	// Search messages
-	messages, err := client.ListMessages(*query, *limit)
+	var result *common.MessageListInfo
+	var err error
+	if *local {
+		result, err = searchLocal(*query, maxResults, withBody)
+	} else {
+		result, err = searchGmail(*query, maxResults, *pageToken, withBody, *batch, *workers)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to search messages: %v", err)
+		return err
 	}
+	messageInfos := result.Messages
 
-	if len(messages) == 0 {
+	if len(messageInfos) == 0 && len(result.Errors) == 0 && *output != "json" {
 		fmt.Println("No messages found matching query.")
 		return nil
 	}
 
-	// Get full message details
-	var messageInfos []common.MessageInfo
-	for _, msg := range messages {
-		fullMsg, err := client.GetMessage(msg.Id)
-		if err != nil {
-			fmt.Printf("Warning: failed to get message %s: %v\n", msg.Id, err)
-			continue
-		}
-
-		headers := common.ExtractHeaders(fullMsg)
-		body := ""
-		if *output == "detailed" || *output == "json" {
-			body = common.ExtractMessageBody(fullMsg)
+	if !*envelope {
+		for _, f := range result.Errors {
+			fmt.Fprintf(os.Stderr, "Warning: failed to get message %s: %s\n", f.ID, f.Error)
 		}
-
-		info := common.MessageInfo{
-			ID:       fullMsg.Id,
-			ThreadID: fullMsg.ThreadId,
-			From:     headers["from"],
-			To:       headers["to"],
-			Subject:  headers["subject"],
-			Date:     headers["date"],
-			Snippet:  fullMsg.Snippet,
-			Body:     body,
-			Labels:   common.GetLabelNames(fullMsg.LabelIds),
-		}
-		
-		messageInfos = append(messageInfos, info)
 	}
 
 	// Output results
-	fmt.Printf("Found %d messages matching query: %s\n\n", len(messageInfos), *query)
-	
+	if *output != "json" {
+		fmt.Printf("Found %d messages matching query: %s\n\n", len(messageInfos), *query)
+	}
+
 	switch *output {
 	case "json":
-		jsonData, err := json.MarshalIndent(messageInfos, "", "  ")
+		var out interface{} = messageInfos
+		if *envelope {
+			out = result
+		}
+		jsonData, err := json.MarshalIndent(out, "", "  ")
 		if err != nil {
-			return fmt.Errorf("failed to marshal JSON: %v", err)
+			return fmt.Errorf("failed to marshal JSON: %w", err)
 		}
 		fmt.Println(string(jsonData))
 		
@@ -124,5 +126,85 @@ func RunSearchMessages(args []string) error {
 		}
 	}
 
+	if result.NextPageToken != "" && !*envelope {
+		printMoreResults(result.NextPageToken, *output == "json")
+	}
+
 	return nil
-}
\ No newline at end of file
+}
+
+// printMoreResults tells the user how to fetch the next page. Bare JSON
+// output has nowhere to put the token, so it goes to stderr there.
+func printMoreResults(pageToken string, jsonOutput bool) {
+	w := os.Stdout
+	if jsonOutput {
+		w = os.Stderr
+	}
+	fmt.Fprintf(w, "\nMore results available. Resume with --page-token %s\n", pageToken)
+}
+
+// searchGmail runs query through Gmail's search engine and hydrates the
+// matches.
+func searchGmail(query string, maxResults int64, pageToken string, withBody, batch bool, workers int) (*common.MessageListInfo, error) {
+	// Create client
+	client, err := common.NewGmailClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Gmail client: %w", err)
+	}
+	defer client.Close()
+
+	// Search messages
+	list, err := client.ListMessages(query, maxResults, pageToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search messages: %w", err)
+	}
+
+	// Get full message details
+	var fullMessages []*gmail.Message
+	var failures []common.MessageError
+	if batch {
+		fullMessages, failures, err = client.BatchGetMessages(common.MessageIDs(list.Messages))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch messages: %w", err)
+		}
+	} else {
+		fullMessages, failures = client.HydrateMessages(list.Messages, workers)
+	}
+
+	messageInfos := []common.MessageInfo{}
+	for _, fullMsg := range fullMessages {
+		messageInfos = append(messageInfos, common.NewMessageInfo(fullMsg, withBody))
+	}
+
+	return &common.MessageListInfo{
+		Messages:           messageInfos,
+		NextPageToken:      list.NextPageToken,
+		ResultSizeEstimate: list.ResultSizeEstimate,
+		Errors:             failures,
+	}, nil
+}
+
+// searchLocal runs query against the local full-text index built from
+// cached and mirrored messages. It needs no network or credentials.
+func searchLocal(query string, maxResults int64, withBody bool) (*common.MessageListInfo, error) {
+	cache, err := common.OpenCache(common.DefaultCachePath())
+	if err != nil {
+		return nil, err
+	}
+	defer cache.Close()
+
+	messageInfos, err := cache.SearchIndex(query, int(maxResults))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search local index: %w", err)
+	}
+	if messageInfos == nil {
+		messageInfos = []common.MessageInfo{}
+	}
+	if !withBody {
+		for i := range messageInfos {
+			messageInfos[i].Body = ""
+		}
+	}
+
+	return &common.MessageListInfo{Messages: messageInfos}, nil
+}
@@ -0,0 +1,166 @@
+package tools
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/blue/support-agent/common"
+	"google.golang.org/api/gmail/v1"
+)
+
+// syncStatePrefix names the checkpoint files (under TOKEN_DIR) used by the
+// sync command.
+const syncStatePrefix = "sync_state"
+
+// labelStateName returns the checkpoint name for a command syncing labelID.
+// A checkpoint only covers changes to the label it was taken for, so each
+// label gets its own; "all" is used for all mail.
+func labelStateName(prefix, labelID string) string {
+	if labelID == "" {
+		return prefix + "-all"
+	}
+	return prefix + "-" + strings.Map(func(r rune) rune {
+		if r < 0x80 && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-') {
+			return r
+		}
+		return '_'
+	}, labelID)
+}
+
+// RunSync emits what changed in the mailbox since the last run as NDJSON
+// events, using the Gmail History API.
+func RunSync(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+
+	label := fs.String("label", "INBOX", "Only sync messages with this label (name or ID; empty for all mail)")
+	reset := fs.Bool("reset", false, "Ignore the saved checkpoint and do a full resync")
+	dryRun := fs.Bool("dry-run", false, "Emit events without saving the new checkpoint")
+	limit := fs.Int64("limit", 0, "Maximum messages to emit during a full resync (0 for all); a resync cut short saves no checkpoint")
+	mirror := fs.Bool("mirror", false, "Also fetch changed messages into the local cache and search index (for search-messages --local)")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	client, err := common.NewGmailClient()
+	if err != nil {
+		return fmt.Errorf("failed to create Gmail client: %w", err)
+	}
+	defer client.Close()
+
+	labelID, err := resolveSyncLabel(client, *label)
+	if err != nil {
+		return err
+	}
+
+	state, err := common.LoadSyncState(labelStateName(syncStatePrefix, labelID))
+	if err != nil {
+		return err
+	}
+	start := state.HistoryID
+	if *reset {
+		start = 0
+	}
+
+	if *mirror && client.Cache == nil {
+		return fmt.Errorf("--mirror needs the local cache; remove --no-cache or SUPPORT_AGENT_CACHE=off")
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	var changed []*gmail.Message
+	var deleted []string
+	historyID, err := client.Sync(start, labelID, *limit, func(ev common.SyncEvent) error {
+		if *mirror {
+			switch ev.Type {
+			case common.EventMessageAdded, common.EventLabelsAdded, common.EventLabelsRemoved:
+				changed = append(changed, &gmail.Message{Id: ev.MessageID})
+			case common.EventMessageDeleted:
+				deleted = append(deleted, ev.MessageID)
+			}
+		}
+		return enc.Encode(ev)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to sync: %w", err)
+	}
+
+	failed := 0
+	if *mirror {
+		if failed, err = mirrorChanges(client, changed, deleted); err != nil {
+			return err
+		}
+	}
+
+	if historyID == 0 {
+		// Checkpointing now would skip the messages past the limit.
+		fmt.Fprintf(os.Stderr, "Warning: resync stopped at --limit %d; checkpoint not saved, the next sync resyncs again\n", *limit)
+		return nil
+	}
+	if err := enc.Encode(common.SyncEvent{Type: common.EventCheckpoint, HistoryID: historyID}); err != nil {
+		return err
+	}
+
+	if *dryRun {
+		return nil
+	}
+	if failed > 0 {
+		// Keep the old checkpoint so the next sync sees these changes again.
+		fmt.Fprintf(os.Stderr, "Warning: %d message(s) failed to mirror; checkpoint not saved, the next sync will retry them\n", failed)
+		return nil
+	}
+	return common.SaveSyncState(labelStateName(syncStatePrefix, labelID), &common.SyncState{HistoryID: historyID, UpdatedAt: time.Now()})
+}
+
+// mirrorChanges fetches changed messages through the cache, which indexes
+// them for local search, and drops deleted ones from the index. A message
+// that fails to fetch is reported and counted in the returned total; the
+// caller then keeps the old checkpoint so the next sync fetches it again.
+func mirrorChanges(client *common.GmailClient, changed []*gmail.Message, deleted []string) (int, error) {
+	seen := make(map[string]bool)
+	var stubs []*gmail.Message
+	for _, m := range changed {
+		if !seen[m.Id] {
+			seen[m.Id] = true
+			stubs = append(stubs, m)
+		}
+	}
+
+	failed := 0
+	if len(stubs) > 0 {
+		_, failures := client.HydrateMessages(stubs, common.DefaultHydrateWorkers)
+		for _, f := range failures {
+			if f.Kind == common.KindNotFound {
+				deleted = append(deleted, f.ID)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Warning: failed to mirror message %s: %s\n", f.ID, f.Error)
+			failed++
+		}
+	}
+
+	if err := client.Cache.RemoveFromIndex(deleted); err != nil {
+		return failed, fmt.Errorf("failed to update search index: %w", err)
+	}
+	return failed, nil
+}
+
+// resolveSyncLabel turns a label name or ID into the ID the History API
+// filters on. An empty label means all mail.
+func resolveSyncLabel(client *common.GmailClient, label string) (string, error) {
+	if label == "" {
+		return "", nil
+	}
+	ids, err := client.ResolveLabelNames([]string{label}, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve label: %w", err)
+	}
+	if len(ids) == 0 {
+		return "", nil
+	}
+	return ids[0], nil
+}
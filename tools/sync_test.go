@@ -0,0 +1,21 @@
+package tools
+
+import "testing"
+
+func TestLabelStateName(t *testing.T) {
+	tests := []struct {
+		prefix, labelID, want string
+	}{
+		{"sync_state", "", "sync_state-all"},
+		{"sync_state", "INBOX", "sync_state-INBOX"},
+		{"sync_state", "Label_12", "sync_state-Label_12"},
+		{"watch_state", "INBOX", "watch_state-INBOX"},
+		{"sync_state", "../etc/passwd", "sync_state-___etc_passwd"},
+		{"sync_state", "Ünïcode label", "sync_state-_n_code_label"},
+	}
+	for _, tt := range tests {
+		if got := labelStateName(tt.prefix, tt.labelID); got != tt.want {
+			t.Errorf("labelStateName(%q, %q) = %q, want %q", tt.prefix, tt.labelID, got, tt.want)
+		}
+	}
+}
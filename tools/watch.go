@@ -0,0 +1,261 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/blue/support-agent/common"
+)
+
+// watchStatePrefix names the checkpoint files (under TOKEN_DIR) used by the
+// watch command, one per label as for sync (see labelStateName). They are
+// separate from the sync checkpoints so running both doesn't make either
+// skip changes.
+const watchStatePrefix = "watch_state"
+
+// watchRenewInterval is how often the Gmail watch is renewed. Watches expire
+// after 7 days; Google recommends renewing daily.
+const watchRenewInterval = 24 * time.Hour
+
+// RunWatch streams newly arrived messages as NDJSON, one common.MessageInfo
+// per line. It polls the History API on an interval and, with --listen, also
+// syncs immediately when a Pub/Sub push notification arrives.
+func RunWatch(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+
+	interval := fs.Duration("interval", 30*time.Second, "Polling interval (0 to rely on push notifications only)")
+	listen := fs.String("listen", "", "Address for the Pub/Sub push endpoint (e.g. :8080)")
+	path := fs.String("path", "/gmail/push", "HTTP path of the push endpoint")
+	pushToken := fs.String("push-token", common.Settings().WatchPushToken, "Shared secret required as ?token= on push requests")
+	topic := fs.String("topic", "", "Pub/Sub topic to register with Gmail (projects/PROJECT/topics/TOPIC)")
+	label := fs.String("label", "INBOX", "Only emit messages arriving with this label (name or ID)")
+	noBody := fs.Bool("no-body", false, "Omit message bodies from events")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *interval <= 0 && *listen == "" {
+		return fmt.Errorf("either --interval or --listen is required")
+	}
+	// Without a token anyone who can reach the endpoint can make the watch
+	// hammer the History API.
+	if *listen != "" && *pushToken == "" {
+		return fmt.Errorf("--listen requires --push-token (or watch_push_token) so only Pub/Sub can trigger syncs")
+	}
+
+	client, err := common.NewGmailClient()
+	if err != nil {
+		return fmt.Errorf("failed to create Gmail client: %w", err)
+	}
+	// A watch runs for days and bbolt lets one process at a time hold the
+	// cache, so release it and fetch new messages straight from Gmail;
+	// other commands on this profile keep using the cache meanwhile.
+	client.Close()
+
+	labelID, err := resolveSyncLabel(client, *label)
+	if err != nil {
+		return err
+	}
+
+	state, err := common.LoadSyncState(labelStateName(watchStatePrefix, labelID))
+	if err != nil {
+		return err
+	}
+
+	w := &watcher{
+		client:    client,
+		labelID:   labelID,
+		withBody:  !*noBody,
+		enc:       json.NewEncoder(os.Stdout),
+		historyID: state.HistoryID,
+		seen:      make(map[string]bool),
+	}
+
+	// Without a checkpoint, start from "now" rather than replaying the
+	// whole mailbox as new mail.
+	if w.historyID == 0 {
+		if err := w.rebaseline(); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var renew <-chan time.Time
+	if *topic != "" {
+		if err := w.startWatch(*topic); err != nil {
+			return err
+		}
+		ticker := time.NewTicker(watchRenewInterval)
+		defer ticker.Stop()
+		renew = ticker.C
+	}
+
+	var push <-chan common.PushNotification
+	serverErr := make(chan error, 1)
+	if *listen != "" {
+		handler := common.NewPushHandler(*pushToken)
+		mux := http.NewServeMux()
+		mux.Handle(*path, handler)
+		server := &http.Server{Addr: *listen, Handler: mux}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serverErr <- err
+			}
+		}()
+		defer server.Shutdown(context.Background())
+		push = handler.Notifications
+		fmt.Fprintf(os.Stderr, "watch: listening for push notifications on %s%s\n", *listen, *path)
+	}
+
+	var poll <-chan time.Time
+	if *interval > 0 {
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	// Catch up on anything that arrived since the last run.
+	if err := w.poll(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-serverErr:
+			return fmt.Errorf("push endpoint failed: %w", err)
+		case <-renew:
+			if err := w.startWatch(*topic); err != nil {
+				fmt.Fprintf(os.Stderr, "watch: failed to renew Gmail watch: %v\n", err)
+			}
+		case <-poll:
+			if err := w.poll(); err != nil {
+				return err
+			}
+		case <-push:
+			if err := w.poll(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// watcher holds the state of a running watch.
+type watcher struct {
+	client    *common.GmailClient
+	labelID   string
+	withBody  bool
+	enc       *json.Encoder
+	historyID uint64
+	seen      map[string]bool // message IDs already emitted this run
+}
+
+// poll emits every message added since the checkpoint and advances it.
+// Transient errors are logged and retried on the next tick rather than
+// ending the watch; the checkpoint then only advances past the history
+// records handled in full, so a message that failed is emitted next time.
+func (w *watcher) poll() error {
+	result, err := w.client.History(w.historyID, w.labelID)
+	if errors.Is(err, common.ErrHistoryExpired) {
+		fmt.Fprintf(os.Stderr, "watch: history checkpoint expired; restarting from now (messages in the gap are not emitted)\n")
+		return w.rebaseline()
+	}
+	if err != nil {
+		if common.ErrorKindOf(err) == common.KindAuthExpired {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "watch: sync failed, will retry: %v\n", err)
+		return nil
+	}
+
+	handled := w.historyID
+	for _, h := range result.Records {
+		for _, added := range h.MessagesAdded {
+			m := added.Message
+			if w.seen[m.Id] || !w.inScope(m.LabelIds) {
+				continue
+			}
+			full, err := w.client.GetMessage(m.Id)
+			if errors.Is(err, common.ErrNotFound) {
+				continue // deleted before we got to it
+			}
+			if err != nil {
+				if common.ErrorKindOf(err) == common.KindAuthExpired {
+					return err
+				}
+				fmt.Fprintf(os.Stderr, "watch: failed to get message %s, will retry: %v\n", m.Id, err)
+				return w.checkpoint(handled)
+			}
+			if err := w.enc.Encode(common.NewMessageInfo(full, w.withBody)); err != nil {
+				return err
+			}
+			w.seen[m.Id] = true
+		}
+		handled = h.Id
+	}
+
+	// History records are ordered, so the seen set only needs to guard
+	// against overlap between consecutive polls, and against re-emitting
+	// the messages of a record that is retried after a failure.
+	if len(w.seen) > 10000 {
+		w.seen = make(map[string]bool)
+	}
+
+	return w.checkpoint(result.HistoryID)
+}
+
+// inScope reports whether a message with labelIDs should be emitted.
+func (w *watcher) inScope(labelIDs []string) bool {
+	if w.labelID == "" {
+		return true
+	}
+	for _, id := range labelIDs {
+		if id == w.labelID {
+			return true
+		}
+	}
+	return false
+}
+
+// rebaseline moves the checkpoint to the mailbox's current history ID.
+func (w *watcher) rebaseline() error {
+	profile, err := w.client.GetProfile()
+	if err != nil {
+		return fmt.Errorf("failed to get mailbox profile: %w", err)
+	}
+	return w.checkpoint(profile.HistoryId)
+}
+
+func (w *watcher) checkpoint(historyID uint64) error {
+	if historyID == 0 || historyID == w.historyID {
+		return nil
+	}
+	w.historyID = historyID
+	return common.SaveSyncState(labelStateName(watchStatePrefix, w.labelID), &common.SyncState{HistoryID: historyID, UpdatedAt: time.Now()})
+}
+
+// startWatch registers (or renews) the Gmail push watch on topic.
+func (w *watcher) startWatch(topic string) error {
+	var labels []string
+	if w.labelID != "" {
+		labels = []string{w.labelID}
+	}
+	resp, err := w.client.Watch(topic, labels)
+	if err != nil {
+		return fmt.Errorf("failed to start Gmail watch: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "watch: Gmail watch active on %s until %s\n", topic, time.UnixMilli(resp.Expiration).Format(time.RFC3339))
+	return nil
+}
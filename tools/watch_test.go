@@ -0,0 +1,159 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/blue/support-agent/common"
+	"github.com/blue/support-agent/common/fakegmail"
+)
+
+// newTestWatcher returns a watcher on labelID resuming from its saved
+// checkpoint, as RunWatch starts one, and the buffer it writes to.
+func newTestWatcher(t *testing.T, labelID string) (*watcher, *bytes.Buffer) {
+	t.Helper()
+	client, err := common.NewGmailClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := common.LoadSyncState(labelStateName(watchStatePrefix, labelID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	w := &watcher{
+		client:    client,
+		labelID:   labelID,
+		enc:       json.NewEncoder(&out),
+		historyID: state.HistoryID,
+		seen:      make(map[string]bool),
+	}
+	if w.historyID == 0 {
+		if err := w.rebaseline(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, &out
+}
+
+// emitted returns the IDs of the messages written to out, and resets it.
+func emitted(t *testing.T, out *bytes.Buffer) []string {
+	t.Helper()
+	var ids []string
+	dec := json.NewDecoder(out)
+	for dec.More() {
+		var info common.MessageInfo
+		if err := dec.Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, info.ID)
+	}
+	out.Reset()
+	return ids
+}
+
+func savedCheckpoint(t *testing.T, labelID string) uint64 {
+	t.Helper()
+	state, err := common.LoadSyncState(labelStateName(watchStatePrefix, labelID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state.HistoryID
+}
+
+func TestWatchPartialFailureAndRestart(t *testing.T) {
+	mb := fakegmail.New()
+	mb.Add(fakegmail.Message{ID: "old", Subject: "Before the watch", Labels: []string{"INBOX"}})
+	useServer(t, mb)
+
+	w, out := newTestWatcher(t, "INBOX")
+	for _, id := range []string{"m1", "m2", "m3"} {
+		mb.Add(fakegmail.Message{ID: id, Subject: "Subject " + id, Labels: []string{"INBOX"}})
+	}
+	m1 := mb.Message("m1").HistoryId
+
+	// m2 fails mid-history: m1 is emitted and the checkpoint stops after
+	// m1's record, so m2 and m3 come next time.
+	mb.FailOn("GetMessage m2", errors.New("backend hiccup"))
+	if err := w.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if got := emitted(t, out); !reflect.DeepEqual(got, []string{"m1"}) {
+		t.Errorf("first poll emitted %v, want [m1]", got)
+	}
+	if got := savedCheckpoint(t, "INBOX"); got != m1 {
+		t.Errorf("checkpoint after the failure = %d, want m1's %d", got, m1)
+	}
+
+	mb.FailOn("GetMessage m2", nil)
+	if err := w.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if got := emitted(t, out); !reflect.DeepEqual(got, []string{"m2", "m3"}) {
+		t.Errorf("second poll emitted %v, want [m2 m3]", got)
+	}
+	profile, _ := mb.Profile()
+	if got := savedCheckpoint(t, "INBOX"); got != profile.HistoryId {
+		t.Errorf("checkpoint = %d, want the mailbox's %d", got, profile.HistoryId)
+	}
+
+	// A restarted watch resumes from the checkpoint: nothing is replayed
+	// and what arrived meanwhile is emitted.
+	mb.Add(fakegmail.Message{ID: "m4", Subject: "While stopped", Labels: []string{"INBOX"}})
+	w, out = newTestWatcher(t, "INBOX")
+	if err := w.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if got := emitted(t, out); !reflect.DeepEqual(got, []string{"m4"}) {
+		t.Errorf("after restart emitted %v, want [m4]", got)
+	}
+}
+
+func TestWatchLabelIsolation(t *testing.T) {
+	mb := fakegmail.New()
+	billing := mb.AddLabel("Billing").Id
+	useServer(t, mb)
+
+	inbox, inboxOut := newTestWatcher(t, "INBOX")
+	bills, billsOut := newTestWatcher(t, billing)
+
+	mb.Add(fakegmail.Message{ID: "question", Labels: []string{"INBOX"}})
+	mb.Add(fakegmail.Message{ID: "invoice", Labels: []string{billing}})
+	mb.Add(fakegmail.Message{ID: "both", Labels: []string{"INBOX", billing}})
+
+	if err := inbox.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if got := emitted(t, inboxOut); !reflect.DeepEqual(got, []string{"question", "both"}) {
+		t.Errorf("INBOX watch emitted %v, want [question both]", got)
+	}
+	inboxCheckpoint := savedCheckpoint(t, "INBOX")
+
+	// The Billing watch resumes from its own checkpoint, so the INBOX poll
+	// didn't make it skip anything, and it leaves the INBOX one alone.
+	mb.Add(fakegmail.Message{ID: "late", Labels: []string{"INBOX"}})
+	if err := bills.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if got := emitted(t, billsOut); !reflect.DeepEqual(got, []string{"invoice", "both"}) {
+		t.Errorf("Billing watch emitted %v, want [invoice both]", got)
+	}
+	if got := savedCheckpoint(t, "INBOX"); got != inboxCheckpoint {
+		t.Errorf("INBOX checkpoint moved to %d by the Billing watch, want %d", got, inboxCheckpoint)
+	}
+	if got := savedCheckpoint(t, billing); got <= inboxCheckpoint {
+		t.Errorf("Billing checkpoint = %d, want past %d", got, inboxCheckpoint)
+	}
+}
+
+func TestWatchListenRequiresPushToken(t *testing.T) {
+	useConfig(t)
+	err := RunWatch([]string{"--listen", "127.0.0.1:0"})
+	if err == nil || !strings.Contains(err.Error(), "--push-token") {
+		t.Fatalf("err = %v, want --listen refused without a push token", err)
+	}
+}